@@ -8,7 +8,11 @@ const (
 	AlgSha1                       = "sha1"
 	AlgSha256                     = "sha256"
 	AlgSha512                     = "sha512"
+	AllowedCredentialCommands     = "Allowed Credential Commands"
+	AllowedPostValidationCommands = "Allowed Post-Validation Commands"
+	AllowedPrePackageCommands     = "Allowed Pre-Packaging Commands"
 	BaggingDirectory              = "Bagging Directory"
+	BagItProfileAuto              = "auto"
 	BagItProfileBTR               = "btr-v1.0.json"
 	BagItProfileDefault           = "aptrust-v2.2.json"
 	BagReaderTypeFileSystem       = "filesystem"
@@ -25,6 +29,13 @@ const (
 	EmptyProfileID                = "73d1b307-4d6b-494b-b0c9-a8595222ae5a"
 	EmptyProfileIdentifier        = "https://raw.githubusercontent.com/APTrust/dart/tree/master/profiles/empty_profile.json"
 	EmptyUUID                     = "00000000-0000-0000-0000-000000000000"
+	EnvApiToken                   = "DART_API_TOKEN"
+	EnvMasterKey                  = "DART_MASTER_KEY"
+	EnvMasterKeyFile              = "DART_MASTER_KEY_FILE"
+	EnvMasterPassphrase           = "DART_MASTER_PASSPHRASE"
+	EnvNewMasterKey               = "DART_NEW_MASTER_KEY"
+	EnvNewMasterKeyFile           = "DART_NEW_MASTER_KEY_FILE"
+	EnvNewMasterPassphrase        = "DART_NEW_MASTER_PASSPHRASE"
 	EventTypeBatchCompleted       = "batch completed"
 	EventTypeDisconnect           = "disconnect"
 	EventTypeError                = "error"
@@ -33,6 +44,7 @@ const (
 	EventTypeInit                 = "init"
 	EventTypeStart                = "start"
 	EventTypeWarning              = "warning"
+	ExitCancelled                 = 130
 	ExitOK                        = 0
 	ExitRuntimeErr                = 1
 	ExitUsageErr                  = 2
@@ -43,6 +55,8 @@ const (
 	FileTypeTag                   = "tag file"
 	FileTypeTagManifest           = "tag manifest"
 	FlashCookieName               = "dart-flash-message"
+	HostKeyPolicyStrict           = "strict"
+	HostKeyPolicyTOFU             = "tofu"
 	ImportSourceJson              = "json"
 	ImportSourceUrl               = "url"
 	ItemTypeFile                  = "file"
@@ -57,6 +71,10 @@ const (
 	ModeAptCmd                    = "apt-cmd"
 	ModeDartGUI                   = "dart-gui"
 	ModeDartRunner                = "dart-runner"
+	ModeDartServer                = "dart-server"
+	OnFailureContinue             = "continue"
+	OnFailureSkipUploads          = "skip-uploads"
+	OnFailureStop                 = "stop"
 	PackageFormatBagIt            = "BagIt"
 	PackageFormatNone             = "None" // Used when a job or workflow has no package operation.
 	PluginIdAPTrustClientv3       = "c5a6b7db-5a5f-4ca5-a8f8-31b2e60c84bd"
@@ -66,6 +84,8 @@ const (
 	PostValidateCommandTypeGo     = "go"
 	PostValidateCommandTypeSystem = "system"
 	PostValidateGzipCommand       = "DART.gzip"
+	PrePackageClamdCommand        = "DART.clamd"
+	PrePackageDefaultClamdSocket  = "/var/run/clamav/clamd.ctl"
 	ProfileIDAPTrust              = "043f1c22-c9ff-4112-86f8-8f8f1e6a2dca"
 	ProfileIDBTR                  = "a4e95eae-9b93-4ebb-895e-d2ab23fd2c7c"
 	ProfileIDEmpty                = "73d1b307-4d6b-494b-b0c9-a8595222ae5a"
@@ -74,24 +94,42 @@ const (
 	ProfileTypeLOCUnordered       = "loc-unordered"
 	ProfileTypeStandard           = "standard"
 	ProfileTypeUnknown            = "unknown"
+	ProtocolFile                  = "file"
 	ProtocolS3                    = "s3"
 	ProtocolSFTP                  = "sftp"
+	ProtocolWebDAV                = "webdav"
+	QueueStateCancelled           = "cancelled"
+	QueueStateFailed              = "failed"
+	QueueStateQueued              = "queued"
+	QueueStateRunning             = "running"
+	QueueStateSucceeded           = "succeeded"
+	ReconcileStatusMissing        = "missing"
+	ReconcileStatusPresent        = "present"
+	ReconcileStatusSizeMismatch   = "size mismatch"
 	ResultTypeList                = "list"
 	ResultTypeSingle              = "single"
 	ResultTypeUnitialized         = "unintialized"
+	S3EncryptionSSEC              = "SSE-C"
+	S3EncryptionSSEKMS            = "SSE-KMS"
+	S3EncryptionSSES3             = "SSE-S3"
 	SerialFormatNone              = "none (bag as directory)"
 	SerialFormatTar               = "application/tar"
 	SerializationForbidden        = "forbidden"
 	SerializationOptional         = "optional"
 	SerializationRequired         = "required"
+	StageChecksumSidecar          = "checksum-sidecar"
+	StageDownload                 = "download"
 	StageFinish                   = "finish"
 	StagePackage                  = "package"
 	StagePostValidation           = "post validation"
+	StagePrePackage               = "pre-package"
 	StagePreRun                   = "pre-run"
 	StageUpload                   = "upload"
 	StageValidation               = "validation"
+	StatusCancelled               = "cancelled"
 	StatusFailed                  = "failed"
 	StatusRunning                 = "running"
+	StatusSkipped                 = "skipped"
 	StatusStarting                = "starting"
 	StatusSuccess                 = "success"
 	TypeAppSetting                = "AppSetting"
@@ -181,6 +219,57 @@ var ExportableSettingTypes = []string{
 	TypeStorageService,
 }
 
+// HostKeyPolicies describe how the SFTP client checks server host keys.
+// Strict accepts only keys matching a pinned fingerprint or a known_hosts
+// file. TOFU (trust on first use) accepts and records the first key a
+// server presents, and then requires that key on later connections.
+var HostKeyPolicies = []string{
+	HostKeyPolicyStrict,
+	HostKeyPolicyTOFU,
+}
+
+// S3EncryptionTypes are the server-side encryption options
+// a StorageService can request for S3 uploads.
+var S3EncryptionTypes = []string{
+	S3EncryptionSSEC,
+	S3EncryptionSSEKMS,
+	S3EncryptionSSES3,
+}
+
+// S3StorageClasses are the storage classes recognized by AWS S3.
+// Other S3-compatible services may support only some of these.
+var S3StorageClasses = []string{
+	"DEEP_ARCHIVE",
+	"EXPRESS_ONEZONE",
+	"GLACIER",
+	"GLACIER_IR",
+	"INTELLIGENT_TIERING",
+	"ONEZONE_IA",
+	"OUTPOSTS",
+	"REDUCED_REDUNDANCY",
+	"STANDARD",
+	"STANDARD_IA",
+}
+
+// PipelineStageTypes are the types of stage a workflow can
+// list in its pipeline.
+var PipelineStageTypes = []string{
+	StagePrePackage,
+	StagePackage,
+	StageValidation,
+	StagePostValidation,
+	StageChecksumSidecar,
+	StageUpload,
+}
+
+// OnFailureActions describe what a workflow pipeline does when
+// one of its stages fails.
+var OnFailureActions = []string{
+	OnFailureContinue,
+	OnFailureSkipUploads,
+	OnFailureStop,
+}
+
 // We have only one format at the moment, but in future we
 // may add OCFL and others.
 var PackageFormats = []string{
@@ -23,3 +23,31 @@ var ErrNoSuchClient = errors.New("no client exists for this repository type")
 var ErrUnknownReport = errors.New("unknown report")
 
 var ErrRepoUnauthorized = errors.New("access unauthorized or forbidden - be sure your user id and api token are correct")
+
+var ErrBaseProfileNotFound = errors.New("base profile not found")
+
+var ErrProfileInheritanceCycle = errors.New("profile inheritance cycle")
+
+var ErrProfileConflict = errors.New("profile overrides conflict with base profile")
+
+var ErrAmbiguousProfile = errors.New("more than one profile matches")
+
+var ErrUploadVerificationFailed = errors.New("upload verification failed")
+
+var ErrHostKeyChanged = errors.New("host key has changed")
+
+var ErrHostKeyUnknown = errors.New("host key is not trusted")
+
+var ErrRemoteItemNotFound = errors.New("remote item not found")
+
+var ErrCredentialUnavailable = errors.New("credential is unavailable")
+
+var ErrCommandNotAllowed = errors.New("command is not in the list of allowed post-validation commands")
+
+var ErrVirusFound = errors.New("virus scan found infected files")
+
+var ErrClamdStreamTooLarge = errors.New("file is too large to stream to clamd")
+
+var ErrMasterKeyRequired = errors.New("secrets in the DART database are encrypted, but no master key was supplied")
+
+var ErrWrongMasterKey = errors.New("master key does not match the key that encrypted the DART database's secrets")
@@ -0,0 +1,462 @@
+package core
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/gin-gonic/gin"
+)
+
+// ApiUnixSocketPrefix is the prefix of ApiServer addresses that
+// point to a Unix socket rather than a TCP host and port.
+const ApiUnixSocketPrefix = "unix:"
+
+// ApiServer lets other programs on the same machine submit and monitor
+// DART jobs over HTTP. It listens only on the loopback interface or a
+// Unix socket, and every request must include the header
+// "Authorization: Bearer <token>".
+//
+// Submitted jobs go into DART's job queue, and the server's JobDaemon
+// runs them. Because the queue is persistent, jobs submitted with
+// dart-runner --enqueue appear in the API too, and vice versa.
+//
+// Endpoints:
+//
+//	POST   /jobs                 Queue a job described by JobParams JSON
+//	POST   /batches              Queue a job for each item in a batch file
+//	GET    /jobs                 List queued jobs, optionally ?state=
+//	GET    /jobs/:id             Get one queued job
+//	GET    /jobs/:id/events      Stream the job's EventMessages (SSE)
+//	POST   /jobs/:id/cancel      Cancel a queued or running job
+//	GET    /jobs/:id/artifacts   List a finished job's artifacts
+//	GET    /artifacts/:id        Get one artifact
+type ApiServer struct {
+	Address   string
+	Workflow  *Workflow
+	OutputDir string
+	Daemon    *JobDaemon
+	token     string
+	router    *gin.Engine
+	server    *http.Server
+}
+
+// ApiBatchRequest is the body of a POST to /batches. If Workflow is
+// nil, the server uses its own workflow. If OutputDir is empty, the
+// server uses its own output directory.
+type ApiBatchRequest struct {
+	BatchFile string    `json:"batchFile"`
+	OutputDir string    `json:"outputDir"`
+	Workflow  *Workflow `json:"workflow"`
+}
+
+// ApiError is the body of all error responses from the ApiServer.
+// Errors describes validation problems, keyed by field name, when
+// a submitted job or workflow is invalid.
+type ApiError struct {
+	Error  string            `json:"error"`
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+// NewApiServer returns a server that will listen at address, which
+// must be a loopback host and port, such as "127.0.0.1:8444", or
+// "unix:" followed by the path to a Unix socket. Clients must send
+// token to authenticate. Param workflow may be nil, in which case
+// clients must include a workflow with each job. Jobs that don't
+// specify an output path write their bags to outputDir. The daemon
+// runs the submitted jobs.
+func NewApiServer(address, token string, workflow *Workflow, outputDir string, daemon *JobDaemon) (*ApiServer, error) {
+	if err := checkApiAddress(address); err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(token) == "" {
+		return nil, fmt.Errorf("API server requires a token")
+	}
+	if daemon == nil {
+		return nil, fmt.Errorf("API server requires a job daemon")
+	}
+	if daemon.Events == nil {
+		daemon.Events = NewEventHub()
+	}
+	s := &ApiServer{
+		Address:   address,
+		Workflow:  workflow,
+		OutputDir: outputDir,
+		Daemon:    daemon,
+		token:     token,
+	}
+	s.initRouter()
+	s.server = &http.Server{Handler: s.router}
+	return s, nil
+}
+
+// checkApiAddress returns an error unless address is a Unix socket
+// or a host and port on the loopback interface.
+func checkApiAddress(address string) error {
+	if strings.HasPrefix(address, ApiUnixSocketPrefix) {
+		if strings.TrimPrefix(address, ApiUnixSocketPrefix) == "" {
+			return fmt.Errorf("unix socket address requires a path")
+		}
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("invalid address %s: %s", address, err.Error())
+	}
+	ip := net.ParseIP(host)
+	if host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("API server must listen on localhost or a unix socket, not %s", host)
+	}
+	return nil
+}
+
+// Handler returns the server's http.Handler.
+func (s *ApiServer) Handler() http.Handler {
+	return s.router
+}
+
+// RunContext is like Run, but when ctx is cancelled, it stops serving
+// and cancels running jobs, which go back in the queue. See
+// JobDaemon.Shutdown.
+func (s *ApiServer) RunContext(ctx context.Context) int {
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Daemon.Shutdown()
+			s.Stop()
+		case <-stopped:
+		}
+	}()
+	return s.Run()
+}
+
+// Run starts the server's JobDaemon and serves requests until Stop is
+// called. It returns the exit code for dart-runner.
+func (s *ApiServer) Run() int {
+	listener, err := s.listen()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot start API server: %s\n", err.Error())
+		return constants.ExitRuntimeErr
+	}
+	daemonExitCode := make(chan int, 1)
+	go func() { daemonExitCode <- s.Daemon.Run() }()
+	err = s.server.Serve(listener)
+	s.Daemon.Stop()
+	<-daemonExitCode
+	if err != nil && err != http.ErrServerClosed {
+		fmt.Fprintf(os.Stderr, "API server stopped: %s\n", err.Error())
+		return constants.ExitRuntimeErr
+	}
+	return constants.ExitOK
+}
+
+// Stop stops accepting requests, gives open requests a few seconds to
+// finish before closing their connections, and tells the daemon to stop
+// after its current jobs.
+func (s *ApiServer) Stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s.server.Shutdown(ctx)
+	s.server.Close()
+	s.Daemon.Stop()
+}
+
+func (s *ApiServer) listen() (net.Listener, error) {
+	if !strings.HasPrefix(s.Address, ApiUnixSocketPrefix) {
+		return net.Listen("tcp", s.Address)
+	}
+	socketPath := strings.TrimPrefix(s.Address, ApiUnixSocketPrefix)
+	// Remove the socket left behind by an earlier server,
+	// but don't delete anything else.
+	if info, err := os.Stat(socketPath); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(socketPath)
+	}
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	// Only the user who started the server can connect.
+	if err = os.Chmod(socketPath, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+func (s *ApiServer) initRouter() {
+	gin.SetMode(gin.ReleaseMode)
+	s.router = gin.New()
+	s.router.Use(gin.Recovery(), s.authenticate)
+	s.router.POST("/jobs", s.postJob)
+	s.router.POST("/batches", s.postBatch)
+	s.router.GET("/jobs", s.listJobs)
+	s.router.GET("/jobs/:id", s.getJob)
+	s.router.GET("/jobs/:id/events", s.streamEvents)
+	s.router.POST("/jobs/:id/cancel", s.cancelJob)
+	s.router.GET("/jobs/:id/artifacts", s.listArtifacts)
+	s.router.GET("/artifacts/:id", s.getArtifact)
+}
+
+func (s *ApiServer) authenticate(c *gin.Context) {
+	token, found := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !found || subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, ApiError{Error: "Missing or invalid token"})
+		return
+	}
+	c.Next()
+}
+
+func (s *ApiServer) postJob(c *gin.Context) {
+	partialParams := &JobParams{}
+	if err := c.ShouldBindJSON(partialParams); err != nil {
+		c.JSON(http.StatusBadRequest, ApiError{Error: fmt.Sprintf("JobParams JSON: %s", err.Error())})
+		return
+	}
+	workflow, ok := s.workflowFor(c, partialParams.Workflow)
+	if !ok {
+		return
+	}
+	outputPath := partialParams.OutputPath
+	if outputPath == "" {
+		outputPath = filepath.Join(s.OutputDir, partialParams.PackageName)
+	}
+	params := NewJobParams(workflow, partialParams.PackageName, outputPath, partialParams.Files, partialParams.Tags)
+	params.JobOverrides = partialParams.JobOverrides
+	job := params.ToJob()
+	qj, err := JobQueueAdd(job)
+	if err == constants.ErrObjecValidation {
+		c.JSON(http.StatusBadRequest, ApiError{Error: "Job is invalid", Errors: job.Errors})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiError{Error: err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, qj)
+}
+
+func (s *ApiServer) postBatch(c *gin.Context) {
+	request := &ApiBatchRequest{}
+	if err := c.ShouldBindJSON(request); err != nil {
+		c.JSON(http.StatusBadRequest, ApiError{Error: fmt.Sprintf("Batch request JSON: %s", err.Error())})
+		return
+	}
+	if request.BatchFile == "" {
+		c.JSON(http.StatusBadRequest, ApiError{Error: "Batch request requires a batchFile"})
+		return
+	}
+	workflow, ok := s.workflowFor(c, request.Workflow)
+	if !ok {
+		return
+	}
+	outputDir := request.OutputDir
+	if outputDir == "" {
+		outputDir = s.OutputDir
+	}
+	queuedJobs, err := JobQueueAddBatch(workflow, request.BatchFile, outputDir)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ApiError{Error: err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, queuedJobs)
+}
+
+// workflowFor returns the workflow a client submitted, or the server's
+// workflow if the client didn't submit one. If there's no usable
+// workflow, this writes an error response and returns false.
+func (s *ApiServer) workflowFor(c *gin.Context, workflow *Workflow) (*Workflow, bool) {
+	if workflow == nil {
+		if s.Workflow == nil {
+			c.JSON(http.StatusBadRequest, ApiError{Error: "Request requires a workflow, because the server has none"})
+			return nil, false
+		}
+		return s.Workflow.Copy(), true
+	}
+	workflow.resolveStorageServices()
+	if !workflow.Validate() {
+		c.JSON(http.StatusBadRequest, ApiError{Error: "Workflow is invalid", Errors: workflow.Errors})
+		return nil, false
+	}
+	return workflow, true
+}
+
+func (s *ApiServer) listJobs(c *gin.Context) {
+	queuedJobs, err := QueuedJobList(c.Query("state"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiError{Error: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, queuedJobs)
+}
+
+func (s *ApiServer) getJob(c *gin.Context) {
+	qj, ok := s.findJob(c)
+	if ok {
+		c.JSON(http.StatusOK, qj)
+	}
+}
+
+// findJob returns the queued job named in the request path. If there's
+// no such job, this writes an error response and returns false.
+func (s *ApiServer) findJob(c *gin.Context) (*QueuedJob, bool) {
+	qj, err := QueuedJobFind(c.Param("id"))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, ApiError{Error: fmt.Sprintf("No job with id %s", c.Param("id"))})
+		return nil, false
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiError{Error: err.Error()})
+		return nil, false
+	}
+	return qj, true
+}
+
+func (s *ApiServer) cancelJob(c *gin.Context) {
+	qj, ok := s.findJob(c)
+	if !ok {
+		return
+	}
+	if err := QueuedJobCancel(qj.ID); err != nil {
+		// The daemon stops a running job and closes its
+		// event streams when the job is done.
+		if qj.State == constants.QueueStateRunning && s.Daemon.CancelJob(qj.ID) {
+			c.JSON(http.StatusAccepted, qj)
+			return
+		}
+		c.JSON(http.StatusConflict, ApiError{Error: err.Error()})
+		return
+	}
+	s.Daemon.Events.Close(qj.ID)
+	qj, ok = s.findJob(c)
+	if ok {
+		c.JSON(http.StatusOK, qj)
+	}
+}
+
+// streamEvents sends the job's EventMessages as Server-Sent Events,
+// named for their EventType, until the job finishes or the client
+// disconnects. The last event is always a finish event. If the job
+// has already finished, that's the only event.
+func (s *ApiServer) streamEvents(c *gin.Context) {
+	// Subscribe before checking the job's state, so we can't miss
+	// the end of a job that finishes in between.
+	events, unsubscribe := s.Daemon.Events.Subscribe(c.Param("id"))
+	defer unsubscribe()
+	qj, ok := s.findJob(c)
+	if !ok {
+		return
+	}
+	c.Header("Cache-Control", "no-cache")
+	if queuedJobIsDone(qj) {
+		c.SSEvent(constants.EventTypeFinish, queuedJobFinishEvent(qj))
+		return
+	}
+	// Send headers now, so clients know the stream is open
+	// before the job starts.
+	c.Header("Content-Type", "text/event-stream")
+	c.Writer.WriteHeaderNow()
+	c.Writer.Flush()
+	sentFinish := false
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case e, open := <-events:
+			if !open {
+				// The job is done, but we may have missed its
+				// finish event if we fell behind.
+				if !sentFinish {
+					if qj, err := QueuedJobFind(qj.ID); err == nil {
+						c.SSEvent(constants.EventTypeFinish, queuedJobFinishEvent(qj))
+					}
+				}
+				return false
+			}
+			c.SSEvent(e.EventType, e)
+			sentFinish = e.EventType == constants.EventTypeFinish && e.Stage == constants.StageFinish
+			return true
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
+
+func (s *ApiServer) listArtifacts(c *gin.Context) {
+	qj, ok := s.findJob(c)
+	if !ok {
+		return
+	}
+	obj, err := qj.Object()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiError{Error: err.Error()})
+		return
+	}
+	artifacts, err := ArtifactListByJobID(obj.ObjID())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiError{Error: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, artifacts)
+}
+
+func (s *ApiServer) getArtifact(c *gin.Context) {
+	artifact, err := ArtifactFind(c.Param("id"))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, ApiError{Error: fmt.Sprintf("No artifact with id %s", c.Param("id"))})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiError{Error: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, artifact)
+}
+
+func queuedJobIsDone(qj *QueuedJob) bool {
+	return qj.State == constants.QueueStateSucceeded ||
+		qj.State == constants.QueueStateFailed ||
+		qj.State == constants.QueueStateCancelled
+}
+
+// queuedJobFinishEvent returns a finish event describing the final
+// state of qj. Jobs that were cancelled or never ran have no result.
+func queuedJobFinishEvent(qj *QueuedJob) *EventMessage {
+	if result := qj.Result(); result != nil {
+		return FinishEvent(result)
+	}
+	message := qj.Error
+	status := constants.StatusFailed
+	if qj.State == constants.QueueStateCancelled {
+		message = "Job cancelled"
+		status = constants.StatusCancelled
+	}
+	return &EventMessage{
+		EventType: constants.EventTypeFinish,
+		Stage:     constants.StageFinish,
+		Status:    status,
+		Message:   message,
+	}
+}
+
+// ApiTokenFromEnv returns the API token in the DART_API_TOKEN
+// environment variable, or a new random token if that's empty.
+// The bool is true if the token is new. If the system can't generate
+// a random token, this returns an empty string.
+func ApiTokenFromEnv() (string, bool) {
+	if token := strings.TrimSpace(os.Getenv(constants.EnvApiToken)); token != "" {
+		return token, false
+	}
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return "", false
+	}
+	return hex.EncodeToString(token), true
+}
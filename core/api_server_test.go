@@ -0,0 +1,279 @@
+package core_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/core"
+	"github.com/APTrust/dart-runner/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const apiTestToken = "test-token"
+
+type apiTestEvent struct {
+	Name    string
+	Message *core.EventMessage
+}
+
+func getTestApiServer(t *testing.T) (*core.ApiServer, *core.Workflow) {
+	workflow := getPipelineTestWorkflow(t, []*core.StageDefinition{
+		{Type: constants.StagePackage},
+		{Type: constants.StageUpload, StorageService: "Primary"},
+	})
+	server, err := core.NewApiServer("127.0.0.1:0", apiTestToken, workflow, t.TempDir(), getTestJobDaemon(t, 1))
+	require.NoError(t, err)
+	return server, workflow
+}
+
+func apiTestRequest(t *testing.T, server *core.ApiServer, method, path string, body interface{}, response interface{}) int {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		require.NoError(t, err)
+		reader = bytes.NewReader(data)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	req.Header.Set("Authorization", "Bearer "+apiTestToken)
+	w := httptest.NewRecorder()
+	server.Handler().ServeHTTP(w, req)
+	if response != nil {
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), response), w.Body.String())
+	}
+	return w.Code
+}
+
+// readApiTestEvents reads Server-Sent Events from r until the
+// stream ends.
+func readApiTestEvents(t *testing.T, r io.Reader) []apiTestEvent {
+	events := make([]apiTestEvent, 0)
+	name := ""
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if value, found := strings.CutPrefix(line, "event:"); found {
+			name = value
+		} else if value, found := strings.CutPrefix(line, "data:"); found {
+			e := &core.EventMessage{}
+			require.NoError(t, json.Unmarshal([]byte(value), e))
+			events = append(events, apiTestEvent{Name: name, Message: e})
+		}
+	}
+	return events
+}
+
+func apiTestJobParams() *core.JobParams {
+	return &core.JobParams{
+		PackageName: "api_test_bag",
+		Files:       []string{filepath.Join(util.PathToTestData(), "files")},
+		Tags:        getTestTags(),
+	}
+}
+
+func TestNewApiServer(t *testing.T) {
+	daemon := getTestJobDaemon(t, 1)
+	for _, address := range []string{"127.0.0.1:8444", "localhost:8444", "[::1]:8444", "unix:/tmp/dart.sock"} {
+		_, err := core.NewApiServer(address, apiTestToken, nil, "", daemon)
+		assert.NoError(t, err, address)
+	}
+	for _, address := range []string{"0.0.0.0:8444", "example.com:8444", "192.168.1.1:8444", "unix:", "8444"} {
+		_, err := core.NewApiServer(address, apiTestToken, nil, "", daemon)
+		assert.Error(t, err, address)
+	}
+	_, err := core.NewApiServer("127.0.0.1:8444", " ", nil, "", daemon)
+	assert.Error(t, err)
+	_, err = core.NewApiServer("127.0.0.1:8444", apiTestToken, nil, "", nil)
+	assert.Error(t, err)
+}
+
+func TestApiServerAuth(t *testing.T) {
+	server, _ := getTestApiServer(t)
+	for _, header := range []string{"", "Bearer wrong-token", apiTestToken} {
+		req := httptest.NewRequest(http.MethodGet, "/jobs", nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		w := httptest.NewRecorder()
+		server.Handler().ServeHTTP(w, req)
+		assert.Equal(t, http.StatusUnauthorized, w.Code, header)
+	}
+	assert.Equal(t, http.StatusOK, apiTestRequest(t, server, http.MethodGet, "/jobs", nil, nil))
+}
+
+func TestApiServerSubmitAndCancel(t *testing.T) {
+	require.NoError(t, core.ClearJobQueueTable())
+	defer core.ClearJobQueueTable()
+	server, workflow := getTestApiServer(t)
+
+	qj := &core.QueuedJob{}
+	status := apiTestRequest(t, server, http.MethodPost, "/jobs", apiTestJobParams(), qj)
+	require.Equal(t, http.StatusCreated, status)
+	assert.Equal(t, constants.QueueStateQueued, qj.State)
+	assert.Equal(t, "api_test_bag", qj.JobName)
+
+	// Invalid jobs are rejected with their errors.
+	params := apiTestJobParams()
+	params.Files = []string{"/path/does/not/exist"}
+	apiErr := &core.ApiError{}
+	status = apiTestRequest(t, server, http.MethodPost, "/jobs", params, apiErr)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, "Job is invalid", apiErr.Error)
+	assert.NotEmpty(t, apiErr.Errors)
+
+	// Clients can send their own workflow.
+	params = apiTestJobParams()
+	params.Workflow = workflow.Copy()
+	params.OutputPath = filepath.Join(t.TempDir(), "api_test_bag")
+	status = apiTestRequest(t, server, http.MethodPost, "/jobs", params, &core.QueuedJob{})
+	assert.Equal(t, http.StatusCreated, status)
+	params.Workflow.Name = ""
+	apiErr = &core.ApiError{}
+	status = apiTestRequest(t, server, http.MethodPost, "/jobs", params, apiErr)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Contains(t, apiErr.Errors, "Name")
+
+	queuedJobs := make([]*core.QueuedJob, 0)
+	status = apiTestRequest(t, server, http.MethodGet, "/jobs?state=queued", nil, &queuedJobs)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Len(t, queuedJobs, 2)
+
+	// Queued jobs can be cancelled. Their event streams end
+	// with a finish event.
+	cancelled := &core.QueuedJob{}
+	status = apiTestRequest(t, server, http.MethodPost, "/jobs/"+qj.ID+"/cancel", nil, cancelled)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, constants.QueueStateCancelled, cancelled.State)
+	status = apiTestRequest(t, server, http.MethodPost, "/jobs/"+qj.ID+"/cancel", nil, nil)
+	assert.Equal(t, http.StatusConflict, status)
+	req := httptest.NewRequest(http.MethodGet, "/jobs/"+qj.ID+"/events", nil)
+	req.Header.Set("Authorization", "Bearer "+apiTestToken)
+	w := httptest.NewRecorder()
+	server.Handler().ServeHTTP(w, req)
+	events := readApiTestEvents(t, w.Body)
+	require.Len(t, events, 1)
+	assert.Equal(t, constants.EventTypeFinish, events[0].Name)
+	assert.Equal(t, "Job cancelled", events[0].Message.Message)
+
+	for _, path := range []string{"/jobs/no-such-job", "/jobs/no-such-job/events", "/jobs/no-such-job/artifacts", "/artifacts/no-such-artifact"} {
+		assert.Equal(t, http.StatusNotFound, apiTestRequest(t, server, http.MethodGet, path, nil, nil), path)
+	}
+	assert.Equal(t, http.StatusNotFound, apiTestRequest(t, server, http.MethodPost, "/jobs/no-such-job/cancel", nil, nil))
+}
+
+func TestApiServerBatch(t *testing.T) {
+	require.NoError(t, core.ClearJobQueueTable())
+	defer core.ClearJobQueueTable()
+	server, _ := getTestApiServer(t)
+
+	dir := t.TempDir()
+	sourceDir := filepath.Join(dir, "source")
+	writeJournalTestFile(t, sourceDir)
+	batchFile := filepath.Join(dir, "batch.csv")
+	rows := []string{journalTestHeaders, journalTestRow("ApiOne", sourceDir), journalTestRow("ApiTwo", sourceDir)}
+	require.NoError(t, os.WriteFile(batchFile, []byte(strings.Join(rows, "\n")+"\n"), 0644))
+
+	queuedJobs := make([]*core.QueuedJob, 0)
+	status := apiTestRequest(t, server, http.MethodPost, "/batches", &core.ApiBatchRequest{BatchFile: batchFile}, &queuedJobs)
+	require.Equal(t, http.StatusCreated, status)
+	require.Len(t, queuedJobs, 2)
+	assert.Equal(t, "ApiOne", queuedJobs[0].JobName)
+
+	apiErr := &core.ApiError{}
+	status = apiTestRequest(t, server, http.MethodPost, "/batches", &core.ApiBatchRequest{}, apiErr)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Contains(t, apiErr.Error, "batchFile")
+	status = apiTestRequest(t, server, http.MethodPost, "/batches", &core.ApiBatchRequest{BatchFile: filepath.Join(dir, "missing.csv")}, apiErr)
+	assert.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestApiServerEventsAndArtifacts(t *testing.T) {
+	require.NoError(t, core.ClearJobQueueTable())
+	defer core.ClearJobQueueTable()
+	runtimeMode := core.Dart.RuntimeMode
+	core.Dart.RuntimeMode = constants.ModeDartServer
+	defer func() { core.Dart.RuntimeMode = runtimeMode }()
+
+	server, workflow := getTestApiServer(t)
+	httpServer := httptest.NewServer(server.Handler())
+	defer httpServer.Close()
+
+	qj := &core.QueuedJob{}
+	require.Equal(t, http.StatusCreated, apiTestRequest(t, server, http.MethodPost, "/jobs", apiTestJobParams(), qj))
+
+	// Listen for events, then run the job.
+	req, err := http.NewRequest(http.MethodGet, httpServer.URL+"/jobs/"+qj.ID+"/events", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+apiTestToken)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	for i := 0; i < 100 && server.Daemon.Events.SubscriberCount(qj.ID) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	ranJob, err := server.Daemon.RunNext()
+	require.NoError(t, err)
+	require.True(t, ranJob)
+
+	events := readApiTestEvents(t, resp.Body)
+	require.Greater(t, len(events), 1)
+	names := make([]string, len(events))
+	for i, e := range events {
+		names[i] = e.Name
+	}
+	assert.Contains(t, names, constants.EventTypeStart)
+	last := events[len(events)-1]
+	assert.Equal(t, constants.EventTypeFinish, last.Name)
+	require.NotNil(t, last.Message.JobResult)
+	assert.True(t, last.Message.JobResult.Succeeded)
+	assert.True(t, util.FileExists(filepath.Join(bucketOf(workflow, "Primary"), "api_test_bag.tar")))
+
+	finished := &core.QueuedJob{}
+	require.Equal(t, http.StatusOK, apiTestRequest(t, server, http.MethodGet, "/jobs/"+qj.ID, nil, finished))
+	assert.Equal(t, constants.QueueStateSucceeded, finished.State)
+	require.NotNil(t, finished.Result())
+	assert.True(t, finished.Result().Succeeded)
+
+	// In server mode, bagging artifacts go into the database, along
+	// with the job result.
+	artifacts := make([]*core.Artifact, 0)
+	require.Equal(t, http.StatusOK, apiTestRequest(t, server, http.MethodGet, "/jobs/"+qj.ID+"/artifacts", nil, &artifacts))
+	itemTypes := make(map[string]bool)
+	for _, artifact := range artifacts {
+		itemTypes[artifact.ItemType] = true
+	}
+	assert.True(t, itemTypes[constants.ItemTypeJobResult])
+	assert.True(t, itemTypes[constants.ItemTypeManifest])
+	assert.True(t, itemTypes[constants.ItemTypeTagFile])
+	artifact := &core.Artifact{}
+	require.Equal(t, http.StatusOK, apiTestRequest(t, server, http.MethodGet, "/artifacts/"+artifacts[0].ID, nil, artifact))
+	assert.Equal(t, artifacts[0].RawData, artifact.RawData)
+}
+
+func TestApiServerRunOnUnixSocket(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "dart.sock")
+	server, err := core.NewApiServer(core.ApiUnixSocketPrefix+socketPath, apiTestToken, nil, "", getTestJobDaemon(t, 1))
+	require.NoError(t, err)
+	exitCode := make(chan int)
+	go func() { exitCode <- server.Run() }()
+	for i := 0; i < 100 && !util.FileExists(socketPath); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	info, err := os.Stat(socketPath)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	server.Stop()
+	assert.Equal(t, constants.ExitOK, <-exitCode)
+}
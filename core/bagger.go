@@ -1,6 +1,7 @@
 package core
 
 import (
+	"context"
 	"embed"
 	"fmt"
 	"os"
@@ -33,6 +34,7 @@ type Bagger struct {
 	Warnings            map[string]string
 	SerializationFormat string
 	writer              BagWriter
+	ctx                 context.Context
 	bagName             string
 	currentFileNum      int64
 	totalFileCount      int64
@@ -61,6 +63,14 @@ func NewBagger(outputPath string, profile *BagItProfile, filesToBag []*util.Exte
 
 // Run builds the bag and returns the number of files bagged.
 func (b *Bagger) Run() bool {
+	return b.RunContext(context.Background())
+}
+
+// RunContext builds the bag, stopping early if ctx is cancelled.
+// A cancelled bagger records the cancellation in Errors, deletes
+// the partially written bag and returns false.
+func (b *Bagger) RunContext(ctx context.Context) bool {
+	b.ctx = ctx
 	b.reset()
 	if !b.checkIllegalControlCharacters() {
 		return b.finish()
@@ -187,6 +197,11 @@ func (b *Bagger) addPayloadFiles() bool {
 	payloadFileCount := len(b.FilesToBag)
 
 	for currentFileNumber, xFileInfo := range b.FilesToBag {
+		if err := contextErr(b.ctx); err != nil {
+			b.Errors["Cancelled"] = fmt.Sprintf("Bagging was cancelled: %s", err.Error())
+			return false
+		}
+
 		// This change addresses https://trello.com/c/oPPNjCus
 		// in which jobs that have to bag huge numbers of files
 		// hang indefinitely. The problem here was that we were
@@ -206,7 +221,10 @@ func (b *Bagger) addPayloadFiles() bool {
 
 		pathInBag := b.PathForPayloadFile(xFileInfo.FullPath)
 		checksums, err := b.writer.AddFile(xFileInfo, pathInBag)
-		if err != nil {
+		if err != nil && contextErr(b.ctx) != nil {
+			b.Errors["Cancelled"] = fmt.Sprintf("Bagging was cancelled: %s", err.Error())
+			return false
+		} else if err != nil {
 			b.Errors[xFileInfo.FullPath] = err.Error()
 		}
 
@@ -339,7 +357,14 @@ func (b *Bagger) addTagFiles() bool {
 func (b *Bagger) validateProfile() bool {
 	if b.Profile == nil {
 		b.Errors["Profile"] = "BagIt profile cannot be nil"
+		return false
+	}
+	profile, err := b.Profile.resolveOrWarn(FindProfile)
+	if err != nil {
+		b.Errors["BaseProfileID"] = err.Error()
+		return false
 	}
+	b.Profile = profile
 	if !b.Profile.Validate() {
 		b.Errors = b.Profile.Errors
 	}
@@ -372,6 +397,14 @@ func (b *Bagger) initWriter() bool {
 	} else {
 		Dart.Log.Infof("Bagger chose writer for serialization type %s", b.SerializationFormat)
 	}
+	// Let the writer stop in the middle of a large file if
+	// the job is cancelled.
+	switch w := b.writer.(type) {
+	case *FileSystemBagWriter:
+		w.ctx = b.ctx
+	case *TarredBagWriter:
+		w.ctx = b.ctx
+	}
 	b.writer.Open()
 	return true
 }
@@ -481,6 +514,9 @@ func (b *Bagger) finish() bool {
 			b.Errors["BagWriter"] = fmt.Sprintf("Error closing bag writer: %s", err.Error())
 		}
 	}
+	if contextErr(b.ctx) != nil && b.writer != nil {
+		b.removePartialBag()
+	}
 	Dart.Log.Infof("Finished writing bag %s", b.bagName)
 	if len(b.Errors) > 0 {
 		Dart.Log.Errorf("Bagging %s failed with the following errors:", b.bagName)
@@ -491,6 +527,23 @@ func (b *Bagger) finish() bool {
 	return len(b.Errors) == 0
 }
 
+// removePartialBag deletes the incomplete bag that a cancelled
+// bagger leaves at OutputPath, so no one mistakes it for a
+// finished bag.
+func (b *Bagger) removePartialBag() {
+	var err error
+	if b.SerializationFormat == constants.SerialFormatNone {
+		err = os.RemoveAll(b.OutputPath)
+	} else {
+		err = os.Remove(b.OutputPath)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		Dart.Log.Warningf("Bagger could not delete partial bag %s: %v", b.OutputPath, err)
+	} else {
+		Dart.Log.Infof("Bagger deleted partial bag %s after cancellation", b.OutputPath)
+	}
+}
+
 func (b *Bagger) info(message string) {
 	Dart.Log.Info(message)
 	if b.MessageChannel == nil {
@@ -1,6 +1,7 @@
 package core_test
 
 import (
+	"context"
 	"os"
 	"path"
 	"path/filepath"
@@ -240,3 +241,21 @@ func TestPathForFileMethods(t *testing.T) {
 	assert.Equal(t, "core/bagger.go", bagger.PathForTagFile("core/bagger.go"))
 
 }
+
+func TestBaggerRunContextCancelled(t *testing.T) {
+	files, err := util.RecursiveFileList(util.PathToTestData(), false)
+	require.Nil(t, err)
+	for _, bagName := range []string{"cancelled_bag.tar", "cancelled_bag"} {
+		bagger := getBagger(t, bagName, emptyProfile, files)
+		defer os.RemoveAll(bagger.OutputPath)
+		setBagInfoTags(bagger.Profile)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		assert.False(t, bagger.RunContext(ctx), bagName)
+		assert.Contains(t, bagger.Errors["Cancelled"], "Bagging was cancelled", bagName)
+
+		// The partial bag should be gone.
+		assert.False(t, util.FileExists(bagger.OutputPath), bagName)
+	}
+}
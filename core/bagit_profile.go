@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
@@ -31,6 +32,7 @@ type BagItProfile struct {
 	BaseProfileID        string            `json:"baseProfileId"`
 	Description          string            `json:"description"`
 	Errors               map[string]string `json:"-"`
+	InheritsFromBase     bool              `json:"inheritsFromBase,omitempty"`
 	IsBuiltIn            bool              `json:"isBuiltIn"`
 	ManifestsAllowed     []string          `json:"manifestsAllowed"`
 	ManifestsRequired    []string          `json:"manifestsRequired"`
@@ -42,6 +44,12 @@ type BagItProfile struct {
 	TagManifestsRequired []string          `json:"tagManifestsRequired"`
 	Tags                 []*TagDefinition  `json:"tags"`
 	TarDirMustMatchName  bool              `json:"tarDirMustMatchName"`
+
+	// cachedBase and cachedBaseRef hold the effective base profile
+	// that Resolve found for BaseProfileID, so repeated calls to
+	// Validate don't search the database each time.
+	cachedBase    *BagItProfile
+	cachedBaseRef string
 }
 
 func NewBagItProfile() *BagItProfile {
@@ -76,6 +84,7 @@ func BagItProfileClone(p *BagItProfile) *BagItProfile {
 		BaseProfileID:        p.BaseProfileID,
 		Description:          p.Description,
 		Errors:               make(map[string]string),
+		InheritsFromBase:     p.InheritsFromBase,
 		ManifestsAllowed:     make([]string, len(p.ManifestsAllowed)),
 		ManifestsRequired:    make([]string, len(p.ManifestsRequired)),
 		Name:                 fmt.Sprintf("Copy of %s", p.Name),
@@ -100,6 +109,10 @@ func BagItProfileClone(p *BagItProfile) *BagItProfile {
 }
 
 // BagItProfileLoad loads a BagIt Profile from the specified file.
+// If the profile inherits from a base profile, this returns the effective profile,
+// with the base profile looked up among the JSON files in the same
+// directory, then in the local database, then among DART's built-in
+// profiles. See BagItProfile.Resolve for details.
 func BagItProfileLoad(filename string) (*BagItProfile, error) {
 	file, err := os.Open(filename)
 	if err != nil {
@@ -110,7 +123,11 @@ func BagItProfileLoad(filename string) (*BagItProfile, error) {
 	if err != nil {
 		return nil, err
 	}
-	return BagItProfileFromJSON(string(data))
+	profile, err := BagItProfileFromJSON(string(data))
+	if err != nil {
+		return nil, err
+	}
+	return profile.resolveOrWarn(siblingProfileLookup(filepath.Dir(filename)))
 }
 
 // BagItProfileFromJSON converts a JSON representation of a BagIt Profile
@@ -321,32 +338,43 @@ func (p *BagItProfile) HasTagFile(name string) bool {
 
 // Validate returns true if this profile is valid. This is not to be
 // confused with bag validation. We're just making sure the profile itself
-// is complete and makes sense.
+// is complete and makes sense. For profiles that inherit from a base,
+// this checks the effective profile, since the derived profile may leave
+// out settings it inherits.
 func (p *BagItProfile) Validate() bool {
 	p.Errors = make(map[string]string)
+	effective := p
+	if p.inheritsFromBase() {
+		resolved, err := p.Resolve()
+		if err != nil {
+			p.Errors["BaseProfileID"] = err.Error()
+		} else {
+			effective = resolved
+		}
+	}
 	if !util.LooksLikeUUID(p.ID) {
 		p.Errors["ID"] = "Profile ID is missing."
 	}
 	if strings.TrimSpace(p.Name) == "" {
 		p.Errors["Name"] = "Profile requires a name."
 	}
-	if util.IsEmptyStringList(p.AcceptBagItVersion) {
+	if util.IsEmptyStringList(effective.AcceptBagItVersion) {
 		p.Errors["AcceptBagItVersion"] = "Profile must accept at least one BagIt version."
 	}
-	if util.IsEmptyStringList(p.ManifestsAllowed) {
+	if util.IsEmptyStringList(effective.ManifestsAllowed) {
 		p.Errors["ManifestsAllowed"] = "Profile must allow at least one manifest algorithm."
 	}
-	if !p.HasTagFile("bagit.txt") {
+	if !effective.HasTagFile("bagit.txt") {
 		p.Errors["BagIt"] = "Profile lacks requirements for bagit.txt tag file."
 	}
-	if !p.HasTagFile("bag-info.txt") {
+	if !effective.HasTagFile("bag-info.txt") {
 		p.Errors["BagInfo"] = "Profile lacks requirements for bag-info.txt tag file."
 	}
-	if !util.StringListContains(constants.SerializationOptions, p.Serialization) {
+	if !util.StringListContains(constants.SerializationOptions, effective.Serialization) {
 		p.Errors["Serialization"] = fmt.Sprintf("Serialization must be one of: %s.", strings.Join(constants.SerializationOptions, ","))
 	}
-	if p.Serialization == constants.SerializationOptional || p.Serialization == constants.SerializationRequired {
-		if util.IsEmptyStringList(p.AcceptSerialization) {
+	if effective.Serialization == constants.SerializationOptional || effective.Serialization == constants.SerializationRequired {
+		if util.IsEmptyStringList(effective.AcceptSerialization) {
 			p.Errors["AcceptSerialization"] = "When serialization is allowed, you must specify at least one serialization format."
 		}
 	}
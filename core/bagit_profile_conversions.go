@@ -69,6 +69,143 @@ func (p *BagItProfile) ToStandardFormat() *StandardProfile {
 	return sp
 }
 
+// ToLOCOrdered converts this BagIt Profile to an ordered Library of
+// Congress profile, as used by https://github.com/LibraryOfCongress/bagger.
+//
+// LOC profiles describe only the tags in bag-info.txt, so a lot of what
+// a DART profile can say gets lost in translation. The returned map
+// describes each constraint that could not be represented, keyed by
+// profile field name or by fully qualified tag name. If the map is
+// empty, the conversion was lossless.
+func (p *BagItProfile) ToLOCOrdered() (*LOCOrderedProfile, map[string]string) {
+	locProfile := &LOCOrderedProfile{
+		Tags: make([]map[string]LOCTagDef, 0),
+	}
+	for _, tagDef := range p.Tags {
+		if tagDef.TagFile != "bag-info.txt" {
+			continue
+		}
+		locProfile.Tags = append(locProfile.Tags, map[string]LOCTagDef{
+			tagDef.TagName: toLOCTagDef(tagDef),
+		})
+	}
+	return locProfile, p.locUnrepresentable()
+}
+
+// ToLOCUnordered converts this BagIt Profile to an unordered Library
+// of Congress profile, which is a map of tag name to tag definition.
+// Like ToLOCOrdered, it returns a map describing the constraints that
+// could not be represented in the LOC format.
+//
+// If the profile defines the same bag-info.txt tag more than once,
+// only the first definition is exported.
+func (p *BagItProfile) ToLOCUnordered() (map[string]LOCTagDef, map[string]string) {
+	locProfile := make(map[string]LOCTagDef)
+	for _, tagDef := range p.Tags {
+		if tagDef.TagFile != "bag-info.txt" {
+			continue
+		}
+		if _, exists := locProfile[tagDef.TagName]; !exists {
+			locProfile[tagDef.TagName] = toLOCTagDef(tagDef)
+		}
+	}
+	return locProfile, p.locUnrepresentable()
+}
+
+// toLOCTagDef converts a DART tag definition to a Library of Congress
+// tag definition. This is the inverse of convertLOCTag: a required tag
+// with exactly one legal value becomes a requiredValue.
+func toLOCTagDef(tagDef *TagDefinition) LOCTagDef {
+	if tagDef.Required && len(tagDef.Values) == 1 {
+		return LOCTagDef{
+			Required:      true,
+			RequiredValue: tagDef.Values[0],
+		}
+	}
+	locTagDef := LOCTagDef{
+		Required:     tagDef.Required,
+		DefaultValue: tagDef.DefaultValue,
+	}
+	if len(tagDef.Values) > 0 {
+		locTagDef.Values = make([]string, len(tagDef.Values))
+		copy(locTagDef.Values, tagDef.Values)
+	}
+	return locTagDef
+}
+
+// locUnrepresentable returns a map describing the constraints in this
+// profile that a Library of Congress profile cannot express.
+func (p *BagItProfile) locUnrepresentable() map[string]string {
+	lost := make(map[string]string)
+	if !util.IsEmptyStringList(p.ManifestsRequired) {
+		lost["ManifestsRequired"] = fmt.Sprintf("Required manifests (%s) cannot be represented.", strings.Join(p.ManifestsRequired, ", "))
+	}
+	if !util.IsEmptyStringList(p.TagManifestsRequired) {
+		lost["TagManifestsRequired"] = fmt.Sprintf("Required tag manifests (%s) cannot be represented.", strings.Join(p.TagManifestsRequired, ", "))
+	}
+	if !util.IsEmptyStringList(p.TagFilesRequired) {
+		lost["TagFilesRequired"] = fmt.Sprintf("Required tag files (%s) cannot be represented.", strings.Join(p.TagFilesRequired, ", "))
+	}
+	if isRestrictedList(p.ManifestsAllowed, constants.PreferredAlgsInOrder) {
+		lost["ManifestsAllowed"] = fmt.Sprintf("Restriction of manifests to %s cannot be represented.", strings.Join(p.ManifestsAllowed, ", "))
+	}
+	if isRestrictedList(p.TagManifestsAllowed, constants.PreferredAlgsInOrder) {
+		lost["TagManifestsAllowed"] = fmt.Sprintf("Restriction of tag manifests to %s cannot be represented.", strings.Join(p.TagManifestsAllowed, ", "))
+	}
+	if !util.IsEmptyStringList(p.TagFilesAllowed) && !util.StringListContains(p.TagFilesAllowed, "*") {
+		lost["TagFilesAllowed"] = fmt.Sprintf("Restriction of tag files to %s cannot be represented.", strings.Join(p.TagFilesAllowed, ", "))
+	}
+	if isRestrictedList(p.AcceptBagItVersion, constants.AcceptBagItVersion) {
+		lost["AcceptBagItVersion"] = fmt.Sprintf("Restriction of BagIt versions to %s cannot be represented.", strings.Join(p.AcceptBagItVersion, ", "))
+	}
+	if isRestrictedList(p.AcceptSerialization, constants.AcceptSerialization) {
+		lost["AcceptSerialization"] = fmt.Sprintf("Restriction of serialization formats to %s cannot be represented.", strings.Join(p.AcceptSerialization, ", "))
+	}
+	if p.Serialization == constants.SerializationRequired || p.Serialization == constants.SerializationForbidden {
+		lost["Serialization"] = fmt.Sprintf("Serialization rule '%s' cannot be represented.", p.Serialization)
+	}
+	if p.TarDirMustMatchName {
+		lost["TarDirMustMatchName"] = "Requirement that the tarred bag directory match the bag name cannot be represented."
+	}
+	if !p.AllowFetchTxt {
+		lost["AllowFetchTxt"] = "Prohibition on fetch.txt cannot be represented."
+	}
+	for _, tagDef := range p.Tags {
+		if tagDef.TagFile == "bagit.txt" {
+			// Defined by the BagIt spec, so LOC profiles don't need them.
+			continue
+		}
+		if tagDef.TagFile != "bag-info.txt" {
+			if tagDef.hasConstraints() {
+				lost[tagDef.FullyQualifiedName()] = fmt.Sprintf("Tag %s cannot be represented because LOC profiles describe only bag-info.txt.", tagDef.FullyQualifiedName())
+			}
+			continue
+		}
+		if tagDef.Required && tagDef.EmptyOK {
+			lost[tagDef.FullyQualifiedName()] = fmt.Sprintf("Tag %s allows an empty value, which cannot be represented.", tagDef.FullyQualifiedName())
+		} else if tagDef.Required && len(tagDef.Values) == 1 && tagDef.DefaultValue != "" && tagDef.DefaultValue != tagDef.Values[0] {
+			lost[tagDef.FullyQualifiedName()] = fmt.Sprintf("Default value for tag %s cannot be represented alongside its required value.", tagDef.FullyQualifiedName())
+		}
+	}
+	return lost
+}
+
+// isRestrictedList returns true if allowed is not empty and leaves out
+// any of the values in all. An empty list places no restriction. LOC
+// profiles can't say which values are allowed, so importing one allows
+// all of them.
+func isRestrictedList(allowed, all []string) bool {
+	if util.IsEmptyStringList(allowed) {
+		return false
+	}
+	for _, value := range all {
+		if !util.StringListContains(allowed, value) {
+			return true
+		}
+	}
+	return false
+}
+
 // GuessProfileTypeFromJson tries to determine the type of a BagIt profile based
 // on its structure.
 func GuessProfileTypeFromJson(jsonBytes []byte) (string, error) {
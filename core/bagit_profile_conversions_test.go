@@ -1,6 +1,7 @@
 package core_test
 
 import (
+	"encoding/json"
 	"fmt"
 	"path/filepath"
 	"strings"
@@ -278,3 +279,102 @@ func TestConvertFromDartProfile(t *testing.T) {
 
 	assert.True(t, profile.Validate(), profile.Errors)
 }
+
+func TestBagItProfileToLOCUnordered(t *testing.T) {
+	jsonData := loadTestProfile(t, "loc", "unordered-loc-profile.json")
+	profile, err := core.ConvertProfile(jsonData, "https://example.com/unordered-profile.json")
+	require.Nil(t, err)
+
+	locProfile, lost := profile.ToLOCUnordered()
+	require.NotNil(t, locProfile)
+
+	assert.Equal(t, "Sandy Bostian", locProfile["Send-To-Name"].RequiredValue)
+	assert.True(t, locProfile["Send-To-Name"].Required)
+	assert.True(t, locProfile["External-Identifier"].Required)
+	assert.False(t, locProfile["Media-Identifiers"].Required)
+	assert.Equal(t, "World Digital Library, Library of Congress, 101 Independence Ave, SE, Washington, DC 20540 USA", locProfile["Ship-To-Address"].RequiredValue)
+	_, hasBagItVersion := locProfile["BagIt-Version"]
+	assert.False(t, hasBagItVersion)
+
+	// Imported LOC profiles have nothing DART-specific to lose,
+	// except that DART disallows fetch.txt by default.
+	assert.Equal(t, 1, len(lost), lost)
+	assert.NotEmpty(t, lost["AllowFetchTxt"])
+
+	// Round trip should give us back the same tag definitions.
+	exported, err := json.Marshal(locProfile)
+	require.Nil(t, err)
+	profileType, err := core.GuessProfileTypeFromJson(exported)
+	require.Nil(t, err)
+	assert.Equal(t, constants.ProfileTypeLOCUnordered, profileType)
+	reimported, err := core.ConvertProfile(exported, "")
+	require.Nil(t, err)
+	for _, tagDef := range profile.TagsInFile("bag-info.txt") {
+		reimportedTag := reimported.GetTagDef("bag-info.txt", tagDef.TagName)
+		require.NotNil(t, reimportedTag, tagDef.TagName)
+		assert.Equal(t, tagDef.Required, reimportedTag.Required, tagDef.TagName)
+		assert.Equal(t, tagDef.DefaultValue, reimportedTag.DefaultValue, tagDef.TagName)
+		assert.Equal(t, len(tagDef.Values), len(reimportedTag.Values), tagDef.TagName)
+	}
+}
+
+func TestBagItProfileToLOCOrdered(t *testing.T) {
+	jsonData := loadTestProfile(t, "loc", "SANC-state-profile.json")
+	profile, err := core.ConvertProfile(jsonData, "https://example.com/ordered-profile.json")
+	require.Nil(t, err)
+
+	locProfile, _ := profile.ToLOCOrdered()
+	require.NotNil(t, locProfile)
+	assert.Equal(t, len(profile.TagsInFile("bag-info.txt")), len(locProfile.Tags))
+
+	// Order follows the DART profile.
+	i := 0
+	for _, tagDef := range profile.Tags {
+		if tagDef.TagFile != "bag-info.txt" {
+			continue
+		}
+		_, ok := locProfile.Tags[i][tagDef.TagName]
+		assert.True(t, ok, tagDef.TagName)
+		i++
+	}
+
+	exported, err := json.Marshal(locProfile)
+	require.Nil(t, err)
+	profileType, err := core.GuessProfileTypeFromJson(exported)
+	require.Nil(t, err)
+	assert.Equal(t, constants.ProfileTypeLOCOrdered, profileType)
+}
+
+func TestBagItProfileToLOCUnrepresentable(t *testing.T) {
+	profile := loadProfile(t, "aptrust-v2.3.json")
+	_, lost := profile.ToLOCUnordered()
+	assert.NotEmpty(t, lost["ManifestsRequired"])
+	assert.NotEmpty(t, lost["Serialization"])
+	assert.NotEmpty(t, lost["TarDirMustMatchName"])
+	assert.NotEmpty(t, lost["aptrust-info.txt/Access"])
+	assert.NotEmpty(t, lost["aptrust-info.txt/Title"])
+	_, hasBagItVersion := lost["bagit.txt/BagIt-Version"]
+	assert.False(t, hasBagItVersion)
+
+	// APTrust accepts only tar files, but allows every manifest
+	// algorithm, BagIt version and tag file.
+	assert.Contains(t, lost["AcceptSerialization"], "application/tar")
+	for _, key := range []string{"ManifestsAllowed", "TagManifestsAllowed", "TagFilesAllowed", "AcceptBagItVersion"} {
+		_, hasKey := lost[key]
+		assert.False(t, hasKey, key)
+	}
+
+	_, orderedLost := profile.ToLOCOrdered()
+	assert.Equal(t, lost, orderedLost)
+
+	// Restricted lists of allowed values are lost too.
+	profile.ManifestsAllowed = []string{"md5", "sha256"}
+	profile.TagManifestsAllowed = []string{"sha256"}
+	profile.TagFilesAllowed = []string{"bag-info.txt", "aptrust-info.txt"}
+	profile.AcceptBagItVersion = []string{"1.0"}
+	_, lost = profile.ToLOCUnordered()
+	assert.Contains(t, lost["ManifestsAllowed"], "md5, sha256")
+	assert.Contains(t, lost["TagManifestsAllowed"], "sha256")
+	assert.Contains(t, lost["TagFilesAllowed"], "bag-info.txt, aptrust-info.txt")
+	assert.Contains(t, lost["AcceptBagItVersion"], "1.0")
+}
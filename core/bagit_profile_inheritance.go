@@ -0,0 +1,443 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/profiles"
+	"github.com/APTrust/dart-runner/util"
+)
+
+// ProfileLookupFunc returns the BagIt profile whose ID or
+// BagItProfileIdentifier matches ref, or nil if it can't find one.
+type ProfileLookupFunc func(ref string) *BagItProfile
+
+// Resolve returns the effective profile for p. If p doesn't inherit from
+// a base, this returns p itself. A profile inherits from its base only if
+// InheritsFromBase is true and BaseProfileID names the base. (DART's
+// "Base this profile on..." option sets BaseProfileID on a complete copy
+// of the base, and those copies are used as they are.) For profiles that
+// do inherit, this returns a new profile in which p's settings are layered
+// on top of its base (and its base's base, and so on).
+//
+// The base is looked up by ID or by BagItProfileInfo.BagItProfileIdentifier,
+// first in the local database and then among the profiles built in to DART.
+// Resolve remembers the base it found, so later calls don't look it up again.
+//
+// Merge rules:
+//
+//   - Name, description, serialization and non-empty profile info fields
+//     in the derived profile replace those in the base.
+//   - Non-empty lists of allowed BagIt versions, serialization formats,
+//     manifests, tag manifests and tag files replace those in the base.
+//   - Required manifests, tag manifests and tag files are added to
+//     those required by the base.
+//   - AllowFetchTxt and TarDirMustMatchName are true in the effective
+//     profile if they're true in either the base or the derived profile.
+//   - A tag definition in the derived profile replaces the base tag
+//     definition with the same file and name. Tags not in the base
+//     are added.
+//
+// This returns an error wrapping constants.ErrBaseProfileNotFound if
+// the base profile doesn't exist, constants.ErrProfileInheritanceCycle
+// if the chain of bases loops back on itself, and
+// constants.ErrProfileConflict if the derived profile's overrides
+// contradict settings it inherits from the base.
+func (p *BagItProfile) Resolve() (*BagItProfile, error) {
+	if !p.inheritsFromBase() {
+		return p, nil
+	}
+	if p.cachedBase == nil || p.cachedBaseRef != p.BaseProfileID {
+		base, err := p.resolveBase(FindProfile, make(map[string]bool))
+		if err != nil {
+			return nil, err
+		}
+		p.cachedBase = base
+		p.cachedBaseRef = p.BaseProfileID
+	}
+	return p.mergeOnto(p.cachedBase)
+}
+
+// ResolveWith resolves the effective profile, as described in Resolve,
+// using lookup to find base profiles.
+func (p *BagItProfile) ResolveWith(lookup ProfileLookupFunc) (*BagItProfile, error) {
+	return p.resolve(lookup, make(map[string]bool))
+}
+
+// inheritsFromBase returns true if this profile opts in to
+// inheriting settings from the profile named in BaseProfileID.
+func (p *BagItProfile) inheritsFromBase() bool {
+	return p.InheritsFromBase && strings.TrimSpace(p.BaseProfileID) != ""
+}
+
+func (p *BagItProfile) resolve(lookup ProfileLookupFunc, seen map[string]bool) (*BagItProfile, error) {
+	if !p.inheritsFromBase() {
+		return p, nil
+	}
+	effectiveBase, err := p.resolveBase(lookup, seen)
+	if err != nil {
+		return nil, err
+	}
+	return p.mergeOnto(effectiveBase)
+}
+
+// resolveBase returns the effective profile of p's base.
+func (p *BagItProfile) resolveBase(lookup ProfileLookupFunc, seen map[string]bool) (*BagItProfile, error) {
+	seen[p.ID] = true
+	if p.BaseProfileID == p.ID || p.BaseProfileID == p.BagItProfileInfo.BagItProfileIdentifier {
+		return nil, fmt.Errorf("%w: profile '%s' names itself as its base", constants.ErrProfileInheritanceCycle, p.Name)
+	}
+	base := lookup(p.BaseProfileID)
+	if base == nil {
+		return nil, fmt.Errorf("%w: %s", constants.ErrBaseProfileNotFound, p.BaseProfileID)
+	}
+	if seen[base.ID] {
+		return nil, fmt.Errorf("%w: profile '%s' inherits from itself through '%s'", constants.ErrProfileInheritanceCycle, p.Name, base.Name)
+	}
+	return base.resolve(lookup, seen)
+}
+
+// mergeOnto layers p on top of its effective base and checks
+// the result for conflicts.
+func (p *BagItProfile) mergeOnto(effectiveBase *BagItProfile) (*BagItProfile, error) {
+	if err := p.checkTagOverrides(); err != nil {
+		return nil, err
+	}
+	effective := mergeProfiles(effectiveBase, p)
+	if err := effective.checkInheritedConstraints(); err != nil {
+		return nil, err
+	}
+	// The effective profile still names its base. Remember the base,
+	// so validating the effective profile doesn't have to find it again.
+	effective.cachedBase = effectiveBase
+	effective.cachedBaseRef = p.BaseProfileID
+	return effective, nil
+}
+
+// mergeProfiles returns a new profile with the settings of derived
+// layered on top of base. Neither base nor derived is altered.
+func mergeProfiles(base, derived *BagItProfile) *BagItProfile {
+	effective := BagItProfileClone(base)
+	effective.ID = derived.ID
+	effective.Name = derived.Name
+	effective.BaseProfileID = derived.BaseProfileID
+	effective.InheritsFromBase = derived.InheritsFromBase
+	effective.IsBuiltIn = derived.IsBuiltIn
+	effective.AllowFetchTxt = base.AllowFetchTxt || derived.AllowFetchTxt
+	effective.TarDirMustMatchName = base.TarDirMustMatchName || derived.TarDirMustMatchName
+	if derived.Description != "" {
+		effective.Description = derived.Description
+	}
+	if derived.Serialization != "" {
+		effective.Serialization = derived.Serialization
+	}
+	effective.BagItProfileInfo = mergeProfileInfo(base.BagItProfileInfo, derived.BagItProfileInfo)
+
+	effective.AcceptBagItVersion = overrideList(effective.AcceptBagItVersion, derived.AcceptBagItVersion)
+	effective.AcceptSerialization = overrideList(effective.AcceptSerialization, derived.AcceptSerialization)
+	effective.ManifestsAllowed = overrideList(effective.ManifestsAllowed, derived.ManifestsAllowed)
+	effective.TagManifestsAllowed = overrideList(effective.TagManifestsAllowed, derived.TagManifestsAllowed)
+	effective.TagFilesAllowed = overrideList(effective.TagFilesAllowed, derived.TagFilesAllowed)
+
+	effective.ManifestsRequired = extendList(base.ManifestsRequired, derived.ManifestsRequired)
+	effective.TagManifestsRequired = extendList(base.TagManifestsRequired, derived.TagManifestsRequired)
+	effective.TagFilesRequired = extendList(base.TagFilesRequired, derived.TagFilesRequired)
+
+	// Tags may legitimately repeat (e.g. multiple Internal-Sender-Identifier
+	// values added for a job), so only the first instance of a tag overrides
+	// the base definition. Later instances are appended.
+	overridden := make(map[string]bool)
+	for _, tagDef := range derived.Tags {
+		key := strings.ToLower(tagDef.FullyQualifiedName())
+		inherited := effective.GetTagDef(tagDef.TagFile, tagDef.TagName)
+		if inherited != nil && !overridden[key] {
+			*inherited = *tagDef.Copy()
+		} else {
+			effective.Tags = append(effective.Tags, tagDef.Copy())
+		}
+		overridden[key] = true
+	}
+	return effective
+}
+
+func mergeProfileInfo(base, derived ProfileInfo) ProfileInfo {
+	info := CopyProfileInfo(base)
+	if derived.BagItProfileIdentifier != "" {
+		info.BagItProfileIdentifier = derived.BagItProfileIdentifier
+	}
+	if derived.BagItProfileVersion != "" {
+		info.BagItProfileVersion = derived.BagItProfileVersion
+	}
+	if derived.ContactEmail != "" {
+		info.ContactEmail = derived.ContactEmail
+	}
+	if derived.ContactName != "" {
+		info.ContactName = derived.ContactName
+	}
+	if derived.ExternalDescription != "" {
+		info.ExternalDescription = derived.ExternalDescription
+	}
+	if derived.SourceOrganization != "" {
+		info.SourceOrganization = derived.SourceOrganization
+	}
+	if derived.Version != "" {
+		info.Version = derived.Version
+	}
+	return info
+}
+
+// overrideList returns a copy of derived if it has any non-empty
+// entries. Otherwise, it returns base.
+func overrideList(base, derived []string) []string {
+	if util.IsEmptyStringList(derived) {
+		return base
+	}
+	list := make([]string, len(derived))
+	copy(list, derived)
+	return list
+}
+
+// extendList returns the distinct values of base and derived,
+// with base values first.
+func extendList(base, derived []string) []string {
+	list := make([]string, 0, len(base)+len(derived))
+	for _, value := range append(base, derived...) {
+		if value != "" && !util.StringListContains(list, value) {
+			list = append(list, value)
+		}
+	}
+	return list
+}
+
+// checkTagOverrides returns an error if the derived profile defines the
+// same tag more than once in ways that disagree, since we can't tell
+// which definition should override the base.
+func (p *BagItProfile) checkTagOverrides() error {
+	conflicts := make([]string, 0)
+	defined := make(map[string]*TagDefinition)
+	for _, tagDef := range p.Tags {
+		key := strings.ToLower(tagDef.FullyQualifiedName())
+		previous, exists := defined[key]
+		if !exists {
+			defined[key] = tagDef
+			continue
+		}
+		if !tagDef.hasConstraints() || !previous.hasConstraints() {
+			// Repeated instance of a tag, holding another value.
+			continue
+		}
+		if previous.Required != tagDef.Required || previous.DefaultValue != tagDef.DefaultValue || !slices.Equal(previous.Values, tagDef.Values) {
+			conflicts = append(conflicts, fmt.Sprintf("tag %s has more than one conflicting definition", tagDef.FullyQualifiedName()))
+		}
+	}
+	if len(conflicts) > 0 {
+		return fmt.Errorf("%w: %s", constants.ErrProfileConflict, strings.Join(conflicts, "; "))
+	}
+	return nil
+}
+
+// hasConstraints returns true if this tag definition says anything
+// about what the tag must contain.
+func (t *TagDefinition) hasConstraints() bool {
+	return t.Required || t.DefaultValue != "" || len(t.Values) > 0
+}
+
+// checkInheritedConstraints returns an error if the effective profile
+// contradicts itself. This happens when a derived profile narrows a list
+// of allowed values so that it excludes something the base requires.
+func (p *BagItProfile) checkInheritedConstraints() error {
+	conflicts := make([]string, 0)
+	for _, alg := range p.ManifestsRequired {
+		if !util.StringListContains(p.ManifestsAllowed, alg) {
+			conflicts = append(conflicts, fmt.Sprintf("manifest-%s.txt is required but algorithm %s is not allowed", alg, alg))
+		}
+	}
+	for _, alg := range p.TagManifestsRequired {
+		if !util.StringListContains(p.TagManifestsAllowed, alg) {
+			conflicts = append(conflicts, fmt.Sprintf("tagmanifest-%s.txt is required but algorithm %s is not allowed", alg, alg))
+		}
+	}
+	for _, tagFile := range p.TagFilesRequired {
+		if !p.tagFileAllowed(tagFile) {
+			conflicts = append(conflicts, fmt.Sprintf("tag file %s is required but not allowed", tagFile))
+		}
+	}
+	if p.Serialization == constants.SerializationRequired && util.IsEmptyStringList(p.AcceptSerialization) {
+		conflicts = append(conflicts, "serialization is required but no serialization formats are accepted")
+	}
+	for _, tagDef := range p.Tags {
+		if tagDef.DefaultValue != "" && len(tagDef.Values) > 0 && !util.StringListContains(tagDef.Values, tagDef.DefaultValue) {
+			conflicts = append(conflicts, fmt.Sprintf("default value '%s' for tag %s is not one of its allowed values", tagDef.DefaultValue, tagDef.FullyQualifiedName()))
+		}
+	}
+	if len(conflicts) > 0 {
+		return fmt.Errorf("%w: %s", constants.ErrProfileConflict, strings.Join(conflicts, "; "))
+	}
+	return nil
+}
+
+// tagFileAllowed returns true if the profile's TagFilesAllowed
+// permits tagFile. An empty list permits everything.
+func (p *BagItProfile) tagFileAllowed(tagFile string) bool {
+	if util.IsEmptyStringList(p.TagFilesAllowed) {
+		return true
+	}
+	for _, pattern := range p.TagFilesAllowed {
+		if pattern == "*" || pattern == tagFile {
+			return true
+		}
+		if matched, _ := filepath.Match(pattern, tagFile); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesProfileRef returns true if ref is this profile's
+// ID or BagItProfileIdentifier.
+func (p *BagItProfile) matchesProfileRef(ref string) bool {
+	return ref != "" && (p.ID == ref || p.BagItProfileInfo.BagItProfileIdentifier == ref)
+}
+
+// FindProfile returns the profile whose ID or BagItProfileIdentifier
+// matches ref, as described in LookupProfile. It returns nil if it can't
+// find a match, or if more than one profile matches.
+func FindProfile(ref string) *BagItProfile {
+	profile, err := LookupProfile(ref)
+	if err != nil {
+		Dart.Log.Warningf("Can't choose a profile for %s: %s", ref, err.Error())
+	}
+	return profile
+}
+
+// LookupProfile returns the profile whose ID or BagItProfileIdentifier
+// matches ref. Since users can copy a profile without changing its
+// identifier, this checks in the following order:
+//
+//  1. Profiles in the local database whose ID is ref.
+//  2. Profiles built in to DART whose ID or identifier is ref.
+//  3. Profiles in the local database whose identifier is ref.
+//
+// It returns nil and no error if nothing matches. If more than one
+// profile in the database has identifier ref, and no built-in profile
+// does, it returns an error wrapping constants.ErrAmbiguousProfile.
+func LookupProfile(ref string) (*BagItProfile, error) {
+	if ref == "" {
+		return nil, nil
+	}
+	stored := storedProfiles()
+	for _, profile := range stored {
+		if profile.ID == ref {
+			return profile, nil
+		}
+	}
+	if profile := findBuiltInProfile(ref); profile != nil {
+		return profile, nil
+	}
+	matches := make([]*BagItProfile, 0)
+	for _, profile := range stored {
+		if profile.matchesProfileRef(ref) {
+			matches = append(matches, profile)
+		}
+	}
+	if len(matches) > 1 {
+		names := make([]string, len(matches))
+		for i, profile := range matches {
+			names[i] = fmt.Sprintf("'%s' (%s)", profile.Name, profile.ID)
+		}
+		return nil, fmt.Errorf("%w: %s is the identifier of %s", constants.ErrAmbiguousProfile, ref, strings.Join(names, ", "))
+	}
+	if len(matches) == 1 {
+		return matches[0], nil
+	}
+	return nil, nil
+}
+
+// storedProfiles returns the profiles in the local database, in
+// name order. This reads profiles as they are stored, without
+// resolving them, so that looking up a base profile can't loop
+// back into resolving the profile that asked for it.
+func storedProfiles() []*BagItProfile {
+	if Dart.DB == nil {
+		return nil
+	}
+	rows, err := Dart.DB.Query("select obj_json from dart where obj_type = ? order by obj_name", constants.TypeBagItProfile)
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+	qr := NewQueryResult(constants.ResultTypeList)
+	bagItProfileList(rows, qr)
+	if qr.Error != nil {
+		return nil
+	}
+	return qr.BagItProfiles
+}
+
+func findBuiltInProfile(ref string) *BagItProfile {
+	for _, profileJson := range []string{profiles.APTrust_V_2_2, profiles.APTrust_V_2_3, profiles.BTR_V_1_0, profiles.Empty_V_1_0} {
+		profile, err := BagItProfileFromJSON(profileJson)
+		if err == nil && profile.matchesProfileRef(ref) {
+			return profile
+		}
+	}
+	return nil
+}
+
+// siblingProfileLookup returns a lookup function that searches the
+// JSON files in dir before falling back to FindProfile. This lets
+// a derived profile on disk refer to a base profile in the same
+// directory.
+func siblingProfileLookup(dir string) ProfileLookupFunc {
+	return func(ref string) *BagItProfile {
+		files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+		for _, file := range files {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				continue
+			}
+			profile, err := BagItProfileFromJSON(string(data))
+			if err == nil && profile.matchesProfileRef(ref) {
+				return profile
+			}
+		}
+		return FindProfile(ref)
+	}
+}
+
+// resolveOrWarn resolves the effective profile. If the base profile
+// can't be found, it logs a warning and returns p unchanged. Profiles
+// exported from DART are complete copies of their base, so they remain
+// usable on machines that don't have the base.
+func (p *BagItProfile) resolveOrWarn(lookup ProfileLookupFunc) (*BagItProfile, error) {
+	effective, err := p.ResolveWith(lookup)
+	if errors.Is(err, constants.ErrBaseProfileNotFound) {
+		Dart.Log.Warningf("Profile '%s': %s. Using the profile as-is.", p.Name, err.Error())
+		return p, nil
+	}
+	return effective, err
+}
+
+// resolveLoadedProfiles replaces each profile in qr that inherits from
+// a base with its effective profile, so that code loading profiles from
+// the database gets the settings it will actually bag and validate with.
+// If a profile can't be resolved, this logs a warning and leaves it as
+// stored.
+func resolveLoadedProfiles(qr *QueryResult) {
+	for i, profile := range qr.BagItProfiles {
+		if !profile.inheritsFromBase() {
+			continue
+		}
+		effective, err := profile.Resolve()
+		if err != nil {
+			Dart.Log.Warningf("Profile '%s': %s. Using the profile as stored.", profile.Name, err.Error())
+			continue
+		}
+		qr.BagItProfiles[i] = effective
+	}
+}
@@ -0,0 +1,365 @@
+package core_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/core"
+	"github.com/APTrust/dart-runner/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func inheritanceProfilePath(name string) string {
+	return filepath.Join(util.PathToTestData(), "profiles", "inheritance", name)
+}
+
+func derivedTestProfile() *core.BagItProfile {
+	profile := &core.BagItProfile{
+		ID:               "11111111-2222-4333-8444-555555555555",
+		Name:             "Derived",
+		BaseProfileID:    constants.ProfileIDAPTrust,
+		InheritsFromBase: true,
+		Tags:             make([]*core.TagDefinition, 0),
+	}
+	return profile
+}
+
+func TestBagItProfileResolveNoBase(t *testing.T) {
+	profile := loadProfile(t, "aptrust-v2.2.json")
+	effective, err := profile.Resolve()
+	require.Nil(t, err)
+	assert.Same(t, profile, effective)
+}
+
+func TestBagItProfileResolveBuiltInBase(t *testing.T) {
+	derived := derivedTestProfile()
+	derived.ManifestsRequired = []string{"sha256"}
+	derived.Tags = append(derived.Tags, &core.TagDefinition{
+		TagFile:  "aptrust-info.txt",
+		TagName:  "Access",
+		Required: true,
+		Values:   []string{"Institution", "Restricted"},
+	}, &core.TagDefinition{
+		TagFile:  "bag-info.txt",
+		TagName:  "Collection-Identifier",
+		Required: true,
+	})
+
+	effective, err := derived.Resolve()
+	require.Nil(t, err)
+	require.NotNil(t, effective)
+	assert.NotSame(t, derived, effective)
+
+	assert.Equal(t, derived.ID, effective.ID)
+	assert.Equal(t, "Derived", effective.Name)
+	assert.Equal(t, derived.BaseProfileID, effective.BaseProfileID)
+
+	// Inherited from base
+	assert.Equal(t, constants.SerializationRequired, effective.Serialization)
+	assert.Equal(t, []string{"application/tar"}, effective.AcceptSerialization)
+	assert.Equal(t, []string{"md5", "sha256"}, effective.ManifestsAllowed)
+	assert.NotNil(t, effective.GetTagDef("aptrust-info.txt", "Title"))
+	assert.Equal(t, constants.DefaultProfileIdentifier, effective.BagItProfileInfo.BagItProfileIdentifier)
+
+	// Required manifests extend the base
+	assert.Equal(t, []string{"md5", "sha256"}, effective.ManifestsRequired)
+
+	// Overridden tag replaces base definition
+	access := effective.GetTagDef("aptrust-info.txt", "Access")
+	require.NotNil(t, access)
+	assert.Equal(t, []string{"Institution", "Restricted"}, access.Values)
+	accessDefs, err := effective.FindMatchingTags("TagName", "Access")
+	require.Nil(t, err)
+	assert.Equal(t, 1, len(accessDefs))
+
+	// New tag is added
+	collectionID := effective.GetTagDef("bag-info.txt", "Collection-Identifier")
+	require.NotNil(t, collectionID)
+	assert.True(t, collectionID.Required)
+
+	// Derived profile is unchanged
+	assert.Nil(t, derived.GetTagDef("aptrust-info.txt", "Title"))
+	assert.Equal(t, []string{"sha256"}, derived.ManifestsRequired)
+
+	assert.True(t, effective.Validate(), effective.Errors)
+}
+
+func TestBagItProfileResolveRepeatedTags(t *testing.T) {
+	derived := derivedTestProfile()
+	derived.Tags = append(derived.Tags, &core.TagDefinition{
+		TagFile:   "bag-info.txt",
+		TagName:   "Internal-Sender-Identifier",
+		UserValue: "first",
+	}, &core.TagDefinition{
+		TagFile:   "bag-info.txt",
+		TagName:   "Internal-Sender-Identifier",
+		UserValue: "second",
+	})
+	effective, err := derived.Resolve()
+	require.Nil(t, err)
+	tags, err := effective.FindMatchingTags("TagName", "Internal-Sender-Identifier")
+	require.Nil(t, err)
+	require.Equal(t, 2, len(tags))
+	assert.Equal(t, "first", tags[0].UserValue)
+	assert.Equal(t, "second", tags[1].UserValue)
+
+	// Resolving the effective profile again should change nothing.
+	again, err := effective.Resolve()
+	require.Nil(t, err)
+	assert.Equal(t, len(effective.Tags), len(again.Tags))
+}
+
+func TestBagItProfileResolveConflicts(t *testing.T) {
+	// Base requires md5, derived allows only sha256.
+	derived := derivedTestProfile()
+	derived.ManifestsAllowed = []string{"sha256"}
+	_, err := derived.Resolve()
+	require.NotNil(t, err)
+	assert.ErrorIs(t, err, constants.ErrProfileConflict)
+	assert.Contains(t, err.Error(), "manifest-md5.txt is required")
+
+	// Derived narrows allowed values so the base default is illegal.
+	derived = derivedTestProfile()
+	derived.Tags = append(derived.Tags, &core.TagDefinition{
+		TagFile:      "aptrust-info.txt",
+		TagName:      "Storage-Option",
+		Required:     true,
+		Values:       []string{"Glacier-OH"},
+		DefaultValue: "Standard",
+	})
+	_, err = derived.Resolve()
+	require.NotNil(t, err)
+	assert.ErrorIs(t, err, constants.ErrProfileConflict)
+
+	// Derived defines the same tag twice, differently.
+	derived = derivedTestProfile()
+	derived.Tags = append(derived.Tags, &core.TagDefinition{
+		TagFile:  "aptrust-info.txt",
+		TagName:  "Access",
+		Required: true,
+		Values:   []string{"Institution"},
+	}, &core.TagDefinition{
+		TagFile:  "aptrust-info.txt",
+		TagName:  "Access",
+		Required: true,
+		Values:   []string{"Consortia"},
+	})
+	_, err = derived.Resolve()
+	require.NotNil(t, err)
+	assert.ErrorIs(t, err, constants.ErrProfileConflict)
+	assert.Contains(t, err.Error(), "aptrust-info.txt/Access")
+
+	// Conflicts show up as validation errors.
+	derived = derivedTestProfile()
+	derived.ManifestsAllowed = []string{"sha256"}
+	derived.Name = "Conflicted"
+	derived.EnsureMinimumRequirements()
+	assert.False(t, derived.Validate())
+	assert.Contains(t, derived.Errors["BaseProfileID"], "is not allowed")
+}
+
+func TestBagItProfileResolveMissingBase(t *testing.T) {
+	derived := derivedTestProfile()
+	derived.BaseProfileID = "00000000-c9ff-4112-86f8-8f8f1e6a2dca"
+	_, err := derived.Resolve()
+	assert.ErrorIs(t, err, constants.ErrBaseProfileNotFound)
+
+	// Profiles that inherit can't be validated without their base.
+	assert.False(t, derived.Validate())
+	assert.Contains(t, derived.Errors["BaseProfileID"], "not found")
+
+	// Missing base is not a validation error for profiles that
+	// don't inherit, because they're full copies of their base.
+	profile := loadProfile(t, "aptrust-v2.2.json")
+	profile.BaseProfileID = "00000000-c9ff-4112-86f8-8f8f1e6a2dca"
+	assert.True(t, profile.Validate(), profile.Errors)
+}
+
+func TestBagItProfileResolveWithoutOptIn(t *testing.T) {
+	// DART's "Base this profile on..." option sets BaseProfileID on
+	// a full copy of the base. The copy's settings are used as-is,
+	// even where the user removed tags or manifests the base has.
+	profile := loadProfile(t, "aptrust-v2.2.json")
+	profile.ID = "44444444-2222-4333-8444-555555555555"
+	profile.BaseProfileID = constants.ProfileIDAPTrust
+	profile.ManifestsRequired = []string{"sha256"}
+	profile.Tags = profile.Tags[:len(profile.Tags)-1]
+	effective, err := profile.Resolve()
+	require.Nil(t, err)
+	assert.Same(t, profile, effective)
+	assert.Equal(t, []string{"sha256"}, effective.ManifestsRequired)
+}
+
+func TestBagItProfileResolveBooleans(t *testing.T) {
+	base := core.FindProfile(constants.ProfileIDAPTrust)
+	require.NotNil(t, base)
+	require.False(t, base.AllowFetchTxt)
+	derived := derivedTestProfile()
+	effective, err := derived.Resolve()
+	require.Nil(t, err)
+	assert.False(t, effective.AllowFetchTxt)
+	assert.Equal(t, base.TarDirMustMatchName, effective.TarDirMustMatchName)
+
+	derived.AllowFetchTxt = true
+	derived.TarDirMustMatchName = true
+	effective, err = derived.Resolve()
+	require.Nil(t, err)
+	assert.True(t, effective.AllowFetchTxt)
+	assert.True(t, effective.TarDirMustMatchName)
+
+	// Omitting a setting in the derived profile doesn't
+	// turn it off in the base.
+	again := derivedTestProfile()
+	again.BaseProfileID = derived.ID
+	again.ID = "55555555-2222-4333-8444-555555555555"
+	lookup := func(ref string) *core.BagItProfile {
+		if ref == derived.ID {
+			return derived
+		}
+		return core.FindProfile(ref)
+	}
+	effective, err = again.ResolveWith(lookup)
+	require.Nil(t, err)
+	assert.True(t, effective.AllowFetchTxt)
+	assert.True(t, effective.TarDirMustMatchName)
+}
+
+func TestBagItProfileSparseDerivedInDB(t *testing.T) {
+	defer core.ClearDartTable()
+	derived, err := core.BagItProfileFromJSON(`{"id":"66666666-2222-4333-8444-555555555555","name":"Sparse","baseProfileId":"` +
+		constants.ProfileIDAPTrust + `","inheritsFromBase":true,"tags":[]}`)
+	require.Nil(t, err)
+	require.True(t, derived.Validate(), derived.Errors)
+	require.Nil(t, core.ObjSave(derived))
+
+	// Loading the profile returns the effective profile.
+	result := core.ObjFind(derived.ID)
+	require.Nil(t, result.Error)
+	loaded := result.BagItProfile()
+	require.NotNil(t, loaded)
+	assert.Equal(t, "Sparse", loaded.Name)
+	assert.Equal(t, constants.SerializationRequired, loaded.Serialization)
+	assert.NotNil(t, loaded.GetTagDef("aptrust-info.txt", "Access"))
+
+	result = core.ObjList(constants.TypeBagItProfile, "obj_name", 10, 0)
+	require.Nil(t, result.Error)
+	require.Len(t, result.BagItProfiles, 1)
+	assert.NotNil(t, result.BagItProfiles[0].GetTagDef("aptrust-info.txt", "Access"))
+}
+
+func TestBagItProfileResolveCycle(t *testing.T) {
+	a := derivedTestProfile()
+	a.BaseProfileID = "22222222-2222-4333-8444-555555555555"
+	b := derivedTestProfile()
+	b.ID = "22222222-2222-4333-8444-555555555555"
+	b.BaseProfileID = a.ID
+	lookup := func(ref string) *core.BagItProfile {
+		for _, p := range []*core.BagItProfile{a, b} {
+			if p.ID == ref {
+				return p
+			}
+		}
+		return nil
+	}
+	_, err := a.ResolveWith(lookup)
+	assert.ErrorIs(t, err, constants.ErrProfileInheritanceCycle)
+
+	a.BaseProfileID = a.ID
+	_, err = a.ResolveWith(lookup)
+	assert.ErrorIs(t, err, constants.ErrProfileInheritanceCycle)
+}
+
+func TestBagItProfileResolveFromDB(t *testing.T) {
+	defer core.ClearDartTable()
+	base := loadProfile(t, "btr-v1.0-1.3.0.json")
+	base.ID = "33333333-2222-4333-8444-555555555555"
+	base.BagItProfileInfo.BagItProfileIdentifier = "https://example.edu/btr-local.json"
+	base.Name = "Local BTR"
+	require.Nil(t, core.ObjSave(base))
+
+	derived := derivedTestProfile()
+	derived.BaseProfileID = "https://example.edu/btr-local.json"
+	effective, err := derived.Resolve()
+	require.Nil(t, err)
+	assert.Equal(t, base.AcceptSerialization, effective.AcceptSerialization)
+
+	derived.BaseProfileID = base.ID
+	effective, err = derived.Resolve()
+	require.Nil(t, err)
+	assert.Equal(t, base.AcceptSerialization, effective.AcceptSerialization)
+}
+
+func TestBagItProfileLoadResolvesSiblings(t *testing.T) {
+	profile, err := core.BagItProfileLoad(inheritanceProfilePath("example_derived.json"))
+	require.Nil(t, err)
+	require.NotNil(t, profile)
+
+	assert.Equal(t, "Example Special Collections", profile.Name)
+	assert.True(t, profile.TarDirMustMatchName)
+
+	// From example_base.json
+	assert.Equal(t, "example.edu", profile.BagItProfileInfo.SourceOrganization)
+	assert.Equal(t, "https://example.edu/profiles/example-special-collections.json", profile.BagItProfileInfo.BagItProfileIdentifier)
+	storageOption := profile.GetTagDef("aptrust-info.txt", "Storage-Option")
+	require.NotNil(t, storageOption)
+	assert.Equal(t, "Glacier-Deep-OR", storageOption.DefaultValue)
+	assert.Equal(t, []string{"md5", "sha256"}, profile.ManifestsRequired)
+
+	// From APTrust 2.2, two levels up
+	assert.Equal(t, constants.SerializationRequired, profile.Serialization)
+	assert.NotNil(t, profile.GetTagDef("aptrust-info.txt", "Access"))
+
+	// Its own
+	assert.NotNil(t, profile.GetTagDef("bag-info.txt", "Collection-Identifier"))
+
+	assert.True(t, profile.Validate(), profile.Errors)
+}
+
+func TestLookupProfile(t *testing.T) {
+	defer core.ClearDartTable()
+
+	// A user's copy of a built-in profile keeps its identifier,
+	// but doesn't shadow the built-in.
+	userCopy := loadProfile(t, "aptrust-v2.2.json")
+	userCopy.ID = "77777777-2222-4333-8444-555555555555"
+	userCopy.Name = "A Copy of APTrust"
+	require.Nil(t, core.ObjSave(userCopy))
+	profile, err := core.LookupProfile(constants.DefaultProfileIdentifier)
+	require.Nil(t, err)
+	require.NotNil(t, profile)
+	assert.Equal(t, constants.ProfileIDAPTrust, profile.ID)
+
+	// Exact ID matches come first.
+	profile, err = core.LookupProfile(userCopy.ID)
+	require.Nil(t, err)
+	require.NotNil(t, profile)
+	assert.Equal(t, "A Copy of APTrust", profile.Name)
+
+	// One local profile with an identifier is found...
+	local := loadProfile(t, "btr-v1.0-1.3.0.json")
+	local.ID = "88888888-2222-4333-8444-555555555555"
+	local.Name = "Local One"
+	local.BagItProfileInfo.BagItProfileIdentifier = "https://example.edu/local.json"
+	require.Nil(t, core.ObjSave(local))
+	profile, err = core.LookupProfile("https://example.edu/local.json")
+	require.Nil(t, err)
+	require.NotNil(t, profile)
+	assert.Equal(t, local.ID, profile.ID)
+
+	// ...but two are ambiguous.
+	local.ID = "99999999-2222-4333-8444-555555555555"
+	local.Name = "Local Two"
+	require.Nil(t, core.ObjSave(local))
+	profile, err = core.LookupProfile("https://example.edu/local.json")
+	assert.Nil(t, profile)
+	assert.ErrorIs(t, err, constants.ErrAmbiguousProfile)
+	assert.Contains(t, err.Error(), "Local One")
+	assert.Contains(t, err.Error(), "Local Two")
+	assert.Nil(t, core.FindProfile("https://example.edu/local.json"))
+
+	profile, err = core.LookupProfile("https://example.edu/nothing.json")
+	assert.Nil(t, profile)
+	assert.Nil(t, err)
+}
@@ -0,0 +1,99 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/APTrust/dart-runner/constants"
+)
+
+// BatchRowState records the outcome of the last attempt to run one row
+// of a workflow batch. The WorkflowRunner saves one of these for each
+// row it runs, so that when a large batch is interrupted, the user can
+// rerun it with --resume to skip the rows that already succeeded, or
+// with --retry-failed to run only the rows that failed.
+//
+// Rows are keyed by workflow and Bag-Name rather than by CSV file, so
+// a failed-rows CSV written by one run can be fed straight back in.
+type BatchRowState struct {
+	WorkflowID  string
+	BagName     string
+	Fingerprint string
+	Status      string
+	JobID       string
+	UpdatedAt   time.Time
+}
+
+// NewBatchRowState returns a new BatchRowState for the specified row.
+// Status should be constants.StatusSuccess or constants.StatusFailed.
+func NewBatchRowState(workflowID, bagName, fingerprint, status, jobID string) *BatchRowState {
+	return &BatchRowState{
+		WorkflowID:  workflowID,
+		BagName:     bagName,
+		Fingerprint: fingerprint,
+		Status:      status,
+		JobID:       jobID,
+		UpdatedAt:   time.Now().UTC(),
+	}
+}
+
+// BatchRowFingerprint returns a digest of the values in a batch item,
+// along with the size and modification time of each of its source files
+// or directories. If the user edits the item, or adds or removes files
+// directly under its source directories, the fingerprint changes, and
+// --resume will run the item again even if it succeeded before.
+func BatchRowFingerprint(entry *WorkflowCSVEntry) string {
+	hash := sha256.New()
+	hash.Write([]byte(strings.Join(entry.record, "\x1f")))
+	for _, sourceFile := range entry.SourceFiles() {
+		stat, err := os.Stat(sourceFile)
+		if err == nil {
+			fmt.Fprintf(hash, "\n%s\n%d\n%d", sourceFile, stat.Size(), stat.ModTime().UnixNano())
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// batchWorkflowID returns the ID under which we journal a workflow's
+// batch rows. Workflows exported from DART have IDs, but hand-written
+// workflow JSON may have only a name.
+func batchWorkflowID(workflow *Workflow) string {
+	if workflow.ID != "" {
+		return workflow.ID
+	}
+	return workflow.Name
+}
+
+// shouldSkipBatchRow returns true if a previous run of this row means
+// we shouldn't run it now. With retryFailed, we run only rows whose last
+// attempt failed. With resume, we skip rows that succeeded, unless their
+// fingerprint has changed since.
+func shouldSkipBatchRow(state *BatchRowState, fingerprint string, resume, retryFailed bool) bool {
+	if retryFailed {
+		return state == nil || state.Status != constants.StatusFailed
+	}
+	if resume {
+		return state != nil && state.Status == constants.StatusSuccess && state.Fingerprint == fingerprint
+	}
+	return false
+}
+
+// FailedRowsFileName returns the name of the file to which the
+// WorkflowRunner writes the items that failed in a run of the batch
+// in pathToBatchFile. Failed items from CSV batches go to a CSV file.
+// Failed items from JSON Lines and YAML batches go to a JSON Lines
+// file. Running a failed-rows file produces a file with the same name,
+// so repeated retries don't pile up suffixes.
+func FailedRowsFileName(pathToBatchFile string) string {
+	baseName := strings.TrimSuffix(filepath.Base(pathToBatchFile), filepath.Ext(pathToBatchFile))
+	baseName = strings.TrimSuffix(baseName, "_failed")
+	if BatchFileFormat(pathToBatchFile) == "csv" {
+		return baseName + "_failed.csv"
+	}
+	return baseName + "_failed.jsonl"
+}
@@ -0,0 +1,113 @@
+package core_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/core"
+	"github.com/APTrust/dart-runner/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const journalTestHeaders = "Bag-Name,Root-Directory,aptrust-info.txt/Title,aptrust-info.txt/Description,aptrust-info.txt/Access,bag-info.txt/Source-Organization,bag-info.txt/Custom-Tag,custom-tag-file.txt/Tag-One,custom-tag-file.txt/Tag-Two"
+
+func journalTestRow(bagName, rootDir string) string {
+	return bagName + "," + rootDir + ",Journal Test,Files for batch journal tests,Institution,Test University,Custom Value,Alpha,Brie"
+}
+
+func writeJournalTestFile(t *testing.T, dir string) string {
+	require.NoError(t, os.MkdirAll(dir, 0755))
+	path := filepath.Join(dir, "file.txt")
+	require.NoError(t, os.WriteFile(path, []byte("journal test"), 0644))
+	return path
+}
+
+func runJournalTestBatch(t *testing.T, workflowFile, batchFile, outputDir string, resume, retryFailed bool) (*core.WorkflowRunner, int) {
+	runner, err := core.NewWorkflowRunner(workflowFile, batchFile, outputDir, false, true, 2)
+	require.NoError(t, err)
+	runner.Resume = resume
+	runner.RetryFailed = retryFailed
+	runner.FailedRowsFile = filepath.Join(outputDir, core.FailedRowsFileName(batchFile))
+	runner.SetStdOut(new(bytes.Buffer))
+	runner.SetStdErr(new(bytes.Buffer))
+	return runner, runner.Run()
+}
+
+func TestBatchJournal(t *testing.T) {
+	workflow := getPipelineTestWorkflow(t, []*core.StageDefinition{
+		{Type: constants.StagePackage},
+		{Type: constants.StageUpload, StorageService: "Primary"},
+	})
+	require.NoError(t, core.BatchRowStateDeleteByWorkflow(workflow.ID))
+	defer core.BatchRowStateDeleteByWorkflow(workflow.ID)
+	data, err := json.Marshal(workflow)
+	require.NoError(t, err)
+	dir := t.TempDir()
+	workflowFile := filepath.Join(dir, "workflow.json")
+	require.NoError(t, os.WriteFile(workflowFile, data, 0644))
+
+	goodDir := filepath.Join(dir, "good")
+	badDir := filepath.Join(dir, "bad")
+	writeJournalTestFile(t, goodDir)
+	batchFile := filepath.Join(dir, "batch.csv")
+	badRow := journalTestRow("JournalBad", badDir)
+	batch := strings.Join([]string{journalTestHeaders, journalTestRow("JournalGood", goodDir), badRow}, "\n") + "\n"
+	require.NoError(t, os.WriteFile(batchFile, []byte(batch), 0644))
+	outputDir := filepath.Join(dir, "output")
+	require.NoError(t, os.MkdirAll(outputDir, 0755))
+	failedRowsFile := filepath.Join(outputDir, "batch_failed.csv")
+
+	// The first run records both outcomes and writes the failed row.
+	runner, exitCode := runJournalTestBatch(t, workflowFile, batchFile, outputDir, false, false)
+	assert.Equal(t, constants.ExitRuntimeErr, exitCode)
+	assert.Equal(t, 1, runner.SuccessCount)
+	assert.Equal(t, 1, runner.FailureCount)
+	state, err := core.BatchRowStateFind(workflow.ID, "JournalGood")
+	require.NoError(t, err)
+	assert.Equal(t, constants.StatusSuccess, state.Status)
+	state, err = core.BatchRowStateFind(workflow.ID, "JournalBad")
+	require.NoError(t, err)
+	assert.Equal(t, constants.StatusFailed, state.Status)
+	failedRows, err := util.ReadFile(failedRowsFile)
+	require.NoError(t, err)
+	assert.Equal(t, journalTestHeaders+"\n"+badRow+"\n", string(failedRows))
+
+	// Resume skips the row that succeeded.
+	runner, exitCode = runJournalTestBatch(t, workflowFile, batchFile, outputDir, true, false)
+	assert.Equal(t, constants.ExitRuntimeErr, exitCode)
+	assert.Equal(t, 1, runner.SkippedCount)
+	assert.Equal(t, 1, runner.FailureCount)
+
+	// Retry-failed reruns only the failure, which now succeeds, so
+	// the failed rows file goes away.
+	writeJournalTestFile(t, badDir)
+	runner, exitCode = runJournalTestBatch(t, workflowFile, batchFile, outputDir, false, true)
+	assert.Equal(t, constants.ExitOK, exitCode)
+	assert.Equal(t, 1, runner.SkippedCount)
+	assert.Equal(t, 1, runner.SuccessCount)
+	assert.False(t, util.FileExists(failedRowsFile))
+
+	runner, exitCode = runJournalTestBatch(t, workflowFile, batchFile, outputDir, false, true)
+	assert.Equal(t, constants.ExitOK, exitCode)
+	assert.Equal(t, 2, runner.SkippedCount)
+	assert.Equal(t, 0, runner.SuccessCount)
+
+	// Resume runs a successful row again if its input changed.
+	require.NoError(t, os.WriteFile(filepath.Join(goodDir, "new.txt"), []byte("new file"), 0644))
+	runner, exitCode = runJournalTestBatch(t, workflowFile, batchFile, outputDir, true, false)
+	assert.Equal(t, constants.ExitOK, exitCode)
+	assert.Equal(t, 1, runner.SkippedCount)
+	assert.Equal(t, 1, runner.SuccessCount)
+}
+
+func TestFailedRowsFileName(t *testing.T) {
+	assert.Equal(t, "batch_failed.csv", core.FailedRowsFileName("/data/batch.csv"))
+	assert.Equal(t, "batch_failed.csv", core.FailedRowsFileName("/output/batch_failed.csv"))
+	assert.Equal(t, "items_failed.csv", core.FailedRowsFileName("items"))
+}
@@ -0,0 +1,101 @@
+package core
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// BatchSource reads the items in a workflow batch file one at a time,
+// so the WorkflowRunner never has to hold the whole batch in memory.
+//
+// WorkflowCSVFile reads CSV files, JSONLinesBatchFile reads JSON Lines
+// files, and YAMLBatchFile reads YAML files. Call NewBatchSource to get
+// the right one for a file.
+type BatchSource interface {
+	// ReadNext returns the next item in the batch. It returns io.EOF
+	// when there are no more items.
+	ReadNext() (*WorkflowCSVEntry, error)
+
+	// WriteEntries writes entries to a new batch file at path, in a
+	// format this source can read. The WorkflowRunner uses this to
+	// write the items that failed.
+	WriteEntries(path string, entries []*WorkflowCSVEntry) error
+
+	// Close closes the underlying file.
+	Close()
+}
+
+// NewBatchSource returns a BatchSource for the file at pathToFile,
+// based on its extension. Files ending in .jsonl or .ndjson are JSON
+// Lines, files ending in .yaml or .yml are YAML, and all others are CSV.
+func NewBatchSource(pathToFile string) (BatchSource, error) {
+	switch BatchFileFormat(pathToFile) {
+	case "jsonl":
+		return NewJSONLinesBatchFile(pathToFile)
+	case "yaml":
+		return NewYAMLBatchFile(pathToFile)
+	default:
+		return NewWorkflowCSVFile(pathToFile)
+	}
+}
+
+// BatchFileFormat returns "csv", "jsonl" or "yaml" to describe the
+// format of the batch file at pathToFile, based on its extension.
+func BatchFileFormat(pathToFile string) string {
+	switch strings.ToLower(filepath.Ext(pathToFile)) {
+	case ".jsonl", ".ndjson":
+		return "jsonl"
+	case ".yaml", ".yml":
+		return "yaml"
+	default:
+		return "csv"
+	}
+}
+
+// entryFromJobParams converts the JobParams for one item in a JSON Lines
+// or YAML batch to a WorkflowCSVEntry. Param jsonData is the item's JSON,
+// which we keep so we can write failed items back out.
+func entryFromJobParams(params *JobParams, jsonData []byte) *WorkflowCSVEntry {
+	entry := NewWorkflowCSVEntry(params.PackageName, "")
+	entry.Files = params.Files
+	if len(params.Files) > 0 {
+		entry.RootDir = params.Files[0]
+	}
+	for _, tag := range params.Tags {
+		if tag != nil {
+			entry.AddTag(tag.TagFile, tag.TagName, tag.Value)
+		}
+	}
+	entry.Overrides = params.JobOverrides
+	entry.record = []string{string(jsonData)}
+	return entry
+}
+
+// writeJSONLinesEntries writes the JSON of each entry from a JSON Lines
+// or YAML batch as one line of a JSON Lines file.
+func writeJSONLinesEntries(path string, entries []*WorkflowCSVEntry) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	writer := bufio.NewWriter(file)
+	for _, entry := range entries {
+		if _, err = writer.WriteString(strings.Join(entry.record, "") + "\n"); err != nil {
+			return err
+		}
+	}
+	return writer.Flush()
+}
+
+// jobParamsFromJson parses one batch item. Like the job params that
+// dart-runner reads from STDIN, items may have packageName, files and
+// tags, but the workflow and output path come from the batch.
+func jobParamsFromJson(data []byte) (*JobParams, error) {
+	params := &JobParams{}
+	err := json.Unmarshal(data, params)
+	return params, err
+}
@@ -0,0 +1,238 @@
+package core_test
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/core"
+	"github.com/APTrust/dart-runner/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const batchSourceTags = `[
+	{"tagFile": "aptrust-info.txt", "tagName": "Title", "value": "Batch Source Test"},
+	{"tagFile": "aptrust-info.txt", "tagName": "Description", "value": "Files for batch source tests"},
+	{"tagFile": "aptrust-info.txt", "tagName": "Access", "value": "Institution"},
+	{"tagFile": "aptrust-info.txt", "tagName": "Storage-Option", "value": "Standard"},
+	{"tagFile": "bag-info.txt", "tagName": "Source-Organization", "value": "Test University"},
+	{"tagFile": "bag-info.txt", "tagName": "Keyword", "value": "cats"},
+	{"tagFile": "bag-info.txt", "tagName": "Keyword", "value": "dogs"}
+]`
+
+const batchSourceYAMLTags = `  tags:
+    - {tagFile: aptrust-info.txt, tagName: Title, value: Batch Source Test}
+    - tagFile: aptrust-info.txt
+      tagName: Description
+      value: >
+        Files for batch
+        source tests
+    - {tagFile: aptrust-info.txt, tagName: Access, value: Institution}
+    - {tagFile: aptrust-info.txt, tagName: Storage-Option, value: Standard}
+    - {tagFile: bag-info.txt, tagName: Source-Organization, value: Test University}
+    - {tagFile: bag-info.txt, tagName: Keyword, value: cats}
+    - {tagFile: bag-info.txt, tagName: Keyword, value: dogs}
+`
+
+func jsonLinesItem(packageName string, files ...string) string {
+	filesJson, _ := json.Marshal(files)
+	return `{"packageName": "` + packageName + `", "files": ` + string(filesJson) + `, "tags": ` + strings.ReplaceAll(batchSourceTags, "\n", "") + `}`
+}
+
+func readAllEntries(t *testing.T, source core.BatchSource) []*core.WorkflowCSVEntry {
+	entries := make([]*core.WorkflowCSVEntry, 0)
+	for {
+		entry, err := source.ReadNext()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestBatchFileFormat(t *testing.T) {
+	assert.Equal(t, "csv", core.BatchFileFormat("/data/batch.csv"))
+	assert.Equal(t, "csv", core.BatchFileFormat("/data/batch.txt"))
+	assert.Equal(t, "jsonl", core.BatchFileFormat("/data/batch.jsonl"))
+	assert.Equal(t, "jsonl", core.BatchFileFormat("/data/batch.NDJSON"))
+	assert.Equal(t, "yaml", core.BatchFileFormat("/data/batch.yaml"))
+	assert.Equal(t, "yaml", core.BatchFileFormat("/data/batch.yml"))
+	assert.Equal(t, "batch_failed.jsonl", core.FailedRowsFileName("/data/batch.yaml"))
+	assert.Equal(t, "batch_failed.jsonl", core.FailedRowsFileName("/output/batch_failed.jsonl"))
+}
+
+func TestJSONLinesBatchFile(t *testing.T) {
+	dir := t.TempDir()
+	batchFile := filepath.Join(dir, "batch.jsonl")
+	contents := jsonLinesItem("photos.tar", "/data/photos", "/data/notes.txt") + "\n\n" + jsonLinesItem("letters.tar", "/data/letters") + "\n"
+	require.NoError(t, os.WriteFile(batchFile, []byte(contents), 0644))
+
+	source, err := core.NewBatchSource(batchFile)
+	require.NoError(t, err)
+	defer source.Close()
+	require.IsType(t, &core.JSONLinesBatchFile{}, source)
+	entries := readAllEntries(t, source)
+	require.Len(t, entries, 2)
+	assert.Equal(t, "photos.tar", entries[0].BagName)
+	assert.Equal(t, "/data/photos", entries[0].RootDir)
+	assert.Equal(t, []string{"/data/photos", "/data/notes.txt"}, entries[0].SourceFiles())
+	require.Len(t, entries[0].Tags, 7)
+	assert.Len(t, entries[0].FindTags("bag-info.txt", "Keyword"), 2)
+	assert.Equal(t, "letters.tar", entries[1].BagName)
+
+	// Failed items are written back out as they came in.
+	outFile := filepath.Join(dir, "out.jsonl")
+	require.NoError(t, source.WriteEntries(outFile, entries[1:]))
+	data, err := os.ReadFile(outFile)
+	require.NoError(t, err)
+	assert.Equal(t, jsonLinesItem("letters.tar", "/data/letters")+"\n", string(data))
+
+	// Errors include the line number.
+	require.NoError(t, os.WriteFile(batchFile, []byte(contents+"{not json}\n"), 0644))
+	source, err = core.NewBatchSource(batchFile)
+	require.NoError(t, err)
+	defer source.Close()
+	_, _ = source.ReadNext()
+	_, _ = source.ReadNext()
+	_, err = source.ReadNext()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "line 4")
+}
+
+func TestYAMLBatchFile(t *testing.T) {
+	dir := t.TempDir()
+	batchFile := filepath.Join(dir, "batch.yaml")
+	contents := "# Test batch\n---\n- packageName: photos.tar\n  files:\n    - /data/photos\n    - /data/notes.txt\n" + batchSourceYAMLTags +
+		"\n- packageName: letters.tar\n  files: [/data/letters]\n" +
+		"- packageName: 007\n  files: [&dir /data/bond, *dir]\n  tags:\n    - {tagFile: bag-info.txt, tagName: Bagging-Date, value: 2024-01-01}\n    - {tagFile: bag-info.txt, tagName: Internal-Sender-Identifier, value: yes}\n"
+	require.NoError(t, os.WriteFile(batchFile, []byte(contents), 0644))
+
+	source, err := core.NewBatchSource(batchFile)
+	require.NoError(t, err)
+	defer source.Close()
+	require.IsType(t, &core.YAMLBatchFile{}, source)
+	entries := readAllEntries(t, source)
+	require.Len(t, entries, 3)
+	assert.Equal(t, "photos.tar", entries[0].BagName)
+	assert.Equal(t, []string{"/data/photos", "/data/notes.txt"}, entries[0].SourceFiles())
+	require.Len(t, entries[0].Tags, 7)
+	assert.Equal(t, "Files for batch source tests\n", entries[0].FindTags("aptrust-info.txt", "Description")[0].Value)
+	assert.Equal(t, "letters.tar", entries[1].BagName)
+	assert.Equal(t, []string{"/data/letters"}, entries[1].SourceFiles())
+	assert.Empty(t, entries[1].Tags)
+
+	// Values are strings, just as they're written.
+	assert.Equal(t, "007", entries[2].BagName)
+	assert.Equal(t, []string{"/data/bond", "/data/bond"}, entries[2].SourceFiles())
+	assert.Equal(t, "2024-01-01", entries[2].FindTags("bag-info.txt", "Bagging-Date")[0].Value)
+	assert.Equal(t, "yes", entries[2].FindTags("bag-info.txt", "Internal-Sender-Identifier")[0].Value)
+
+	// YAML items that fail are written as JSON Lines.
+	outFile := filepath.Join(dir, "out.jsonl")
+	require.NoError(t, source.WriteEntries(outFile, entries[1:2]))
+	data, err := os.ReadFile(outFile)
+	require.NoError(t, err)
+	assert.Equal(t, `{"files":["/data/letters"],"packageName":"letters.tar"}`+"\n", string(data))
+
+	badYAML := map[string]string{
+		"items:\n  - packageName: x\n":               "should be a list of items",
+		"- packageName: x\nfiles: []\n":              "expected a list item",
+		"- packageName: x\n    files: []\n":          "item starting on line 1",
+		"- just a string\n":                          "item should have packageName",
+		"- packageName: x\n  files: /not/a/list\n":   "line 1",
+		"- packageName: x\n- packageName: [y, z]\n":  "line 2",
+		"# comment\n\n- packageName: 'unclosed\n":    "item starting on line 3",
+		"- packageName: x\n  tags: \"not a list\"\n": "cannot unmarshal",
+		"- packageName: x\n  packageName: y\n":       "duplicate key \"packageName\"",
+	}
+	for yaml, expected := range badYAML {
+		require.NoError(t, os.WriteFile(batchFile, []byte(yaml), 0644))
+		source, err := core.NewBatchSource(batchFile)
+		require.NoError(t, err)
+		var readErr error
+		for readErr == nil {
+			_, readErr = source.ReadNext()
+		}
+		source.Close()
+		require.NotEqual(t, io.EOF, readErr, yaml)
+		assert.Contains(t, readErr.Error(), expected, yaml)
+	}
+}
+
+func TestBatchSourceParserAndValidation(t *testing.T) {
+	workflow := loadJsonWorkflow(t)
+	dir := t.TempDir()
+	filesDir := filepath.Join(util.PathToTestData(), "files")
+	batchFile := filepath.Join(dir, "batch.jsonl")
+	require.NoError(t, os.WriteFile(batchFile, []byte(jsonLinesItem("bag1.tar", filesDir)+"\n"), 0644))
+
+	parser := core.NewCSVBatchParser(batchFile, workflow)
+	jobParamsList, err := parser.ParseAll("/tmp/out")
+	require.NoError(t, err)
+	require.Len(t, jobParamsList, 1)
+	assert.Equal(t, "bag1.tar", jobParamsList[0].PackageName)
+	assert.Equal(t, filepath.Join("/tmp/out", "bag1.tar"), jobParamsList[0].OutputPath)
+	assert.Equal(t, []string{filesDir}, jobParamsList[0].Files)
+	assert.Len(t, jobParamsList[0].Tags, 7)
+
+	wb := core.NewWorkflowBatch(workflow, batchFile)
+	assert.True(t, wb.Validate(), wb.Errors)
+
+	// Missing files and required tags are reported by item number.
+	item := `{"packageName": "bag2.tar", "files": ["/path/does/not/exist"], "tags": []}`
+	require.NoError(t, os.WriteFile(batchFile, []byte(item+"\n"), 0644))
+	assert.False(t, wb.Validate())
+	assert.Equal(t, "Item 1: file or directory does not exist: '/path/does/not/exist'.", wb.Errors["/path/does/not/exist"])
+	assert.Equal(t, "Required tag aptrust-info.txt/Title on line 1 is missing or empty.", wb.Errors["1-aptrust-info.txt/Title"])
+
+	require.NoError(t, os.WriteFile(batchFile, []byte("not json\n"), 0644))
+	assert.False(t, wb.Validate())
+	assert.Contains(t, wb.Errors["CSVFile"], "Be sure this is a valid JSONL file")
+}
+
+func TestWorkflowRunnerWithYAMLBatch(t *testing.T) {
+	workflow := getPipelineTestWorkflow(t, []*core.StageDefinition{
+		{Type: constants.StagePackage},
+		{Type: constants.StageUpload, StorageService: "Primary"},
+	})
+	workflow.ID = "yaml-batch-workflow"
+	require.NoError(t, core.BatchRowStateDeleteByWorkflow(workflow.ID))
+	defer core.BatchRowStateDeleteByWorkflow(workflow.ID)
+	data, err := json.Marshal(workflow)
+	require.NoError(t, err)
+	dir := t.TempDir()
+	workflowFile := filepath.Join(dir, "workflow.json")
+	require.NoError(t, os.WriteFile(workflowFile, data, 0644))
+
+	goodDir := filepath.Join(dir, "good")
+	goodFile := writeJournalTestFile(t, goodDir)
+	badDir := filepath.Join(dir, "bad")
+	batchFile := filepath.Join(dir, "batch.yaml")
+	contents := "- packageName: YAMLGood\n  files:\n    - " + goodDir + "\n    - " + goodFile + "\n" + batchSourceYAMLTags +
+		"- packageName: YAMLBad\n  files: [" + badDir + "]\n" + batchSourceYAMLTags
+	require.NoError(t, os.WriteFile(batchFile, []byte(contents), 0644))
+	outputDir := filepath.Join(dir, "output")
+	require.NoError(t, os.MkdirAll(outputDir, 0755))
+
+	runner, exitCode := runJournalTestBatch(t, workflowFile, batchFile, outputDir, false, false)
+	assert.Equal(t, constants.ExitRuntimeErr, exitCode)
+	assert.Equal(t, 1, runner.SuccessCount)
+	assert.Equal(t, 1, runner.FailureCount)
+	assert.True(t, util.FileExists(filepath.Join(bucketOf(workflow, "Primary"), "YAMLGood.tar")))
+
+	// The failed item can be fed straight back in.
+	failedRowsFile := filepath.Join(outputDir, "batch_failed.jsonl")
+	require.True(t, util.FileExists(failedRowsFile))
+	writeJournalTestFile(t, badDir)
+	runner, exitCode = runJournalTestBatch(t, workflowFile, failedRowsFile, outputDir, false, false)
+	assert.Equal(t, constants.ExitOK, exitCode)
+	assert.Equal(t, 1, runner.SuccessCount)
+	assert.False(t, util.FileExists(failedRowsFile))
+}
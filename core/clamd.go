@@ -0,0 +1,205 @@
+package core
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/APTrust/dart-runner/constants"
+)
+
+// clamdChunkSize is the size of the chunks we stream to clamd. This is
+// just a buffer size. clamd's StreamMaxLength (25 MB by default) limits
+// the size of the whole stream, not each chunk, so larger files fail with
+// constants.ErrClamdStreamTooLarge unless clamd can read them from disk.
+const clamdChunkSize = 64 * 1024
+
+// clamdSizeLimitReply is clamd's reply when a stream exceeds its
+// StreamMaxLength.
+const clamdSizeLimitReply = "INSTREAM size limit exceeded. ERROR"
+
+// ClamdScan asks the clamd daemon at address to scan the file at path,
+// and returns the name of the signature the file matched. It returns an
+// empty string if the file is clean.
+//
+// Param address may be a Unix socket path, such as /var/run/clamav/clamd.ctl,
+// or a TCP host and port, such as 127.0.0.1:3310. Prefixes "unix:" and
+// "tcp:" make the choice explicit.
+//
+// A clamd on a Unix socket runs on this machine, so we send it the file's
+// path with the SCAN command, and it reads the file itself. If it can't
+// read the file, usually because the clamd user doesn't have permission,
+// we send the file's contents with INSTREAM instead, as we always do for
+// clamd over TCP.
+func ClamdScan(address, path string, timeout time.Duration) (string, error) {
+	network, _ := clamdNetwork(address)
+	if network == "unix" {
+		signature, err := clamdScanPath(address, path, timeout)
+		var clamdErr *clamdError
+		if !errors.As(err, &clamdErr) {
+			return signature, err
+		}
+		Dart.Log.Infof("clamd could not scan %s (%s), so streaming it instead", path, clamdErr.reply)
+	}
+	return clamdScanStream(address, path, timeout)
+}
+
+// clamdError is an error reply from clamd.
+type clamdError struct {
+	reply string
+}
+
+func (e *clamdError) Error() string {
+	return fmt.Sprintf("clamd returned an error: %s", e.reply)
+}
+
+// clamdScanPath sends clamd the SCAN command with the absolute path of
+// the file to scan.
+func clamdScanPath(address, path string, timeout time.Duration) (string, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	// clamd's commands end at a newline or NUL, so it can't scan
+	// paths that contain them.
+	if strings.ContainsAny(absPath, "\n\x00") {
+		return "", &clamdError{reply: "path contains a newline"}
+	}
+	conn, err := dialClamd(address, timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	// The z prefix means clamd terminates commands and replies with NUL.
+	if _, err = conn.Write([]byte("zSCAN " + absPath + "\x00")); err != nil {
+		return "", fmt.Errorf("can't send to clamd: %w", err)
+	}
+	reply, err := readClamdReply(conn)
+	if err != nil {
+		return "", err
+	}
+	return parseClamdReply(reply, absPath+":")
+}
+
+// clamdScanStream sends the contents of the file at path to clamd
+// with the INSTREAM command.
+func clamdScanStream(address, path string, timeout time.Duration) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	conn, err := dialClamd(address, timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	if _, err = conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return "", fmt.Errorf("can't send to clamd: %w", err)
+	}
+	buf := make([]byte, clamdChunkSize)
+	size := make([]byte, 4)
+	for {
+		n, readErr := file.Read(buf)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size, uint32(n))
+			if _, err = conn.Write(append(size, buf[:n]...)); err != nil {
+				// clamd replies and hangs up when the stream
+				// exceeds its limit, so check for that reply.
+				return "", clamdStreamError(conn, path, err)
+			}
+		}
+		if readErr == io.EOF {
+			break
+		} else if readErr != nil {
+			return "", readErr
+		}
+	}
+	// A zero-length chunk ends the stream.
+	binary.BigEndian.PutUint32(size, 0)
+	if _, err = conn.Write(size); err != nil {
+		return "", clamdStreamError(conn, path, err)
+	}
+	reply, err := readClamdReply(conn)
+	if err != nil {
+		return "", err
+	}
+	if reply == clamdSizeLimitReply {
+		return "", clamdSizeLimitError(path)
+	}
+	return parseClamdReply(reply, "stream:")
+}
+
+// clamdStreamError returns the error for a failed write to clamd. If
+// clamd hung up because the stream was too large, this says so.
+func clamdStreamError(conn net.Conn, path string, writeErr error) error {
+	reply, _ := readClamdReply(conn)
+	if reply == clamdSizeLimitReply {
+		return clamdSizeLimitError(path)
+	}
+	return fmt.Errorf("can't send to clamd: %w", writeErr)
+}
+
+func clamdSizeLimitError(path string) error {
+	return fmt.Errorf("%w: %s is larger than clamd's StreamMaxLength. Increase StreamMaxLength in clamd.conf, or scan through clamd's local socket so it can read the file from disk", constants.ErrClamdStreamTooLarge, path)
+}
+
+func dialClamd(address string, timeout time.Duration) (net.Conn, error) {
+	network, addr := clamdNetwork(address)
+	conn, err := net.DialTimeout(network, addr, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("can't connect to clamd at %s: %w", address, err)
+	}
+	if err = conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// readClamdReply reads a NUL-terminated reply from clamd.
+func readClamdReply(conn net.Conn) (string, error) {
+	reply, err := bufio.NewReader(conn).ReadString('\x00')
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("can't read clamd reply: %w", err)
+	}
+	return strings.TrimRight(reply, "\x00\n"), nil
+}
+
+// parseClamdReply returns the signature from a clamd reply, which looks
+// like "stream: OK" for clean files and "stream: Eicar-Signature FOUND"
+// for infected ones. For SCAN, the reply begins with the file's path
+// instead of "stream". Param prefix is the part of the reply before the
+// result.
+func parseClamdReply(reply, prefix string) (string, error) {
+	result := strings.TrimSpace(strings.TrimPrefix(reply, prefix))
+	switch {
+	case result == "OK":
+		return "", nil
+	case strings.HasSuffix(result, " FOUND"):
+		return strings.TrimSuffix(result, " FOUND"), nil
+	default:
+		return "", &clamdError{reply: reply}
+	}
+}
+
+func clamdNetwork(address string) (string, string) {
+	if strings.HasPrefix(address, "unix:") {
+		return "unix", strings.TrimPrefix(address, "unix:")
+	}
+	if strings.HasPrefix(address, "tcp:") {
+		return "tcp", strings.TrimPrefix(address, "tcp:")
+	}
+	if strings.HasPrefix(address, "/") || strings.HasPrefix(address, ".") {
+		return "unix", address
+	}
+	return "tcp", address
+}
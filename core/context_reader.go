@@ -0,0 +1,40 @@
+package core
+
+import (
+	"context"
+	"io"
+)
+
+// contextReader wraps a reader so that reads fail with the context's
+// error once the context is cancelled. Bag writers, bag readers and
+// upload clients use this so a cancelled job stops in the middle of
+// a large file, rather than after it.
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+// newContextReader returns reader wrapped in a contextReader, or
+// reader itself if ctx is nil.
+func newContextReader(ctx context.Context, reader io.Reader) io.Reader {
+	if ctx == nil {
+		return reader
+	}
+	return &contextReader{ctx: ctx, reader: reader}
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.reader.Read(p)
+}
+
+// contextErr returns ctx's error, or nil if ctx is nil or hasn't
+// been cancelled.
+func contextErr(ctx context.Context) error {
+	if ctx == nil {
+		return nil
+	}
+	return ctx.Err()
+}
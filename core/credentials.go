@@ -0,0 +1,363 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/util"
+)
+
+// CredentialProvider returns the secret that ref describes. Param ref
+// is the part of a credential reference that follows the scheme, so for
+// "file:/run/secrets/s3_key", the file provider receives
+// "/run/secrets/s3_key".
+type CredentialProvider func(ref string) (string, error)
+
+// credentialCacheTTL is how long we keep values from providers that
+// run external programs, so that a WebDAV upload, which authenticates
+// every request, doesn't run a helper command for each file.
+const credentialCacheTTL = 5 * time.Minute
+
+// credentialCommandTimeout is the longest we wait for a cmd: or keyring: helper.
+const credentialCommandTimeout = 30 * time.Second
+
+// AWS shared config keys.
+const (
+	AWSAccessKeyID     = "aws_access_key_id"
+	AWSSecretAccessKey = "aws_secret_access_key"
+	AWSSessionToken    = "aws_session_token"
+)
+
+var credentialProviders = map[string]CredentialProvider{
+	"env":         envCredential,
+	"file":        fileCredential,
+	"cmd":         cachedCredential("cmd", commandCredential),
+	"aws-profile": awsProfileCredential,
+	"keyring":     cachedCredential("keyring", keyringCredential),
+}
+
+var credentialCache = make(map[string]cachedSecret)
+var credentialCacheMutex sync.Mutex
+
+type cachedSecret struct {
+	value   string
+	expires time.Time
+}
+
+// RegisterCredentialProvider adds a provider for credentials that begin
+// with scheme followed by a colon, or replaces the existing provider
+// for that scheme.
+func RegisterCredentialProvider(scheme string, provider CredentialProvider) {
+	credentialProviders[scheme] = provider
+}
+
+// CredentialSchemes returns the schemes of all registered providers.
+func CredentialSchemes() []string {
+	schemes := make([]string, 0, len(credentialProviders))
+	for scheme := range credentialProviders {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// IsCredentialReference returns true if value begins with the scheme
+// of a registered credential provider, such as "env:" or "file:". These
+// values describe where to find a secret rather than containing it, so
+// they're safe to export.
+func IsCredentialReference(value string) bool {
+	scheme, _, found := strings.Cut(value, ":")
+	if !found {
+		return false
+	}
+	_, ok := credentialProviders[scheme]
+	return ok
+}
+
+// ResolveCredential returns the secret that value refers to. Values
+// that don't begin with a provider scheme are literal credentials and
+// are returned verbatim. The built-in schemes are:
+//
+//	env:VAR_NAME                    the value of an environment variable
+//	file:/path/to/secret            the contents of a file, minus any trailing newline
+//	cmd:/path/to/helper arg1 arg2   the output of a helper command (see AllowedCredentialCommands)
+//	aws-profile:name/key            a key from ~/.aws/credentials or ~/.aws/config
+//	keyring:service/account         a password from the OS keyring
+func ResolveCredential(value string) (string, error) {
+	if !IsCredentialReference(value) {
+		return value, nil
+	}
+	scheme, ref, _ := strings.Cut(value, ":")
+	secret, err := credentialProviders[scheme](ref)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", constants.ErrCredentialUnavailable, err.Error())
+	}
+	return secret, nil
+}
+
+// ClearCredentialCache discards the cached output of cmd: and keyring:
+// helpers, so the next lookup runs them again.
+func ClearCredentialCache() {
+	credentialCacheMutex.Lock()
+	defer credentialCacheMutex.Unlock()
+	credentialCache = make(map[string]cachedSecret)
+}
+
+// resolveCredentialOrWarn resolves value, logging a warning that names
+// the field and object if it can't. Our getters return plain strings,
+// so a missing credential surfaces as an authentication failure, and
+// this log entry explains why.
+func resolveCredentialOrWarn(value, field, objName string) string {
+	secret, err := ResolveCredential(value)
+	if err != nil {
+		Dart.Log.Warningf("Can't resolve %s for '%s': %s", field, objName, err.Error())
+	}
+	return secret
+}
+
+// withAWSField appends field to an aws-profile: reference that doesn't
+// name one, so "aws-profile:default" in a login resolves to the
+// profile's access key ID and in a password to its secret key.
+func withAWSField(value, field string) string {
+	if strings.HasPrefix(value, "aws-profile:") && !strings.Contains(value, "/") {
+		return value + "/" + field
+	}
+	return value
+}
+
+func cachedCredential(scheme string, provider CredentialProvider) CredentialProvider {
+	return func(ref string) (string, error) {
+		key := scheme + ":" + ref
+		credentialCacheMutex.Lock()
+		cached, ok := credentialCache[key]
+		credentialCacheMutex.Unlock()
+		if ok && time.Now().Before(cached.expires) {
+			return cached.value, nil
+		}
+		value, err := provider(ref)
+		if err != nil {
+			return "", err
+		}
+		credentialCacheMutex.Lock()
+		credentialCache[key] = cachedSecret{value: value, expires: time.Now().Add(credentialCacheTTL)}
+		credentialCacheMutex.Unlock()
+		return value, nil
+	}
+}
+
+func envCredential(ref string) (string, error) {
+	value, ok := os.LookupEnv(ref)
+	if !ok || value == "" {
+		return "", fmt.Errorf("environment variable %s is not set", ref)
+	}
+	return value, nil
+}
+
+func fileCredential(ref string) (string, error) {
+	path, err := expandHome(ref)
+	if err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("can't read credential file: %w", err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// commandCredential runs ref as a command, without a shell, and returns
+// its trimmed output. Arguments are separated by white space. The command
+// must be one of the AllowedCredentialCommands.
+func commandCredential(ref string) (string, error) {
+	args := strings.Fields(ref)
+	if len(args) == 0 {
+		return "", fmt.Errorf("cmd: credential has no command")
+	}
+	if !IsAllowedCredentialCommand(args[0]) {
+		return "", fmt.Errorf("%s is not in the %s setting", args[0], constants.AllowedCredentialCommands)
+	}
+	return runCredentialHelper(args[0], args[1:]...)
+}
+
+// AllowedCredentialCommands returns the helper commands that cmd:
+// credentials may run. Storage services and remote repositories often
+// come from imported workflows and job files, so, as with
+// AllowedPostValidationCommands, an administrator must list these in a
+// setting that workflows and jobs can't change.
+func AllowedCredentialCommands() []string {
+	return allowedCommands(constants.AllowedCredentialCommands)
+}
+
+// IsAllowedCredentialCommand returns true if command exactly matches
+// one of the AllowedCredentialCommands.
+func IsAllowedCredentialCommand(command string) bool {
+	return util.StringListContains(AllowedCredentialCommands(), command)
+}
+
+// awsProfileCredential returns a key from an AWS profile. The ref is
+// the profile name and key, separated by a slash, as in
+// "default/aws_secret_access_key".
+func awsProfileCredential(ref string) (string, error) {
+	profile, key, found := strings.Cut(ref, "/")
+	if !found || key == "" {
+		return "", fmt.Errorf("aws-profile: credential '%s' should look like profile/%s", ref, AWSAccessKeyID)
+	}
+	values, err := AWSProfileValues(profile)
+	if err != nil {
+		return "", err
+	}
+	value := values[key]
+	if value == "" {
+		return "", fmt.Errorf("AWS profile '%s' has no %s", profile, key)
+	}
+	return value, nil
+}
+
+// AWSProfileValues returns the settings for the named profile from the
+// AWS shared credentials and config files. Settings in the credentials
+// file take precedence. Like the AWS CLI, this reads the files named in
+// AWS_SHARED_CREDENTIALS_FILE and AWS_CONFIG_FILE, if they're set.
+func AWSProfileValues(profile string) (map[string]string, error) {
+	if profile == "" {
+		profile = "default"
+	}
+	credentialsFile := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if credentialsFile == "" {
+		credentialsFile = "~/.aws/credentials"
+	}
+	configFile := os.Getenv("AWS_CONFIG_FILE")
+	if configFile == "" {
+		configFile = "~/.aws/config"
+	}
+	configSection := "profile " + profile
+	if profile == "default" {
+		configSection = "default"
+	}
+	values := make(map[string]string)
+	foundProfile := false
+	// Read config first, so credentials overwrite it.
+	for _, source := range []struct{ file, section string }{
+		{configFile, configSection},
+		{credentialsFile, profile},
+	} {
+		path, err := expandHome(source.file)
+		if err != nil {
+			return nil, err
+		}
+		section, found, err := readINISection(path, source.section)
+		if err != nil {
+			return nil, err
+		}
+		foundProfile = foundProfile || found
+		for key, value := range section {
+			values[key] = value
+		}
+	}
+	if !foundProfile {
+		return nil, fmt.Errorf("AWS profile '%s' not found in %s or %s", profile, credentialsFile, configFile)
+	}
+	return values, nil
+}
+
+// readINISection returns the key-value pairs in the named section of
+// an INI file, and whether the section exists. A missing file is not
+// an error, since most users have only one of the AWS files.
+func readINISection(path, name string) (map[string]string, bool, error) {
+	values := make(map[string]string)
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return values, false, nil
+	} else if err != nil {
+		return values, false, err
+	}
+	defer file.Close()
+	found := false
+	inSection := false
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			inSection = strings.TrimSpace(line[1:len(line)-1]) == name
+			found = found || inSection
+			continue
+		}
+		if !inSection {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if ok {
+			values[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+	return values, found, scanner.Err()
+}
+
+// keyringCredential returns a password from the OS keyring. The ref is
+// the service and account, separated by a slash. This uses the security
+// tool on macOS and secret-tool (libsecret) on Linux and BSD. There's no
+// standard command-line reader for the Windows Credential Manager, so on
+// Windows, use a cmd: helper instead.
+func keyringCredential(ref string) (string, error) {
+	service, account, found := strings.Cut(ref, "/")
+	if !found || service == "" || account == "" {
+		return "", fmt.Errorf("keyring: credential '%s' should look like service/account", ref)
+	}
+	switch runtime.GOOS {
+	case "darwin":
+		return runCredentialHelper("security", "find-generic-password", "-s", service, "-a", account, "-w")
+	case "windows":
+		return "", fmt.Errorf("keyring: credentials are not supported on Windows; use a cmd: helper to read the Credential Manager")
+	default:
+		return runCredentialHelper("secret-tool", "lookup", "service", service, "account", account)
+	}
+}
+
+// runCredentialHelper runs a helper program and returns its output,
+// minus surrounding white space. The error includes the helper's stderr
+// but never its stdout, which may hold part of a secret.
+func runCredentialHelper(command string, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), credentialCommandTimeout)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, command, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", fmt.Errorf("%s did not finish within %s", command, credentialCommandTimeout)
+	}
+	if err != nil {
+		return "", fmt.Errorf("%s failed: %v %s", command, err, strings.TrimSpace(stderr.String()))
+	}
+	value := strings.TrimSpace(stdout.String())
+	if value == "" {
+		return "", fmt.Errorf("%s returned an empty credential", command)
+	}
+	return value, nil
+}
+
+// expandHome replaces a leading "~/" in path with the user's home directory.
+func expandHome(path string) (string, error) {
+	if !strings.HasPrefix(path, "~/") {
+		return path, nil
+	}
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(homeDir, path[2:]), nil
+}
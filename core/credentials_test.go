@@ -0,0 +1,189 @@
+package core_test
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const awsTestCredentials = `[default]
+aws_access_key_id = AKIDEFAULT
+aws_secret_access_key = default-secret
+
+[temporary]
+aws_access_key_id = ASIATEMP
+aws_secret_access_key = temp-secret
+aws_session_token = temp-session-token
+`
+
+const awsTestConfig = `[default]
+region = us-east-1
+
+[profile config-only]
+aws_access_key_id = AKIDCONFIG
+aws_secret_access_key = config-secret
+`
+
+func setAWSTestFiles(t *testing.T) {
+	dir := t.TempDir()
+	credentialsFile := filepath.Join(dir, "credentials")
+	configFile := filepath.Join(dir, "config")
+	require.NoError(t, os.WriteFile(credentialsFile, []byte(awsTestCredentials), 0600))
+	require.NoError(t, os.WriteFile(configFile, []byte(awsTestConfig), 0600))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", credentialsFile)
+	t.Setenv("AWS_CONFIG_FILE", configFile)
+}
+
+func TestIsCredentialReference(t *testing.T) {
+	for _, value := range []string{"env:X", "file:/run/secrets/x", "cmd:pass show x", "aws-profile:default", "keyring:dart/x"} {
+		assert.True(t, core.IsCredentialReference(value), value)
+	}
+	for _, value := range []string{"", "secret", "http://example.com", "p@ss:word", "ENV:X"} {
+		assert.False(t, core.IsCredentialReference(value), value)
+	}
+	assert.Subset(t, core.CredentialSchemes(), []string{"aws-profile", "cmd", "env", "file", "keyring"})
+}
+
+func TestResolveCredentialLiteralAndEnv(t *testing.T) {
+	value, err := core.ResolveCredential("plain old password")
+	require.NoError(t, err)
+	assert.Equal(t, "plain old password", value)
+
+	t.Setenv("DART_TEST_CREDENTIAL", "from env")
+	value, err = core.ResolveCredential("env:DART_TEST_CREDENTIAL")
+	require.NoError(t, err)
+	assert.Equal(t, "from env", value)
+
+	_, err = core.ResolveCredential("env:DART_TEST_CREDENTIAL_NOT_SET")
+	assert.ErrorIs(t, err, constants.ErrCredentialUnavailable)
+}
+
+func TestResolveCredentialFile(t *testing.T) {
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	require.NoError(t, os.WriteFile(secretFile, []byte("  from file \n"), 0600))
+	value, err := core.ResolveCredential("file:" + secretFile)
+	require.NoError(t, err)
+	// Only the trailing newline is trimmed.
+	assert.Equal(t, "  from file ", value)
+
+	_, err = core.ResolveCredential("file:" + secretFile + "-missing")
+	assert.ErrorIs(t, err, constants.ErrCredentialUnavailable)
+}
+
+func TestResolveCredentialCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("helper scripts in this test require a posix shell")
+	}
+	core.ClearCredentialCache()
+	defer core.ClearCredentialCache()
+
+	// The helper counts its runs, so we can tell when we've cached its output.
+	dir := t.TempDir()
+	counter := filepath.Join(dir, "count")
+	helper := filepath.Join(dir, "helper.sh")
+	script := "#!/bin/sh\necho run >> " + counter + "\necho \"secret-for-$1\"\n"
+	require.NoError(t, os.WriteFile(helper, []byte(script), 0700))
+	failing := filepath.Join(dir, "failing.sh")
+	require.NoError(t, os.WriteFile(failing, []byte("#!/bin/sh\necho partial-secret\necho vault is sealed >&2\nexit 2\n"), 0700))
+
+	// Helpers don't run until an administrator allows them.
+	assert.False(t, core.IsAllowedCredentialCommand(helper))
+	_, err := core.ResolveCredential("cmd:" + helper + " bucket")
+	require.Error(t, err)
+	assert.ErrorIs(t, err, constants.ErrCredentialUnavailable)
+	assert.Contains(t, err.Error(), constants.AllowedCredentialCommands)
+	_, err = os.Stat(counter)
+	assert.True(t, os.IsNotExist(err))
+
+	setting := core.NewAppSetting(constants.AllowedCredentialCommands, helper+"\n"+failing)
+	require.NoError(t, core.ObjSave(setting))
+	t.Cleanup(func() {
+		assert.NoError(t, core.ObjDelete(setting))
+	})
+	assert.Equal(t, []string{helper, failing}, core.AllowedCredentialCommands())
+
+	value, err := core.ResolveCredential("cmd:" + helper + " bucket")
+	require.NoError(t, err)
+	assert.Equal(t, "secret-for-bucket", value)
+	value, err = core.ResolveCredential("cmd:" + helper + " bucket")
+	require.NoError(t, err)
+	assert.Equal(t, "secret-for-bucket", value)
+	runs, err := os.ReadFile(counter)
+	require.NoError(t, err)
+	assert.Equal(t, "run\n", string(runs))
+
+	core.ClearCredentialCache()
+	_, err = core.ResolveCredential("cmd:" + helper + " bucket")
+	require.NoError(t, err)
+	runs, err = os.ReadFile(counter)
+	require.NoError(t, err)
+	assert.Equal(t, "run\nrun\n", string(runs))
+
+	_, err = core.ResolveCredential("cmd:" + failing)
+	require.Error(t, err)
+	assert.ErrorIs(t, err, constants.ErrCredentialUnavailable)
+	assert.Contains(t, err.Error(), "vault is sealed")
+	assert.NotContains(t, err.Error(), "partial-secret")
+}
+
+func TestResolveCredentialAWSProfile(t *testing.T) {
+	setAWSTestFiles(t)
+
+	value, err := core.ResolveCredential("aws-profile:default/aws_access_key_id")
+	require.NoError(t, err)
+	assert.Equal(t, "AKIDEFAULT", value)
+
+	value, err = core.ResolveCredential("aws-profile:config-only/aws_secret_access_key")
+	require.NoError(t, err)
+	assert.Equal(t, "config-secret", value)
+
+	_, err = core.ResolveCredential("aws-profile:default/aws_session_token")
+	assert.ErrorIs(t, err, constants.ErrCredentialUnavailable)
+	_, err = core.ResolveCredential("aws-profile:no-such-profile/aws_access_key_id")
+	assert.ErrorIs(t, err, constants.ErrCredentialUnavailable)
+	_, err = core.ResolveCredential("aws-profile:default")
+	assert.ErrorIs(t, err, constants.ErrCredentialUnavailable)
+
+	values, err := core.AWSProfileValues("default")
+	require.NoError(t, err)
+	assert.Equal(t, "us-east-1", values["region"])
+	assert.Equal(t, "default-secret", values[core.AWSSecretAccessKey])
+}
+
+func TestResolveCredentialKeyring(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("this test stubs the Linux secret-tool")
+	}
+	core.ClearCredentialCache()
+	defer core.ClearCredentialCache()
+
+	dir := t.TempDir()
+	script := "#!/bin/sh\n[ \"$1 $2 $3 $4 $5\" = \"lookup service dart account uploader\" ] || exit 1\necho keyring-secret\n"
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "secret-tool"), []byte(script), 0700))
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	value, err := core.ResolveCredential("keyring:dart/uploader")
+	require.NoError(t, err)
+	assert.Equal(t, "keyring-secret", value)
+
+	_, err = core.ResolveCredential("keyring:dart/someone-else")
+	assert.ErrorIs(t, err, constants.ErrCredentialUnavailable)
+	_, err = core.ResolveCredential("keyring:no-account")
+	assert.ErrorIs(t, err, constants.ErrCredentialUnavailable)
+}
+
+func TestRegisterCredentialProvider(t *testing.T) {
+	core.RegisterCredentialProvider("test-vault", func(ref string) (string, error) {
+		return "vault-" + ref, nil
+	})
+	assert.True(t, core.IsCredentialReference("test-vault:s3"))
+	value, err := core.ResolveCredential("test-vault:s3")
+	require.NoError(t, err)
+	assert.Equal(t, "vault-s3", value)
+}
@@ -1,6 +1,7 @@
 package core
 
 import (
+	"io"
 	"path/filepath"
 	"strings"
 
@@ -29,7 +30,13 @@ func NewCSVBatchParser(pathToCSVFile string, workflow *Workflow) *CSVBatchParser
 // Unless you have some special reason, outputDir should be set to
 // the value of the built-in app setting called "Bagging Directory".
 // You can get that with a call to core.GetAppSetting("Bagging Directory").
+//
+// If PathToCSVFile is a JSON Lines or YAML file, this parses it with the
+// matching BatchSource.
 func (p *CSVBatchParser) ParseAll(outputDir string) ([]*JobParams, error) {
+	if BatchFileFormat(p.PathToCSVFile) != "csv" {
+		return p.parseBatchSource(outputDir)
+	}
 	jobParamsList := make([]*JobParams, 0)
 	_, records, err := util.ParseCSV(p.PathToCSVFile)
 	if err != nil {
@@ -45,6 +52,35 @@ func (p *CSVBatchParser) ParseAll(outputDir string) ([]*JobParams, error) {
 		outputFile := filepath.Join(outputDir, packageName)
 		tags := p.parseTags(nvpList)
 		jobParams := NewJobParams(p.Workflow, packageName, outputFile, filesToBag, tags)
+		for _, nvp := range nvpList.Items {
+			if isOverrideColumn(nvp.Name) {
+				jobParams.JobOverrides.setFromColumn(nvp.Name, nvp.Value)
+			}
+		}
+		jobParamsList = append(jobParamsList, jobParams)
+	}
+	return jobParamsList, nil
+}
+
+// parseBatchSource converts the items in a JSON Lines or YAML
+// batch file to a slice of JobParams objects.
+func (p *CSVBatchParser) parseBatchSource(outputDir string) ([]*JobParams, error) {
+	source, err := NewBatchSource(p.PathToCSVFile)
+	if err != nil {
+		return nil, err
+	}
+	defer source.Close()
+	jobParamsList := make([]*JobParams, 0)
+	for {
+		entry, err := source.ReadNext()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		outputFile := filepath.Join(outputDir, entry.BagName)
+		jobParams := NewJobParams(p.Workflow, entry.BagName, outputFile, entry.SourceFiles(), entry.Tags)
+		jobParams.JobOverrides = entry.Overrides
 		jobParamsList = append(jobParamsList, jobParams)
 	}
 	return jobParamsList, nil
@@ -61,6 +97,9 @@ func (p *CSVBatchParser) ParseAll(outputDir string) ([]*JobParams, error) {
 func (p *CSVBatchParser) parseTags(record *util.NameValuePairList) []*Tag {
 	tags := make([]*Tag, 0)
 	for _, nvp := range record.Items {
+		if isOverrideColumn(nvp.Name) {
+			continue
+		}
 		var tagName string
 		var tagFile string
 		// Field name is in format file-name.txt/Tag-Name.
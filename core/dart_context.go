@@ -37,6 +37,7 @@ func init() {
 	}
 	if !util.TestsAreRunning() {
 		InitDBForFirstUse()
+		initSecretEncryption()
 	}
 }
 
@@ -51,7 +52,17 @@ func initDB(paths *util.Paths) *sql.DB {
 	if err != nil {
 		fmt.Println(err.Error())
 	}
-	db, err := sql.Open("sqlite", DataFilePath())
+	// The job daemon and other dart-runner processes may write to
+	// the database at the same time, so wait for locks rather than
+	// failing right away.
+	dsn := dataFile + "?_pragma=busy_timeout(10000)"
+	if dataFile == ":memory:" {
+		// Each connection to ":memory:" opens its own empty
+		// database. Tests that use the database from several
+		// go routines need all connections to share one.
+		dsn = "file:dart-test?mode=memory&cache=shared"
+	}
+	db, err := sql.Open("sqlite", dsn)
 	if err != nil {
 		log.Fatal(err)
 	}
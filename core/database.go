@@ -40,6 +40,61 @@ func InitSchema() error {
 	);
 	create index if not exists ix_artifact_bag_name on artifacts(bag_name);
 	create index if not exists ix_artifact_job_id on artifacts(job_id);
+	create table if not exists upload_checkpoints (
+		uuid text primary key not null,
+		storage_service_id text not null,
+		bucket text not null,
+		object_key text not null,
+		local_path text not null,
+		file_size integer not null,
+		file_mod_time datetime not null,
+		upload_id text not null,
+		part_size integer not null,
+		parts_json text not null,
+		created_at datetime not null,
+		updated_at datetime not null
+	);
+	create unique index if not exists ix_upload_checkpoint_target on upload_checkpoints(storage_service_id, bucket, object_key, local_path);
+	create table if not exists trusted_host_keys (
+		address text primary key not null,
+		key_type text not null,
+		public_key text not null,
+		fingerprint text not null,
+		created_at datetime not null
+	);
+	create table if not exists batch_rows (
+		workflow_id text not null,
+		bag_name text not null,
+		fingerprint text not null,
+		status text not null,
+		job_id text not null,
+		updated_at datetime not null,
+		primary key (workflow_id, bag_name)
+	);
+	create table if not exists job_queue (
+		id text primary key not null,
+		job_type text not null,
+		job_name text not null,
+		job_json text not null,
+		state text not null,
+		attempts integer not null default 0,
+		worker_id text not null default '',
+		result_json text not null default '',
+		error text not null default '',
+		enqueued_at datetime not null,
+		started_at datetime,
+		finished_at datetime,
+		heartbeat_at datetime
+	);
+	create index if not exists ix_job_queue_state on job_queue(state, enqueued_at);
+	create table if not exists encryption_keys (
+		id text primary key not null,
+		wrapped_key text not null,
+		kdf text not null,
+		salt text not null,
+		created_at datetime not null,
+		updated_at datetime not null
+	);
 	`
 	_, err := Dart.DB.Exec(schema)
 	return err
@@ -142,7 +197,14 @@ func objSave(obj PersistentObject, validate bool) error {
 	if FindConflictingUUID(obj) != "" {
 		return constants.ErrUniqueConstraint
 	}
+	// Encrypt secrets only for the duration of json.Marshal, so
+	// the caller's copy of obj keeps its plain text values.
+	restoreSecrets, err := encryptSecrets(obj)
+	if err != nil {
+		return err
+	}
 	jsonBytes, err := json.Marshal(obj)
+	restoreSecrets()
 	if err != nil {
 		return err
 	}
@@ -169,12 +231,28 @@ func ObjByNameAndType(objName, objType string) *QueryResult {
 func findOne(row *sql.Row) *QueryResult {
 	var objType string
 	var objJson string
-	qr := NewQueryResult(constants.ResultTypeSingle)
-	qr.ResultType = constants.ResultTypeSingle
-	qr.Error = row.Scan(&objType, &objJson)
-	if qr.Error != nil {
+	err := row.Scan(&objType, &objJson)
+	if err != nil {
+		qr := NewQueryResult(constants.ResultTypeSingle)
+		qr.Error = err
 		return qr
 	}
+	qr := queryResultFromJson(objType, objJson)
+	if qr.Error == nil {
+		qr.Error = decryptQueryResult(qr)
+	}
+	if qr.Error == nil {
+		resolveLoadedProfiles(qr) // see doc comments on this
+	}
+	return qr
+}
+
+// queryResultFromJson returns a single-object QueryResult containing
+// the object of type objType described by objJson. Secrets in the
+// object are as they were stored, which may mean encrypted.
+func queryResultFromJson(objType, objJson string) *QueryResult {
+	qr := NewQueryResult(constants.ResultTypeSingle)
+	qr.ResultType = constants.ResultTypeSingle
 	qr.ObjType = objType
 	qr.ObjCount = 1
 	switch objType {
@@ -281,6 +359,12 @@ func ObjList(objType, orderBy string, limit, offset int) *QueryResult {
 	default:
 		qr.Error = constants.ErrUnknownType
 	}
+	if qr.Error == nil {
+		qr.Error = decryptQueryResult(qr)
+	}
+	if qr.Error == nil {
+		resolveLoadedProfiles(qr)
+	}
 	return qr
 }
 
@@ -350,6 +434,29 @@ func GetAppSetting(name string) (string, error) {
 	return setting.Value, err
 }
 
+// SetAppSetting saves value as the value of the named AppSetting,
+// creating the setting if it doesn't exist. This lets administrators
+// set values, such as the allowed command lists, that workflow and
+// job files can't change.
+func SetAppSetting(name, value string) error {
+	result := ObjByNameAndType(name, constants.TypeAppSetting)
+	if result.Error != nil && result.Error != sql.ErrNoRows {
+		return result.Error
+	}
+	setting := result.AppSetting()
+	if setting == nil {
+		setting = NewAppSetting(name, value)
+	}
+	setting.Value = value
+	err := ObjSave(setting)
+	if err == constants.ErrObjecValidation {
+		for _, message := range setting.Errors {
+			return fmt.Errorf("%w: %s", err, message)
+		}
+	}
+	return err
+}
+
 // FindConflictingUUID returns the UUID of the object having the same name and type
 // as obj. The dart table has a unique constraint on obj_type + obj_name. That should
 // prevent inserts that conflict with the constraint, but it doesn't. The modernc sqlite
@@ -650,6 +757,334 @@ func ArtifactDelete(uuid string) error {
 	return err
 }
 
+// UploadCheckpointSave inserts or updates a multipart upload checkpoint.
+func UploadCheckpointSave(cp *UploadCheckpoint) error {
+	partsJson, err := cp.partsJson()
+	if err != nil {
+		return err
+	}
+	cp.UpdatedAt = time.Now().UTC()
+	stmt := `insert into upload_checkpoints (uuid, storage_service_id, bucket, object_key, local_path, file_size, file_mod_time, upload_id, part_size, parts_json, created_at, updated_at) values (?,?,?,?,?,?,?,?,?,?,?,?)
+	on conflict do update set file_size=excluded.file_size, file_mod_time=excluded.file_mod_time,
+	upload_id=excluded.upload_id, part_size=excluded.part_size, parts_json=excluded.parts_json,
+	updated_at=excluded.updated_at where uuid=excluded.uuid`
+	_, err = Dart.DB.Exec(stmt, cp.ID, cp.StorageServiceID, cp.Bucket, cp.ObjectKey, cp.LocalPath, cp.FileSize, cp.FileModTime, cp.UploadID, cp.PartSize, partsJson, cp.CreatedAt, cp.UpdatedAt)
+	return err
+}
+
+// UploadCheckpointFind returns the checkpoint for uploading localPath
+// to the specified bucket and key. It returns sql.ErrNoRows if there
+// is no checkpoint.
+func UploadCheckpointFind(storageServiceID, bucket, objectKey, localPath string) (*UploadCheckpoint, error) {
+	query := uploadCheckpointSelect + " where storage_service_id=? and bucket=? and object_key=? and local_path=?"
+	checkpoints, err := uploadCheckpointList(query, storageServiceID, bucket, objectKey, localPath)
+	if err != nil {
+		return nil, err
+	}
+	if len(checkpoints) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return checkpoints[0], nil
+}
+
+// UploadCheckpointListOlderThan returns checkpoints for the specified
+// storage service that have not been updated since cutoff. If
+// storageServiceID is empty, this returns stale checkpoints for all
+// storage services.
+func UploadCheckpointListOlderThan(storageServiceID string, cutoff time.Time) ([]*UploadCheckpoint, error) {
+	if storageServiceID == "" {
+		return uploadCheckpointList(uploadCheckpointSelect+" where updated_at < ? order by updated_at", cutoff.UTC())
+	}
+	return uploadCheckpointList(uploadCheckpointSelect+" where storage_service_id=? and updated_at < ? order by updated_at", storageServiceID, cutoff.UTC())
+}
+
+// UploadCheckpointDelete deletes the checkpoint with the specified uuid.
+func UploadCheckpointDelete(uuid string) error {
+	_, err := Dart.DB.Exec("delete from upload_checkpoints where uuid=?", uuid)
+	return err
+}
+
+const uploadCheckpointSelect = "select uuid, storage_service_id, bucket, object_key, local_path, file_size, file_mod_time, upload_id, part_size, parts_json, created_at, updated_at from upload_checkpoints"
+
+func uploadCheckpointList(query string, params ...interface{}) ([]*UploadCheckpoint, error) {
+	rows, err := Dart.DB.Query(query, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	checkpoints := make([]*UploadCheckpoint, 0)
+	for rows.Next() {
+		cp := UploadCheckpoint{}
+		partsJson := ""
+		err = rows.Scan(
+			&cp.ID,
+			&cp.StorageServiceID,
+			&cp.Bucket,
+			&cp.ObjectKey,
+			&cp.LocalPath,
+			&cp.FileSize,
+			&cp.FileModTime,
+			&cp.UploadID,
+			&cp.PartSize,
+			&partsJson,
+			&cp.CreatedAt,
+			&cp.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal([]byte(partsJson), &cp.Parts)
+		if err != nil {
+			return nil, err
+		}
+		checkpoints = append(checkpoints, &cp)
+	}
+	return checkpoints, rows.Err()
+}
+
+// TrustedHostKeySave records the host key an SFTP server presented the
+// first time we connected to it, for trust-on-first-use host key checking.
+// If we already have a key for the server's address, this replaces it.
+func TrustedHostKeySave(key *TrustedHostKey) error {
+	stmt := `insert into trusted_host_keys (address, key_type, public_key, fingerprint, created_at) values (?,?,?,?,?)
+	on conflict do update set key_type=excluded.key_type, public_key=excluded.public_key,
+	fingerprint=excluded.fingerprint, created_at=excluded.created_at`
+	_, err := Dart.DB.Exec(stmt, key.Address, key.KeyType, key.PublicKey, key.Fingerprint, key.CreatedAt)
+	return err
+}
+
+// TrustedHostKeyFind returns the trusted host key for address, which
+// should be in the form returned by knownhosts.Normalize. It returns
+// sql.ErrNoRows if we have no key for that address.
+func TrustedHostKeyFind(address string) (*TrustedHostKey, error) {
+	key := &TrustedHostKey{}
+	row := Dart.DB.QueryRow("select address, key_type, public_key, fingerprint, created_at from trusted_host_keys where address=?", address)
+	err := row.Scan(&key.Address, &key.KeyType, &key.PublicKey, &key.Fingerprint, &key.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// TrustedHostKeyDelete deletes the trusted host key for address. Do
+// this after a server's key has legitimately changed, so the next
+// connection can record the new key.
+func TrustedHostKeyDelete(address string) error {
+	_, err := Dart.DB.Exec("delete from trusted_host_keys where address=?", address)
+	return err
+}
+
+// BatchRowStateSave records the outcome of running one row of a workflow
+// batch, replacing any earlier outcome for the same workflow and bag.
+func BatchRowStateSave(state *BatchRowState) error {
+	stmt := `insert into batch_rows (workflow_id, bag_name, fingerprint, status, job_id, updated_at) values (?,?,?,?,?,?)
+	on conflict do update set fingerprint=excluded.fingerprint, status=excluded.status,
+	job_id=excluded.job_id, updated_at=excluded.updated_at`
+	_, err := Dart.DB.Exec(stmt, state.WorkflowID, state.BagName, state.Fingerprint, state.Status, state.JobID, state.UpdatedAt)
+	return err
+}
+
+// BatchRowStateFind returns the last recorded outcome of running the
+// specified bag through the specified workflow. It returns sql.ErrNoRows
+// if the bag has never run.
+func BatchRowStateFind(workflowID, bagName string) (*BatchRowState, error) {
+	state := &BatchRowState{}
+	row := Dart.DB.QueryRow("select workflow_id, bag_name, fingerprint, status, job_id, updated_at from batch_rows where workflow_id=? and bag_name=?", workflowID, bagName)
+	err := row.Scan(&state.WorkflowID, &state.BagName, &state.Fingerprint, &state.Status, &state.JobID, &state.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// BatchRowStateDeleteByWorkflow deletes the recorded batch outcomes for
+// the specified workflow, so its next batch starts from scratch.
+func BatchRowStateDeleteByWorkflow(workflowID string) error {
+	_, err := Dart.DB.Exec("delete from batch_rows where workflow_id=?", workflowID)
+	return err
+}
+
+// QueuedJobSave inserts or updates a job in the job queue.
+func QueuedJobSave(qj *QueuedJob) error {
+	stmt := `insert into job_queue (id, job_type, job_name, job_json, state, attempts, worker_id, result_json, error, enqueued_at, started_at, finished_at, heartbeat_at) values (?,?,?,?,?,?,?,?,?,?,?,?,?)
+	on conflict do update set job_type=excluded.job_type, job_name=excluded.job_name, job_json=excluded.job_json,
+	state=excluded.state, attempts=excluded.attempts, worker_id=excluded.worker_id, result_json=excluded.result_json,
+	error=excluded.error, started_at=excluded.started_at, finished_at=excluded.finished_at, heartbeat_at=excluded.heartbeat_at`
+	_, err := Dart.DB.Exec(stmt, qj.ID, qj.JobType, qj.JobName, qj.jobJson, qj.State, qj.Attempts, qj.WorkerID, string(qj.ResultJson), qj.Error,
+		qj.EnqueuedAt, nullTime(qj.StartedAt), nullTime(qj.FinishedAt), nullTime(qj.HeartbeatAt))
+	return err
+}
+
+// QueuedJobFind returns the queued job with the specified id. It
+// returns sql.ErrNoRows if there's no such job.
+func QueuedJobFind(id string) (*QueuedJob, error) {
+	jobs, err := queuedJobList(queuedJobSelect+" where id=?", id)
+	if err != nil {
+		return nil, err
+	}
+	if len(jobs) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return jobs[0], nil
+}
+
+// QueuedJobList returns the jobs in the queue that are in the specified
+// state, oldest first. If state is empty, this returns all jobs.
+func QueuedJobList(state string) ([]*QueuedJob, error) {
+	if state == "" {
+		return queuedJobList(queuedJobSelect + " order by enqueued_at, rowid")
+	}
+	return queuedJobList(queuedJobSelect+" where state=? order by enqueued_at, rowid", state)
+}
+
+// QueuedJobClaimNext marks the oldest queued job as running on behalf of
+// workerID, and returns it. It returns sql.ErrNoRows if no jobs are
+// queued. Several workers, even in different processes, can claim jobs
+// at the same time, and each job goes to only one of them.
+func QueuedJobClaimNext(workerID string) (*QueuedJob, error) {
+	for {
+		var id string
+		row := Dart.DB.QueryRow("select id from job_queue where state=? order by enqueued_at, rowid limit 1", constants.QueueStateQueued)
+		if err := row.Scan(&id); err != nil {
+			return nil, err
+		}
+		now := time.Now().UTC()
+		stmt := `update job_queue set state=?, attempts=attempts+1, worker_id=?, error='',
+		started_at=?, finished_at=null, heartbeat_at=? where id=? and state=?`
+		result, err := Dart.DB.Exec(stmt, constants.QueueStateRunning, workerID, now, now, id, constants.QueueStateQueued)
+		if err != nil {
+			return nil, err
+		}
+		// If another worker claimed this job first, try the next one.
+		if count, _ := result.RowsAffected(); count == 1 {
+			return QueuedJobFind(id)
+		}
+	}
+}
+
+// QueuedJobHeartbeat records that workerID is still running the job
+// with the specified id.
+func QueuedJobHeartbeat(id, workerID string) error {
+	_, err := Dart.DB.Exec("update job_queue set heartbeat_at=? where id=? and worker_id=? and state=?",
+		time.Now().UTC(), id, workerID, constants.QueueStateRunning)
+	return err
+}
+
+// QueuedJobRecoverStale finds running jobs whose workers have not sent
+// a heartbeat since cutoff, which usually means the worker crashed. Jobs
+// that have been attempted fewer than maxAttempts times go back into the
+// queue. The rest fail. This returns the number of jobs recovered.
+func QueuedJobRecoverStale(cutoff time.Time, maxAttempts int) (int, error) {
+	now := time.Now().UTC()
+	failed, err := Dart.DB.Exec("update job_queue set state=?, error=?, finished_at=? where state=? and heartbeat_at < ? and attempts >= ?",
+		constants.QueueStateFailed, fmt.Sprintf("Worker stopped while running this job. Giving up after %d attempts.", maxAttempts),
+		now, constants.QueueStateRunning, cutoff.UTC(), maxAttempts)
+	if err != nil {
+		return 0, err
+	}
+	requeued, err := Dart.DB.Exec("update job_queue set state=?, worker_id='', error=? where state=? and heartbeat_at < ?",
+		constants.QueueStateQueued, "Worker stopped while running this job. Requeued.", constants.QueueStateRunning, cutoff.UTC())
+	if err != nil {
+		return 0, err
+	}
+	failedCount, _ := failed.RowsAffected()
+	requeuedCount, _ := requeued.RowsAffected()
+	return int(failedCount + requeuedCount), nil
+}
+
+// QueuedJobCancel cancels a job that has not started running. It
+// returns sql.ErrNoRows if there's no such job, and an error if
+// the job has already started.
+func QueuedJobCancel(id string) error {
+	result, err := Dart.DB.Exec("update job_queue set state=?, finished_at=? where id=? and state=?",
+		constants.QueueStateCancelled, time.Now().UTC(), id, constants.QueueStateQueued)
+	if err != nil {
+		return err
+	}
+	if count, _ := result.RowsAffected(); count == 1 {
+		return nil
+	}
+	qj, err := QueuedJobFind(id)
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("job %s is %s and cannot be cancelled", id, qj.State)
+}
+
+const queuedJobSelect = "select id, job_type, job_name, job_json, state, attempts, worker_id, result_json, error, enqueued_at, started_at, finished_at, heartbeat_at from job_queue"
+
+func queuedJobList(query string, params ...interface{}) ([]*QueuedJob, error) {
+	rows, err := Dart.DB.Query(query, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	jobs := make([]*QueuedJob, 0)
+	for rows.Next() {
+		qj := &QueuedJob{}
+		var resultJson string
+		var startedAt, finishedAt, heartbeatAt sql.NullTime
+		err = rows.Scan(
+			&qj.ID,
+			&qj.JobType,
+			&qj.JobName,
+			&qj.jobJson,
+			&qj.State,
+			&qj.Attempts,
+			&qj.WorkerID,
+			&resultJson,
+			&qj.Error,
+			&qj.EnqueuedAt,
+			&startedAt,
+			&finishedAt,
+			&heartbeatAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if resultJson != "" {
+			qj.ResultJson = json.RawMessage(resultJson)
+		}
+		qj.StartedAt = startedAt.Time
+		qj.FinishedAt = finishedAt.Time
+		qj.HeartbeatAt = heartbeatAt.Time
+		jobs = append(jobs, qj)
+	}
+	return jobs, rows.Err()
+}
+
+// nullTime returns nil for the zero time, so we store NULL
+// rather than year one.
+func nullTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UTC()
+}
+
+// EncryptionKeySave saves a wrapped data key for encrypting secrets.
+// If a key with the same ID exists, as when we rotate the master key,
+// this replaces it.
+func EncryptionKeySave(key *EncryptionKey) error {
+	stmt := `insert into encryption_keys (id, wrapped_key, kdf, salt, created_at, updated_at) values (?,?,?,?,?,?)
+	on conflict do update set wrapped_key=excluded.wrapped_key, kdf=excluded.kdf,
+	salt=excluded.salt, updated_at=excluded.updated_at`
+	_, err := Dart.DB.Exec(stmt, key.ID, key.WrappedKey, key.KDF, key.Salt, key.CreatedAt, key.UpdatedAt)
+	return err
+}
+
+// EncryptionKeyFind returns the wrapped data key for encrypting secrets.
+// It returns sql.ErrNoRows if secrets have never been encrypted.
+func EncryptionKeyFind() (*EncryptionKey, error) {
+	key := &EncryptionKey{}
+	row := Dart.DB.QueryRow("select id, wrapped_key, kdf, salt, created_at, updated_at from encryption_keys order by created_at desc limit 1")
+	err := row.Scan(&key.ID, &key.WrappedKey, &key.KDF, &key.Salt, &key.CreatedAt, &key.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
 // ClearDartTable is for testing use only
 func ClearDartTable() error {
 	if !util.TestsAreRunning() {
@@ -667,3 +1102,39 @@ func ClearArtifactsTable() error {
 	_, err := Dart.DB.Exec("delete from artifacts")
 	return err
 }
+
+// ClearTrustedHostKeysTable is for testing use only
+func ClearTrustedHostKeysTable() error {
+	if !util.TestsAreRunning() {
+		return constants.ErrInvalidOperation
+	}
+	_, err := Dart.DB.Exec("delete from trusted_host_keys")
+	return err
+}
+
+// ClearUploadCheckpointsTable is for testing use only
+func ClearUploadCheckpointsTable() error {
+	if !util.TestsAreRunning() {
+		return constants.ErrInvalidOperation
+	}
+	_, err := Dart.DB.Exec("delete from upload_checkpoints")
+	return err
+}
+
+// ClearJobQueueTable is for testing use only
+func ClearJobQueueTable() error {
+	if !util.TestsAreRunning() {
+		return constants.ErrInvalidOperation
+	}
+	_, err := Dart.DB.Exec("delete from job_queue")
+	return err
+}
+
+// ClearEncryptionKeysTable is for testing use only
+func ClearEncryptionKeysTable() error {
+	if !util.TestsAreRunning() {
+		return constants.ErrInvalidOperation
+	}
+	_, err := Dart.DB.Exec("delete from encryption_keys")
+	return err
+}
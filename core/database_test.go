@@ -228,6 +228,27 @@ func TestGetAppSetting(t *testing.T) {
 	assert.Equal(t, "Test Value", value)
 }
 
+func TestSetAppSetting(t *testing.T) {
+	defer core.ClearDartTable()
+	require.NoError(t, core.SetAppSetting("Test Setting", "First Value"))
+	value, err := core.GetAppSetting("Test Setting")
+	require.NoError(t, err)
+	assert.Equal(t, "First Value", value)
+
+	// Setting it again updates the existing setting.
+	require.NoError(t, core.SetAppSetting("Test Setting", "Second Value"))
+	value, err = core.GetAppSetting("Test Setting")
+	require.NoError(t, err)
+	assert.Equal(t, "Second Value", value)
+	count, err := core.ObjCount(constants.TypeAppSetting)
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	err = core.SetAppSetting("Test Setting", "")
+	assert.ErrorIs(t, err, constants.ErrObjecValidation)
+	assert.Contains(t, err.Error(), "Value cannot be empty")
+}
+
 func TestArtifactNameIDList(t *testing.T) {
 	defer core.ClearArtifactsTable()
 	for i := 0; i < 5; i++ {
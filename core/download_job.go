@@ -0,0 +1,206 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/util"
+	"github.com/google/uuid"
+)
+
+// DownloadJob retrieves bags or other items from an S3 or SFTP storage
+// service into a local directory, and optionally validates each item
+// it retrieves. Use this to restore materials from your own storage.
+//
+// The job's storage service may be defined inline, as it is in workflow
+// files exported for DART Runner, or referenced by StorageServiceID, in
+// which case we load it from the DART database.
+//
+// If ValidateBags is true, the job validates each item it downloads
+// against the profile BagItProfileID, which may be
+// constants.BagItProfileAuto. See ValidationJob for how auto mode uses
+// FallbackProfileID and FetchProfiles.
+type DownloadJob struct {
+	ID                string                 `json:"id"`
+	BagItProfileID    string                 `json:"bagItProfileId"`
+	DownloadOps       []*DownloadOperation   `json:"downloadOps"`
+	Errors            map[string]string      `json:"errors"`
+	FallbackProfileID string                 `json:"fallbackProfileId"`
+	FetchProfiles     bool                   `json:"fetchProfiles"`
+	Items             []string               `json:"items"`
+	Name              string                 `json:"name"`
+	OutputDir         string                 `json:"outputDir"`
+	Results           []*JobResult           `json:"-"`
+	StorageService    *StorageService        `json:"storageService"`
+	StorageServiceID  string                 `json:"storageServiceId"`
+	ValidateBags      bool                   `json:"validateBags"`
+	ValidationOps     []*ValidationOperation `json:"validationOps"`
+}
+
+func NewDownloadJob() *DownloadJob {
+	id := uuid.NewString()
+	return &DownloadJob{
+		ID:            id,
+		DownloadOps:   make([]*DownloadOperation, 0),
+		Errors:        make(map[string]string),
+		Items:         make([]string, 0),
+		Name:          fmt.Sprintf("Download Job - %s", id),
+		Results:       make([]*JobResult, 0),
+		ValidationOps: make([]*ValidationOperation, 0),
+	}
+}
+
+// DownloadJobFromJson loads a DownloadJob from the JSON file at
+// pathToFile.
+func DownloadJobFromJson(pathToFile string) (*DownloadJob, error) {
+	data, err := util.ReadFile(pathToFile)
+	if err != nil {
+		return nil, err
+	}
+	job := NewDownloadJob()
+	err = json.Unmarshal(data, job)
+	return job, err
+}
+
+// String returns a string representation of this DownloadJob,
+// which is the same as its Name.
+func (job *DownloadJob) String() string {
+	return job.Name
+}
+
+// Validate returns true if this DownloadJob is valid, false if not.
+// Check the value of Errors or GetErrors() after calling this
+// to see why validation failed.
+func (job *DownloadJob) Validate() bool {
+	job.Errors = make(map[string]string)
+	if len(job.Items) == 0 {
+		job.Errors["Items"] = "You must specify at least one item to download."
+	}
+	if strings.TrimSpace(job.OutputDir) == "" {
+		job.Errors["OutputDir"] = "You must specify a directory to download into."
+	} else if !util.IsDirectory(job.OutputDir) {
+		job.Errors["OutputDir"] = fmt.Sprintf("Output directory %s does not exist.", job.OutputDir)
+	}
+	if job.StorageService == nil && strings.TrimSpace(job.StorageServiceID) == "" {
+		job.Errors["StorageService"] = "Please choose a storage service to download from."
+	}
+	if job.ValidateBags && strings.TrimSpace(job.BagItProfileID) == "" {
+		job.Errors["BagItProfileID"] = "Please choose a BagIt profile to validate downloaded bags."
+	}
+	if job.FallbackProfileID != "" {
+		if msg := fallbackProfileError(job.FallbackProfileID); msg != "" {
+			job.Errors["FallbackProfileID"] = msg
+		}
+	}
+	return len(job.Errors) == 0
+}
+
+// GetErrors returns a map of errors describing why this
+// DownloadJob is not valid.
+func (job *DownloadJob) GetErrors() map[string]string {
+	return job.Errors
+}
+
+// Run downloads each of the job's items and, if ValidateBags is true,
+// validates each one that downloads successfully. It records one
+// JobResult per item in job.Results and, if messageChannel is not nil,
+// sends each one to the listener in a finish event as the item completes.
+//
+// Like the other job types, this keeps going when an item fails. It
+// returns constants.ExitOK if every item downloaded (and validated),
+// constants.ExitUsageErr if the job definition is invalid, and
+// constants.ExitRuntimeErr if any item failed.
+func (job *DownloadJob) Run(messageChannel chan *EventMessage) int {
+	return job.RunContext(context.Background(), messageChannel)
+}
+
+// RunContext is like Run, but it stops the download or validation in
+// progress, and skips the remaining items, if ctx is cancelled. In that
+// case, it returns constants.ExitCancelled.
+func (job *DownloadJob) RunContext(ctx context.Context, messageChannel chan *EventMessage) int {
+	job.DownloadOps = make([]*DownloadOperation, 0)
+	job.ValidationOps = make([]*ValidationOperation, 0)
+	job.Results = make([]*JobResult, 0)
+
+	if !job.Validate() {
+		return constants.ExitUsageErr
+	}
+	if job.StorageService == nil {
+		result := ObjFind(job.StorageServiceID)
+		if result.Error != nil {
+			job.Errors["StorageService"] = result.Error.Error()
+			return constants.ExitUsageErr
+		}
+		job.StorageService = result.StorageService()
+	}
+
+	var valJob *ValidationJob
+	var profile *BagItProfile
+	if job.ValidateBags {
+		valJob = NewValidationJob()
+		valJob.Name = job.Name
+		valJob.BagItProfileID = job.BagItProfileID
+		valJob.FallbackProfileID = job.FallbackProfileID
+		valJob.FetchProfiles = job.FetchProfiles
+		var exitCode int
+		profile, exitCode = valJob.loadProfile()
+		if exitCode != constants.ExitOK {
+			for key, value := range valJob.Errors {
+				job.Errors[key] = value
+			}
+			return exitCode
+		}
+	}
+
+	exitCode := constants.ExitOK
+	for _, item := range job.Items {
+		if ctx.Err() != nil {
+			break
+		}
+		result := job.runOne(ctx, item, valJob, profile, messageChannel)
+		job.Results = append(job.Results, result)
+		if !result.Succeeded {
+			exitCode = constants.ExitRuntimeErr
+		}
+		if messageChannel != nil {
+			status := constants.StatusSuccess
+			if !result.Succeeded {
+				status = constants.StatusFailed
+			}
+			messageChannel <- &EventMessage{
+				EventType: constants.EventTypeFinish,
+				Stage:     constants.StageDownload,
+				Status:    status,
+				Message:   item,
+				JobResult: result,
+			}
+		}
+	}
+	if ctx.Err() != nil {
+		return constants.ExitCancelled
+	}
+	return exitCode
+}
+
+// runOne downloads a single item and, if valJob is not nil, validates it.
+func (job *DownloadJob) runOne(ctx context.Context, item string, valJob *ValidationJob, profile *BagItProfile, messageChannel chan *EventMessage) *JobResult {
+	downloadOp := NewDownloadOperation(job.StorageService, item, job.OutputDir)
+	job.DownloadOps = append(job.DownloadOps, downloadOp)
+	downloadOp.Result.Start()
+	if !downloadOp.Validate() {
+		downloadOp.Result.Finish(downloadOp.Errors)
+		return NewJobResultFromDownload(job, downloadOp, nil)
+	}
+	ok := downloadOp.DoDownloadContext(ctx, messageChannel)
+	downloadOp.Result.Finish(downloadOp.Errors)
+	if !ok || valJob == nil {
+		return NewJobResultFromDownload(job, downloadOp, nil)
+	}
+	valJob.runOne(ctx, downloadOp.LocalPath, profile, messageChannel)
+	validationOp := valJob.ValidationOps[len(valJob.ValidationOps)-1]
+	job.ValidationOps = append(job.ValidationOps, validationOp)
+	return NewJobResultFromDownload(job, downloadOp, validationOp)
+}
@@ -0,0 +1,172 @@
+package core_test
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/core"
+	"github.com/APTrust/dart-runner/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewDownloadJob(t *testing.T) {
+	job := core.NewDownloadJob()
+	require.NotNil(t, job)
+	assert.True(t, util.LooksLikeUUID(job.ID))
+	assert.NotEmpty(t, job.Name)
+	assert.Equal(t, job.Name, job.String())
+	assert.NotNil(t, job.Errors)
+	assert.NotNil(t, job.Items)
+	assert.NotNil(t, job.DownloadOps)
+	assert.NotNil(t, job.ValidationOps)
+	assert.NotNil(t, job.Results)
+}
+
+func TestDownloadJobValidate(t *testing.T) {
+	job := core.NewDownloadJob()
+	job.ValidateBags = true
+	job.FallbackProfileID = "not a uuid"
+	assert.False(t, job.Validate())
+	assert.Equal(t, "You must specify at least one item to download.", job.Errors["Items"])
+	assert.Equal(t, "You must specify a directory to download into.", job.Errors["OutputDir"])
+	assert.Equal(t, "Please choose a storage service to download from.", job.Errors["StorageService"])
+	assert.Equal(t, "Please choose a BagIt profile to validate downloaded bags.", job.Errors["BagItProfileID"])
+	assert.Equal(t, "Fallback profile ID must be a UUID.", job.Errors["FallbackProfileID"])
+
+	job.OutputDir = "/path/does/not/exist"
+	assert.False(t, job.Validate())
+	assert.Equal(t, "Output directory /path/does/not/exist does not exist.", job.Errors["OutputDir"])
+
+	job.Items = []string{"bag.tar"}
+	job.OutputDir = t.TempDir()
+	job.StorageServiceID = "7d7a5d3f-42c1-4cf9-9c8d-0db6a0e3cd01"
+	job.BagItProfileID = constants.BagItProfileAuto
+	job.FallbackProfileID = ""
+	assert.True(t, job.Validate(), job.Errors)
+	assert.Equal(t, constants.ExitUsageErr, core.NewDownloadJob().Run(nil))
+}
+
+func TestDownloadJobFromJson(t *testing.T) {
+	ss := getSftpStorageService()
+	ss.AllowsDownload = true
+	jobDef := map[string]interface{}{
+		"name":           "Restore test bags",
+		"items":          []string{"bag1.tar", "bags/bag2/"},
+		"storageService": ss,
+		"validateBags":   true,
+		"bagItProfileId": constants.BagItProfileAuto,
+	}
+	data, err := json.Marshal(jobDef)
+	require.NoError(t, err)
+	jobFile := filepath.Join(t.TempDir(), "download_job.json")
+	require.NoError(t, os.WriteFile(jobFile, data, 0644))
+
+	job, err := core.DownloadJobFromJson(jobFile)
+	require.NoError(t, err)
+	assert.Equal(t, "Restore test bags", job.Name)
+	assert.Equal(t, []string{"bag1.tar", "bags/bag2/"}, job.Items)
+	require.NotNil(t, job.StorageService)
+	assert.Equal(t, ss.Name, job.StorageService.Name)
+	assert.True(t, job.ValidateBags)
+	assert.Equal(t, constants.BagItProfileAuto, job.BagItProfileID)
+	assert.True(t, util.LooksLikeUUID(job.ID))
+
+	_, err = core.DownloadJobFromJson(filepath.Join(t.TempDir(), "missing.json"))
+	assert.Error(t, err)
+}
+
+func TestDownloadJobRun(t *testing.T) {
+	defer core.ClearDartTable()
+	defer core.ClearTrustedHostKeysTable()
+	aptProfile := loadProfile(t, APTProfile)
+	require.NoError(t, core.ObjSave(aptProfile))
+
+	ss, uploadDir := getDownloadSftpStorageService(t)
+	for _, bagName := range []string{"example.edu.sample_good.tar", "example.edu.sample_missing_data_file.tar"} {
+		data, err := os.ReadFile(util.PathToUnitTestBag(bagName))
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(uploadDir, bagName), data, 0644))
+	}
+
+	job := core.NewDownloadJob()
+	job.StorageService = ss
+	job.OutputDir = t.TempDir()
+	job.Items = []string{
+		"example.edu.sample_good.tar",
+		"example.edu.sample_missing_data_file.tar",
+		"example.edu.not_there.tar",
+	}
+	job.ValidateBags = true
+	job.BagItProfileID = constants.BagItProfileAuto
+	job.FallbackProfileID = aptProfile.ID
+
+	messageChannel := make(chan *core.EventMessage, 500)
+	exitCode := job.Run(messageChannel)
+	close(messageChannel)
+	assert.Equal(t, constants.ExitRuntimeErr, exitCode)
+	require.Equal(t, 3, len(job.Results))
+	assert.Equal(t, 3, len(job.DownloadOps))
+
+	// Only the items we downloaded were validated.
+	assert.Equal(t, 2, len(job.ValidationOps))
+
+	// Good bag downloads and validates.
+	result := job.Results[0]
+	assert.True(t, result.Succeeded)
+	assert.Equal(t, job.ID, result.JobID)
+	assert.Equal(t, "example.edu.sample_good.tar", result.JobName)
+	require.Equal(t, 1, len(result.DownloadResults))
+	assert.True(t, result.DownloadResults[0].Succeeded())
+	require.Equal(t, 1, len(result.ValidationResults))
+	assert.True(t, result.ValidationResults[0].Succeeded())
+	assert.Contains(t, result.ValidationResults[0].Warning, "does not declare a BagIt-Profile-Identifier")
+	assert.Equal(t, int64(1), result.PayloadFileCount)
+
+	// Bad bag downloads but fails validation.
+	result = job.Results[1]
+	assert.False(t, result.Succeeded)
+	assert.True(t, result.DownloadResults[0].Succeeded())
+	require.Equal(t, 1, len(result.ValidationResults))
+	assert.False(t, result.ValidationResults[0].Succeeded())
+
+	// Missing bag fails to download and is not validated.
+	result = job.Results[2]
+	assert.False(t, result.Succeeded)
+	assert.False(t, result.DownloadResults[0].Succeeded())
+	assert.Empty(t, result.ValidationResults)
+
+	// The listener gets a finish event with a result for each item.
+	finishEvents := 0
+	for msg := range messageChannel {
+		if msg.EventType == constants.EventTypeFinish && msg.Stage == constants.StageDownload {
+			require.NotNil(t, msg.JobResult)
+			assert.Equal(t, job.Items[finishEvents], msg.JobResult.JobName)
+			finishEvents++
+		}
+	}
+	assert.Equal(t, 3, finishEvents)
+}
+
+func TestDownloadJobRunCancelled(t *testing.T) {
+	defer core.ClearTrustedHostKeysTable()
+	ss, uploadDir := getDownloadSftpStorageService(t)
+	data, err := os.ReadFile(util.PathToUnitTestBag("example.edu.sample_good.tar"))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(uploadDir, "sample_good.tar"), data, 0644))
+
+	job := core.NewDownloadJob()
+	job.StorageService = ss
+	job.OutputDir = t.TempDir()
+	job.Items = []string{"sample_good.tar"}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, constants.ExitCancelled, job.RunContext(ctx, nil))
+	assert.Empty(t, job.Results)
+	assert.False(t, util.FileExists(filepath.Join(job.OutputDir, "sample_good.tar")))
+}
@@ -0,0 +1,273 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/util"
+)
+
+// DownloadOperation retrieves a single item from a storage service into
+// a local directory. For S3 services, Item is an object key in the
+// service's bucket, or a key prefix ending in a slash. For SFTP services,
+// Item is the path of a file or directory relative to the service's
+// bucket (upload directory), or an absolute path on the server.
+//
+// The item is saved in OutputDir under the last segment of its key or
+// path. That is, item "bags/photos.tar" comes down to
+// OutputDir/photos.tar, and prefix "bags/photos/" comes down to the
+// directory OutputDir/photos.
+type DownloadOperation struct {
+	Errors         map[string]string `json:"errors"`
+	Item           string            `json:"item"`
+	LocalPath      string            `json:"localPath"`
+	OutputDir      string            `json:"outputDir"`
+	Result         *OperationResult  `json:"result"`
+	StorageService *StorageService   `json:"storageService"`
+}
+
+func NewDownloadOperation(ss *StorageService, item, outputDir string) *DownloadOperation {
+	opResult := NewOperationResult("download", "Downloader - "+constants.AppVersion)
+	if ss != nil {
+		opResult.RemoteTargetName = ss.Name
+	}
+	localPath := ""
+	if outputDir != "" && item != "" {
+		localPath = filepath.Join(outputDir, path.Base(strings.TrimSuffix(filepath.ToSlash(item), "/")))
+	}
+	return &DownloadOperation{
+		Errors:         make(map[string]string),
+		Item:           item,
+		LocalPath:      localPath,
+		OutputDir:      outputDir,
+		Result:         opResult,
+		StorageService: ss,
+	}
+}
+
+// Validate returns true if this operation has everything it needs to
+// run. We refuse to download over an existing file or directory,
+// because restoring into a directory that holds stale files from an
+// earlier download would produce a bag that mixes the two.
+func (d *DownloadOperation) Validate() bool {
+	d.Errors = make(map[string]string)
+	if d.StorageService == nil {
+		d.Errors["DownloadOperation.StorageService"] = "DownloadOperation requires a StorageService"
+	} else {
+		if !d.StorageService.Validate() {
+			for key, errMsg := range d.StorageService.Errors {
+				d.Errors["StorageService."+key] = errMsg
+			}
+		}
+		if !d.StorageService.AllowsDownload {
+			d.Errors["StorageService.AllowsDownload"] = fmt.Sprintf("Storage service %s does not allow downloads.", d.StorageService.Name)
+		}
+		if !util.StringListContains([]string{constants.ProtocolS3, constants.ProtocolSFTP}, d.StorageService.Protocol) {
+			d.Errors["StorageService.Protocol"] = fmt.Sprintf("Unsupported download protocol: %s", d.StorageService.Protocol)
+		}
+	}
+	if strings.TrimSpace(d.Item) == "" || path.Base(strings.TrimSuffix(filepath.ToSlash(d.Item), "/")) == ".." {
+		d.Errors["DownloadOperation.Item"] = "DownloadOperation requires the key or path of an item to download"
+	}
+	if !util.IsDirectory(d.OutputDir) {
+		d.Errors["DownloadOperation.OutputDir"] = fmt.Sprintf("Output directory %s does not exist", d.OutputDir)
+	} else if d.LocalPath != "" && util.FileExists(d.LocalPath) {
+		d.Errors["DownloadOperation.LocalPath"] = fmt.Sprintf("%s already exists. Move or delete it before downloading %s.", d.LocalPath, d.Item)
+	}
+	for key, value := range d.Errors {
+		Dart.Log.Errorf("%s: %s", key, value)
+	}
+	return len(d.Errors) == 0
+}
+
+// DoDownload retrieves this operation's item from its storage service.
+// Downloads that fail with retryable errors are retried according to
+// the storage service's RetryPolicy, and each attempt is recorded in
+// d.Result.History. Each retry starts the download over. If the download
+// ultimately fails, we delete whatever part of it we saved, so the
+// output directory never holds an incomplete bag.
+func (d *DownloadOperation) DoDownload(messageChannel chan *EventMessage) bool {
+	return d.DoDownloadContext(context.Background(), messageChannel)
+}
+
+// DoDownloadContext is like DoDownload, but it stops the transfer in
+// progress, and makes no more attempts, if ctx is cancelled.
+func (d *DownloadOperation) DoDownloadContext(ctx context.Context, messageChannel chan *EventMessage) bool {
+	policy := d.StorageService.GetRetryPolicy()
+	for attempt := 1; ; attempt++ {
+		started := time.Now()
+		d.Errors = make(map[string]string)
+		var err error
+		if d.StorageService.Protocol == constants.ProtocolS3 {
+			err = d.fetchFromS3(ctx, messageChannel)
+		} else {
+			err = d.fetchFromSFTP(ctx, messageChannel)
+		}
+		if err == nil {
+			d.Result.RecordAttempt(started, d.Errors, false)
+			d.Result.FilePath = d.LocalPath
+			if stat, statErr := os.Stat(d.LocalPath); statErr == nil {
+				d.Result.FileMTime = stat.ModTime()
+				if !stat.IsDir() {
+					d.Result.FileSize = stat.Size()
+				}
+			}
+			return true
+		}
+		key := fmt.Sprintf("%s - %s", d.StorageService.Name, d.Item)
+		d.Errors[key] = fmt.Sprintf("Error downloading %s: %s", d.Item, err.Error())
+		retryable := policy.IsRetryable(err) && ctx.Err() == nil
+		d.Result.RecordAttempt(started, d.Errors, retryable)
+		Dart.Log.Errorf("Error downloading %s from %s service %s at %s: %v", d.Item, d.StorageService.Protocol, d.StorageService.Name, d.StorageService.HostAndPort(), err)
+		removeErr := os.RemoveAll(d.LocalPath)
+		if removeErr != nil {
+			Dart.Log.Warningf("Could not remove partial download %s: %v", d.LocalPath, removeErr)
+		}
+		if !retryable || attempt >= policy.MaxAttempts {
+			return false
+		}
+		delay := policy.Delay(attempt)
+		Dart.Log.Infof("Retrying download of %s from %s in %s (attempt %d of %d)", d.Item, d.StorageService.Name, delay, attempt+1, policy.MaxAttempts)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return false
+		}
+		d.Result.Attempt += 1
+	}
+}
+
+// fetchFromS3 downloads the operation's item from an S3 service.
+func (d *DownloadOperation) fetchFromS3(ctx context.Context, messageChannel chan *EventMessage) error {
+	s3Client, err := NewS3Client(d.StorageService, d.useSSL(), messageChannel)
+	if err != nil {
+		return fmt.Errorf("error initializing S3 client for %s: %w", d.StorageService.Name, err)
+	}
+	key := strings.TrimPrefix(filepath.ToSlash(d.Item), "/")
+	err = s3Client.DownloadContext(ctx, key, d.LocalPath)
+	d.Result.RemoteURL = d.StorageService.URL(key)
+	d.Result.PayloadSize = s3Client.DownloadSize()
+	d.Result.BytesDownloaded = s3Client.BytesDownloaded()
+	d.Result.FilesDownloaded = s3Client.FilesDownloaded()
+	if err == nil {
+		Dart.Log.Infof("Finished S3 download of %s from %s to %s", key, d.StorageService.Name, d.LocalPath)
+	}
+	return err
+}
+
+// fetchFromSFTP downloads the operation's item from an SFTP server.
+func (d *DownloadOperation) fetchFromSFTP(ctx context.Context, messageChannel chan *EventMessage) error {
+	var progress *StreamProgress
+	if messageChannel != nil {
+		progress = NewDownloadProgress(0, messageChannel)
+		messageChannel <- StartEvent(constants.StageDownload, fmt.Sprintf("Downloading from %s", d.StorageService.Name))
+	}
+	sftpClient, err := NewSFTPClient(d.StorageService, nil)
+	if err != nil {
+		return fmt.Errorf("error initializing SFTP client for %s: %w", d.StorageService.Name, err)
+	}
+	defer sftpClient.Close()
+
+	remotePath := d.sftpRemotePath()
+	err = sftpClient.DownloadContext(ctx, remotePath, d.LocalPath, progress)
+	d.Result.RemoteURL = fmt.Sprintf("%s://%s%s", d.StorageService.Protocol, d.StorageService.HostAndPort(), path.Clean("/"+remotePath))
+	d.Result.PayloadSize = sftpClient.DownloadSize()
+	d.Result.BytesDownloaded = sftpClient.BytesDownloaded()
+	d.Result.FilesDownloaded = sftpClient.FilesDownloaded()
+	if err == nil {
+		Dart.Log.Infof("Finished SFTP download of %s from %s to %s", remotePath, d.StorageService.Name, d.LocalPath)
+	}
+	return err
+}
+
+// sftpRemotePath returns the path of the item on the SFTP server.
+// Relative paths are relative to the storage service's bucket, which
+// is the directory we upload to.
+func (d *DownloadOperation) sftpRemotePath() string {
+	item := filepath.ToSlash(d.Item)
+	if strings.HasPrefix(item, "/") || d.StorageService.Bucket == "" {
+		return item
+	}
+	return path.Join(d.StorageService.Bucket, item)
+}
+
+// useSSL returns true unless we're talking to localhost, as we do in
+// unit tests. See UploadOperation.useSSL.
+func (d *DownloadOperation) useSSL() bool {
+	return !strings.HasPrefix(d.StorageService.Host, "localhost") && !strings.HasPrefix(d.StorageService.Host, "127.0.0.1")
+}
+
+// downloadTargetPath returns the local path for a file at relPath under
+// a downloaded prefix or directory. Remote names are not under our
+// control, so this returns an error if relPath would put the file
+// outside destination.
+func downloadTargetPath(destination, relPath string) (string, error) {
+	localPath := filepath.Join(destination, filepath.FromSlash(relPath))
+	relToDest, err := filepath.Rel(destination, localPath)
+	if err != nil || relToDest == "." || relToDest == ".." || strings.HasPrefix(relToDest, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("remote item %s would be saved outside %s", relPath, destination)
+	}
+	return localPath, nil
+}
+
+// saveDownload copies size bytes from reader to a temp file next to
+// localPath, syncs it to disk and renames it to localPath, so that an
+// interrupted download never leaves a truncated file under the final
+// name. This returns an error wrapping io.ErrUnexpectedEOF, which our
+// retry policy treats as transient, if reader ends early.
+func saveDownload(reader io.Reader, localPath string, size int64, mode os.FileMode, progress *StreamProgress) error {
+	dir := filepath.Dir(localPath)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create directory %s: %w", dir, err)
+	}
+	tmpFile, err := os.CreateTemp(dir, "."+filepath.Base(localPath)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file in %s: %w", dir, err)
+	}
+	tmpPath := tmpFile.Name()
+	renamed := false
+	defer func() {
+		if !renamed {
+			tmpFile.Close()
+			os.Remove(tmpPath)
+		}
+	}()
+
+	if progress != nil {
+		reader = &progressReader{reader: reader, progress: progress}
+	}
+	written, err := io.Copy(tmpFile, reader)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", tmpPath, err)
+	}
+	if written != size {
+		return fmt.Errorf("received %d of %d bytes for %s: %w", written, size, localPath, io.ErrUnexpectedEOF)
+	}
+	err = tmpFile.Chmod(mode)
+	if err != nil {
+		return fmt.Errorf("failed to set file permissions on %s: %w", tmpPath, err)
+	}
+	err = tmpFile.Sync()
+	if err != nil {
+		return fmt.Errorf("failed to sync %s: %w", tmpPath, err)
+	}
+	err = tmpFile.Close()
+	if err != nil {
+		return fmt.Errorf("failed to close %s: %w", tmpPath, err)
+	}
+	err = os.Rename(tmpPath, localPath)
+	if err != nil {
+		return fmt.Errorf("failed to rename %s to %s: %w", tmpPath, localPath, err)
+	}
+	renamed = true
+	syncDir(dir)
+	return nil
+}
@@ -0,0 +1,220 @@
+package core_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/core"
+	"github.com/APTrust/dart-runner/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// getDownloadSftpStorageService starts an in-process SFTP server and
+// returns a storage service that can download from it, along with the
+// server's upload directory, which holds whatever we put there.
+func getDownloadSftpStorageService(t *testing.T) (*core.StorageService, string) {
+	address, root := startTestSFTPServer(t, newTestHostKey(t))
+	ss := getLocalSftpStorageService(t, address)
+	ss.HostKeyPolicy = constants.HostKeyPolicyTOFU
+	ss.AllowsDownload = true
+	uploadDir := filepath.Join(root, ss.Bucket)
+	require.NoError(t, os.MkdirAll(uploadDir, 0755))
+	return ss, uploadDir
+}
+
+func TestNewDownloadOperation(t *testing.T) {
+	ss := getSftpStorageService()
+	op := core.NewDownloadOperation(ss, "bags/photos.tar", "/tmp/restore")
+	require.NotNil(t, op)
+	assert.Equal(t, "bags/photos.tar", op.Item)
+	assert.Equal(t, filepath.Join("/tmp/restore", "photos.tar"), op.LocalPath)
+	assert.Equal(t, "download", op.Result.Operation)
+	assert.Equal(t, ss.Name, op.Result.RemoteTargetName)
+	assert.NotNil(t, op.Errors)
+
+	// Prefixes come down as directories named for the last segment.
+	op = core.NewDownloadOperation(ss, "bags/photos/", "/tmp/restore")
+	assert.Equal(t, filepath.Join("/tmp/restore", "photos"), op.LocalPath)
+}
+
+func TestDownloadOperationValidate(t *testing.T) {
+	op := core.NewDownloadOperation(nil, "", "/path/does/not/exist")
+	assert.False(t, op.Validate())
+	assert.Equal(t, "DownloadOperation requires a StorageService", op.Errors["DownloadOperation.StorageService"])
+	assert.Equal(t, "DownloadOperation requires the key or path of an item to download", op.Errors["DownloadOperation.Item"])
+	assert.Equal(t, "Output directory /path/does/not/exist does not exist", op.Errors["DownloadOperation.OutputDir"])
+
+	outputDir := t.TempDir()
+	ss := getSftpStorageService()
+	op = core.NewDownloadOperation(ss, "bag.tar", outputDir)
+	assert.False(t, op.Validate())
+	assert.Equal(t, "Storage service Local SFTP test service does not allow downloads.", op.Errors["StorageService.AllowsDownload"])
+
+	ss.AllowsDownload = true
+	assert.True(t, op.Validate(), op.Errors)
+
+	fileService := getFileStorageService(t)
+	op = core.NewDownloadOperation(fileService, "bag.tar", outputDir)
+	assert.False(t, op.Validate())
+	assert.Equal(t, "Unsupported download protocol: file", op.Errors["StorageService.Protocol"])
+
+	// We don't download over existing files.
+	require.NoError(t, os.WriteFile(filepath.Join(outputDir, "bag.tar"), []byte("old"), 0644))
+	op = core.NewDownloadOperation(ss, "bag.tar", outputDir)
+	assert.False(t, op.Validate())
+	assert.Contains(t, op.Errors["DownloadOperation.LocalPath"], "already exists")
+}
+
+func TestDownloadOperationSFTPFile(t *testing.T) {
+	ss, uploadDir := getDownloadSftpStorageService(t)
+	defer core.ClearTrustedHostKeysTable()
+	data, err := os.ReadFile(util.PathToUnitTestBag("example.edu.sample_good.tar"))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(uploadDir, "sample_good.tar"), data, 0640))
+
+	outputDir := t.TempDir()
+	op := core.NewDownloadOperation(ss, "sample_good.tar", outputDir)
+	require.True(t, op.Validate(), op.Errors)
+	op.Result.Start()
+	require.True(t, op.DoDownload(nil), op.Errors)
+	op.Result.Finish(op.Errors)
+	assert.True(t, op.Result.Succeeded())
+
+	downloaded, err := os.ReadFile(op.LocalPath)
+	require.NoError(t, err)
+	assert.Equal(t, data, downloaded)
+	stat, err := os.Stat(op.LocalPath)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), stat.Mode().Perm())
+
+	assert.Equal(t, op.LocalPath, op.Result.FilePath)
+	assert.Equal(t, int64(len(data)), op.Result.FileSize)
+	assert.Equal(t, int64(len(data)), op.Result.BytesDownloaded)
+	assert.Equal(t, int64(1), op.Result.FilesDownloaded)
+	assert.Contains(t, op.Result.RemoteURL, "/uploads/sample_good.tar")
+
+	// No temp files left behind
+	entries, err := os.ReadDir(outputDir)
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(entries))
+}
+
+func TestDownloadOperationSFTPDirectory(t *testing.T) {
+	ss, uploadDir := getDownloadSftpStorageService(t)
+	defer core.ClearTrustedHostKeysTable()
+	files := map[string]string{
+		"bagit.txt":            "BagIt-Version: 1.0\n",
+		"data/one.txt":         "one",
+		"data/nested/two.txt":  "two two",
+		"data/nested/empty.md": "",
+	}
+	for name, content := range files {
+		filePath := filepath.Join(uploadDir, "restore_me", filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(filePath), 0755))
+		require.NoError(t, os.WriteFile(filePath, []byte(content), 0644))
+	}
+
+	progressChannel := make(chan *core.EventMessage, 100)
+	outputDir := t.TempDir()
+	op := core.NewDownloadOperation(ss, "restore_me/", outputDir)
+	require.True(t, op.Validate(), op.Errors)
+	op.Result.Start()
+	require.True(t, op.DoDownload(progressChannel), op.Errors)
+	close(progressChannel)
+
+	assert.Equal(t, filepath.Join(outputDir, "restore_me"), op.LocalPath)
+	for name, content := range files {
+		downloaded, err := os.ReadFile(filepath.Join(op.LocalPath, filepath.FromSlash(name)))
+		require.NoError(t, err, name)
+		assert.Equal(t, content, string(downloaded))
+	}
+	assert.Equal(t, int64(4), op.Result.FilesDownloaded)
+	assert.Equal(t, int64(29), op.Result.BytesDownloaded)
+	assert.Equal(t, int64(29), op.Result.PayloadSize)
+
+	var lastProgress *core.EventMessage
+	for msg := range progressChannel {
+		assert.Equal(t, constants.StageDownload, msg.Stage)
+		if msg.EventType == constants.EventTypeInfo {
+			lastProgress = msg
+		}
+	}
+	require.NotNil(t, lastProgress)
+	assert.Equal(t, 100, lastProgress.Percent)
+}
+
+func TestDownloadOperationSFTPNotFound(t *testing.T) {
+	ss, _ := getDownloadSftpStorageService(t)
+	defer core.ClearTrustedHostKeysTable()
+	outputDir := t.TempDir()
+	op := core.NewDownloadOperation(ss, "no_such_bag.tar", outputDir)
+	require.True(t, op.Validate(), op.Errors)
+	op.Result.Start()
+	assert.False(t, op.DoDownload(nil))
+	op.Result.Finish(op.Errors)
+	assert.False(t, op.Result.Succeeded())
+	assert.Contains(t, op.Result.Errors["Local SFTP test service - no_such_bag.tar"], "does not exist")
+
+	// Missing items aren't worth retrying, and failed
+	// downloads leave nothing behind.
+	require.Equal(t, 1, len(op.Result.History))
+	assert.False(t, op.Result.History[0].Retryable)
+	assert.False(t, util.FileExists(op.LocalPath))
+}
+
+func TestDownloadOperationSFTPCancelled(t *testing.T) {
+	ss, uploadDir := getDownloadSftpStorageService(t)
+	defer core.ClearTrustedHostKeysTable()
+	ss.RetryPolicy = &core.RetryPolicy{MaxAttempts: 3, BaseDelayMs: 10}
+	data, err := os.ReadFile(util.PathToUnitTestBag("example.edu.sample_good.tar"))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(uploadDir, "sample_good.tar"), data, 0640))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	op := core.NewDownloadOperation(ss, "sample_good.tar", t.TempDir())
+	require.True(t, op.Validate(), op.Errors)
+	op.Result.Start()
+	assert.False(t, op.DoDownloadContext(ctx, nil))
+
+	// Cancelled downloads aren't retried and leave nothing behind.
+	require.Equal(t, 1, len(op.Result.History))
+	assert.False(t, op.Result.History[0].Retryable)
+	assert.False(t, util.FileExists(op.LocalPath))
+}
+
+func TestDownloadOperationS3(t *testing.T) {
+	ss := getS3StorageService()
+	ss.AllowsDownload = true
+	client, err := core.NewS3Client(ss, false, nil)
+	require.NoError(t, err)
+	bagDir := util.PathToTestData()
+	pathToBag := filepath.Join(bagDir, "bags", "example.edu.sample_good.tar")
+	require.NoError(t, client.Upload(pathToBag, "example.edu.sample_good.tar"))
+
+	outputDir := t.TempDir()
+	op := core.NewDownloadOperation(ss, "example.edu.sample_good.tar", outputDir)
+	require.True(t, op.Validate(), op.Errors)
+	op.Result.Start()
+	require.True(t, op.DoDownload(nil), op.Errors)
+	expected, err := os.ReadFile(pathToBag)
+	require.NoError(t, err)
+	downloaded, err := os.ReadFile(op.LocalPath)
+	require.NoError(t, err)
+	assert.Equal(t, expected, downloaded)
+	assert.Equal(t, int64(1), op.Result.FilesDownloaded)
+
+	// Download a prefix
+	pathToDir := filepath.Join(bagDir, "files")
+	require.NoError(t, client.Upload(pathToDir, "files"))
+	op = core.NewDownloadOperation(ss, "files/", outputDir)
+	require.True(t, op.Validate(), op.Errors)
+	op.Result.Start()
+	require.True(t, op.DoDownload(nil), op.Errors)
+	assert.True(t, util.IsDirectory(op.LocalPath))
+	assert.True(t, op.Result.FilesDownloaded > 1)
+}
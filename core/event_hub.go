@@ -0,0 +1,83 @@
+package core
+
+import (
+	"sync"
+)
+
+// eventHubBufferSize is the number of events each subscriber can
+// fall behind before the hub starts dropping events for it.
+const eventHubBufferSize = 256
+
+// EventHub passes the EventMessages of running jobs to any number of
+// listeners, such as the API server's event streams. Listeners
+// subscribe to one job at a time, by queued job id.
+//
+// Publishing never blocks. If a listener falls too far behind, it
+// misses some progress events, but Close always tells it when the
+// job is done, so it can look up the job's final result.
+type EventHub struct {
+	mutex       sync.Mutex
+	subscribers map[string]map[chan *EventMessage]bool
+}
+
+// NewEventHub returns a new EventHub with no subscribers.
+func NewEventHub() *EventHub {
+	return &EventHub{
+		subscribers: make(map[string]map[chan *EventMessage]bool),
+	}
+}
+
+// Subscribe returns a channel that receives the events published for
+// the job with the specified id, and a function to call when the
+// caller no longer wants them. The channel is closed when Close is
+// called for the job, or when the caller unsubscribes.
+func (h *EventHub) Subscribe(jobID string) (<-chan *EventMessage, func()) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	ch := make(chan *EventMessage, eventHubBufferSize)
+	if h.subscribers[jobID] == nil {
+		h.subscribers[jobID] = make(map[chan *EventMessage]bool)
+	}
+	h.subscribers[jobID][ch] = true
+	unsubscribe := func() {
+		h.mutex.Lock()
+		defer h.mutex.Unlock()
+		if h.subscribers[jobID][ch] {
+			delete(h.subscribers[jobID], ch)
+			close(ch)
+		}
+	}
+	return ch, unsubscribe
+}
+
+// Publish sends event e to each subscriber of the job with the
+// specified id, skipping subscribers whose buffers are full.
+func (h *EventHub) Publish(jobID string, e *EventMessage) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for ch := range h.subscribers[jobID] {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// Close closes the channels of all subscribers to the job with the
+// specified id. Call this when the job is finished or cancelled.
+func (h *EventHub) Close(jobID string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for ch := range h.subscribers[jobID] {
+		close(ch)
+	}
+	delete(h.subscribers, jobID)
+}
+
+// SubscriberCount returns the number of subscribers listening for
+// events from the job with the specified id.
+func (h *EventHub) SubscriberCount(jobID string) int {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return len(h.subscribers[jobID])
+}
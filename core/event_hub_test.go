@@ -0,0 +1,58 @@
+package core_test
+
+import (
+	"testing"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventHub(t *testing.T) {
+	hub := core.NewEventHub()
+	events1, unsubscribe1 := hub.Subscribe("job-1")
+	events2, unsubscribe2 := hub.Subscribe("job-1")
+	otherEvents, unsubscribeOther := hub.Subscribe("job-2")
+	defer unsubscribeOther()
+	assert.Equal(t, 2, hub.SubscriberCount("job-1"))
+
+	hub.Publish("job-1", core.InfoEvent(constants.StagePackage, "Adding file"))
+	for _, events := range []<-chan *core.EventMessage{events1, events2} {
+		e := <-events
+		require.NotNil(t, e)
+		assert.Equal(t, "Adding file", e.Message)
+	}
+	assert.Empty(t, otherEvents)
+
+	// Unsubscribing closes only that subscriber's channel.
+	unsubscribe1()
+	_, open := <-events1
+	assert.False(t, open)
+	assert.Equal(t, 1, hub.SubscriberCount("job-1"))
+
+	// Close ends all subscriptions to the job.
+	hub.Close("job-1")
+	_, open = <-events2
+	assert.False(t, open)
+	assert.Equal(t, 0, hub.SubscriberCount("job-1"))
+	assert.Equal(t, 1, hub.SubscriberCount("job-2"))
+
+	// Unsubscribing after Close, or publishing to a job with no
+	// subscribers, is harmless.
+	unsubscribe2()
+	hub.Publish("job-1", core.InfoEvent(constants.StagePackage, "Nobody's listening"))
+}
+
+func TestEventHubSlowSubscriber(t *testing.T) {
+	hub := core.NewEventHub()
+	events, unsubscribe := hub.Subscribe("job-1")
+	defer unsubscribe()
+
+	// Publishing never blocks, even if the subscriber isn't reading.
+	for i := 0; i < 1000; i++ {
+		hub.Publish("job-1", core.InfoEvent(constants.StagePackage, "Adding file"))
+	}
+	assert.Less(t, len(events), 1000)
+	assert.Greater(t, len(events), 0)
+}
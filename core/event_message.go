@@ -117,6 +117,9 @@ func FinishEvent(jobResult *JobResult) *EventMessage {
 	if jobResult.Succeeded {
 		message = "Job succeeded"
 		status = constants.StatusSuccess
+	} else if jobResult.Cancelled {
+		message = "Job cancelled"
+		status = constants.StatusCancelled
 	}
 	return &EventMessage{
 		EventType: constants.EventTypeFinish,
@@ -88,6 +88,19 @@ func (settings *ExportSettings) ContainsPlaintextAPIToken() bool {
 	return false
 }
 
+// secretFields returns pointers to the secrets in these settings'
+// storage services and remote repositories.
+func (settings *ExportSettings) secretFields() []*string {
+	fields := make([]*string, 0)
+	for _, ss := range settings.StorageServices {
+		fields = append(fields, ss.secretFields()...)
+	}
+	for _, repo := range settings.RemoteRepositories {
+		fields = append(fields, repo.secretFields()...)
+	}
+	return fields
+}
+
 // GetErrors returns a map of validation errors for this object.
 func (settings *ExportSettings) GetErrors() map[string]string {
 	return settings.Errors
@@ -0,0 +1,306 @@
+package core
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/APTrust/dart-runner/util"
+)
+
+// FileClient copies files to a local directory, or to an NFS or SMB
+// share mounted on the local file system. The StorageService.Bucket
+// attribute is the root directory of the deposit area, and the optional
+// StorageService.PathTemplate describes where, under that root, each
+// file goes.
+//
+// Each file is written to a temporary name in its target directory,
+// synced to disk, checked against the source's SHA-256 digest and then
+// renamed into place, so readers of the deposit area never see a
+// partially written file.
+type FileClient struct {
+	storageService     *StorageService
+	totalBytesToUpload int64
+	bytesUploaded      int64
+	filesUploaded      int64
+	uploadProgress     *StreamProgress
+	bagTags            map[string]string
+	checksums          map[string]string
+}
+
+// NewFileClient returns a new client that copies files to the directory
+// described by ss. If param uploadProgress is not nil, this will update
+// the progress bar as files are copied. Param uploadProgress should be
+// nil unless we're running in DART 3 GUI mode.
+func NewFileClient(ss *StorageService, uploadProgress *StreamProgress) (*FileClient, error) {
+	root := strings.TrimSpace(ss.Bucket)
+	if root == "" {
+		return nil, fmt.Errorf("storage service %s has no root directory", ss.Name)
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, fmt.Errorf("can't access root directory %s: %w", root, err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("root %s is not a directory", root)
+	}
+	return &FileClient{
+		storageService: ss,
+		uploadProgress: uploadProgress,
+		checksums:      make(map[string]string),
+	}, nil
+}
+
+// SetBagTags sets the bag tag values used to fill in placeholders in
+// the storage service's path template. Keys are fully qualified tag
+// names, such as "bag-info.txt/Source-Organization".
+func (fc *FileClient) SetBagTags(tags map[string]string) {
+	fc.bagTags = tags
+}
+
+// Upload copies a file or directory to the storage service's root
+// directory, at the location described by the service's path template.
+// It returns the path to which source was copied.
+func (fc *FileClient) Upload(source string) (string, error) {
+	return fc.UploadContext(context.Background(), source)
+}
+
+// UploadContext is like Upload, but it stops if ctx is cancelled.
+// The temp file of the copy in progress is removed, so the deposit
+// area never holds a partial copy.
+func (fc *FileClient) UploadContext(ctx context.Context, source string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	info, err := os.Stat(source)
+	if err != nil {
+		return "", fmt.Errorf("failed to stat source: %w", err)
+	}
+
+	fc.totalBytesToUpload = int64(0)
+	fc.bytesUploaded = int64(0)
+	fc.filesUploaded = int64(0)
+	fc.checksums = make(map[string]string)
+
+	destination, err := fc.DestinationPath(source)
+	if err != nil {
+		return "", err
+	}
+	if info.IsDir() {
+		fc.totalBytesToUpload, err = GetUploadPayloadSize(source)
+		if err != nil {
+			return "", err
+		}
+		return destination, fc.copyDirectory(ctx, source, destination)
+	}
+	fc.totalBytesToUpload = info.Size()
+	err = os.MkdirAll(filepath.Dir(destination), 0755)
+	if err != nil {
+		return "", fmt.Errorf("failed to create directory %s: %w", filepath.Dir(destination), err)
+	}
+	return destination, fc.copyFile(ctx, source, destination, info)
+}
+
+// DestinationPath returns the absolute path to which source will be
+// copied. If the storage service has no path template, that's the
+// source's base name under the root directory. This returns an error
+// if the expanded template points outside the root.
+func (fc *FileClient) DestinationPath(source string) (string, error) {
+	root, err := filepath.Abs(fc.storageService.Bucket)
+	if err != nil {
+		return "", err
+	}
+	relPath := filepath.Base(source)
+	if strings.TrimSpace(fc.storageService.PathTemplate) != "" {
+		relPath, err = ExpandUploadTemplate(fc.storageService.PathTemplate, source, fc.bagTags)
+		if err != nil {
+			return "", fmt.Errorf("can't expand path template for %s: %w", source, err)
+		}
+	}
+	destination := filepath.Join(root, filepath.FromSlash(relPath))
+	relToRoot, err := filepath.Rel(root, destination)
+	if err != nil || relToRoot == "." || relToRoot == ".." || strings.HasPrefix(relToRoot, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("path template for %s resolves to %s, which is not inside root directory %s", source, destination, root)
+	}
+	return destination, nil
+}
+
+// copyDirectory recursively copies a directory to destination.
+func (fc *FileClient) copyDirectory(ctx context.Context, source, destination string) error {
+	return filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(source, path)
+		if err != nil {
+			return fmt.Errorf("failed to get relative path for %s: %w", path, err)
+		}
+		target := filepath.Join(destination, relPath)
+		if info.IsDir() {
+			err = os.MkdirAll(target, info.Mode().Perm()|0700)
+			if err != nil {
+				return fmt.Errorf("failed to create directory %s: %w", target, err)
+			}
+		} else if info.Mode().IsRegular() {
+			err = fc.copyFile(ctx, path, target, info)
+			if err != nil {
+				return fmt.Errorf("file client: error copying %s: %w", path, err)
+			}
+		} else {
+			Dart.Log.Warningf("File client is skipping %s because it's not a regular file", path)
+		}
+		return nil
+	})
+}
+
+// copyFile copies a single file to a temp file next to destination,
+// syncs it to disk, verifies its checksum and then renames it to
+// destination. If anything goes wrong, the temp file is removed and
+// destination is left as it was.
+func (fc *FileClient) copyFile(ctx context.Context, source, destination string, info os.FileInfo) error {
+	srcFile, err := os.Open(source)
+	if err != nil {
+		return fmt.Errorf("failed to open local file: %w", err)
+	}
+	defer srcFile.Close()
+
+	dir := filepath.Dir(destination)
+	tmpFile, err := os.CreateTemp(dir, "."+filepath.Base(destination)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file in %s: %w", dir, err)
+	}
+	tmpPath := tmpFile.Name()
+	renamed := false
+	defer func() {
+		if !renamed {
+			tmpFile.Close()
+			os.Remove(tmpPath)
+		}
+	}()
+
+	// Hash the source as we copy it, so we read it only once.
+	hash := sha256.New()
+	var reader io.Reader = io.TeeReader(newContextReader(ctx, srcFile), hash)
+	if fc.uploadProgress != nil {
+		reader = &progressReader{reader: reader, progress: fc.uploadProgress}
+	}
+	_, err = io.Copy(tmpFile, reader)
+	if err != nil {
+		return fmt.Errorf("failed to copy %s to %s: %w", source, tmpPath, err)
+	}
+	err = tmpFile.Chmod(info.Mode().Perm())
+	if err != nil {
+		return fmt.Errorf("failed to set file permissions on %s: %w", tmpPath, err)
+	}
+	err = tmpFile.Sync()
+	if err != nil {
+		return fmt.Errorf("failed to sync %s: %w", tmpPath, err)
+	}
+	err = tmpFile.Close()
+	if err != nil {
+		return fmt.Errorf("failed to close %s: %w", tmpPath, err)
+	}
+
+	// Read back what we wrote. On network file systems, this catches
+	// corruption that a successful write and sync do not rule out.
+	sourceDigest := hex.EncodeToString(hash.Sum(nil))
+	copySize, copyDigest, err := sha256OfFile(tmpPath)
+	if err != nil {
+		return err
+	}
+	if copySize != info.Size() || copyDigest != sourceDigest {
+		return uploadVerificationError(source, destination, fmt.Sprintf("local sha256 is %s (%d bytes), copy's sha256 is %s (%d bytes)", sourceDigest, info.Size(), copyDigest, copySize))
+	}
+
+	err = os.Rename(tmpPath, destination)
+	if err != nil {
+		return fmt.Errorf("failed to rename %s to %s: %w", tmpPath, destination, err)
+	}
+	renamed = true
+	syncDir(dir)
+
+	fc.checksums[destination] = copyDigest
+	fc.bytesUploaded += info.Size()
+	fc.filesUploaded += 1
+	Dart.Log.Infof("Copied file: %s -> %s (sha256 %s)", source, destination, copyDigest)
+	return nil
+}
+
+// List returns the files under the root directory whose paths relative
+// to the root begin with prefix.
+func (fc *FileClient) List(prefix string) ([]*RemoteObject, error) {
+	root := filepath.Clean(fc.storageService.Bucket)
+	start := filepath.Join(root, filepath.FromSlash(listingDir(prefix)))
+	objects := make([]*RemoteObject, 0)
+	if start != root && !util.FileExists(start) {
+		return objects, nil
+	}
+	err := filepath.Walk(start, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		relPath, err := filepath.Rel(root, filePath)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(relPath)
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, &RemoteObject{
+				Key:      key,
+				Size:     info.Size(),
+				Modified: info.ModTime(),
+			})
+		}
+		return nil
+	})
+	return objects, err
+}
+
+// syncDir flushes dir's entries to disk, so a rename into dir survives
+// a crash. Some platforms and network file systems don't support syncing
+// directories, so this logs failures rather than returning them.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		Dart.Log.Debugf("Can't open %s to sync: %v", dir, err)
+		return
+	}
+	defer d.Close()
+	if err = d.Sync(); err != nil {
+		Dart.Log.Debugf("Can't sync directory %s: %v", dir, err)
+	}
+}
+
+func (fc *FileClient) FilesUploaded() int64 {
+	return fc.filesUploaded
+}
+
+func (fc *FileClient) BytesUploaded() int64 {
+	return fc.bytesUploaded
+}
+
+func (fc *FileClient) PayloadSize() int64 {
+	return fc.totalBytesToUpload
+}
+
+// VerifiedChecksums returns a map of copied file paths and the SHA-256
+// digests of the files at those paths. The file client always verifies
+// its copies, so this includes every file copied.
+func (fc *FileClient) VerifiedChecksums() map[string]string {
+	checksums := make(map[string]string)
+	for key, value := range fc.checksums {
+		checksums[key] = value
+	}
+	return checksums
+}
@@ -0,0 +1,117 @@
+package core_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/core"
+	"github.com/APTrust/dart-runner/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func getFileStorageService(t *testing.T) *core.StorageService {
+	ss := core.NewStorageService()
+	ss.Name = "Local deposit"
+	ss.Protocol = constants.ProtocolFile
+	ss.Bucket = t.TempDir()
+	return ss
+}
+
+func TestNewFileClient(t *testing.T) {
+	ss := getFileStorageService(t)
+	client, err := core.NewFileClient(ss, nil)
+	require.NoError(t, err)
+	require.NotNil(t, client)
+
+	ss.Bucket = filepath.Join(ss.Bucket, "does-not-exist")
+	_, err = core.NewFileClient(ss, nil)
+	assert.Error(t, err)
+
+	ss.Bucket = ""
+	_, err = core.NewFileClient(ss, nil)
+	assert.Error(t, err)
+}
+
+func TestFileClientUploadFile(t *testing.T) {
+	ss := getFileStorageService(t)
+	messageChannel := make(chan *core.EventMessage, 1000)
+	bagFile := util.PathToUnitTestBag("example.edu.tagsample_good.tar")
+	info, err := os.Stat(bagFile)
+	require.NoError(t, err)
+
+	progress := core.NewStreamProgress(info.Size(), messageChannel)
+	client, err := core.NewFileClient(ss, progress)
+	require.NoError(t, err)
+
+	destination, err := client.Upload(bagFile)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(ss.Bucket, "example.edu.tagsample_good.tar"), destination)
+	assert.FileExists(t, destination)
+	assert.EqualValues(t, 1, client.FilesUploaded())
+	assert.Equal(t, info.Size(), client.BytesUploaded())
+	assert.Equal(t, info.Size(), client.PayloadSize())
+	assert.Equal(t, info.Size(), progress.Current)
+	assert.Equal(t, 100, progress.Percent)
+
+	checksums := client.VerifiedChecksums()
+	require.Equal(t, 1, len(checksums))
+	assert.Equal(t, sha256Hex(t, bagFile), checksums[destination])
+
+	// No temp files should be left behind.
+	entries, err := os.ReadDir(ss.Bucket)
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(entries))
+
+	// Copying again should replace the existing file.
+	_, err = client.Upload(bagFile)
+	require.NoError(t, err)
+	assert.Equal(t, sha256Hex(t, bagFile), sha256Hex(t, destination))
+}
+
+func TestFileClientUploadDirectory(t *testing.T) {
+	ss := getFileStorageService(t)
+	client, err := core.NewFileClient(ss, nil)
+	require.NoError(t, err)
+
+	source := filepath.Join(util.ProjectRoot(), "profiles")
+	expectedSize, err := core.GetUploadPayloadSize(source)
+	require.NoError(t, err)
+
+	destination, err := client.Upload(source)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(ss.Bucket, "profiles"), destination)
+	assert.Equal(t, expectedSize, client.BytesUploaded())
+	assert.True(t, client.FilesUploaded() > 1)
+	assert.EqualValues(t, client.FilesUploaded(), len(client.VerifiedChecksums()))
+	assert.FileExists(t, filepath.Join(destination, "aptrust-v2.2.json"))
+}
+
+func TestFileClientPathTemplate(t *testing.T) {
+	ss := getFileStorageService(t)
+	ss.PathTemplate = "{{Source-Organization}}/{{bagname}}/{{filename}}"
+	client, err := core.NewFileClient(ss, nil)
+	require.NoError(t, err)
+	client.SetBagTags(map[string]string{"bag-info.txt/Source-Organization": "example.edu"})
+
+	bagFile := util.PathToUnitTestBag("example.edu.tagsample_good.tar")
+	destination, err := client.Upload(bagFile)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(ss.Bucket, "example.edu", "example.edu.tagsample_good", "example.edu.tagsample_good.tar"), destination)
+	assert.FileExists(t, destination)
+
+	// Templates can't escape the root directory, even when
+	// the parent directory reference comes from a tag value.
+	ss.PathTemplate = "{{Source-Organization}}/{{filename}}"
+	client.SetBagTags(map[string]string{"bag-info.txt/Source-Organization": "../.."})
+	_, err = client.DestinationPath(bagFile)
+	assert.Error(t, err)
+	_, err = client.Upload(bagFile)
+	assert.Error(t, err)
+
+	ss.PathTemplate = "{{No-Such-Tag}}"
+	_, err = client.DestinationPath(bagFile)
+	assert.Error(t, err)
+}
@@ -61,6 +61,9 @@ func (r *FileSystemBagReader) ScanPayload() error {
 	totalFiles := len(r.fileList)
 	lastPercent := -1
 	for i, xFileInfo := range r.fileList {
+		if err := contextErr(r.validator.ctx); err != nil {
+			return err
+		}
 		err := r.processPayloadEntry(xFileInfo)
 		if err == io.EOF {
 			Dart.Log.Debugf("FileSystemBagReader.ScanPayload finished reading payload in %s", xFileInfo.FullPath)
@@ -253,8 +256,9 @@ func (r *FileSystemBagReader) addChecksums(pathInBag, fullPathToFile string, fil
 		Dart.Log.Errorf("FileSystemBagReader error opening file for read %s: %v", fullPathToFile, err)
 		return err
 	}
+	defer sourceFile.Close()
 
-	_, err = io.Copy(multiWriter, sourceFile)
+	_, err = io.Copy(multiWriter, newContextReader(r.validator.ctx, sourceFile))
 	if err != nil {
 		Dart.Log.Errorf("FileSystemBagReader error adding checksums for file %s: %v", fullPathToFile, err)
 		return err
@@ -1,6 +1,7 @@
 package core
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -15,6 +16,7 @@ type FileSystemBagWriter struct {
 	rootDirName    string
 	digestAlgs     []string
 	rootDirCreated bool
+	ctx            context.Context
 }
 
 func NewFileSystemBagWriter(outputPath string, digestAlgs []string) *FileSystemBagWriter {
@@ -94,7 +96,7 @@ func (writer *FileSystemBagWriter) AddFile(xFileInfo *util.ExtendedFileInfo, pat
 	}
 	writers[len(writers)-1] = outfile
 	multiWriter := io.MultiWriter(writers...)
-	bytesWritten, err := io.Copy(multiWriter, file)
+	bytesWritten, err := io.Copy(multiWriter, newContextReader(writer.ctx, file))
 	if bytesWritten != xFileInfo.Size() {
 		message := fmt.Sprintf("FileSystemBagWriter.addToArchive() copied only %d of %d bytes for file %s", bytesWritten, xFileInfo.Size(), xFileInfo.FullPath)
 		Dart.Log.Error(message)
@@ -0,0 +1,445 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/util"
+)
+
+// HotFolderSidecarSuffix is the suffix of a sidecar file in a hot
+// folder. The sidecar for item "photos" is "photos.dart.json". It
+// contains job params JSON, usually just tags, but it may also set
+// packageName and any of the overrides described in JobOverrides.
+const HotFolderSidecarSuffix = ".dart.json"
+
+// HotFolderResultSuffix is the suffix of the JobResult JSON file
+// that the HotFolderWatcher writes next to each processed item in
+// the done or failed folder.
+const HotFolderResultSuffix = ".result.json"
+
+// HotFolderWatcher watches a directory into which people or machines
+// drop files and directories to be bagged. When an item is ready, the
+// watcher runs it through Workflow, then moves it, along with its
+// sidecar, done marker and result JSON, into DoneDir or FailedDir.
+//
+// An item is ready when its done marker exists, or when it has not
+// changed for QuietPeriod. The done marker for item "photos" is a file
+// called "photos" + DoneMarker, such as "photos.done". If QuietPeriod
+// is zero, items are ready only when their done markers exist.
+//
+// Tags come from the item's sidecar file (see HotFolderSidecarSuffix)
+// and from its name. If NameTags is set, the watcher splits the item's
+// name, minus its extension, on NameSeparator, and assigns the parts to
+// NameTags in order. For example, with NameTags ["bag-info.txt/Source-
+// Organization", "aptrust-info.txt/Title"], item "Test U_Cat Photos"
+// gets Source-Organization "Test U" and Title "Cat Photos". Names
+// without a tag file go into bag-info.txt. Sidecar tags take precedence
+// over tags from the name.
+//
+// On Linux, the watcher uses inotify to notice new items quickly. It
+// also rescans the folder every PollInterval, which is how it finds
+// new items on other systems.
+type HotFolderWatcher struct {
+	Workflow      *Workflow
+	WatchDir      string
+	OutputDir     string
+	DoneDir       string
+	FailedDir     string
+	DoneMarker    string
+	QuietPeriod   time.Duration
+	PollInterval  time.Duration
+	NameTags      []string
+	NameSeparator string
+	Cleanup       bool
+	SkipArtifacts bool
+	SuccessCount  int
+	FailureCount  int
+	pending       map[string]*hotFolderItemState
+	stop          chan struct{}
+	stopOnce      sync.Once
+	stdOutWriter  *bytes.Buffer
+	stdErrWriter  *bytes.Buffer
+	ctx           context.Context
+}
+
+// hotFolderItemState records when we first saw an item in its current
+// state, so we can tell how long it has been unchanged.
+type hotFolderItemState struct {
+	signature string
+	since     time.Time
+}
+
+// NewHotFolderWatcher creates a watcher that runs the items that appear
+// in watchDir through the workflow in workflowFile, writing bags to
+// outputDir. It creates the done and failed folders inside watchDir if
+// they don't already exist.
+//
+// cleanup describes whether or not DART should delete the bags it
+// creates after successful upload.
+func NewHotFolderWatcher(workflowFile, watchDir, outputDir string, cleanup, skipArtifacts bool) (*HotFolderWatcher, error) {
+	if !util.IsDirectory(watchDir) {
+		return nil, fmt.Errorf("watch directory '%s' does not exist", watchDir)
+	}
+	if !util.FileExists(outputDir) {
+		return nil, fmt.Errorf("output directory '%s' does not exist; you must create it first", outputDir)
+	}
+	workflow, err := WorkflowFromJson(workflowFile)
+	if err != nil {
+		return nil, err
+	}
+	watcher := &HotFolderWatcher{
+		Workflow:      workflow,
+		WatchDir:      watchDir,
+		OutputDir:     outputDir,
+		DoneDir:       filepath.Join(watchDir, "done"),
+		FailedDir:     filepath.Join(watchDir, "failed"),
+		DoneMarker:    ".done",
+		QuietPeriod:   60 * time.Second,
+		PollInterval:  5 * time.Second,
+		NameSeparator: "_",
+		Cleanup:       cleanup,
+		SkipArtifacts: skipArtifacts,
+		pending:       make(map[string]*hotFolderItemState),
+		stop:          make(chan struct{}),
+	}
+	for _, dir := range []string{watcher.DoneDir, watcher.FailedDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	return watcher, nil
+}
+
+// SetStdOut causes messages to be written to buffer b instead of
+// os.Stdout. See WorkflowRunner.SetStdOut.
+func (w *HotFolderWatcher) SetStdOut(b *bytes.Buffer) {
+	w.stdOutWriter = b
+}
+
+// SetStdErr causes messages to be written to buffer b instead of
+// os.Stderr. See WorkflowRunner.SetStdOut.
+func (w *HotFolderWatcher) SetStdErr(b *bytes.Buffer) {
+	w.stdErrWriter = b
+}
+
+// Run watches the folder until Stop is called, running each item as it
+// becomes ready, and writing each job's result JSON to STDOUT. It returns
+// an exit code.
+func (w *HotFolderWatcher) Run() int {
+	events, closeNotifier, err := watchFolderEvents(w.WatchDir)
+	if err != nil {
+		Dart.Log.Infof("Watching %s by polling every %s: %v", w.WatchDir, w.PollInterval, err)
+	} else {
+		defer closeNotifier()
+	}
+	ticker := time.NewTicker(w.PollInterval)
+	defer ticker.Stop()
+	w.writeStdErr(fmt.Sprintf("Watching %s", w.WatchDir))
+	for {
+		if _, err := w.Scan(); err != nil {
+			w.writeStdErr(fmt.Sprintf("Error scanning %s: %s", w.WatchDir, err.Error()))
+			return constants.ExitRuntimeErr
+		}
+		select {
+		case <-w.stop:
+			return constants.ExitOK
+		case <-ticker.C:
+		case <-events:
+		}
+	}
+}
+
+// RunContext is like Run, but when ctx is cancelled, it cancels the
+// job it's running and returns. The item that job was working on stays
+// in the watch folder, so the watcher runs it again when it restarts.
+func (w *HotFolderWatcher) RunContext(ctx context.Context) int {
+	w.ctx = ctx
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-ctx.Done():
+			w.Stop()
+		case <-stopped:
+		}
+	}()
+	return w.Run()
+}
+
+// Stop tells Run to return after it finishes the item it's working on.
+func (w *HotFolderWatcher) Stop() {
+	w.stopOnce.Do(func() { close(w.stop) })
+}
+
+// Scan looks through the watch folder once, and runs each item that's
+// ready. It returns the number of items it ran.
+func (w *HotFolderWatcher) Scan() (int, error) {
+	names, err := w.listItems()
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	seen := make(map[string]bool)
+	for _, name := range names {
+		seen[name] = true
+		if !w.isReady(name) {
+			continue
+		}
+		w.processItem(name)
+		delete(w.pending, name)
+		count++
+		select {
+		case <-w.stop:
+			return count, nil
+		default:
+		}
+	}
+	// Forget items that were removed before they were ready.
+	for name := range w.pending {
+		if !seen[name] {
+			delete(w.pending, name)
+		}
+	}
+	return count, nil
+}
+
+// listItems returns the names of the items in the watch folder, in
+// sorted order. It skips hidden files, which are often partial copies,
+// along with sidecars, done markers and the done and failed folders.
+func (w *HotFolderWatcher) listItems() ([]string, error) {
+	entries, err := os.ReadDir(w.WatchDir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0)
+	for _, entry := range entries {
+		name := entry.Name()
+		path := filepath.Join(w.WatchDir, name)
+		if strings.HasPrefix(name, ".") || path == w.DoneDir || path == w.FailedDir {
+			continue
+		}
+		if strings.HasSuffix(name, HotFolderSidecarSuffix) {
+			continue
+		}
+		if w.DoneMarker != "" && strings.HasSuffix(name, w.DoneMarker) {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// isReady returns true if the item's done marker exists, or if the item
+// hasn't changed in QuietPeriod.
+func (w *HotFolderWatcher) isReady(name string) bool {
+	if w.DoneMarker != "" && util.FileExists(w.itemPath(name)+w.DoneMarker) {
+		return true
+	}
+	if w.QuietPeriod <= 0 {
+		return false
+	}
+	signature, err := hotFolderSignature(w.itemPath(name))
+	if err != nil {
+		return false
+	}
+	state := w.pending[name]
+	if state == nil || state.signature != signature {
+		w.pending[name] = &hotFolderItemState{signature: signature, since: time.Now()}
+		return false
+	}
+	return time.Since(state.since) >= w.QuietPeriod
+}
+
+// hotFolderSignature describes the size and modification time of
+// every file in an item, so we can tell when it changes.
+func hotFolderSignature(path string) (string, error) {
+	var fileCount, totalSize, latest int64
+	err := filepath.WalkDir(path, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		fileCount++
+		totalSize += info.Size()
+		if modTime := info.ModTime().UnixNano(); modTime > latest {
+			latest = modTime
+		}
+		return nil
+	})
+	return fmt.Sprintf("%d/%d/%d", fileCount, totalSize, latest), err
+}
+
+// processItem runs one item through the workflow, then moves it and
+// its result to the done or failed folder.
+func (w *HotFolderWatcher) processItem(name string) {
+	params, err := w.getJobParams(name)
+	job := params.ToJob()
+	var result *JobResult
+	if err != nil {
+		result = NewJobResult(job)
+		result.Succeeded = false
+		result.ValidationErrors = map[string]string{"Sidecar": err.Error()}
+	} else {
+		exitCode := RunJobContext(w.context(), job, w.Cleanup, w.SkipArtifacts, false)
+		result = NewJobResult(job)
+		result.Succeeded = exitCode == constants.ExitOK
+		if exitCode == constants.ExitCancelled {
+			w.writeStdErr(fmt.Sprintf("Cancelled %s. It will run again when the watcher restarts.", name))
+			return
+		}
+	}
+	destDir := w.DoneDir
+	if result.Succeeded {
+		w.SuccessCount++
+	} else {
+		destDir = w.FailedDir
+		w.FailureCount++
+	}
+	resultJson, _ := result.ToJson()
+	w.writeStdOut(resultJson)
+	if err := w.moveItem(name, destDir, resultJson); err != nil {
+		w.writeStdErr(fmt.Sprintf("Error moving %s to %s: %s", name, destDir, err.Error()))
+	}
+}
+
+// context returns the context that the watcher's jobs run under.
+func (w *HotFolderWatcher) context() context.Context {
+	if w.ctx == nil {
+		return context.Background()
+	}
+	return w.ctx
+}
+
+// getJobParams returns the job params for an item, with tags from
+// its name and sidecar. It returns an error if the sidecar is invalid,
+// along with params that have only the tags from the name.
+func (w *HotFolderWatcher) getJobParams(name string) (*JobParams, error) {
+	bagName := strings.TrimSuffix(name, filepath.Ext(name))
+	if util.IsDirectory(w.itemPath(name)) {
+		bagName = name
+	}
+	tags := w.tagsFromName(bagName)
+	sidecar := &JobParams{}
+	var sidecarErr error
+	sidecarPath := w.itemPath(name) + HotFolderSidecarSuffix
+	if util.FileExists(sidecarPath) {
+		data, err := os.ReadFile(sidecarPath)
+		if err == nil {
+			err = json.Unmarshal(data, sidecar)
+		}
+		if err != nil {
+			sidecar = &JobParams{}
+			sidecarErr = fmt.Errorf("Error reading sidecar %s: %s", sidecarPath, err.Error())
+		}
+	}
+	if sidecar.PackageName != "" {
+		bagName = sidecar.PackageName
+	}
+	params := NewJobParams(
+		w.Workflow.Copy(),
+		bagName,
+		filepath.Join(w.OutputDir, bagName),
+		[]string{w.itemPath(name)},
+		mergeSidecarTags(tags, sidecar.Tags))
+	params.JobOverrides = sidecar.JobOverrides
+	return params, sidecarErr
+}
+
+// tagsFromName returns the tags encoded in an item's name. See the
+// NameTags and NameSeparator fields of HotFolderWatcher.
+func (w *HotFolderWatcher) tagsFromName(name string) []*Tag {
+	tags := make([]*Tag, 0)
+	if len(w.NameTags) == 0 || w.NameSeparator == "" {
+		return tags
+	}
+	parts := strings.SplitN(name, w.NameSeparator, len(w.NameTags))
+	for i, part := range parts {
+		tagFile := "bag-info.txt"
+		tagName := strings.TrimSpace(w.NameTags[i])
+		if fileAndName := strings.SplitN(tagName, "/", 2); len(fileAndName) == 2 {
+			tagFile, tagName = fileAndName[0], fileAndName[1]
+		}
+		tags = append(tags, NewTag(tagFile, tagName, strings.TrimSpace(part)))
+	}
+	return tags
+}
+
+// mergeSidecarTags returns sidecarTags plus any nameTags that
+// the sidecar doesn't set.
+func mergeSidecarTags(nameTags, sidecarTags []*Tag) []*Tag {
+	tags := make([]*Tag, 0, len(nameTags)+len(sidecarTags))
+	for _, nameTag := range nameTags {
+		overridden := false
+		for _, tag := range sidecarTags {
+			if tag != nil && tag.TagFile == nameTag.TagFile && tag.TagName == nameTag.TagName {
+				overridden = true
+				break
+			}
+		}
+		if !overridden {
+			tags = append(tags, nameTag)
+		}
+	}
+	for _, tag := range sidecarTags {
+		if tag != nil {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// moveItem moves an item, its sidecar and its done marker into destDir,
+// and writes its result JSON there. If destDir already has an item with
+// the same name, we add a timestamp to the name rather than overwrite it.
+func (w *HotFolderWatcher) moveItem(name, destDir, resultJson string) error {
+	destName := name
+	if util.FileExists(filepath.Join(destDir, destName)) {
+		destName = fmt.Sprintf("%s-%s", name, time.Now().UTC().Format("20060102T150405.000000000"))
+	}
+	if err := os.Rename(w.itemPath(name), filepath.Join(destDir, destName)); err != nil {
+		return err
+	}
+	for _, suffix := range []string{HotFolderSidecarSuffix, w.DoneMarker} {
+		if suffix != "" && util.FileExists(w.itemPath(name)+suffix) {
+			if err := os.Rename(w.itemPath(name)+suffix, filepath.Join(destDir, destName+suffix)); err != nil {
+				return err
+			}
+		}
+	}
+	return os.WriteFile(filepath.Join(destDir, destName+HotFolderResultSuffix), []byte(resultJson+"\n"), 0644)
+}
+
+func (w *HotFolderWatcher) itemPath(name string) string {
+	return filepath.Join(w.WatchDir, name)
+}
+
+func (w *HotFolderWatcher) writeStdOut(msg string) {
+	if w.stdOutWriter != nil {
+		fmt.Fprintln(w.stdOutWriter, msg)
+	} else {
+		fmt.Println(msg)
+	}
+}
+
+func (w *HotFolderWatcher) writeStdErr(msg string) {
+	if w.stdErrWriter != nil {
+		fmt.Fprintln(w.stdErrWriter, msg)
+	} else {
+		fmt.Fprintln(os.Stderr, msg)
+	}
+}
@@ -0,0 +1,45 @@
+//go:build linux
+
+package core
+
+import (
+	"os"
+	"syscall"
+)
+
+// hotFolderEventMask describes the inotify events that may mean a new
+// item has arrived in a hot folder, or that an item has changed.
+const hotFolderEventMask = syscall.IN_CREATE | syscall.IN_MOVED_TO | syscall.IN_CLOSE_WRITE |
+	syscall.IN_MODIFY | syscall.IN_ATTRIB | syscall.IN_DELETE | syscall.IN_MOVED_FROM
+
+// watchFolderEvents uses inotify to watch dir. The returned channel
+// receives a value when something in dir changes. We don't care what
+// changed, because the watcher rescans the whole folder. Call the
+// returned function to stop watching.
+func watchFolderEvents(dir string) (<-chan struct{}, func(), error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err = syscall.InotifyAddWatch(fd, dir, hotFolderEventMask); err != nil {
+		syscall.Close(fd)
+		return nil, nil, err
+	}
+	// Since fd is non-blocking, os.File uses the runtime poller,
+	// and closing the file ends the pending Read below.
+	file := os.NewFile(uintptr(fd), "inotify")
+	events := make(chan struct{}, 1)
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			if _, err := file.Read(buf); err != nil {
+				return
+			}
+			select {
+			case events <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return events, func() { file.Close() }, nil
+}
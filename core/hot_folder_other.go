@@ -0,0 +1,11 @@
+//go:build !linux
+
+package core
+
+import "fmt"
+
+// watchFolderEvents returns an error on systems without inotify, and
+// the HotFolderWatcher falls back to polling.
+func watchFolderEvents(dir string) (<-chan struct{}, func(), error) {
+	return nil, nil, fmt.Errorf("folder events are not supported on this system")
+}
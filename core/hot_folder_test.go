@@ -0,0 +1,155 @@
+package core_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/core"
+	"github.com/APTrust/dart-runner/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const hotFolderSidecar = `{"tags": [
+	{"tagFile": "aptrust-info.txt", "tagName": "Description", "value": "Dropped into a hot folder"},
+	{"tagFile": "aptrust-info.txt", "tagName": "Access", "value": "Institution"},
+	{"tagFile": "aptrust-info.txt", "tagName": "Storage-Option", "value": "Standard"}
+]}`
+
+func getHotFolderWatcher(t *testing.T) (*core.HotFolderWatcher, *core.Workflow) {
+	workflow := getPipelineTestWorkflow(t, []*core.StageDefinition{
+		{Type: constants.StagePackage},
+		{Type: constants.StageUpload, StorageService: "Primary"},
+	})
+	data, err := json.Marshal(workflow)
+	require.NoError(t, err)
+	dir := t.TempDir()
+	workflowFile := filepath.Join(dir, "workflow.json")
+	require.NoError(t, os.WriteFile(workflowFile, data, 0644))
+	watchDir := filepath.Join(dir, "watch")
+	outputDir := filepath.Join(dir, "output")
+	require.NoError(t, os.MkdirAll(watchDir, 0755))
+	require.NoError(t, os.MkdirAll(outputDir, 0755))
+
+	watcher, err := core.NewHotFolderWatcher(workflowFile, watchDir, outputDir, false, true)
+	require.NoError(t, err)
+	watcher.QuietPeriod = 0
+	watcher.NameTags = []string{"Source-Organization", "aptrust-info.txt/Title"}
+	watcher.SetStdOut(new(bytes.Buffer))
+	watcher.SetStdErr(new(bytes.Buffer))
+	return watcher, workflow
+}
+
+// dropHotFolderItem writes a directory item into the watch folder,
+// along with an optional sidecar and done marker.
+func dropHotFolderItem(t *testing.T, watcher *core.HotFolderWatcher, name, sidecar string, markDone bool) {
+	itemPath := filepath.Join(watcher.WatchDir, name)
+	writeJournalTestFile(t, itemPath)
+	if sidecar != "" {
+		require.NoError(t, os.WriteFile(itemPath+core.HotFolderSidecarSuffix, []byte(sidecar), 0644))
+	}
+	if markDone {
+		require.NoError(t, os.WriteFile(itemPath+watcher.DoneMarker, nil, 0644))
+	}
+}
+
+func readHotFolderResult(t *testing.T, path string) *core.JobResult {
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	result := &core.JobResult{}
+	require.NoError(t, json.Unmarshal(data, result))
+	return result
+}
+
+func TestHotFolderWatcherScan(t *testing.T) {
+	watcher, workflow := getHotFolderWatcher(t)
+	assert.True(t, util.IsDirectory(watcher.DoneDir))
+	assert.True(t, util.IsDirectory(watcher.FailedDir))
+
+	goodName := "Test University_Cat Photos"
+	dropHotFolderItem(t, watcher, goodName, hotFolderSidecar, true)
+	dropHotFolderItem(t, watcher, "bad", "{not json", true)
+	dropHotFolderItem(t, watcher, "unready", "", false)
+	dropHotFolderItem(t, watcher, ".hidden", "", true)
+
+	count, err := watcher.Scan()
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+	assert.Equal(t, 1, watcher.SuccessCount)
+	assert.Equal(t, 1, watcher.FailureCount)
+
+	// The good item was bagged with tags from its name and sidecar,
+	// and moved to done with its sidecar, marker and result.
+	assert.True(t, util.FileExists(filepath.Join(bucketOf(workflow, "Primary"), goodName+".tar")))
+	for _, suffix := range []string{"", core.HotFolderSidecarSuffix, watcher.DoneMarker} {
+		assert.True(t, util.FileExists(filepath.Join(watcher.DoneDir, goodName+suffix)), suffix)
+		assert.False(t, util.FileExists(filepath.Join(watcher.WatchDir, goodName+suffix)), suffix)
+	}
+	result := readHotFolderResult(t, filepath.Join(watcher.DoneDir, goodName+core.HotFolderResultSuffix))
+	assert.True(t, result.Succeeded)
+
+	// The item with a bad sidecar failed without running.
+	result = readHotFolderResult(t, filepath.Join(watcher.FailedDir, "bad"+core.HotFolderResultSuffix))
+	assert.False(t, result.Succeeded)
+	assert.Contains(t, result.ValidationErrors["Sidecar"], "Error reading sidecar")
+	assert.True(t, util.FileExists(filepath.Join(watcher.FailedDir, "bad")))
+
+	// Items without markers, and hidden items, stay put.
+	assert.True(t, util.FileExists(filepath.Join(watcher.WatchDir, "unready")))
+	assert.True(t, util.FileExists(filepath.Join(watcher.WatchDir, ".hidden")))
+
+	// Once an item has been quiet long enough, it runs.
+	watcher.QuietPeriod = 100 * time.Millisecond
+	count, err = watcher.Scan()
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+	time.Sleep(150 * time.Millisecond)
+	count, err = watcher.Scan()
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+	assert.Equal(t, 2, watcher.SuccessCount)
+	assert.True(t, util.FileExists(filepath.Join(watcher.DoneDir, "unready"+core.HotFolderResultSuffix)))
+
+	// An item with the same name as one already in done doesn't
+	// overwrite it.
+	dropHotFolderItem(t, watcher, goodName, hotFolderSidecar, true)
+	count, err = watcher.Scan()
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+	matches, err := filepath.Glob(filepath.Join(watcher.DoneDir, goodName+"*"+core.HotFolderResultSuffix))
+	require.NoError(t, err)
+	assert.Len(t, matches, 2)
+}
+
+func TestHotFolderWatcherRun(t *testing.T) {
+	watcher, _ := getHotFolderWatcher(t)
+	watcher.PollInterval = 50 * time.Millisecond
+	exitCode := make(chan int)
+	go func() { exitCode <- watcher.Run() }()
+
+	itemName := "Test University_Dog Photos"
+	dropHotFolderItem(t, watcher, itemName, hotFolderSidecar, true)
+	resultFile := filepath.Join(watcher.DoneDir, itemName+core.HotFolderResultSuffix)
+	for i := 0; i < 100 && !util.FileExists(resultFile); i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	watcher.Stop()
+	assert.Equal(t, constants.ExitOK, <-exitCode)
+	assert.True(t, util.FileExists(resultFile))
+	assert.Equal(t, 1, watcher.SuccessCount)
+}
+
+func TestNewHotFolderWatcherErrors(t *testing.T) {
+	dir := t.TempDir()
+	_, err := core.NewHotFolderWatcher("/no/workflow.json", filepath.Join(dir, "missing"), dir, false, false)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "watch directory")
+	_, err = core.NewHotFolderWatcher("/no/workflow.json", dir, filepath.Join(dir, "missing"), false, false)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "output directory")
+}
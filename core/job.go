@@ -45,12 +45,20 @@ type Job struct {
 	Errors            map[string]string          `json:"errors"`
 	PayloadFileCount  int64                      `json:"fileCount"` // still fileCount in JSON for legacy compatibility
 	TotalFileCount    int64                      `json:"totalFileCount"`
+	PrePackageOps     []*PrePackageOperation     `json:"prePackageOps,omitempty"`
 	PackageOp         *PackageOperation          `json:"packageOp"`
 	PostValidationOps []*PostValidationOperation `json:"postValidationOps"`
 	UploadOps         []*UploadOperation         `json:"uploadOps"`
 	ValidationOp      *ValidationOperation       `json:"validationOp"`
 	WorkflowID        string                     `json:"workflowId"`
 	ArtifactsDir      string                     `json:"artifactsDir"`
+	Stages            []*StageDefinition         `json:"stages,omitempty"`
+	StageResults      []*StageResult             `json:"stageResults,omitempty"`
+	Cancelled         bool                       `json:"cancelled,omitempty"`
+
+	// overrideErrors holds problems with the batch overrides this job
+	// was built from. See JobParams.ToJob.
+	overrideErrors map[string]string
 }
 
 // NewJob creates a new Job with a unique ID.
@@ -83,8 +91,13 @@ func JobFromWorkflow(workflow *Workflow) *Job {
 	workflow.resolveStorageServices()
 	job := NewJob()
 	job.WorkflowID = workflow.ID
+	job.PrePackageOps = copyPrePackageOps(workflow.PrePackageOps)
+	job.PostValidationOps = copyPostValidationOps(workflow.PostValidationOps)
 	if workflow.BagItProfile != nil {
 		job.BagItProfile = workflow.BagItProfile
+		if profile, err := workflow.BagItProfile.resolveOrWarn(FindProfile); err == nil {
+			job.BagItProfile = profile
+		}
 		job.PackageOp.PackageFormat = workflow.PackageFormat
 	}
 	for _, ss := range workflow.StorageServices {
@@ -313,6 +326,10 @@ func (job *Job) Validate() bool {
 		}
 	}
 
+	for key, errMsg := range job.overrideErrors {
+		job.Errors["Job.Overrides."+key] = errMsg
+	}
+
 	// UploadOp validation ensures that files exist. They don't yet, so we
 	// don't want to run full validation. Just ensure we have valid storage
 	// service records.
@@ -329,12 +346,54 @@ func (job *Job) Validate() bool {
 			}
 		}
 	}
+	for i, op := range job.PrePackageOps {
+		if !op.Validate() {
+			for key, errMsg := range op.Errors {
+				opKey := strings.Replace(key, "PrePackageOp", fmt.Sprintf("PrePackageOp[%d]", i), 1)
+				job.Errors["Job."+opKey] = errMsg
+			}
+		}
+	}
+	for i, op := range job.PostValidationOps {
+		if !op.Validate() {
+			for key, errMsg := range op.Errors {
+				opKey := strings.Replace(key, "PostValidationOp", fmt.Sprintf("PostValidationOp[%d]", i), 1)
+				job.Errors["Job."+opKey] = errMsg
+			}
+		}
+	}
+	if len(job.Stages) > 0 {
+		storageServices := make([]*StorageService, 0)
+		for _, uploadOp := range job.UploadOps {
+			storageServices = append(storageServices, uploadOp.StorageService)
+		}
+		for key, errMsg := range ValidateStages(job.Stages, storageServices) {
+			job.Errors["Job."+key] = errMsg
+		}
+	}
 	if job.PackageOp == nil && job.ValidationOp == nil && (job.UploadOps == nil || len(job.UploadOps) == 0) {
 		job.Errors["Job"] = "Job has nothing to package, validate, or upload."
 	}
 	return len(job.Errors) == 0
 }
 
+// setTagValue sets the value of a tag in the job's BagIt profile,
+// adding the tag if the profile doesn't define it.
+func (job *Job) setTagValue(tag *Tag) {
+	if job.BagItProfile == nil {
+		return
+	}
+	tagDef := job.BagItProfile.GetTagDef(tag.TagFile, tag.TagName)
+	if tagDef == nil {
+		tagDef = &TagDefinition{
+			TagFile: tag.TagFile,
+			TagName: tag.TagName,
+		}
+		job.BagItProfile.Tags = append(job.BagItProfile.Tags, tagDef)
+	}
+	tagDef.UserValue = tag.Value
+}
+
 // RuntimeErrors returns a list of errors from all of this job's operations.
 func (job *Job) RuntimeErrors() map[string]string {
 	errs := make(map[string]string)
@@ -395,6 +454,16 @@ func (job *Job) HasUploadOps() bool {
 	return len(job.UploadOps) > 0 && job.UploadOps[0] != nil
 }
 
+// secretFields returns pointers to the secrets in this job's
+// upload operations.
+func (job *Job) secretFields() []*string {
+	fields := make([]*string, 0)
+	for _, op := range job.UploadOps {
+		fields = append(fields, op.secretFields()...)
+	}
+	return fields
+}
+
 // PackageFormat returns the name of the format in which this job
 // will package its files. Usually, this will be constants.PackageFormatBagIt,
 // but if the job has no package operation (i.e. an upload-only or validation-only
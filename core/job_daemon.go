@@ -0,0 +1,306 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/APTrust/dart-runner/constants"
+)
+
+// JobDaemon runs the jobs in DART's persistent job queue, with up to
+// Concurrency jobs at a time, until Stop is called. Other processes,
+// such as dart-runner --enqueue, can add jobs to the queue while the
+// daemon runs. See QueuedJob.
+//
+// While a job runs, its worker records a heartbeat every StaleAfter / 4.
+// If the daemon crashes, its running jobs stop sending heartbeats. When
+// a daemon starts, and every StaleAfter while it runs, it requeues jobs
+// whose heartbeats are older than StaleAfter, or fails them if they've
+// already been attempted MaxAttempts times.
+//
+// If Events is not nil, the daemon publishes each running job's
+// progress events there, under the queued job's id.
+//
+// CancelJob stops a running job, which ends in the cancelled state.
+// Shutdown stops all running jobs and puts them back in the queue,
+// so the next daemon runs them again.
+type JobDaemon struct {
+	Events        *EventHub
+	Concurrency   int
+	PollInterval  time.Duration
+	StaleAfter    time.Duration
+	MaxAttempts   int
+	Cleanup       bool
+	SkipArtifacts bool
+	SuccessCount  int
+	FailureCount  int
+	workerPrefix  string
+	stop          chan struct{}
+	stopOnce      sync.Once
+	waitGroup     sync.WaitGroup
+	countMutex    sync.Mutex
+	outMutex      sync.Mutex
+	stdOutWriter  *bytes.Buffer
+	stdErrWriter  *bytes.Buffer
+	ctx           context.Context
+	shutdown      context.CancelFunc
+	runMutex      sync.Mutex
+	running       map[string]context.CancelFunc
+}
+
+// NewJobDaemon creates a daemon that runs up to concurrency jobs at
+// once. Param cleanup describes whether DART should delete the bags
+// it creates after successful upload.
+func NewJobDaemon(concurrency int, cleanup, skipArtifacts bool) (*JobDaemon, error) {
+	if concurrency < 1 {
+		return nil, fmt.Errorf("concurrency must be >= 1")
+	}
+	hostname, _ := os.Hostname()
+	ctx, shutdown := context.WithCancel(context.Background())
+	return &JobDaemon{
+		Concurrency:   concurrency,
+		PollInterval:  5 * time.Second,
+		StaleAfter:    2 * time.Minute,
+		MaxAttempts:   3,
+		Cleanup:       cleanup,
+		SkipArtifacts: skipArtifacts,
+		workerPrefix:  fmt.Sprintf("%s-%d", hostname, os.Getpid()),
+		stop:          make(chan struct{}),
+		ctx:           ctx,
+		shutdown:      shutdown,
+		running:       make(map[string]context.CancelFunc),
+	}, nil
+}
+
+// SetStdOut causes messages to be written to buffer b instead of
+// os.Stdout. See WorkflowRunner.SetStdOut.
+func (d *JobDaemon) SetStdOut(b *bytes.Buffer) {
+	d.stdOutWriter = b
+}
+
+// SetStdErr causes messages to be written to buffer b instead of
+// os.Stderr. See WorkflowRunner.SetStdOut.
+func (d *JobDaemon) SetStdErr(b *bytes.Buffer) {
+	d.stdErrWriter = b
+}
+
+// Run starts the daemon's workers and returns after Stop is called and
+// the workers finish their current jobs. It writes one line of JSON to
+// STDOUT for each job that finishes, describing the job's final state
+// and result.
+func (d *JobDaemon) Run() int {
+	d.recoverStaleJobs()
+	for i := 0; i < d.Concurrency; i++ {
+		d.waitGroup.Add(1)
+		go d.work(fmt.Sprintf("%s-%d", d.workerPrefix, i+1))
+	}
+	ticker := time.NewTicker(d.StaleAfter)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.stop:
+			d.waitGroup.Wait()
+			return constants.ExitOK
+		case <-ticker.C:
+			d.recoverStaleJobs()
+		}
+	}
+}
+
+// RunContext is like Run, but it calls Shutdown when ctx is
+// cancelled, so a signal can stop the daemon without waiting for
+// long-running jobs.
+func (d *JobDaemon) RunContext(ctx context.Context) int {
+	go func() {
+		select {
+		case <-ctx.Done():
+			d.Shutdown()
+		case <-d.stop:
+		}
+	}()
+	return d.Run()
+}
+
+// Stop tells the daemon's workers to quit after their current jobs.
+func (d *JobDaemon) Stop() {
+	d.stopOnce.Do(func() { close(d.stop) })
+}
+
+// Shutdown tells the daemon's workers to quit now. It cancels the
+// jobs they're running and puts them back in the queue.
+func (d *JobDaemon) Shutdown() {
+	d.shutdown()
+	d.Stop()
+}
+
+// CancelJob cancels the job with the specified id if one of this
+// daemon's workers is running it. It returns false if no worker is.
+func (d *JobDaemon) CancelJob(id string) bool {
+	d.runMutex.Lock()
+	defer d.runMutex.Unlock()
+	cancel, ok := d.running[id]
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+// RunNext claims the next job in the queue and runs it. It returns
+// false if the queue is empty.
+func (d *JobDaemon) RunNext() (bool, error) {
+	return d.runNext(d.workerPrefix)
+}
+
+func (d *JobDaemon) work(workerID string) {
+	defer d.waitGroup.Done()
+	for {
+		select {
+		case <-d.stop:
+			return
+		default:
+		}
+		ranJob, err := d.runNext(workerID)
+		if err != nil {
+			d.writeStdErr(fmt.Sprintf("Worker %s: %s", workerID, err.Error()))
+		}
+		if ranJob {
+			continue
+		}
+		select {
+		case <-d.stop:
+			return
+		case <-time.After(d.PollInterval):
+		}
+	}
+}
+
+func (d *JobDaemon) runNext(workerID string) (bool, error) {
+	qj, err := QueuedJobClaimNext(workerID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	stopHeartbeat := d.startHeartbeat(qj.ID, workerID)
+	messageChannel, stopEvents := d.startEvents(qj.ID)
+	ctx, cancel := d.startJob(qj.ID)
+	_, result, runErr := qj.run(ctx, d.Cleanup, d.SkipArtifacts, messageChannel)
+	cancel()
+	stopEvents()
+	stopHeartbeat()
+	if d.ctx.Err() != nil && result != nil && result.Cancelled {
+		err = qj.requeue()
+	} else {
+		err = qj.finish(result, runErr)
+	}
+	if d.Events != nil {
+		d.Events.Close(qj.ID)
+	}
+	d.countMutex.Lock()
+	switch qj.State {
+	case constants.QueueStateSucceeded:
+		d.SuccessCount++
+	case constants.QueueStateFailed:
+		d.FailureCount++
+	}
+	d.countMutex.Unlock()
+	data, _ := json.Marshal(qj)
+	d.writeStdOut(string(data))
+	return true, err
+}
+
+// startJob returns the context for running the job with the specified
+// id, which CancelJob and Shutdown can cancel, and a function to call
+// when the job is done.
+func (d *JobDaemon) startJob(id string) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(d.ctx)
+	d.runMutex.Lock()
+	d.running[id] = cancel
+	d.runMutex.Unlock()
+	return ctx, func() {
+		d.runMutex.Lock()
+		delete(d.running, id)
+		d.runMutex.Unlock()
+		cancel()
+	}
+}
+
+// startHeartbeat records heartbeats for the job with the specified id
+// until the returned function is called.
+func (d *JobDaemon) startHeartbeat(id, workerID string) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(d.StaleAfter / 4)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := QueuedJobHeartbeat(id, workerID); err != nil {
+					Dart.Log.Warningf("Can't record heartbeat for queued job %s: %v", id, err)
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// startEvents returns a channel for the progress events of the job
+// with the specified id, and a function to call when the job is done.
+// Events go to the daemon's EventHub. If the daemon has no EventHub,
+// the channel is nil.
+func (d *JobDaemon) startEvents(id string) (chan *EventMessage, func()) {
+	if d.Events == nil {
+		return nil, func() {}
+	}
+	messageChannel := make(chan *EventMessage, eventHubBufferSize)
+	done := make(chan struct{})
+	go func() {
+		for e := range messageChannel {
+			d.Events.Publish(id, e)
+		}
+		close(done)
+	}()
+	return messageChannel, func() {
+		close(messageChannel)
+		<-done
+	}
+}
+
+func (d *JobDaemon) recoverStaleJobs() {
+	count, err := QueuedJobRecoverStale(time.Now().Add(-d.StaleAfter), d.MaxAttempts)
+	if err != nil {
+		d.writeStdErr(fmt.Sprintf("Error recovering stale jobs: %s", err.Error()))
+	} else if count > 0 {
+		d.writeStdErr(fmt.Sprintf("Recovered %d job(s) whose workers stopped", count))
+	}
+}
+
+// writeStdOut safely writes to STDOUT from concurrent go routines.
+func (d *JobDaemon) writeStdOut(msg string) {
+	d.outMutex.Lock()
+	defer d.outMutex.Unlock()
+	if d.stdOutWriter != nil {
+		fmt.Fprintln(d.stdOutWriter, msg)
+	} else {
+		fmt.Println(msg)
+	}
+}
+
+// writeStdErr safely writes to STDERR from concurrent go routines.
+func (d *JobDaemon) writeStdErr(msg string) {
+	d.outMutex.Lock()
+	defer d.outMutex.Unlock()
+	if d.stdErrWriter != nil {
+		fmt.Fprintln(d.stdErrWriter, msg)
+	} else {
+		fmt.Fprintln(os.Stderr, msg)
+	}
+}
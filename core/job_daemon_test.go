@@ -0,0 +1,135 @@
+package core_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func getTestJobDaemon(t *testing.T, concurrency int) *core.JobDaemon {
+	daemon, err := core.NewJobDaemon(concurrency, false, true)
+	require.NoError(t, err)
+	daemon.SetStdOut(new(bytes.Buffer))
+	daemon.SetStdErr(new(bytes.Buffer))
+	return daemon
+}
+
+func TestNewJobDaemon(t *testing.T) {
+	_, err := core.NewJobDaemon(0, false, false)
+	require.Error(t, err)
+	daemon, err := core.NewJobDaemon(2, true, false)
+	require.NoError(t, err)
+	assert.Equal(t, 2, daemon.Concurrency)
+	assert.Equal(t, 3, daemon.MaxAttempts)
+	assert.True(t, daemon.Cleanup)
+}
+
+func TestJobDaemonRunNext(t *testing.T) {
+	require.NoError(t, core.ClearJobQueueTable())
+	defer core.ClearJobQueueTable()
+
+	goodJob := getQueueTestJob(t, "Primary")
+	good, err := core.JobQueueAdd(goodJob)
+	require.NoError(t, err)
+	bad, err := core.JobQueueAdd(getQueueTestJob(t, "Broken"))
+	require.NoError(t, err)
+	valJob := core.NewValidationJob()
+	valJob.BagItProfileID = constants.ProfileIDAPTrust
+	valJob.PathsToValidate = []string{"/path/does/not/exist.tar"}
+	validation, err := core.JobQueueAdd(valJob)
+	require.NoError(t, err)
+
+	daemon := getTestJobDaemon(t, 1)
+	for i := 0; i < 3; i++ {
+		ranJob, err := daemon.RunNext()
+		require.NoError(t, err)
+		assert.True(t, ranJob)
+	}
+	ranJob, err := daemon.RunNext()
+	require.NoError(t, err)
+	assert.False(t, ranJob)
+	assert.Equal(t, 1, daemon.SuccessCount)
+	assert.Equal(t, 2, daemon.FailureCount)
+
+	good, err = core.QueuedJobFind(good.ID)
+	require.NoError(t, err)
+	assert.Equal(t, constants.QueueStateSucceeded, good.State)
+	assert.False(t, good.FinishedAt.IsZero())
+	require.NotNil(t, good.Result())
+	assert.True(t, good.Result().Succeeded)
+	assert.Equal(t, goodJob.ID, good.Result().JobID)
+
+	for _, id := range []string{bad.ID, validation.ID} {
+		failed, err := core.QueuedJobFind(id)
+		require.NoError(t, err)
+		assert.Equal(t, constants.QueueStateFailed, failed.State)
+		require.NotNil(t, failed.Result())
+		assert.False(t, failed.Result().Succeeded)
+	}
+}
+
+func TestJobDaemonRun(t *testing.T) {
+	require.NoError(t, core.ClearJobQueueTable())
+	defer core.ClearJobQueueTable()
+
+	daemon := getTestJobDaemon(t, 2)
+	daemon.PollInterval = 20 * time.Millisecond
+	exitCode := make(chan int)
+	go func() { exitCode <- daemon.Run() }()
+
+	// Jobs queued while the daemon runs get picked up.
+	ids := make([]string, 3)
+	for i := range ids {
+		qj, err := core.JobQueueAdd(getQueueTestJob(t, "Primary"))
+		require.NoError(t, err)
+		ids[i] = qj.ID
+	}
+	allFinished := func() bool {
+		succeeded, err := core.QueuedJobList(constants.QueueStateSucceeded)
+		require.NoError(t, err)
+		return len(succeeded) == len(ids)
+	}
+	for i := 0; i < 200 && !allFinished(); i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	daemon.Stop()
+	assert.Equal(t, constants.ExitOK, <-exitCode)
+	assert.True(t, allFinished())
+	assert.Equal(t, 3, daemon.SuccessCount)
+}
+
+func TestJobDaemonShutdown(t *testing.T) {
+	require.NoError(t, core.ClearJobQueueTable())
+	defer core.ClearJobQueueTable()
+
+	qj, err := core.JobQueueAdd(getQueueTestJob(t, "Primary"))
+	require.NoError(t, err)
+
+	// Jobs cancelled by a shutdown go back in the queue.
+	daemon := getTestJobDaemon(t, 1)
+	daemon.Shutdown()
+	ranJob, err := daemon.RunNext()
+	require.NoError(t, err)
+	assert.True(t, ranJob)
+	assert.Equal(t, 0, daemon.SuccessCount)
+	assert.Equal(t, 0, daemon.FailureCount)
+
+	qj, err = core.QueuedJobFind(qj.ID)
+	require.NoError(t, err)
+	assert.Equal(t, constants.QueueStateQueued, qj.State)
+	assert.Empty(t, qj.WorkerID)
+	assert.Contains(t, qj.Error, "Requeued")
+
+	// The next daemon picks it up.
+	daemon = getTestJobDaemon(t, 1)
+	ranJob, err = daemon.RunNext()
+	require.NoError(t, err)
+	assert.True(t, ranJob)
+	assert.Equal(t, 1, daemon.SuccessCount)
+	assert.False(t, daemon.CancelJob(qj.ID))
+}
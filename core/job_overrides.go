@@ -0,0 +1,238 @@
+package core
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/profiles"
+	"github.com/APTrust/dart-runner/util"
+)
+
+// JobOverrides describes how one item in a workflow batch differs from
+// the workflow. Any field left empty takes its value from the workflow.
+//
+// In CSV batch files, the overrides come from the optional columns
+// BagIt-Profile, Extra-Files, Serialization and Storage-Services. Columns
+// that take more than one value separate them with semicolons, and may
+// also appear more than once. In JSON Lines and YAML batch files, and in
+// job params, they come from the fields below.
+type JobOverrides struct {
+	// BagItProfileName is the name, ID or BagIt-Profile-Identifier of
+	// the profile to use instead of the workflow's profile.
+	BagItProfileName string `json:"bagItProfile,omitempty"`
+
+	// ExtraFiles are files, directories or glob patterns to bag in
+	// addition to the item's own files.
+	ExtraFiles []string `json:"extraFiles,omitempty"`
+
+	// Serialization is "tar" to produce a tarred bag, or "none" to
+	// produce a bag directory.
+	Serialization string `json:"serialization,omitempty"`
+
+	// StorageServices are the names or IDs of the storage services to
+	// upload to, instead of all of the workflow's storage services.
+	StorageServices []string `json:"storageServices,omitempty"`
+}
+
+// overrideColumns are the CSV columns that override workflow settings.
+var overrideColumns = []string{
+	"BagIt-Profile",
+	"Extra-Files",
+	"Serialization",
+	"Storage-Services",
+}
+
+// isOverrideColumn returns true if header is the name of a CSV
+// column that overrides workflow settings.
+func isOverrideColumn(header string) bool {
+	return util.StringListContains(overrideColumns, header)
+}
+
+// setFromColumn sets the override for the CSV column header.
+func (o *JobOverrides) setFromColumn(header, value string) {
+	switch header {
+	case "BagIt-Profile":
+		o.BagItProfileName = strings.TrimSpace(value)
+	case "Extra-Files":
+		o.ExtraFiles = append(o.ExtraFiles, splitOverrideList(value)...)
+	case "Serialization":
+		o.Serialization = strings.TrimSpace(value)
+	case "Storage-Services":
+		o.StorageServices = append(o.StorageServices, splitOverrideList(value)...)
+	}
+}
+
+func splitOverrideList(value string) []string {
+	values := make([]string, 0)
+	for _, item := range strings.Split(value, ";") {
+		if item = strings.TrimSpace(item); item != "" {
+			values = append(values, item)
+		}
+	}
+	return values
+}
+
+// IsEmpty returns true if these overrides don't change anything.
+func (o *JobOverrides) IsEmpty() bool {
+	return o.BagItProfileName == "" && len(o.ExtraFiles) == 0 && o.Serialization == "" && len(o.StorageServices) == 0
+}
+
+// Validate checks these overrides against workflow, and returns a map
+// of errors keyed by override name. The map is empty if the overrides
+// are valid. It checks that the profile and storage services exist,
+// that the profile allows the serialization, and that the extra files
+// exist and the patterns match at least one file.
+func (o *JobOverrides) Validate(workflow *Workflow) map[string]string {
+	errors := make(map[string]string)
+	profile := workflow.BagItProfile
+	if o.BagItProfileName != "" {
+		profile = findProfileByName(o.BagItProfileName)
+		if profile == nil {
+			errors["BagItProfile"] = fmt.Sprintf("Cannot find a BagIt profile named '%s'.", o.BagItProfileName)
+		}
+	}
+	if _, err := o.expandExtraFiles(); err != nil {
+		errors["ExtraFiles"] = err.Error()
+	}
+	if o.Serialization != "" {
+		if err := o.checkSerialization(workflow, profile); err != nil {
+			errors["Serialization"] = err.Error()
+		}
+	}
+	if _, err := o.resolveStorageServices(workflow); err != nil {
+		errors["StorageServices"] = err.Error()
+	}
+	return errors
+}
+
+// expandExtraFiles returns the paths in ExtraFiles, with glob patterns
+// replaced by the files they match. It returns an error if a path
+// doesn't exist or a pattern matches nothing.
+func (o *JobOverrides) expandExtraFiles() ([]string, error) {
+	files := make([]string, 0)
+	for _, pattern := range o.ExtraFiles {
+		if !strings.ContainsAny(pattern, "*?[") {
+			if !util.FileExists(pattern) {
+				return nil, fmt.Errorf("Extra file '%s' does not exist.", pattern)
+			}
+			files = append(files, pattern)
+			continue
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid pattern '%s': %s", pattern, err.Error())
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("Pattern '%s' does not match any files.", pattern)
+		}
+		files = append(files, matches...)
+	}
+	return files, nil
+}
+
+// serializationIsTar returns true if Serialization asks for a tarred
+// bag, false if it asks for a bag directory, and an error if we don't
+// support the requested format.
+func (o *JobOverrides) serializationIsTar() (bool, error) {
+	switch strings.ToLower(o.Serialization) {
+	case "tar", ".tar", constants.SerialFormatTar, "application/x-tar":
+		return true, nil
+	case "none", "directory", constants.SerialFormatNone:
+		return false, nil
+	default:
+		return false, fmt.Errorf("Serialization '%s' is not supported. Use 'tar' or 'none'.", o.Serialization)
+	}
+}
+
+func (o *JobOverrides) checkSerialization(workflow *Workflow, profile *BagItProfile) error {
+	isTar, err := o.serializationIsTar()
+	if err != nil {
+		return err
+	}
+	if workflow.PackageFormat != constants.PackageFormatBagIt {
+		return fmt.Errorf("Serialization applies only to workflows that create BagIt packages.")
+	}
+	if profile == nil {
+		return nil
+	}
+	if isTar {
+		acceptsTar := util.StringListContains(profile.AcceptSerialization, "application/tar") ||
+			util.StringListContains(profile.AcceptSerialization, "application/x-tar")
+		if profile.Serialization == constants.SerializationForbidden || !acceptsTar {
+			return fmt.Errorf("Profile '%s' does not allow tarred bags.", profile.Name)
+		}
+	} else if profile.Serialization == constants.SerializationRequired {
+		return fmt.Errorf("Profile '%s' requires serialized bags.", profile.Name)
+	}
+	return nil
+}
+
+// resolveStorageServices returns the storage services named in
+// StorageServices, or nil if there's no override. It looks for each
+// service first in the workflow, then in the DART database. In workflow
+// pipelines whose upload stages name their storage services, each
+// override must be one of those services.
+func (o *JobOverrides) resolveStorageServices(workflow *Workflow) ([]*StorageService, error) {
+	if len(o.StorageServices) == 0 {
+		return nil, nil
+	}
+	services := make([]*StorageService, 0, len(o.StorageServices))
+	for _, ref := range o.StorageServices {
+		ss := findStorageServiceByRef(workflow, ref)
+		if ss == nil {
+			return nil, fmt.Errorf("Cannot find a storage service named '%s'.", ref)
+		}
+		if !stagesUpload(workflow.Stages, ss) {
+			return nil, fmt.Errorf("Storage service '%s' is not the target of any upload stage in this workflow.", ref)
+		}
+		services = append(services, ss)
+	}
+	return services, nil
+}
+
+// findStorageServiceByRef returns the storage service whose name or ID
+// is ref, looking in the workflow first, then in the DART database.
+func findStorageServiceByRef(workflow *Workflow, ref string) *StorageService {
+	for _, ss := range workflow.StorageServices {
+		if ss.ID == ref || ss.Name == ref {
+			return ss
+		}
+	}
+	if Dart.DB == nil {
+		return nil
+	}
+	if util.LooksLikeUUID(ref) {
+		result := ObjFind(ref)
+		if result.Error == nil && result.StorageService() != nil {
+			return result.StorageService()
+		}
+	}
+	result := ObjByNameAndType(ref, constants.TypeStorageService)
+	if result.Error == nil {
+		return result.StorageService()
+	}
+	return nil
+}
+
+// findProfileByName returns the BagIt profile whose name is name,
+// looking first in the DART database and then in DART's built-in
+// profiles. If no profile has that name, it falls back to FindProfile,
+// which matches IDs and BagIt-Profile-Identifiers.
+func findProfileByName(name string) *BagItProfile {
+	if Dart.DB != nil {
+		result := ObjByNameAndType(name, constants.TypeBagItProfile)
+		if result.Error == nil && result.BagItProfile() != nil {
+			return result.BagItProfile()
+		}
+	}
+	// Check newer built-in profiles first, since names repeat across versions.
+	for _, profileJson := range []string{profiles.APTrust_V_2_3, profiles.APTrust_V_2_2, profiles.BTR_V_1_0, profiles.Empty_V_1_0} {
+		profile, err := BagItProfileFromJSON(profileJson)
+		if err == nil && profile.Name == name {
+			return profile
+		}
+	}
+	return FindProfile(name)
+}
@@ -0,0 +1,162 @@
+package core_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/APTrust/dart-runner/core"
+	"github.com/APTrust/dart-runner/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeOverrideTestFiles creates a directory with two text files and
+// one log file, and returns the directory's path.
+func writeOverrideTestFiles(t *testing.T) string {
+	dir := t.TempDir()
+	for _, name := range []string{"one.txt", "two.txt", "three.log"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(name), 0644))
+	}
+	return dir
+}
+
+func TestJobParamsWithOverrides(t *testing.T) {
+	workflow := getTestWorkflow(t)
+	extraDir := writeOverrideTestFiles(t)
+	params := core.NewJobParams(workflow, "bag.tar", "/user/homer/bag.tar", getTestFileList(), getTestTags())
+
+	// Without overrides, the job uses the workflow's settings.
+	job := params.ToJob()
+	assert.Equal(t, "Copy of APTrust", job.BagItProfile.Name)
+	assert.Equal(t, "/user/homer/bag.tar", job.PackageOp.OutputPath)
+	assert.Equal(t, getTestFileList(), job.PackageOp.SourceFiles)
+	assert.Len(t, job.UploadOps, 2)
+
+	params.BagItProfileName = "Empty Profile"
+	params.Serialization = "none"
+	params.ExtraFiles = []string{filepath.Join(extraDir, "*.txt"), filepath.Join(extraDir, "three.log")}
+	params.StorageServices = []string{workflow.StorageServices[1].ID}
+	job = params.ToJob()
+	assert.Equal(t, "Copy of Empty Profile", job.BagItProfile.Name)
+	assert.Equal(t, "/user/homer/bag", job.PackageOp.OutputPath)
+	assert.Empty(t, job.PackageOp.BagItSerialization)
+	expectedFiles := append(getTestFileList(),
+		filepath.Join(extraDir, "one.txt"),
+		filepath.Join(extraDir, "two.txt"),
+		filepath.Join(extraDir, "three.log"))
+	assert.Equal(t, expectedFiles, job.PackageOp.SourceFiles)
+	require.Len(t, job.UploadOps, 1)
+	assert.Equal(t, workflow.StorageServices[1].ID, job.UploadOps[0].StorageService.ID)
+	assert.True(t, job.Validate(), job.Errors)
+
+	// Tar serialization works with the empty profile too.
+	params.Serialization = "tar"
+	params.PackageName = "bag"
+	params.OutputPath = "/user/homer/bag"
+	job = params.ToJob()
+	assert.Equal(t, "/user/homer/bag.tar", job.PackageOp.OutputPath)
+	assert.Equal(t, ".tar", job.PackageOp.BagItSerialization)
+}
+
+func TestJobOverridesValidate(t *testing.T) {
+	workflow := getTestWorkflow(t)
+	overrides := &core.JobOverrides{}
+	assert.True(t, overrides.IsEmpty())
+	assert.Empty(t, overrides.Validate(workflow))
+
+	overrides.StorageServices = []string{workflow.StorageServices[0].Name}
+	assert.False(t, overrides.IsEmpty())
+	assert.Empty(t, overrides.Validate(workflow))
+
+	overrides = &core.JobOverrides{
+		BagItProfileName: "No Such Profile",
+		ExtraFiles:       []string{filepath.Join(t.TempDir(), "*.none")},
+		Serialization:    "zip",
+		StorageServices:  []string{"No Such Service"},
+	}
+	errors := overrides.Validate(workflow)
+	assert.Equal(t, "Cannot find a BagIt profile named 'No Such Profile'.", errors["BagItProfile"])
+	assert.Contains(t, errors["ExtraFiles"], "does not match any files")
+	assert.Equal(t, "Serialization 'zip' is not supported. Use 'tar' or 'none'.", errors["Serialization"])
+	assert.Equal(t, "Cannot find a storage service named 'No Such Service'.", errors["StorageServices"])
+
+	// The APTrust profile requires tarred bags.
+	overrides = &core.JobOverrides{
+		ExtraFiles:    []string{"/path/does/not/exist"},
+		Serialization: "none",
+	}
+	errors = overrides.Validate(workflow)
+	assert.Equal(t, "Extra file '/path/does/not/exist' does not exist.", errors["ExtraFiles"])
+	assert.Equal(t, "Profile 'APTrust' requires serialized bags.", errors["Serialization"])
+
+	// Invalid overrides keep the job from running.
+	params := core.NewJobParams(workflow, "bag.tar", "/user/homer/bag.tar", getTestFileList(), getTestTags())
+	params.StorageServices = []string{"No Such Service"}
+	job := params.ToJob()
+	assert.Len(t, job.UploadOps, 2)
+	assert.False(t, job.Validate())
+	assert.Equal(t, "Cannot find a storage service named 'No Such Service'.", job.Errors["Job.Overrides.StorageServices"])
+}
+
+func TestBatchOverrideColumns(t *testing.T) {
+	workflow := loadJsonWorkflow(t)
+	extraDir := writeOverrideTestFiles(t)
+	filesDir := filepath.Join(util.PathToTestData(), "files")
+	dir := t.TempDir()
+	headers := "Bag-Name,Root-Directory,aptrust-info.txt/Title,aptrust-info.txt/Description,aptrust-info.txt/Access,aptrust-info.txt/Storage-Option,bag-info.txt/Source-Organization,Storage-Services,Extra-Files,Extra-Files\n"
+	row := "bag1.tar," + filesDir + ",Title,Description,Institution,Standard,Test University,Local Test Receiving Bucket," +
+		filepath.Join(extraDir, "one.txt") + ";" + filepath.Join(extraDir, "two.txt") + "," + filepath.Join(extraDir, "*.log") + "\n"
+	batchFile := filepath.Join(dir, "batch.csv")
+	require.NoError(t, os.WriteFile(batchFile, []byte(headers+row), 0644))
+
+	// Override columns aren't tags.
+	csvFile, err := core.NewWorkflowCSVFile(batchFile)
+	require.NoError(t, err)
+	entry, err := csvFile.ReadNext()
+	csvFile.Close()
+	require.NoError(t, err)
+	assert.Len(t, entry.Tags, 5)
+	assert.Equal(t, []string{"Local Test Receiving Bucket"}, entry.Overrides.StorageServices)
+	assert.Equal(t, []string{filepath.Join(extraDir, "one.txt"), filepath.Join(extraDir, "two.txt"), filepath.Join(extraDir, "*.log")}, entry.Overrides.ExtraFiles)
+
+	parser := core.NewCSVBatchParser(batchFile, workflow)
+	jobParamsList, err := parser.ParseAll("/tmp/out")
+	require.NoError(t, err)
+	require.Len(t, jobParamsList, 1)
+	assert.Equal(t, entry.Overrides, jobParamsList[0].JobOverrides)
+	for _, tag := range jobParamsList[0].Tags {
+		assert.NotEqual(t, "Storage-Services", tag.TagName)
+		assert.NotEqual(t, "Extra-Files", tag.TagName)
+	}
+
+	wb := core.NewWorkflowBatch(workflow, batchFile)
+	assert.True(t, wb.Validate(), wb.Errors)
+
+	// WorkflowBatch catches bad overrides before the batch runs.
+	badRow := strings.Replace(row, "Local Test Receiving Bucket", "No Such Service", 1)
+	badRow = strings.Replace(badRow, "*.log", "*.none", 1)
+	require.NoError(t, os.WriteFile(batchFile, []byte(headers+row+badRow), 0644))
+	assert.False(t, wb.Validate())
+	assert.Len(t, wb.Errors, 2)
+	assert.Equal(t, "Line 2: Cannot find a storage service named 'No Such Service'.", wb.Errors["2-StorageServices"])
+	assert.Contains(t, wb.Errors["2-ExtraFiles"], "Line 2: Pattern")
+
+	// JSON Lines items use the same overrides, by field name. The empty
+	// profile doesn't require the APTrust tags.
+	batchFile = filepath.Join(dir, "batch.jsonl")
+	item := `{"packageName": "bag2", "files": ["` + filesDir + `"], "tags": [], "bagItProfile": "Empty Profile", "serialization": "none", "storageServices": ["Local Test Receiving Bucket"]}`
+	require.NoError(t, os.WriteFile(batchFile, []byte(item+"\n"), 0644))
+	wb = core.NewWorkflowBatch(workflow, batchFile)
+	assert.True(t, wb.Validate(), wb.Errors)
+	parser = core.NewCSVBatchParser(batchFile, workflow)
+	jobParamsList, err = parser.ParseAll("/tmp/out")
+	require.NoError(t, err)
+	require.Len(t, jobParamsList, 1)
+	assert.Equal(t, "Empty Profile", jobParamsList[0].BagItProfileName)
+	assert.Equal(t, "none", jobParamsList[0].Serialization)
+	job := jobParamsList[0].ToJob()
+	assert.Equal(t, "Copy of Empty Profile", job.BagItProfile.Name)
+	assert.Equal(t, filepath.Join("/tmp/out", "bag2"), job.PackageOp.OutputPath)
+}
@@ -14,6 +14,10 @@ import (
 // by describing what needs to be done (the workflow), what set of
 // files we're operating on (the files) and where we'll store a
 // local copy of the result (the output path).
+//
+// The embedded JobOverrides let a single item in a batch use a
+// different profile, serialization or set of storage services than
+// the rest of the workflow, or bag extra files.
 type JobParams struct {
 	Errors      map[string]string `json:"errors"`
 	Files       []string          `json:"files"`
@@ -21,6 +25,7 @@ type JobParams struct {
 	OutputPath  string            `json:"outputPath"`
 	Tags        []*Tag            `json:"tags"`
 	Workflow    *Workflow         `json:"workflow"`
+	JobOverrides
 }
 
 // NewJobParams creates a new JobParams object.
@@ -42,12 +47,47 @@ func NewJobParams(workflow *Workflow, packageName, outputPath string, files []st
 
 // ToJob converts a JobParams object to a Job object, which can be run
 // directly by the JobRunner.
+//
+// If the overrides are invalid, the job records the errors, and won't
+// pass validation.
 func (p *JobParams) ToJob() *Job {
 	job := NewJob()
-	job.BagItProfile = BagItProfileClone(p.Workflow.BagItProfile)
+	job.overrideErrors = p.JobOverrides.Validate(p.Workflow)
+	baseProfile := p.Workflow.BagItProfile
+	if p.BagItProfileName != "" && job.overrideErrors["BagItProfile"] == "" {
+		baseProfile = findProfileByName(p.BagItProfileName)
+	}
+	// Resolve inherited settings before merging tag values, so values
+	// land on the effective tag definitions.
+	profile, err := baseProfile.resolveOrWarn(FindProfile)
+	if err != nil {
+		if p.Errors == nil {
+			p.Errors = make(map[string]string)
+		}
+		p.Errors["BagItProfile"] = err.Error()
+		profile = baseProfile
+	}
+	job.BagItProfile = BagItProfileClone(profile)
 	job.WorkflowID = p.Workflow.ID
-	p.makePackageOp(job)
-	p.makeValidationOp(job)
+	job.Stages = p.Workflow.Stages
+	// Pipelines that skip packaging or validation get no
+	// operations for those stages.
+	if stagesInclude(job.Stages, constants.StagePrePackage) {
+		job.PrePackageOps = copyPrePackageOps(p.Workflow.PrePackageOps)
+	}
+	if stagesInclude(job.Stages, constants.StagePackage) {
+		p.makePackageOp(job)
+	} else {
+		job.PackageOp = nil
+	}
+	if stagesInclude(job.Stages, constants.StageValidation) {
+		p.makeValidationOp(job)
+	} else {
+		job.ValidationOp = nil
+	}
+	if stagesInclude(job.Stages, constants.StagePostValidation) {
+		job.PostValidationOps = copyPostValidationOps(p.Workflow.PostValidationOps)
+	}
 	p.makeUploadOps(job)
 	p.mergeTags(job)
 	return job
@@ -74,7 +114,7 @@ func (p *JobParams) ToJob() *Job {
 // If the profile requires tags that are missing from the CSV file,
 // the bagger will complain and quit.
 func (p *JobParams) mergeTags(job *Job) {
-	if p.Workflow.BagItProfile == nil {
+	if job.BagItProfile == nil {
 		return
 	}
 	alreadyMatched := make(map[string]bool)
@@ -104,7 +144,7 @@ func (p *JobParams) mergeTags(job *Job) {
 // to S3/SFTP.
 func (p *JobParams) makePackageOp(job *Job) {
 	if p.PackageName != "" {
-		job.PackageOp = NewPackageOperation(p.PackageName, p.OutputPath, p.Files)
+		job.PackageOp = NewPackageOperation(p.PackageName, p.OutputPath, p.sourceFiles())
 		job.PackageOp.PackageFormat = p.Workflow.PackageFormat
 		p.setSerialization(job)
 	}
@@ -113,7 +153,7 @@ func (p *JobParams) makePackageOp(job *Job) {
 // makeValidationOp creates a ValidationOperation if the job is packaging
 // something and includes a BagIt profile.
 func (p *JobParams) makeValidationOp(job *Job) {
-	if p.PackageName != "" && p.Workflow.BagItProfile != nil {
+	if p.PackageName != "" && job.BagItProfile != nil {
 		pathToBag := filepath.Join(p.OutputPath, p.PackageName)
 		if job.PackageOp != nil {
 			pathToBag = job.PackageOp.OutputPath
@@ -126,7 +166,11 @@ func (p *JobParams) makeValidationOp(job *Job) {
 // upload files to 0..N targets. A common case is to create a bag and
 // send it off to an S3 bucket in AWS and a second bucket in Wasabi.
 func (p *JobParams) makeUploadOps(job *Job) {
-	if len(p.Workflow.StorageServices) == 0 {
+	storageServices := p.Workflow.StorageServices
+	if overrides, err := p.resolveStorageServices(p.Workflow); err == nil && overrides != nil {
+		storageServices = overrides
+	}
+	if len(storageServices) == 0 {
 		// No storage services specified, so no uploads to perform.
 		return
 	}
@@ -136,9 +180,14 @@ func (p *JobParams) makeUploadOps(job *Job) {
 		files = []string{job.PackageOp.OutputPath}
 	} else {
 		// No packaging step. We want to upload the files themselves.
-		files = p.Files
+		files = p.sourceFiles()
 	}
-	for _, ss := range p.Workflow.StorageServices {
+	for _, ss := range storageServices {
+		// Workflows with their own pipelines upload only
+		// to the services their upload stages name.
+		if !stagesUpload(job.Stages, ss) {
+			continue
+		}
 		job.UploadOps = append(job.UploadOps, NewUploadOperation(ss, files))
 	}
 }
@@ -154,6 +203,10 @@ func (p *JobParams) setSerialization(job *Job) {
 	if job.PackageOp == nil || job.BagItProfile == nil {
 		return
 	}
+	if p.Serialization != "" {
+		p.overrideSerialization(job)
+		return
+	}
 	profile := job.BagItProfile
 	formats := profile.AcceptSerialization
 	serializationOK := (profile.Serialization == constants.SerializationRequired || profile.Serialization == constants.SerializationOptional)
@@ -166,3 +219,31 @@ func (p *JobParams) setSerialization(job *Job) {
 		}
 	}
 }
+
+// overrideSerialization sets the serialization format the user chose
+// for this item, which we've already checked against the profile.
+func (p *JobParams) overrideSerialization(job *Job) {
+	isTar, err := p.serializationIsTar()
+	if err != nil {
+		return
+	}
+	if isTar {
+		job.PackageOp.BagItSerialization = ".tar"
+		if !strings.HasSuffix(job.PackageOp.OutputPath, ".tar") {
+			job.PackageOp.OutputPath += ".tar"
+		}
+	} else {
+		job.PackageOp.BagItSerialization = ""
+		job.PackageOp.OutputPath = strings.TrimSuffix(job.PackageOp.OutputPath, ".tar")
+	}
+}
+
+// sourceFiles returns the files to package or upload, including
+// any extra files from the overrides.
+func (p *JobParams) sourceFiles() []string {
+	extraFiles, err := p.expandExtraFiles()
+	if err != nil || len(extraFiles) == 0 {
+		return p.Files
+	}
+	return append(append(make([]string, 0, len(p.Files)+len(extraFiles)), p.Files...), extraFiles...)
+}
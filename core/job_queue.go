@@ -0,0 +1,227 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/google/uuid"
+)
+
+// QueuedJob is a Job, UploadJob or ValidationJob waiting in, or taken
+// from, DART's persistent job queue. Jobs move from queued to running,
+// and then to succeeded or failed. Queued jobs may be cancelled. See
+// JobDaemon for the workers that run queued jobs.
+//
+// The queue keeps its own copy of each job's JSON, with secrets
+// encrypted as in the dart table, so the same bag can be queued
+// more than once.
+type QueuedJob struct {
+	ID          string          `json:"id"`
+	JobType     string          `json:"jobType"`
+	JobName     string          `json:"jobName"`
+	State       string          `json:"state"`
+	Attempts    int             `json:"attempts"`
+	WorkerID    string          `json:"workerId,omitempty"`
+	ResultJson  json.RawMessage `json:"result,omitempty"`
+	Error       string          `json:"error,omitempty"`
+	EnqueuedAt  time.Time       `json:"enqueuedAt"`
+	StartedAt   time.Time       `json:"startedAt"`
+	FinishedAt  time.Time       `json:"finishedAt"`
+	HeartbeatAt time.Time       `json:"heartbeatAt"`
+	jobJson     string
+}
+
+// NewQueuedJob returns a QueuedJob for obj, which must be a Job,
+// UploadJob or ValidationJob. This does not add the job to the queue.
+// See JobQueueAdd.
+func NewQueuedJob(obj PersistentObject) (*QueuedJob, error) {
+	switch obj.(type) {
+	case *Job, *UploadJob, *ValidationJob:
+	default:
+		return nil, fmt.Errorf("cannot queue objects of type %s", obj.ObjType())
+	}
+	// Encrypt secrets only for the duration of json.Marshal, as
+	// objSave does.
+	restoreSecrets, err := encryptSecrets(obj)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(obj)
+	restoreSecrets()
+	if err != nil {
+		return nil, err
+	}
+	return &QueuedJob{
+		ID:         uuid.NewString(),
+		JobType:    obj.ObjType(),
+		JobName:    obj.ObjName(),
+		State:      constants.QueueStateQueued,
+		EnqueuedAt: time.Now().UTC(),
+		jobJson:    string(data),
+	}, nil
+}
+
+// JobQueueAdd validates obj, which must be a Job, UploadJob or
+// ValidationJob, and adds it to the end of the job queue. If obj is
+// invalid, this returns constants.ErrObjecValidation, and obj.GetErrors()
+// describes the problems.
+func JobQueueAdd(obj PersistentObject) (*QueuedJob, error) {
+	if !obj.Validate() {
+		return nil, constants.ErrObjecValidation
+	}
+	qj, err := NewQueuedJob(obj)
+	if err != nil {
+		return nil, err
+	}
+	return qj, QueuedJobSave(qj)
+}
+
+// Object returns the Job, UploadJob or ValidationJob in this queue
+// entry, with its secrets decrypted.
+func (qj *QueuedJob) Object() (PersistentObject, error) {
+	qr := queryResultFromJson(qj.JobType, qj.jobJson)
+	if qr.Error == nil {
+		qr.Error = decryptQueryResult(qr)
+	}
+	if qr.Error != nil {
+		return nil, qr.Error
+	}
+	return qr.persistentObjects()[0], nil
+}
+
+// Result returns the result of running this job, or nil if
+// the job hasn't finished.
+func (qj *QueuedJob) Result() *JobResult {
+	if len(qj.ResultJson) == 0 {
+		return nil
+	}
+	result := &JobResult{}
+	if err := json.Unmarshal(qj.ResultJson, result); err != nil {
+		return nil
+	}
+	return result
+}
+
+// run runs the job and returns its exit code and result. Jobs created
+// by bagging workflows clean up and save artifacts as the cleanup and
+// skipArtifacts params say. Upload and validation jobs ignore them.
+//
+// If messageChannel is not nil, the job sends its progress events
+// there, and bagging jobs always save their artifacts, as they do
+// in DART's GUI. If ctx is cancelled, the job stops and its result
+// says it was cancelled.
+func (qj *QueuedJob) run(ctx context.Context, cleanup, skipArtifacts bool, messageChannel chan *EventMessage) (int, *JobResult, error) {
+	obj, err := qj.Object()
+	if err != nil {
+		return constants.ExitRuntimeErr, nil, err
+	}
+	var exitCode int
+	var result *JobResult
+	switch job := obj.(type) {
+	case *Job:
+		if messageChannel != nil {
+			exitCode = RunJobWithMessageChannelContext(ctx, job, cleanup, messageChannel)
+		} else {
+			exitCode = RunJobContext(ctx, job, cleanup, skipArtifacts, false)
+		}
+		result = NewJobResult(job)
+	case *UploadJob:
+		exitCode = job.RunContext(ctx, messageChannel)
+		result = NewJobResultFromUploadJob(job)
+	case *ValidationJob:
+		exitCode = job.RunContext(ctx, messageChannel)
+		result = NewJobResultFromValidationJob(job)
+	default:
+		return constants.ExitRuntimeErr, nil, fmt.Errorf("cannot run queued object of type %s", qj.JobType)
+	}
+	result.Succeeded = exitCode == constants.ExitOK
+	result.Cancelled = exitCode == constants.ExitCancelled
+	return exitCode, result, nil
+}
+
+// finish records the outcome of running this job.
+func (qj *QueuedJob) finish(result *JobResult, err error) error {
+	qj.State = constants.QueueStateSucceeded
+	qj.FinishedAt = time.Now().UTC()
+	if result != nil {
+		resultJson, _ := result.ToJson()
+		qj.ResultJson = json.RawMessage(resultJson)
+	}
+	if err != nil {
+		qj.State = constants.QueueStateFailed
+		qj.Error = err.Error()
+	} else if result != nil && result.Cancelled {
+		qj.State = constants.QueueStateCancelled
+		qj.Error = "Job was cancelled while running."
+	} else if result == nil || !result.Succeeded {
+		qj.State = constants.QueueStateFailed
+		qj.Error = "Job failed. See result for details."
+	}
+	return QueuedJobSave(qj)
+}
+
+// requeue puts a job that was interrupted by a daemon shutdown back
+// in the queue, so the next daemon runs it again.
+func (qj *QueuedJob) requeue() error {
+	qj.State = constants.QueueStateQueued
+	qj.WorkerID = ""
+	qj.Error = "Daemon shut down while running this job. Requeued."
+	return QueuedJobSave(qj)
+}
+
+// JobQueueAddBatch adds a job to the queue for each item in the batch
+// file at pathToBatchFile, running it through workflow and writing its
+// bag to outputDir. It checks all of the jobs before adding any of them.
+// If any job is invalid, this returns an error describing the problems,
+// and adds nothing to the queue.
+func JobQueueAddBatch(workflow *Workflow, pathToBatchFile, outputDir string) ([]*QueuedJob, error) {
+	batch, err := NewBatchSource(pathToBatchFile)
+	if err != nil {
+		return nil, err
+	}
+	defer batch.Close()
+	jobs := make([]*Job, 0)
+	problems := make([]string, 0)
+	for itemNumber := 1; ; itemNumber++ {
+		entry, err := batch.ReadNext()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		params := NewJobParams(workflow.Copy(), entry.BagName, filepath.Join(outputDir, entry.BagName), entry.SourceFiles(), entry.Tags)
+		params.JobOverrides = entry.Overrides
+		job := params.ToJob()
+		if !job.Validate() {
+			keys := make([]string, 0, len(job.Errors))
+			for key := range job.Errors {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				problems = append(problems, fmt.Sprintf("Item %d (%s): %s: %s", itemNumber, entry.BagName, key, job.Errors[key]))
+			}
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("%s", strings.Join(problems, "\n"))
+	}
+	queuedJobs := make([]*QueuedJob, 0, len(jobs))
+	for _, job := range jobs {
+		qj, err := JobQueueAdd(job)
+		if err != nil {
+			return queuedJobs, err
+		}
+		queuedJobs = append(queuedJobs, qj)
+	}
+	return queuedJobs, nil
+}
@@ -0,0 +1,192 @@
+package core_test
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func getQueueTestJob(t *testing.T, uploadTo string) *core.Job {
+	workflow := getPipelineTestWorkflow(t, []*core.StageDefinition{
+		{Type: constants.StagePackage},
+		{Type: constants.StageUpload, StorageService: uploadTo},
+	})
+	return getPipelineTestJob(t, workflow)
+}
+
+func TestJobQueueAdd(t *testing.T) {
+	require.NoError(t, core.ClearJobQueueTable())
+	defer core.ClearJobQueueTable()
+
+	job := getQueueTestJob(t, "Primary")
+	qj, err := core.JobQueueAdd(job)
+	require.NoError(t, err)
+	assert.Equal(t, constants.QueueStateQueued, qj.State)
+	assert.Equal(t, constants.TypeJob, qj.JobType)
+	assert.Equal(t, "pipeline_test_bag", qj.JobName)
+	assert.Nil(t, qj.Result())
+
+	found, err := core.QueuedJobFind(qj.ID)
+	require.NoError(t, err)
+	assert.Equal(t, constants.QueueStateQueued, found.State)
+	assert.True(t, found.StartedAt.IsZero())
+	obj, err := found.Object()
+	require.NoError(t, err)
+	require.IsType(t, &core.Job{}, obj)
+	assert.Equal(t, job.ID, obj.ObjID())
+	assert.Equal(t, job.PackageOp.OutputPath, obj.(*core.Job).PackageOp.OutputPath)
+
+	// The same job can be queued twice.
+	_, err = core.JobQueueAdd(job)
+	require.NoError(t, err)
+	queued, err := core.QueuedJobList(constants.QueueStateQueued)
+	require.NoError(t, err)
+	assert.Len(t, queued, 2)
+
+	// Upload and validation jobs can be queued too.
+	valJob := core.NewValidationJob()
+	valJob.BagItProfileID = constants.ProfileIDAPTrust
+	valJob.PathsToValidate = []string{"/path/to/bag.tar"}
+	qj, err = core.JobQueueAdd(valJob)
+	require.NoError(t, err)
+	obj, err = qj.Object()
+	require.NoError(t, err)
+	require.IsType(t, &core.ValidationJob{}, obj)
+	assert.Equal(t, valJob.PathsToValidate, obj.(*core.ValidationJob).PathsToValidate)
+
+	// Invalid jobs and other kinds of objects can't.
+	_, err = core.JobQueueAdd(core.NewValidationJob())
+	assert.Equal(t, constants.ErrObjecValidation, err)
+	_, err = core.NewQueuedJob(core.NewAppSetting("Name", "Value"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "cannot queue objects of type AppSetting")
+}
+
+func TestQueuedJobClaimAndCancel(t *testing.T) {
+	require.NoError(t, core.ClearJobQueueTable())
+	defer core.ClearJobQueueTable()
+
+	ids := make([]string, 3)
+	for i := range ids {
+		qj, err := core.JobQueueAdd(getQueueTestJob(t, "Primary"))
+		require.NoError(t, err)
+		ids[i] = qj.ID
+	}
+	require.NoError(t, core.QueuedJobCancel(ids[1]))
+
+	// Workers get jobs in the order they were queued,
+	// skipping cancelled jobs.
+	qj, err := core.QueuedJobClaimNext("worker-1")
+	require.NoError(t, err)
+	assert.Equal(t, ids[0], qj.ID)
+	assert.Equal(t, constants.QueueStateRunning, qj.State)
+	assert.Equal(t, "worker-1", qj.WorkerID)
+	assert.Equal(t, 1, qj.Attempts)
+	assert.False(t, qj.StartedAt.IsZero())
+	assert.False(t, qj.HeartbeatAt.IsZero())
+
+	err = core.QueuedJobCancel(ids[0])
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "is running and cannot be cancelled")
+
+	qj, err = core.QueuedJobClaimNext("worker-2")
+	require.NoError(t, err)
+	assert.Equal(t, ids[2], qj.ID)
+	_, err = core.QueuedJobClaimNext("worker-1")
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	cancelled, err := core.QueuedJobFind(ids[1])
+	require.NoError(t, err)
+	assert.Equal(t, constants.QueueStateCancelled, cancelled.State)
+	assert.False(t, cancelled.FinishedAt.IsZero())
+	assert.Equal(t, sql.ErrNoRows, core.QueuedJobCancel("no-such-job"))
+
+	all, err := core.QueuedJobList("")
+	require.NoError(t, err)
+	assert.Len(t, all, 3)
+}
+
+func TestQueuedJobRecoverStale(t *testing.T) {
+	require.NoError(t, core.ClearJobQueueTable())
+	defer core.ClearJobQueueTable()
+
+	for i := 0; i < 2; i++ {
+		_, err := core.JobQueueAdd(getQueueTestJob(t, "Primary"))
+		require.NoError(t, err)
+	}
+	stale, err := core.QueuedJobClaimNext("crashed-worker")
+	require.NoError(t, err)
+	live, err := core.QueuedJobClaimNext("live-worker")
+	require.NoError(t, err)
+	stale.HeartbeatAt = time.Now().Add(-10 * time.Minute)
+	require.NoError(t, core.QueuedJobSave(stale))
+	require.NoError(t, core.QueuedJobHeartbeat(live.ID, live.WorkerID))
+
+	// The crashed worker's job goes back into the queue.
+	count, err := core.QueuedJobRecoverStale(time.Now().Add(-time.Minute), 2)
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+	recovered, err := core.QueuedJobFind(stale.ID)
+	require.NoError(t, err)
+	assert.Equal(t, constants.QueueStateQueued, recovered.State)
+	assert.Contains(t, recovered.Error, "Requeued")
+	live, err = core.QueuedJobFind(live.ID)
+	require.NoError(t, err)
+	assert.Equal(t, constants.QueueStateRunning, live.State)
+
+	// After too many attempts, it fails.
+	stale, err = core.QueuedJobClaimNext("crashed-worker")
+	require.NoError(t, err)
+	assert.Equal(t, 2, stale.Attempts)
+	stale.HeartbeatAt = time.Now().Add(-10 * time.Minute)
+	require.NoError(t, core.QueuedJobSave(stale))
+	count, err = core.QueuedJobRecoverStale(time.Now().Add(-time.Minute), 2)
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+	failed, err := core.QueuedJobFind(stale.ID)
+	require.NoError(t, err)
+	assert.Equal(t, constants.QueueStateFailed, failed.State)
+	assert.Contains(t, failed.Error, "Giving up after 2 attempts")
+}
+
+func TestJobQueueAddBatch(t *testing.T) {
+	require.NoError(t, core.ClearJobQueueTable())
+	defer core.ClearJobQueueTable()
+
+	workflow := getPipelineTestWorkflow(t, []*core.StageDefinition{
+		{Type: constants.StagePackage},
+		{Type: constants.StageUpload, StorageService: "Primary"},
+	})
+	dir := t.TempDir()
+	goodDir := filepath.Join(dir, "good")
+	writeJournalTestFile(t, goodDir)
+	batchFile := filepath.Join(dir, "batch.csv")
+	rows := []string{journalTestHeaders, journalTestRow("QueueOne", goodDir), journalTestRow("QueueTwo", goodDir)}
+	require.NoError(t, os.WriteFile(batchFile, []byte(strings.Join(rows, "\n")+"\n"), 0644))
+
+	queuedJobs, err := core.JobQueueAddBatch(workflow, batchFile, dir)
+	require.NoError(t, err)
+	require.Len(t, queuedJobs, 2)
+	assert.Equal(t, "QueueOne", queuedJobs[0].JobName)
+	assert.Equal(t, "QueueTwo", queuedJobs[1].JobName)
+
+	// If any item is invalid, nothing is queued.
+	require.NoError(t, core.ClearJobQueueTable())
+	rows = append(rows, journalTestRow("QueueBad", filepath.Join(dir, "does-not-exist")))
+	require.NoError(t, os.WriteFile(batchFile, []byte(strings.Join(rows, "\n")+"\n"), 0644))
+	queuedJobs, err = core.JobQueueAddBatch(workflow, batchFile, dir)
+	require.Error(t, err)
+	assert.Nil(t, queuedJobs)
+	assert.Contains(t, err.Error(), "Item 3 (QueueBad)")
+	all, err := core.QueuedJobList("")
+	require.NoError(t, err)
+	assert.Empty(t, all)
+}
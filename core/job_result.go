@@ -2,6 +2,8 @@ package core
 
 import (
 	"encoding/json"
+
+	"github.com/APTrust/dart-runner/constants"
 )
 
 // JobResult collects the results of an attempted job for
@@ -12,9 +14,13 @@ type JobResult struct {
 	PayloadByteCount  int64              `json:"payloadByteCount"`
 	PayloadFileCount  int64              `json:"payloadFileCount"`
 	Succeeded         bool               `json:"succeeded"`
+	Cancelled         bool               `json:"cancelled,omitempty"`
+	PrePackageResults []*OperationResult `json:"prePackageResults,omitempty"`
 	PackageResult     *OperationResult   `json:"packageResult"`
 	ValidationResults []*OperationResult `json:"validationResults"`
 	UploadResults     []*OperationResult `json:"uploadResults"`
+	DownloadResults   []*OperationResult `json:"downloadResults,omitempty"`
+	StageResults      []*StageResult     `json:"stageResults,omitempty"`
 	ValidationErrors  map[string]string  `json:"validationErrors"`
 }
 
@@ -32,6 +38,12 @@ func NewJobResult(job *Job) *JobResult {
 		ValidationResults: make([]*OperationResult, 0),
 		UploadResults:     make([]*OperationResult, 0),
 	}
+	for _, op := range job.PrePackageOps {
+		jobResult.PrePackageResults = append(jobResult.PrePackageResults, op.Result)
+		if op.Result.WasAttempted() && !op.Result.Succeeded() {
+			jobResult.Succeeded = false
+		}
+	}
 	if job.PackageOp != nil && job.PackageOp.Result != nil {
 		jobResult.PackageResult = job.PackageOp.Result
 		if !job.PackageOp.Result.Succeeded() {
@@ -52,6 +64,22 @@ func NewJobResult(job *Job) *JobResult {
 			}
 		}
 	}
+	// Jobs with their own pipelines may skip stages on purpose, so
+	// unattempted operations don't mean failure. The stage results
+	// tell us what happened.
+	if len(job.StageResults) > 0 {
+		jobResult.StageResults = job.StageResults
+		jobResult.Succeeded = len(job.Errors) == 0
+		for _, stageResult := range job.StageResults {
+			if stageResult.Status == constants.StatusFailed {
+				jobResult.Succeeded = false
+			}
+		}
+	}
+	if job.Cancelled {
+		jobResult.Cancelled = true
+		jobResult.Succeeded = false
+	}
 	// Do we want this if statement here or not?
 	//if len(job.Errors) > 0 && !job.PackageAttempted() && !job.ValidationAttempted() && !job.UploadAttempted() {
 	jobResult.ValidationErrors = job.Errors
@@ -97,6 +125,30 @@ func NewJobResultFromUploadJob(uploadJob *UploadJob) *JobResult {
 	return jobResult
 }
 
+// NewJobResultFromDownload creates a new JobResult describing the
+// download of a single item in a DownloadJob, along with its validation
+// if the job validated it. Param validationOp may be nil.
+func NewJobResultFromDownload(downloadJob *DownloadJob, downloadOp *DownloadOperation, validationOp *ValidationOperation) *JobResult {
+	jobResult := &JobResult{
+		JobID:             downloadJob.ID,
+		JobName:           downloadOp.Item,
+		PayloadByteCount:  downloadOp.Result.BytesDownloaded,
+		PayloadFileCount:  downloadOp.Result.FilesDownloaded,
+		Succeeded:         downloadOp.Result.Succeeded(),
+		ValidationResults: make([]*OperationResult, 0),
+		UploadResults:     make([]*OperationResult, 0),
+		DownloadResults:   []*OperationResult{downloadOp.Result},
+		ValidationErrors:  downloadJob.Errors,
+	}
+	if validationOp != nil {
+		jobResult.ValidationResults = append(jobResult.ValidationResults, validationOp.Result)
+		if !validationOp.Result.Succeeded() {
+			jobResult.Succeeded = false
+		}
+	}
+	return jobResult
+}
+
 // ToJson returns a JSON string describing the results of this
 // job's operations.
 func (r *JobResult) ToJson() (string, error) {
@@ -1,6 +1,7 @@
 package core
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -14,6 +15,8 @@ import (
 type Runner struct {
 	Job            *Job
 	MessageChannel chan *EventMessage
+	sidecars       []string
+	ctx            context.Context
 }
 
 // RunJobWithMessageChannel runs a job and pumps progress details
@@ -22,9 +25,17 @@ type Runner struct {
 // means success and non-zero is failure. See the exit codes defined
 // in constants for more info.
 func RunJobWithMessageChannel(job *Job, deleteOnSuccess bool, messageChannel chan *EventMessage) int {
+	return RunJobWithMessageChannelContext(context.Background(), job, deleteOnSuccess, messageChannel)
+}
+
+// RunJobWithMessageChannelContext is like RunJobWithMessageChannel,
+// but it stops the job if ctx is cancelled. A cancelled job returns
+// constants.ExitCancelled.
+func RunJobWithMessageChannelContext(ctx context.Context, job *Job, deleteOnSuccess bool, messageChannel chan *EventMessage) int {
 	runner := &Runner{
 		Job:            job,
 		MessageChannel: messageChannel,
+		ctx:            ctx,
 	}
 	if !runner.ValidateJob() {
 		runner.writeExitMessagesAndSaveResults()
@@ -32,30 +43,9 @@ func RunJobWithMessageChannel(job *Job, deleteOnSuccess bool, messageChannel cha
 	}
 	// DART calls RunJobWithMessageChannel instead of RunJob. For DART,
 	// we always want to save artifacts. They go into the SQLite DB.
-	if !runner.RunPackageOp(false) {
-		runner.writeStageOutcome(constants.StagePackage, runner.Job.PackageOp.Result.Info, false)
-		runner.writeExitMessagesAndSaveResults()
-		return constants.ExitRuntimeErr
-	}
-	runner.writeStageOutcome(constants.StagePackage, runner.Job.PackageOp.Result.Info, true)
-
-	if !runner.RunValidationOp() {
-		runner.writeStageOutcome(constants.StageValidation, runner.Job.ValidationOp.Result.Info, false)
-		runner.writeExitMessagesAndSaveResults()
-		return constants.ExitRuntimeErr
-	}
-	runner.writeStageOutcome(constants.StageValidation, runner.Job.ValidationOp.Result.Info, true)
-
-	if !runner.RunPostValidationOps() {
-		runner.writeStageOutcome(constants.StageUpload, "One or more uploads failed", false)
-		runner.writeExitMessagesAndSaveResults()
-		return constants.ExitRuntimeErr
-	}
-
-	if !runner.RunUploadOps() {
-		runner.writeStageOutcome(constants.StageUpload, "One or more uploads failed", false)
+	if !runner.RunStages(false) {
 		runner.writeExitMessagesAndSaveResults()
-		return constants.ExitRuntimeErr
+		return runner.failureExitCode()
 	}
 	if deleteOnSuccess {
 		runner.cleanup()
@@ -110,26 +100,22 @@ func (r *Runner) writeStageOutcome(stage, message string, succeeded bool) {
 }
 
 func RunJob(job *Job, deleteOnSuccess, skipArtifacts, printOutput bool) int {
-	runner := &Runner{Job: job}
+	return RunJobContext(context.Background(), job, deleteOnSuccess, skipArtifacts, printOutput)
+}
+
+// RunJobContext is like RunJob, but it stops the job if ctx is
+// cancelled. In-flight bagging, validation, commands and uploads stop
+// promptly, partial bags are deleted, and the job returns
+// constants.ExitCancelled.
+func RunJobContext(ctx context.Context, job *Job, deleteOnSuccess, skipArtifacts, printOutput bool) int {
+	runner := &Runner{Job: job, ctx: ctx}
 	if !runner.ValidateJob() {
 		runner.printExitMessages()
 		return constants.ExitRuntimeErr
 	}
-	if !runner.RunPackageOp(skipArtifacts) {
-		runner.printExitMessages()
-		return constants.ExitRuntimeErr
-	}
-	if !runner.RunValidationOp() {
-		runner.printExitMessages()
-		return constants.ExitRuntimeErr
-	}
-	if !runner.RunPostValidationOps() {
-		runner.printExitMessages()
-		return constants.ExitRuntimeErr
-	}
-	if !runner.RunUploadOps() {
+	if !runner.RunStages(skipArtifacts) {
 		runner.printExitMessages()
-		return constants.ExitRuntimeErr
+		return runner.failureExitCode()
 	}
 	if deleteOnSuccess {
 		runner.cleanup()
@@ -144,6 +130,23 @@ func RunJob(job *Job, deleteOnSuccess, skipArtifacts, printOutput bool) int {
 	return constants.ExitOK
 }
 
+// context returns the context this runner's job runs under.
+func (r *Runner) context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// failureExitCode returns the exit code for a job whose stages did
+// not all succeed.
+func (r *Runner) failureExitCode() int {
+	if r.Job.Cancelled {
+		return constants.ExitCancelled
+	}
+	return constants.ExitRuntimeErr
+}
+
 // printExitMessages prints info about a job's exit status to
 // stdout and/or stderr. This does not save job results to the
 // database because DART Runner is intended to run on servers
@@ -192,7 +195,7 @@ func (r *Runner) RunPackageOp(skipArtifacts bool) bool {
 	}
 	bagger := NewBagger(op.OutputPath, r.Job.BagItProfile, sourceFiles)
 	bagger.MessageChannel = r.MessageChannel // Careful! This may be nil.
-	ok := bagger.Run()
+	ok := bagger.RunContext(r.context())
 	if !skipArtifacts {
 		r.saveBaggingArtifacts(bagger)
 	} else {
@@ -233,7 +236,7 @@ func (r *Runner) RunValidationOp() bool {
 		op.Result.Finish(op.Errors)
 		return false
 	}
-	validator, err := NewValidator(r.Job.PackageOp.OutputPath, r.Job.BagItProfile)
+	validator, err := NewValidator(op.PathToBag, r.Job.BagItProfile)
 	if err != nil {
 		op.Result.Finish(validator.Errors)
 		return false
@@ -243,10 +246,12 @@ func (r *Runner) RunValidationOp() bool {
 	if r.MessageChannel != nil {
 		validator.MessageChannel = r.MessageChannel
 	}
-	err = validator.ScanBag()
+	err = validator.ScanBagContext(r.context())
 	if err != nil {
 		errors := make(map[string]string)
-		if len(validator.Errors) > 0 {
+		if contextErr(r.ctx) != nil {
+			errors["Cancelled"] = fmt.Sprintf("Validation was cancelled: %s", err.Error())
+		} else if len(validator.Errors) > 0 {
 			errors = validator.Errors
 		} else {
 			errors["Validator.Scan"] = err.Error()
@@ -263,13 +268,20 @@ func (r *Runner) RunValidationOp() bool {
 }
 
 func (r *Runner) RunUploadOps() bool {
-	if len(r.Job.UploadOps) == 0 {
+	return r.runUploadOps(r.Job.UploadOps)
+}
+
+func (r *Runner) runUploadOps(ops []*UploadOperation) bool {
+	if len(ops) == 0 {
 		return true
 	}
 	// Run upload ops in sequence. If any fails, continue
 	// with remaining uploads.
 	allSucceeded := true
-	for _, op := range r.Job.UploadOps {
+	for _, op := range ops {
+		if contextErr(r.ctx) != nil {
+			return false
+		}
 		err := op.CalculatePayloadSize()
 		if err != nil {
 			op.Result.Finish(map[string]string{"Upload.CalculatePayloadSize": err.Error()})
@@ -277,7 +289,8 @@ func (r *Runner) RunUploadOps() bool {
 			continue
 		}
 		op.Result.Start()
-		ok := op.DoUpload(r.MessageChannel)
+		op.BagTags = BagTagValues(r.Job.BagItProfile)
+		ok := op.DoUploadContext(r.context(), r.MessageChannel)
 		if op.SourceFiles != nil && len(op.SourceFiles) > 0 {
 			r.setResultFileInfo(op.Result, op.SourceFiles[0], op.Errors)
 		}
@@ -292,6 +305,45 @@ func (r *Runner) RunUploadOps() bool {
 	return allSucceeded
 }
 
+// RunPrePackageOps runs the job's pre-packaging operations against its
+// source files. It stops at the first operation that fails, which vetoes
+// packaging. Successful operations may set tag values for the bag.
+func (r *Runner) RunPrePackageOps() bool {
+	if len(r.Job.PrePackageOps) == 0 {
+		return true
+	}
+	sourceFiles := make([]string, 0)
+	packageName := ""
+	if r.Job.PackageOp != nil {
+		sourceFiles = r.Job.PackageOp.SourceFiles
+		packageName = r.Job.PackageOp.PackageName
+	} else if len(r.Job.UploadOps) > 0 {
+		sourceFiles = r.Job.UploadOps[0].SourceFiles
+	}
+	for _, op := range r.Job.PrePackageOps {
+		if len(op.SourceFiles) == 0 {
+			op.SourceFiles = sourceFiles
+		}
+		if op.PackageName == "" {
+			op.PackageName = packageName
+		}
+		op.Result.Start()
+		err := op.RunContext(r.context(), r.MessageChannel)
+		if err != nil {
+			key := fmt.Sprintf("PrePackageOperation.%s", op.Command)
+			op.Result.Finish(map[string]string{key: err.Error()})
+			r.notifyStage(constants.StagePrePackage, op.Command, false)
+			return false
+		}
+		op.Result.Finish(op.Errors)
+		for _, tag := range op.OutputTags() {
+			r.Job.setTagValue(tag)
+		}
+		r.notifyStage(constants.StagePrePackage, op.Command, true)
+	}
+	return true
+}
+
 func (r *Runner) RunPostValidationOps() bool {
 	if r.Job.PostValidationOps == nil || len(r.Job.PostValidationOps) == 0 {
 		return true
@@ -300,22 +352,40 @@ func (r *Runner) RunPostValidationOps() bool {
 	// with remaining uploads.
 	allSucceeded := true
 	for _, op := range r.Job.PostValidationOps {
+		if contextErr(r.ctx) != nil {
+			return false
+		}
+		// System commands may refer to the bag in their args.
+		if op.PathToBag == "" {
+			op.PathToBag = r.pathToBag()
+		}
 		op.Result.Start()
-		err := op.Run(r.MessageChannel)
+		err := op.RunContext(r.context(), r.MessageChannel)
 		if err != nil {
 			key := fmt.Sprintf("PostValidateOperation.%s", op.Command)
 			op.Result.Finish(map[string]string{key: err.Error()})
 			allSucceeded = false
-			r.writeStageOutcome(constants.StagePostValidation, op.Command, false)
+			r.notifyStage(constants.StagePostValidation, op.Command, false)
 			continue
 		} else {
 			op.Result.Finish(op.Errors)
-			r.writeStageOutcome(constants.StagePostValidation, op.Command, true)
+			r.notifyStage(constants.StagePostValidation, op.Command, true)
 		}
 	}
 	return allSucceeded
 }
 
+// pathToBag returns the path to the bag this job built or validated.
+func (r *Runner) pathToBag() string {
+	if r.Job.PackageOp != nil && r.Job.PackageOp.OutputPath != "" {
+		return r.Job.PackageOp.OutputPath
+	}
+	if r.Job.ValidationOp != nil {
+		return r.Job.ValidationOp.PathToBag
+	}
+	return ""
+}
+
 func (r *Runner) setResultFileInfo(opResult *OperationResult, filePath string, errMap map[string]string) {
 	opResult.FilePath = filePath
 	fileInfo, err := os.Stat(filePath)
@@ -372,6 +442,20 @@ func (r *Runner) cleanup() {
 			lastUpload.Result.Info = fmt.Sprintf(
 				"Output file at %s was deleted at %s",
 				bagFile, time.Now().Format(time.RFC3339))
+			r.removeSidecars(lastUpload)
+		}
+	}
+}
+
+// removeSidecars deletes checksum sidecars we wrote next to a bag
+// after deleting the bag itself.
+func (r *Runner) removeSidecars(lastUpload *UploadOperation) {
+	for _, sidecar := range r.sidecars {
+		err := os.Remove(sidecar)
+		if err != nil && !os.IsNotExist(err) {
+			lastUpload.Result.Warning = fmt.Sprintf(
+				"Error deleting checksum file at %s: %s. You should delete this manually.",
+				sidecar, err.Error())
 		}
 	}
 }
@@ -407,10 +491,11 @@ func (r *Runner) saveBaggingArtifacts(bagger *Bagger) {
 		Dart.Log.Warningf("SaveBaggingArtifacts got nil bagger")
 		return
 	}
-	// GUI mode has a local SQLite database; command line
-	// modes for dart-runner and apt-cmd do not, so we save
-	// artifacts to file system.
-	if Dart.RuntimeMode == constants.ModeDartGUI {
+	// GUI mode has a local SQLite database, as does dart-runner's
+	// API server, whose clients fetch artifacts over HTTP. Other
+	// command line modes for dart-runner and apt-cmd do not, so we
+	// save artifacts to file system.
+	if Dart.RuntimeMode == constants.ModeDartGUI || Dart.RuntimeMode == constants.ModeDartServer {
 		r.Job.ArtifactsDir = "~database~"
 		r.saveArtifactsToDatabase(bagger)
 	} else {
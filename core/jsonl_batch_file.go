@@ -0,0 +1,77 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// maxBatchLineSize is the longest line we'll read from a JSON Lines
+// batch file. Items with thousands of files or tags can be long.
+const maxBatchLineSize = 16 * 1024 * 1024
+
+// JSONLinesBatchFile reads a batch file in which each line is a JSON
+// object in the same format as the job params dart-runner reads from
+// STDIN. For example:
+//
+//	{"packageName": "photos.tar", "files": ["/data/photos"], "tags": [{"tagFile": "bag-info.txt", "tagName": "Source-Organization", "value": "Example University"}]}
+//
+// Blank lines are ignored.
+type JSONLinesBatchFile struct {
+	PathToFile string
+	file       *os.File
+	scanner    *bufio.Scanner
+	lineNumber int
+}
+
+// NewJSONLinesBatchFile opens the JSON Lines file at pathToFile. See
+// ReadNext() for extracting data from the file.
+func NewJSONLinesBatchFile(pathToFile string) (*JSONLinesBatchFile, error) {
+	f, err := os.Open(pathToFile)
+	if err != nil {
+		Dart.Log.Errorf("Can't open JSON Lines file %s: %v", pathToFile, err)
+		return nil, err
+	}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), maxBatchLineSize)
+	return &JSONLinesBatchFile{
+		PathToFile: pathToFile,
+		file:       f,
+		scanner:    scanner,
+	}, nil
+}
+
+// ReadNext returns the item on the next non-blank line of the file.
+// It returns io.EOF when there are no more items.
+func (batchFile *JSONLinesBatchFile) ReadNext() (*WorkflowCSVEntry, error) {
+	for batchFile.scanner.Scan() {
+		batchFile.lineNumber++
+		line := bytes.TrimSpace(batchFile.scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		params, err := jobParamsFromJson(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", batchFile.lineNumber, err)
+		}
+		return entryFromJobParams(params, append([]byte(nil), line...)), nil
+	}
+	if err := batchFile.scanner.Err(); err != nil {
+		return nil, fmt.Errorf("line %d: %w", batchFile.lineNumber+1, err)
+	}
+	return nil, io.EOF
+}
+
+// WriteEntries writes entries to a new JSON Lines file at path.
+func (batchFile *JSONLinesBatchFile) WriteEntries(path string, entries []*WorkflowCSVEntry) error {
+	return writeJSONLinesEntries(path, entries)
+}
+
+// Close closes the underlying file.
+func (batchFile *JSONLinesBatchFile) Close() {
+	if batchFile.file != nil {
+		batchFile.file.Close()
+	}
+}
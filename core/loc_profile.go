@@ -12,7 +12,7 @@ type LOCOrderedProfile struct {
 // may appear in both ordered and unordered LOC profiles. Unordered
 // LOC profiles are simply a map in format map[string]LOCTagDef
 type LOCTagDef struct {
-	Required      bool     `json:"fieldRequired,omitempty"`
+	Required      bool     `json:"fieldRequired"`
 	DefaultValue  string   `json:"defaultValue,omitempty"`
 	Values        []string `json:"valueList,omitempty"`
 	RequiredValue string   `json:"requiredValue,omitempty"`
@@ -5,24 +5,41 @@ import (
 )
 
 type OperationResult struct {
-	Attempt          int               `json:"attempt"`
-	BytesUploaded    int64             `json:"bytesUploaded"`
-	Completed        time.Time         `json:"completed"`
-	Errors           map[string]string `json:"errors"`
-	EtagMap          map[string]string `json:"etagMap"`
-	FileMTime        time.Time         `json:"fileMtime"`
-	FilePath         string            `json:"filepath"`
-	FileSize         int64             `json:"filesize"`
-	FilesUploaded    int64             `json:"filesUploaded"`
-	Info             string            `json:"info"`
-	Operation        string            `json:"operation"`
-	PayloadSize      int64             `json:"payloadSize"`
-	Provider         string            `json:"provider"`
-	RemoteTargetName string            `json:"remoteTargetName"`
-	RemoteChecksum   string            `json:"remoteChecksum"`
-	RemoteURL        string            `json:"remoteURL"`
-	Started          time.Time         `json:"started"`
-	Warning          string            `json:"warning"`
+	Attempt           int               `json:"attempt"`
+	BytesDownloaded   int64             `json:"bytesDownloaded,omitempty"`
+	BytesUploaded     int64             `json:"bytesUploaded"`
+	Completed         time.Time         `json:"completed"`
+	Errors            map[string]string `json:"errors"`
+	EtagMap           map[string]string `json:"etagMap"`
+	FileMTime         time.Time         `json:"fileMtime"`
+	FilePath          string            `json:"filepath"`
+	FileSize          int64             `json:"filesize"`
+	FilesDownloaded   int64             `json:"filesDownloaded,omitempty"`
+	FilesUploaded     int64             `json:"filesUploaded"`
+	History           []*AttemptRecord  `json:"history,omitempty"`
+	Info              string            `json:"info"`
+	Operation         string            `json:"operation"`
+	PayloadSize       int64             `json:"payloadSize"`
+	Provider          string            `json:"provider"`
+	RemoteTargetName  string            `json:"remoteTargetName"`
+	RemoteChecksum    string            `json:"remoteChecksum"`
+	RemoteURL         string            `json:"remoteURL"`
+	Started           time.Time         `json:"started"`
+	Stderr            string            `json:"stderr,omitempty"`
+	Stdout            string            `json:"stdout,omitempty"`
+	VerifiedChecksums map[string]string `json:"verifiedChecksums,omitempty"`
+	Warning           string            `json:"warning"`
+}
+
+// AttemptRecord describes one attempt to complete an operation.
+// OperationResult keeps a history of these when an operation is
+// retried, so we can see what went wrong on earlier attempts.
+type AttemptRecord struct {
+	Attempt   int               `json:"attempt"`
+	Started   time.Time         `json:"started"`
+	Completed time.Time         `json:"completed"`
+	Errors    map[string]string `json:"errors"`
+	Retryable bool              `json:"retryable"`
 }
 
 func NewOperationResult(operation, provider string) *OperationResult {
@@ -36,9 +53,11 @@ func NewOperationResult(operation, provider string) *OperationResult {
 
 func (r *OperationResult) Reset() {
 	r.Started = time.Time{}
+	r.BytesDownloaded = 0
 	r.BytesUploaded = 0
 	r.Completed = time.Time{}
 	r.FileSize = 0
+	r.FilesDownloaded = 0
 	r.FilesUploaded = 0
 	r.FileMTime = time.Time{}
 	r.RemoteChecksum = ""
@@ -47,6 +66,9 @@ func (r *OperationResult) Reset() {
 	r.Warning = ""
 	r.Errors = make(map[string]string)
 	r.EtagMap = make(map[string]string)
+	r.VerifiedChecksums = nil
+	r.Stdout = ""
+	r.Stderr = ""
 }
 
 func (r *OperationResult) Start() {
@@ -62,6 +84,24 @@ func (r *OperationResult) Finish(errors map[string]string) {
 	}
 }
 
+// RecordAttempt adds a record of the current attempt to this result's
+// history. Param errors describes what went wrong on this attempt, and
+// retryable describes whether those errors are worth retrying. Unlike
+// the rest of the result, the history survives Reset.
+func (r *OperationResult) RecordAttempt(started time.Time, errors map[string]string, retryable bool) {
+	errorsCopy := make(map[string]string)
+	for key, value := range errors {
+		errorsCopy[key] = value
+	}
+	r.History = append(r.History, &AttemptRecord{
+		Attempt:   r.Attempt,
+		Started:   started,
+		Completed: time.Now(),
+		Errors:    errorsCopy,
+		Retryable: retryable,
+	})
+}
+
 func (r *OperationResult) HasErrors() bool {
 	return len(r.Errors) > 0
 }
@@ -5,20 +5,44 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strings"
 
 	"github.com/APTrust/dart-runner/constants"
 )
 
 type Options struct {
-	WorkflowFilePath  string
-	BatchFilePath     string
-	OutputDir         string
-	StdinData         []byte
-	Concurrency       int
-	DeleteAfterUpload bool
-	SkipArtifacts     bool
-	ShowHelp          bool
-	Version           bool
+	WorkflowFilePath   string
+	BatchFilePath      string
+	OutputDir          string
+	StdinData          []byte
+	Concurrency        int
+	DeleteAfterUpload  bool
+	SkipArtifacts      bool
+	ShowHelp           bool
+	Version            bool
+	LintProfilePath    string
+	CompareProfilePath string
+	ForgetHostKey      string
+	DownloadJobPath    string
+	ListRemote         string
+	Prefix             string
+	Format             string
+	ReconcileBatchPath string
+	RotateMasterKey    bool
+	Resume             bool
+	RetryFailed        bool
+	WatchDir           string
+	QuietSeconds       int
+	PollSeconds        int
+	DoneMarker         string
+	NameTags           string
+	Daemon             bool
+	Enqueue            bool
+	ListQueue          bool
+	CancelJobID        string
+	Serve              string
+	SetSetting         string
+	AbortStaleUploads  string
 }
 
 func ParseOptions() *Options {
@@ -30,6 +54,29 @@ func ParseOptions() *Options {
 	skipArtifacts := flag.Bool("skip-artifacts", false, "Skip saving artifacts? true|false - Default = false.")
 	showHelp := flag.Bool("help", false, "Show help.")
 	version := flag.Bool("version", false, "Show version and exit.")
+	lintProfilePath := flag.String("lint-profile", "", "Path to BagIt profile json file to check for contradictory settings")
+	compareProfilePath := flag.String("compare-profile", "", "Path to BagIt profile json file to compare with --lint-profile")
+	forgetHostKey := flag.String("forget-host-key", "", "SFTP server host:port whose trusted host key should be forgotten")
+	downloadJobPath := flag.String("download", "", "Path to download job json file")
+	listRemote := flag.String("list-remote", "", "Storage service json file, or name or id of a storage service in --workflow, to list")
+	prefix := flag.String("prefix", "", "List only remote items whose keys begin with this prefix")
+	format := flag.String("format", "json", "Output format for --list-remote: json|csv")
+	reconcileBatchPath := flag.String("reconcile", "", "Path to batch file (CSV, JSON Lines or YAML) to compare with --list-remote")
+	resume := flag.Bool("resume", false, "Skip batch rows that succeeded in an earlier run")
+	retryFailed := flag.Bool("retry-failed", false, "Run only the batch rows that failed in an earlier run")
+	watchDir := flag.String("watch", "", "Path to a hot folder whose new items should be run through --workflow")
+	quietSeconds := flag.Int("quiet-seconds", 60, "Run hot folder items that have not changed for this many seconds. 0 = wait for done marker.")
+	pollSeconds := flag.Int("poll-seconds", 5, "How often to rescan the hot folder, in seconds")
+	doneMarker := flag.String("done-marker", ".done", "Suffix of the file that marks a hot folder item as ready")
+	nameTags := flag.String("name-tags", "", "Comma-separated tags to take from the names of hot folder items")
+	daemon := flag.Bool("daemon", false, "Run jobs from the job queue until killed")
+	enqueue := flag.Bool("enqueue", false, "Add the job or batch to the job queue instead of running it")
+	listQueue := flag.Bool("list-queue", false, "List the jobs in the job queue")
+	cancelJobID := flag.String("cancel-job", "", "ID of a queued job to cancel")
+	serve := flag.String("serve", "", "Run the HTTP API on this localhost host:port, or unix:/path/to/socket")
+	setSetting := flag.String("set-setting", "", "Save an application setting, as \"Name=value\"")
+	abortStaleUploads := flag.String("abort-stale-uploads", "", "Storage service json file, or name or id of a storage service in --workflow, whose stale S3 uploads should be aborted")
+	rotateMasterKey := flag.Bool("rotate-master-key", false, "Rewrap the key that encrypts secrets with the key in DART_NEW_MASTER_KEY, DART_NEW_MASTER_KEY_FILE or DART_NEW_MASTER_PASSPHRASE")
 
 	flag.Parse()
 
@@ -39,15 +86,38 @@ func ParseOptions() *Options {
 	}
 
 	return &Options{
-		WorkflowFilePath:  *workflowFilePath,
-		BatchFilePath:     *batchFilePath,
-		OutputDir:         *outputDir,
-		Concurrency:       *concurrency,
-		DeleteAfterUpload: *deleteAfterUpload,
-		SkipArtifacts:     *skipArtifacts,
-		ShowHelp:          *showHelp,
-		Version:           *version,
-		StdinData:         jsonData,
+		WorkflowFilePath:   *workflowFilePath,
+		BatchFilePath:      *batchFilePath,
+		OutputDir:          *outputDir,
+		Concurrency:        *concurrency,
+		DeleteAfterUpload:  *deleteAfterUpload,
+		SkipArtifacts:      *skipArtifacts,
+		ShowHelp:           *showHelp,
+		Version:            *version,
+		StdinData:          jsonData,
+		LintProfilePath:    *lintProfilePath,
+		CompareProfilePath: *compareProfilePath,
+		ForgetHostKey:      *forgetHostKey,
+		DownloadJobPath:    *downloadJobPath,
+		ListRemote:         *listRemote,
+		Prefix:             *prefix,
+		Format:             *format,
+		ReconcileBatchPath: *reconcileBatchPath,
+		RotateMasterKey:    *rotateMasterKey,
+		Resume:             *resume,
+		RetryFailed:        *retryFailed,
+		WatchDir:           *watchDir,
+		QuietSeconds:       *quietSeconds,
+		PollSeconds:        *pollSeconds,
+		DoneMarker:         *doneMarker,
+		NameTags:           *nameTags,
+		Daemon:             *daemon,
+		Enqueue:            *enqueue,
+		ListQueue:          *listQueue,
+		CancelJobID:        *cancelJobID,
+		Serve:              *serve,
+		SetSetting:         *setSetting,
+		AbortStaleUploads:  *abortStaleUploads,
 	}
 }
 
@@ -57,6 +127,27 @@ func (opts Options) AreValid() bool {
 	if opts.Version || opts.ShowHelp {
 		return true
 	}
+	if opts.LintProfilePath != "" || opts.ForgetHostKey != "" || opts.RotateMasterKey {
+		return true
+	}
+	if opts.SetSetting != "" {
+		name, _, found := strings.Cut(opts.SetSetting, "=")
+		return found && strings.TrimSpace(name) != ""
+	}
+	if opts.Daemon || opts.ListQueue || opts.CancelJobID != "" || opts.Serve != "" || opts.AbortStaleUploads != "" {
+		return true
+	}
+	if opts.ListRemote != "" {
+		return opts.Format == "" || opts.Format == "json" || opts.Format == "csv"
+	}
+	if opts.DownloadJobPath != "" && opts.OutputDir != "" {
+		return true
+	}
+	if opts.WatchDir != "" {
+		// Items must become ready somehow, by quiet time or marker.
+		return opts.WorkflowFilePath != "" && opts.OutputDir != "" &&
+			(opts.QuietSeconds > 0 || opts.DoneMarker != "")
+	}
 	if (len(opts.StdinData) > 0 || StdinHasData()) && opts.OutputDir != "" {
 		// We'll validate stdin json later
 		return true
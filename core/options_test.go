@@ -58,4 +58,60 @@ func TestOptionsAreValid(t *testing.T) {
 	// version is a valid option. User just wants to print version & exit.
 	opts.Version = true
 	assert.True(t, opts.AreValid())
+
+	// lint profile needs no other options.
+	opts = &core.Options{LintProfilePath: "/path/to/profile.json"}
+	assert.True(t, opts.AreValid())
+
+	// Neither does forget host key.
+	opts = &core.Options{ForgetHostKey: "sftp.example.com:2222"}
+	assert.True(t, opts.AreValid())
+
+	// Or rotate master key, which reads its keys from the environment.
+	opts = &core.Options{RotateMasterKey: true}
+	assert.True(t, opts.AreValid())
+
+	// Abort stale uploads needs only a storage service.
+	opts = &core.Options{AbortStaleUploads: "My S3 Bucket"}
+	assert.True(t, opts.AreValid())
+
+	// Set setting needs a name and value.
+	opts = &core.Options{SetSetting: "Allowed Post-Validation Commands=/usr/local/bin/scan-bag"}
+	assert.True(t, opts.AreValid())
+	opts = &core.Options{SetSetting: "Allowed Post-Validation Commands"}
+	assert.False(t, opts.AreValid())
+	opts = &core.Options{SetSetting: "=/usr/local/bin/scan-bag"}
+	assert.False(t, opts.AreValid())
+
+	// Download jobs need an output directory.
+	opts = &core.Options{DownloadJobPath: "/path/to/download_job.json"}
+	assert.False(t, opts.AreValid())
+	opts.OutputDir = "/path/to/output_dir"
+	assert.True(t, opts.AreValid())
+
+	// Remote listings need only a storage service,
+	// and a format we support.
+	opts = &core.Options{ListRemote: "/path/to/storage_service.json", Format: "json"}
+	assert.True(t, opts.AreValid())
+	opts.Format = "csv"
+	assert.True(t, opts.AreValid())
+	opts.Format = "xml"
+	assert.False(t, opts.AreValid())
+
+	// Hot folders need a workflow, an output directory, and a
+	// way to tell when items are ready.
+	opts = &core.Options{WatchDir: "/path/to/incoming", WorkflowFilePath: "/path/to/workflow_file.json", QuietSeconds: 60}
+	assert.False(t, opts.AreValid())
+	opts.OutputDir = "/path/to/output_dir"
+	assert.True(t, opts.AreValid())
+	opts.QuietSeconds = 0
+	assert.False(t, opts.AreValid())
+	opts.DoneMarker = ".done"
+	assert.True(t, opts.AreValid())
+
+	// Job queue commands need nothing else.
+	assert.True(t, (&core.Options{Daemon: true}).AreValid())
+	assert.True(t, (&core.Options{ListQueue: true}).AreValid())
+	assert.True(t, (&core.Options{CancelJobID: "1234"}).AreValid())
+	assert.True(t, (&core.Options{Serve: "127.0.0.1:8444"}).AreValid())
 }
@@ -0,0 +1,405 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/util"
+)
+
+// StageDefinition describes one step in a workflow's pipeline. Workflows
+// that define no stages run the default pipeline, which packages,
+// validates, runs post-validation operations and then uploads to every
+// storage service, stopping at the first stage that fails.
+type StageDefinition struct {
+	// Name identifies this stage in the conditions of later stages and
+	// in job results. It defaults to the stage type, or for uploads to
+	// a single storage service, to "upload:" plus StorageService.
+	Name string `json:"name,omitempty"`
+
+	// Type is one of constants.PipelineStageTypes.
+	Type string `json:"type"`
+
+	// StorageService is the ID or name of the one storage service an
+	// upload stage sends to. If it's empty, the stage uploads to all of
+	// the workflow's storage services that no other stage targets.
+	StorageService string `json:"storageService,omitempty"`
+
+	// Algorithm is the digest algorithm for checksum-sidecar stages.
+	// It defaults to sha256.
+	Algorithm string `json:"algorithm,omitempty"`
+
+	// OnFailure is one of constants.OnFailureActions. It defaults to
+	// stop. The job fails if any stage fails, even when the pipeline
+	// continues past that stage.
+	OnFailure string `json:"onFailure,omitempty"`
+
+	// When lists the outcomes of earlier stages that must all hold
+	// for this stage to run. If any don't, we skip this stage.
+	When []*StageCondition `json:"when,omitempty"`
+}
+
+// StageCondition requires that the earlier stage with the given name
+// ended with the given status: success, failed or skipped.
+type StageCondition struct {
+	Stage  string `json:"stage"`
+	Status string `json:"status"`
+}
+
+// StageResult records the outcome of one stage of a job's pipeline.
+type StageResult struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+// DefaultStages returns the pipeline for workflows and jobs that don't
+// define their own.
+func DefaultStages() []*StageDefinition {
+	return []*StageDefinition{
+		{Type: constants.StagePrePackage},
+		{Type: constants.StagePackage},
+		{Type: constants.StageValidation},
+		{Type: constants.StagePostValidation},
+		{Type: constants.StageUpload},
+	}
+}
+
+// StageName returns the name that identifies this stage in conditions
+// and results.
+func (s *StageDefinition) StageName() string {
+	if s.Name != "" {
+		return s.Name
+	}
+	if s.Type == constants.StageUpload && s.StorageService != "" {
+		return s.Type + ":" + s.StorageService
+	}
+	return s.Type
+}
+
+// GetOnFailure returns what the pipeline should do if this stage fails.
+func (s *StageDefinition) GetOnFailure() string {
+	if s.OnFailure == "" {
+		return constants.OnFailureStop
+	}
+	return s.OnFailure
+}
+
+// GetAlgorithm returns the digest algorithm for a checksum-sidecar stage.
+func (s *StageDefinition) GetAlgorithm() string {
+	if s.Algorithm == "" {
+		return constants.AlgSha256
+	}
+	return s.Algorithm
+}
+
+// unmetCondition returns a description of the first of this stage's
+// conditions that the statuses of earlier stages don't satisfy, or an
+// empty string if they satisfy them all.
+func (s *StageDefinition) unmetCondition(statuses map[string]string) string {
+	for _, cond := range s.When {
+		status, ran := statuses[cond.Stage]
+		if !ran {
+			status = "not run"
+		}
+		if status != cond.Status {
+			return fmt.Sprintf("Skipped because stage '%s' was %s, not %s", cond.Stage, status, cond.Status)
+		}
+	}
+	return ""
+}
+
+// targets returns true if this upload stage sends files to ss.
+// Untargeted upload stages don't send to services that other
+// stages target, so param targeted lists those services.
+func (s *StageDefinition) targets(ss *StorageService, targeted []string) bool {
+	if s.StorageService != "" {
+		return ss.ID == s.StorageService || ss.Name == s.StorageService
+	}
+	for _, ref := range targeted {
+		if ss.ID == ref || ss.Name == ref {
+			return false
+		}
+	}
+	return true
+}
+
+// stagesInclude returns true if stages contains a stage of the specified
+// type. An empty pipeline includes all stages, since it means we'll run
+// the default pipeline.
+func stagesInclude(stages []*StageDefinition, stageType string) bool {
+	if len(stages) == 0 {
+		return true
+	}
+	for _, stage := range stages {
+		if stage.Type == stageType {
+			return true
+		}
+	}
+	return false
+}
+
+// stagesUpload returns true if any of the upload stages in stages
+// sends files to ss.
+func stagesUpload(stages []*StageDefinition, ss *StorageService) bool {
+	if len(stages) == 0 {
+		return true
+	}
+	targeted := targetedStorageServices(stages)
+	for _, stage := range stages {
+		if stage.Type == constants.StageUpload && stage.targets(ss, targeted) {
+			return true
+		}
+	}
+	return false
+}
+
+func targetedStorageServices(stages []*StageDefinition) []string {
+	targeted := make([]string, 0)
+	for _, stage := range stages {
+		if stage.Type == constants.StageUpload && stage.StorageService != "" {
+			targeted = append(targeted, stage.StorageService)
+		}
+	}
+	return targeted
+}
+
+// ValidateStages checks a pipeline definition and returns a map of
+// errors, which is empty if the pipeline is valid. Param storageServices
+// lists the services that upload stages may target.
+func ValidateStages(stages []*StageDefinition, storageServices []*StorageService) map[string]string {
+	errors := make(map[string]string)
+	seen := make(map[string]bool)
+	for i, stage := range stages {
+		key := fmt.Sprintf("Stages[%d]", i)
+		if stage == nil {
+			errors[key] = "Stage definition is empty."
+			continue
+		}
+		if !util.StringListContains(constants.PipelineStageTypes, stage.Type) {
+			errors[key+".Type"] = fmt.Sprintf("Stage type must be one of: %s.", strings.Join(constants.PipelineStageTypes, ", "))
+		}
+		if !util.StringListContains(constants.OnFailureActions, stage.GetOnFailure()) {
+			errors[key+".OnFailure"] = fmt.Sprintf("OnFailure must be one of: %s.", strings.Join(constants.OnFailureActions, ", "))
+		}
+		if stage.StorageService != "" {
+			if stage.Type != constants.StageUpload {
+				errors[key+".StorageService"] = "Only upload stages can name a storage service."
+			} else if !storageServiceListed(storageServices, stage.StorageService) {
+				errors[key+".StorageService"] = fmt.Sprintf("Workflow has no storage service with ID or name '%s'.", stage.StorageService)
+			}
+		}
+		if stage.Type == constants.StageChecksumSidecar && !util.StringListContains(constants.PreferredAlgsInOrder, stage.GetAlgorithm()) {
+			errors[key+".Algorithm"] = fmt.Sprintf("Algorithm must be one of: %s.", strings.Join(constants.PreferredAlgsInOrder, ", "))
+		}
+		for j, cond := range stage.When {
+			condKey := fmt.Sprintf("%s.When[%d]", key, j)
+			if !seen[cond.Stage] {
+				errors[condKey+".Stage"] = fmt.Sprintf("Condition refers to '%s', which is not an earlier stage.", cond.Stage)
+			}
+			if cond.Status != constants.StatusSuccess && cond.Status != constants.StatusFailed && cond.Status != constants.StatusSkipped {
+				errors[condKey+".Status"] = "Condition status must be success, failed or skipped."
+			}
+		}
+		name := stage.StageName()
+		if seen[name] {
+			errors[key+".Name"] = fmt.Sprintf("Another stage is already named '%s'.", name)
+		}
+		seen[name] = true
+	}
+	return errors
+}
+
+func storageServiceListed(storageServices []*StorageService, ref string) bool {
+	for _, ss := range storageServices {
+		if ss != nil && (ss.ID == ref || ss.Name == ref) {
+			return true
+		}
+	}
+	return false
+}
+
+// RunStages runs the job's pipeline, or the default pipeline if the job
+// doesn't define one. It returns true if no stage failed. When the job
+// defines its own stages, this records the outcome of each in
+// Job.StageResults.
+//
+// If the runner's context is cancelled, the stage in progress and all
+// later stages end with status cancelled, and Job.Cancelled is set.
+func (r *Runner) RunStages(skipArtifacts bool) bool {
+	stages := r.Job.Stages
+	recordResults := len(stages) > 0
+	if !recordResults {
+		stages = DefaultStages()
+	}
+	r.Job.StageResults = nil
+	r.Job.Cancelled = false
+	targeted := targetedStorageServices(stages)
+	statuses := make(map[string]string)
+	allSucceeded := true
+	skipUploads := false
+	for _, stage := range stages {
+		status := constants.StatusSkipped
+		message := ""
+		if contextErr(r.ctx) != nil {
+			r.Job.Cancelled = true
+		}
+		if r.Job.Cancelled {
+			status = constants.StatusCancelled
+			message = "Cancelled before this stage started"
+		} else if skipUploads && stage.Type == constants.StageUpload {
+			message = "Skipped because an earlier stage failed"
+		} else {
+			message = stage.unmetCondition(statuses)
+		}
+		if message == "" {
+			var ok bool
+			ok, message = r.runStage(stage, skipArtifacts, targeted)
+			status = constants.StatusFailed
+			if ok {
+				status = constants.StatusSuccess
+			} else if contextErr(r.ctx) != nil {
+				status = constants.StatusCancelled
+				message = "Cancelled while this stage was running"
+				r.Job.Cancelled = true
+			}
+		}
+		statuses[stage.StageName()] = status
+		if recordResults {
+			r.Job.StageResults = append(r.Job.StageResults, &StageResult{
+				Name:    stage.StageName(),
+				Type:    stage.Type,
+				Status:  status,
+				Message: message,
+			})
+		}
+		if status == constants.StatusCancelled {
+			allSucceeded = false
+			continue
+		}
+		if status != constants.StatusFailed {
+			continue
+		}
+		allSucceeded = false
+		switch stage.GetOnFailure() {
+		case constants.OnFailureContinue:
+		case constants.OnFailureSkipUploads:
+			skipUploads = true
+		default:
+			return false
+		}
+	}
+	return allSucceeded
+}
+
+// runStage runs a single stage and returns true if it succeeded, along
+// with a message describing the outcome. When running from the UI, this
+// also sends the stage's outcome to the front end.
+func (r *Runner) runStage(stage *StageDefinition, skipArtifacts bool, targeted []string) (bool, string) {
+	ok := true
+	message := ""
+	switch stage.Type {
+	case constants.StagePrePackage:
+		ok = r.RunPrePackageOps()
+		if !ok {
+			message = "A pre-packaging command failed, so the files were not packaged"
+			r.notifyStage(constants.StagePrePackage, message, ok)
+		}
+	case constants.StagePackage:
+		ok = r.RunPackageOp(skipArtifacts)
+		if r.Job.PackageOp != nil {
+			message = r.Job.PackageOp.Result.Info
+			r.notifyStage(constants.StagePackage, message, ok)
+		}
+	case constants.StageValidation:
+		ok = r.RunValidationOp()
+		if r.Job.ValidationOp != nil {
+			message = r.Job.ValidationOp.Result.Info
+			r.notifyStage(constants.StageValidation, message, ok)
+		}
+	case constants.StagePostValidation:
+		ok = r.RunPostValidationOps()
+		if !ok {
+			message = "One or more post-validation operations failed"
+			r.notifyStage(constants.StagePostValidation, message, ok)
+		}
+	case constants.StageChecksumSidecar:
+		ok, message = r.RunChecksumSidecar(stage.GetAlgorithm())
+		r.notifyStage(constants.StageChecksumSidecar, message, ok)
+	case constants.StageUpload:
+		ok = r.runUploadOps(stage.uploadOps(r.Job.UploadOps, targeted))
+		if !ok {
+			message = "One or more uploads failed"
+			r.notifyStage(constants.StageUpload, message, ok)
+		}
+	default:
+		ok = false
+		message = fmt.Sprintf("Unknown stage type '%s'", stage.Type)
+	}
+	return ok, message
+}
+
+// uploadOps returns the operations from ops that this upload stage runs.
+func (s *StageDefinition) uploadOps(ops []*UploadOperation, targeted []string) []*UploadOperation {
+	selected := make([]*UploadOperation, 0)
+	for _, op := range ops {
+		if op.StorageService != nil && s.targets(op.StorageService, targeted) {
+			selected = append(selected, op)
+		}
+	}
+	return selected
+}
+
+// notifyStage sends a stage outcome to the front end, if we're
+// running from the UI.
+func (r *Runner) notifyStage(stage, message string, succeeded bool) {
+	if r.MessageChannel != nil {
+		r.writeStageOutcome(stage, message, succeeded)
+	}
+}
+
+// RunChecksumSidecar writes a file containing the digest of the bag
+// next to the bag, so that recipients can check the bag's integrity
+// before unpacking it. The sidecar is named for the bag plus the
+// algorithm, as in my_bag.tar.sha256, and uses the format of the
+// sha256sum command. Upload stages that run after this one send the
+// sidecar along with the bag.
+func (r *Runner) RunChecksumSidecar(alg string) (bool, string) {
+	bagPath := r.pathToBag()
+	if bagPath == "" || !util.FileExists(bagPath) {
+		return false, "Checksum sidecar requires a bag, but there is none."
+	}
+	if util.IsDirectory(bagPath) {
+		return false, fmt.Sprintf("Checksum sidecar requires a serialized bag, but %s is a directory.", bagPath)
+	}
+	hashes := util.GetHashes([]string{alg})
+	hash, ok := hashes[alg]
+	if !ok {
+		return false, fmt.Sprintf("Unsupported checksum algorithm '%s'.", alg)
+	}
+	bag, err := os.Open(bagPath)
+	if err != nil {
+		return false, fmt.Sprintf("Can't read bag: %s", err.Error())
+	}
+	defer bag.Close()
+	if _, err = io.Copy(hash, newContextReader(r.ctx, bag)); err != nil {
+		return false, fmt.Sprintf("Can't read bag: %s", err.Error())
+	}
+	sidecarPath := bagPath + "." + alg
+	content := fmt.Sprintf("%x  %s\n", hash.Sum(nil), filepath.Base(bagPath))
+	if err = os.WriteFile(sidecarPath, []byte(content), 0644); err != nil {
+		return false, fmt.Sprintf("Can't write checksum sidecar: %s", err.Error())
+	}
+	r.sidecars = append(r.sidecars, sidecarPath)
+	for _, op := range r.Job.UploadOps {
+		if !op.Result.WasAttempted() && !util.StringListContains(op.SourceFiles, sidecarPath) {
+			op.SourceFiles = append(op.SourceFiles, sidecarPath)
+		}
+	}
+	return true, fmt.Sprintf("Wrote %s checksum to %s", alg, sidecarPath)
+}
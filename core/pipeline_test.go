@@ -0,0 +1,257 @@
+package core_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/core"
+	"github.com/APTrust/dart-runner/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// getPipelineTestWorkflow returns the runner test workflow with its S3
+// service replaced by local file services, so pipeline tests don't need
+// a running S3 server. The service named "Broken" fails every upload,
+// because its root directory doesn't exist.
+func getPipelineTestWorkflow(t *testing.T, stages []*core.StageDefinition) *core.Workflow {
+	workflow := loadJsonWorkflow(t)
+	workflow.StorageServices = make([]*core.StorageService, 0)
+	for _, name := range []string{"Primary", "Secondary", "Broken"} {
+		ss := core.NewStorageService()
+		ss.Name = name
+		ss.Protocol = constants.ProtocolFile
+		ss.Bucket = t.TempDir()
+		if name == "Broken" {
+			ss.Bucket = filepath.Join(ss.Bucket, "does-not-exist")
+			ss.RetryPolicy = &core.RetryPolicy{MaxAttempts: 1}
+		}
+		workflow.StorageServices = append(workflow.StorageServices, ss)
+	}
+	workflow.Stages = stages
+	require.True(t, workflow.Validate(), workflow.Errors)
+	return workflow
+}
+
+func getPipelineTestJob(t *testing.T, workflow *core.Workflow) *core.Job {
+	files := []string{
+		filepath.Join(util.PathToTestData(), "files"),
+	}
+	jobParams := core.NewJobParams(workflow, "pipeline_test_bag", t.TempDir(), files, getTestTags())
+	return jobParams.ToJob()
+}
+
+func bucketOf(workflow *core.Workflow, name string) string {
+	for _, ss := range workflow.StorageServices {
+		if ss.Name == name {
+			return ss.Bucket
+		}
+	}
+	return ""
+}
+
+func stageStatuses(job *core.Job) map[string]string {
+	statuses := make(map[string]string)
+	for _, result := range job.StageResults {
+		statuses[result.Name] = result.Status
+	}
+	return statuses
+}
+
+func TestDefaultStages(t *testing.T) {
+	stages := core.DefaultStages()
+	require.Len(t, stages, 5)
+	assert.Equal(t, constants.StagePrePackage, stages[0].StageName())
+	assert.Equal(t, constants.StagePackage, stages[1].StageName())
+	assert.Equal(t, constants.StageValidation, stages[2].StageName())
+	assert.Equal(t, constants.StagePostValidation, stages[3].StageName())
+	assert.Equal(t, constants.StageUpload, stages[4].StageName())
+	for _, stage := range stages {
+		assert.Equal(t, constants.OnFailureStop, stage.GetOnFailure())
+	}
+	assert.Empty(t, core.ValidateStages(stages, nil))
+
+	stage := &core.StageDefinition{Type: constants.StageUpload, StorageService: "Primary"}
+	assert.Equal(t, "upload:Primary", stage.StageName())
+	stage.Name = "Off site"
+	assert.Equal(t, "Off site", stage.StageName())
+
+	stage = &core.StageDefinition{Type: constants.StageChecksumSidecar}
+	assert.Equal(t, constants.AlgSha256, stage.GetAlgorithm())
+}
+
+func TestValidateStages(t *testing.T) {
+	ss := core.NewStorageService()
+	ss.Name = "Primary"
+	stages := []*core.StageDefinition{
+		{Type: constants.StagePackage},
+		{Type: "transmogrify"},
+		{Type: constants.StageValidation, OnFailure: "panic"},
+		{Type: constants.StageChecksumSidecar, Algorithm: "crc32"},
+		{Type: constants.StageUpload, StorageService: "Nowhere"},
+		{Type: constants.StageValidation, StorageService: "Primary"},
+		{Type: constants.StageUpload, StorageService: ss.ID, When: []*core.StageCondition{
+			{Stage: constants.StagePackage, Status: "done"},
+			{Stage: "later", Status: constants.StatusSuccess},
+		}},
+		{Type: constants.StageUpload, Name: "later"},
+	}
+	errors := core.ValidateStages(stages, []*core.StorageService{ss})
+	assert.Len(t, errors, 8, errors)
+	assert.Contains(t, errors["Stages[1].Type"], "Stage type must be one of")
+	assert.Contains(t, errors["Stages[2].OnFailure"], "OnFailure must be one of")
+	assert.Contains(t, errors["Stages[3].Algorithm"], "Algorithm must be one of")
+	assert.Contains(t, errors["Stages[4].StorageService"], "no storage service with ID or name 'Nowhere'")
+	assert.Equal(t, "Only upload stages can name a storage service.", errors["Stages[5].StorageService"])
+	assert.Contains(t, errors["Stages[5].Name"], "already named 'validation'")
+	assert.Equal(t, "Condition status must be success, failed or skipped.", errors["Stages[6].When[0].Status"])
+	assert.Contains(t, errors["Stages[6].When[1].Stage"], "not an earlier stage")
+
+	// Workflows report the same errors.
+	workflow := loadJsonWorkflow(t)
+	workflow.Stages = stages
+	assert.False(t, workflow.Validate())
+	assert.NotEmpty(t, workflow.Errors["Stages[1].Type"])
+}
+
+func TestPipelineWithSidecarAndConditionalUploads(t *testing.T) {
+	stages := []*core.StageDefinition{
+		{Type: constants.StagePackage},
+		{Type: constants.StageValidation},
+		{Type: constants.StageChecksumSidecar},
+		{Type: constants.StageUpload, StorageService: "Primary", Name: "primary"},
+		{Type: constants.StageUpload, StorageService: "Secondary", When: []*core.StageCondition{
+			{Stage: "primary", Status: constants.StatusSuccess},
+		}},
+		{Type: constants.StageUpload, StorageService: "Broken", When: []*core.StageCondition{
+			{Stage: "primary", Status: constants.StatusFailed},
+		}},
+	}
+	workflow := getPipelineTestWorkflow(t, stages)
+	job := getPipelineTestJob(t, workflow)
+	require.NotNil(t, job.PackageOp)
+	require.Len(t, job.UploadOps, 3)
+
+	require.True(t, job.Validate(), job.Errors)
+	assert.Equal(t, constants.ExitOK, core.RunJob(job, false, true, false))
+
+	assert.Equal(t, map[string]string{
+		constants.StagePackage:         constants.StatusSuccess,
+		constants.StageValidation:      constants.StatusSuccess,
+		constants.StageChecksumSidecar: constants.StatusSuccess,
+		"primary":                      constants.StatusSuccess,
+		"upload:Secondary":             constants.StatusSuccess,
+		"upload:Broken":                constants.StatusSkipped,
+	}, stageStatuses(job))
+	assert.Contains(t, job.StageResults[5].Message, "'primary' was success, not failed")
+
+	// Both uploads should include the bag and its checksum.
+	bagName := filepath.Base(job.PackageOp.OutputPath)
+	sidecar := job.PackageOp.OutputPath + ".sha256"
+	require.FileExists(t, sidecar)
+	content, err := os.ReadFile(sidecar)
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(string(content), "  "+bagName+"\n"), string(content))
+	for _, name := range []string{"Primary", "Secondary"} {
+		assert.FileExists(t, filepath.Join(bucketOf(workflow, name), bagName))
+		assert.FileExists(t, filepath.Join(bucketOf(workflow, name), bagName+".sha256"))
+	}
+
+	// The broken upload didn't run, but that doesn't count as failure.
+	result := core.NewJobResult(job)
+	assert.True(t, result.Succeeded)
+	assert.Len(t, result.StageResults, 6)
+}
+
+func TestPipelineOnFailure(t *testing.T) {
+	files := []string{
+		filepath.Join(util.PathToTestData(), "files", "sample_job.json"),
+	}
+	tests := []struct {
+		onFailure        string
+		primaryStatus    string
+		secondaryStatus  string
+		primaryUploaded  bool
+		expectedExitCode int
+	}{
+		{constants.OnFailureStop, "", "", false, constants.ExitRuntimeErr},
+		{constants.OnFailureSkipUploads, constants.StatusSkipped, constants.StatusSkipped, false, constants.ExitRuntimeErr},
+		{constants.OnFailureContinue, constants.StatusSuccess, constants.StatusSkipped, true, constants.ExitRuntimeErr},
+	}
+	for _, test := range tests {
+		// No package stage, so we upload the files as they are.
+		stages := []*core.StageDefinition{
+			{Type: constants.StageUpload, StorageService: "Broken", OnFailure: test.onFailure},
+			{Type: constants.StageUpload, StorageService: "Primary"},
+			{Type: constants.StageUpload, StorageService: "Secondary", When: []*core.StageCondition{
+				{Stage: "upload:Broken", Status: constants.StatusSuccess},
+			}},
+		}
+		workflow := getPipelineTestWorkflow(t, stages)
+		jobParams := core.NewJobParams(workflow, "", t.TempDir(), files, nil)
+		job := jobParams.ToJob()
+		assert.Nil(t, job.PackageOp, test.onFailure)
+		assert.Nil(t, job.ValidationOp, test.onFailure)
+		require.True(t, job.Validate(), job.Errors)
+
+		assert.Equal(t, test.expectedExitCode, core.RunJob(job, false, true, false), test.onFailure)
+		statuses := stageStatuses(job)
+		assert.Equal(t, constants.StatusFailed, statuses["upload:Broken"], test.onFailure)
+		assert.Equal(t, test.primaryStatus, statuses["upload:Primary"], test.onFailure)
+		assert.Equal(t, test.secondaryStatus, statuses["upload:Secondary"], test.onFailure)
+		assert.Equal(t, test.primaryUploaded, util.FileExists(filepath.Join(bucketOf(workflow, "Primary"), "sample_job.json")), test.onFailure)
+
+		// The job fails even if the pipeline continued past the failure.
+		assert.False(t, core.NewJobResult(job).Succeeded, test.onFailure)
+	}
+}
+
+func TestPipelineUploadsOnlyToNamedServices(t *testing.T) {
+	workflow := getPipelineTestWorkflow(t, []*core.StageDefinition{
+		{Type: constants.StagePackage},
+		{Type: constants.StageUpload, StorageService: "Secondary"},
+	})
+	job := getPipelineTestJob(t, workflow)
+	assert.NotNil(t, job.PackageOp)
+	assert.Nil(t, job.ValidationOp)
+	require.Len(t, job.UploadOps, 1)
+	assert.Equal(t, "Secondary", job.UploadOps[0].StorageService.Name)
+	assert.Equal(t, workflow.Stages, job.Stages)
+
+	// Workflows without stages still get every operation.
+	workflow.Stages = nil
+	job = getPipelineTestJob(t, workflow)
+	assert.NotNil(t, job.ValidationOp)
+	assert.Len(t, job.UploadOps, 3)
+	assert.Empty(t, job.Stages)
+}
+
+func TestPipelineCancelled(t *testing.T) {
+	workflow := getPipelineTestWorkflow(t, []*core.StageDefinition{
+		{Type: constants.StagePackage},
+		{Type: constants.StageValidation},
+		{Type: constants.StageUpload, StorageService: "Primary"},
+	})
+	job := getPipelineTestJob(t, workflow)
+	require.True(t, job.Validate(), job.Errors)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, constants.ExitCancelled, core.RunJobContext(ctx, job, false, true, false))
+	assert.True(t, job.Cancelled)
+	for name, status := range stageStatuses(job) {
+		assert.Equal(t, constants.StatusCancelled, status, name)
+	}
+
+	// Nothing was bagged or uploaded.
+	assert.NoFileExists(t, job.PackageOp.OutputPath)
+	assert.NoFileExists(t, filepath.Join(bucketOf(workflow, "Primary"), filepath.Base(job.PackageOp.OutputPath)))
+
+	result := core.NewJobResult(job)
+	assert.True(t, result.Cancelled)
+	assert.False(t, result.Succeeded)
+}
@@ -1,19 +1,36 @@
 package core
 
 import (
+	"context"
 	"fmt"
+	"path/filepath"
 	"strings"
 
 	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/util"
 )
 
+// PostValidationOperation runs a command after a bag passes validation.
+// Go commands are built into DART. System commands are external programs,
+// which run only if they appear in the Allowed Post-Validation Commands
+// setting. System command args may include {{.BagPath}} and {{.BagName}},
+// which we replace with the path and file name of the bag.
 type PostValidationOperation struct {
 	Errors           map[string]string `json:"errors"`
 	Command          string            `json:"goCommand"`
 	CommandArgs      []string          `json:"commandArgs"`
 	CommandType      string            `json:"commandType"`
 	NamedCommandArgs map[string]string `json:"namedCommandArgs"`
+	PathToBag        string            `json:"pathToBag,omitempty"`
 	Result           *OperationResult  `json:"result"`
+	TimeoutSeconds   int               `json:"timeoutSeconds,omitempty"`
+}
+
+// postValidationArgs holds the values that system command
+// arg templates can refer to.
+type postValidationArgs struct {
+	BagPath string
+	BagName string
 }
 
 func NewPostValidationGoOp(goCommand string, namedCommandArgs map[string]string) *PostValidationOperation {
@@ -27,8 +44,10 @@ func NewPostValidationGoOp(goCommand string, namedCommandArgs map[string]string)
 	}
 }
 
+// NewPostValidationSyspemOp creates an operation that runs an external
+// command. The command won't run unless it's in the Allowed Post-Validation
+// Commands setting. See AllowedPostValidationCommands.
 func NewPostValidationSyspemOp(systemCommand string, args ...string) *PostValidationOperation {
-	// TODO: Whitelist system commands.
 	return &PostValidationOperation{
 		Command:          systemCommand,
 		CommandArgs:      args,
@@ -52,12 +71,51 @@ func NewGzipAfterValidation(inputFile string, outputFile string) *PostValidation
 	}
 }
 
+// Copy returns a copy of this operation with a fresh result, so each
+// job in a workflow gets its own. The copy has no PathToBag, since
+// that's set for each job's bag when the operation runs.
+func (op *PostValidationOperation) Copy() *PostValidationOperation {
+	namedArgs := make(map[string]string)
+	for key, value := range op.NamedCommandArgs {
+		namedArgs[key] = value
+	}
+	return &PostValidationOperation{
+		Command:          op.Command,
+		CommandArgs:      append(make([]string, 0, len(op.CommandArgs)), op.CommandArgs...),
+		CommandType:      op.CommandType,
+		Errors:           make(map[string]string),
+		NamedCommandArgs: namedArgs,
+		Result:           NewOperationResult("post validate", "DART - "+constants.AppVersion),
+		TimeoutSeconds:   op.TimeoutSeconds,
+	}
+}
+
+func copyPostValidationOps(ops []*PostValidationOperation) []*PostValidationOperation {
+	if ops == nil {
+		return nil
+	}
+	opsCopy := make([]*PostValidationOperation, len(ops))
+	for i, op := range ops {
+		opsCopy[i] = op.Copy()
+	}
+	return opsCopy
+}
+
 func (op *PostValidationOperation) Validate() bool {
 	op.Errors = make(map[string]string)
 	if strings.TrimSpace(op.Command) == "" {
 		op.Errors["PostValidationOp.command"] = "You must specify either a Go command or a system command."
+	} else if op.CommandType == constants.PostValidateCommandTypeSystem {
+		if !IsAllowedPostValidationCommand(op.Command) {
+			op.Errors["PostValidationOp.command"] = fmt.Sprintf("%s: %s", constants.ErrCommandNotAllowed.Error(), op.Command)
+		}
+		for i, err := range argTemplateErrors(op.CommandArgs) {
+			op.Errors[fmt.Sprintf("PostValidationOp.commandArgs[%d]", i)] = fmt.Sprintf("Invalid template: %s", err.Error())
+		}
+	}
+	if op.TimeoutSeconds < 0 {
+		op.Errors["PostValidationOp.timeoutSeconds"] = "Timeout cannot be negative."
 	}
-	// TODO: Validate that go command has named args and sys command has args?
 	for key, value := range op.Errors {
 		Dart.Log.Infof("%s: %s", key, value)
 	}
@@ -65,13 +123,24 @@ func (op *PostValidationOperation) Validate() bool {
 }
 
 func (op *PostValidationOperation) Run(messageChannel chan *EventMessage) error {
-	var err error
-	// For now, the only operation we support is gzip, which is a golang operation.
+	return op.RunContext(context.Background(), messageChannel)
+}
 
+// RunContext is like Run, but it kills the operation's system command
+// if ctx is cancelled.
+func (op *PostValidationOperation) RunContext(ctx context.Context, messageChannel chan *EventMessage) error {
+	var err error
+	if err = ctx.Err(); err != nil {
+		return err
+	}
 	if messageChannel != nil {
 		//progress = NewStreamProgress(u.PayloadSize, messageChannel)
 		messageChannel <- StartEvent(constants.StagePostValidation, fmt.Sprintf("Running post-validation command %s", op.Command))
 	}
+	if op.CommandType == constants.PostValidateCommandTypeSystem {
+		return op.runSystemCommand(ctx)
+	}
+	// The only Go operation we support is gzip.
 	switch op.Command {
 	case constants.PostValidateGzipCommand:
 		_, err = GzipCompress(op.NamedCommandArgs["inputFile"], op.NamedCommandArgs["outputFile"])
@@ -80,3 +149,43 @@ func (op *PostValidationOperation) Run(messageChannel chan *EventMessage) error
 	}
 	return err
 }
+
+// AllowedPostValidationCommands returns the system commands that
+// post-validation operations may run. An administrator lists these in the
+// Allowed Post-Validation Commands setting, one per line or separated by
+// commas. Workflows and jobs can't add to this list, so a workflow or job
+// file from elsewhere can't run arbitrary programs.
+func AllowedPostValidationCommands() []string {
+	return allowedCommands(constants.AllowedPostValidationCommands)
+}
+
+// IsAllowedPostValidationCommand returns true if command exactly
+// matches one of the AllowedPostValidationCommands.
+func IsAllowedPostValidationCommand(command string) bool {
+	return util.StringListContains(AllowedPostValidationCommands(), command)
+}
+
+// ExpandArgs returns this operation's command args, with {{.BagPath}}
+// and {{.BagName}} replaced by the path and name of the bag. Since a
+// bad value here could let a command do something we don't intend, this
+// returns an error if any expanded arg isn't shell safe.
+func (op *PostValidationOperation) ExpandArgs() ([]string, error) {
+	data := postValidationArgs{
+		BagPath: op.PathToBag,
+		BagName: filepath.Base(op.PathToBag),
+	}
+	return expandCommandArgs(op.CommandArgs, data)
+}
+
+// runSystemCommand runs an allowed system command, without a shell,
+// capturing its stdout and stderr in the operation's result.
+func (op *PostValidationOperation) runSystemCommand(ctx context.Context) error {
+	if !IsAllowedPostValidationCommand(op.Command) {
+		return fmt.Errorf("%w: %s", constants.ErrCommandNotAllowed, op.Command)
+	}
+	args, err := op.ExpandArgs()
+	if err != nil {
+		return err
+	}
+	return runSystemCommand(ctx, op.Command, args, op.TimeoutSeconds, op.Result)
+}
@@ -0,0 +1,140 @@
+package core_test
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// allowPostValidationCommands saves the allowlist setting for the
+// duration of a test.
+func allowPostValidationCommands(t *testing.T, commands string) {
+	setting := core.NewAppSetting(constants.AllowedPostValidationCommands, commands)
+	require.NoError(t, core.ObjSave(setting))
+	t.Cleanup(func() {
+		assert.NoError(t, core.ObjDelete(setting))
+	})
+}
+
+func writeTestScript(t *testing.T, dir, name, script string) string {
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(path, []byte("#!/bin/sh\n"+script), 0700))
+	return path
+}
+
+func TestPostValidationSystemCommandNotAllowed(t *testing.T) {
+	assert.Empty(t, core.AllowedPostValidationCommands())
+
+	op := core.NewPostValidationSyspemOp("/bin/echo", "{{.BagPath}}")
+	op.PathToBag = "/tmp/my_bag.tar"
+	assert.False(t, op.Validate())
+	assert.Contains(t, op.Errors["PostValidationOp.command"], "not in the list of allowed")
+
+	op.Result.Start()
+	err := op.Run(nil)
+	assert.ErrorIs(t, err, constants.ErrCommandNotAllowed)
+
+	// Job validation catches this too.
+	job := core.NewJob()
+	job.PostValidationOps = []*core.PostValidationOperation{op}
+	assert.False(t, job.Validate())
+	assert.NotEmpty(t, job.Errors["Job.PostValidationOp[0].command"])
+}
+
+func TestPostValidationSystemCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("helper scripts in this test require a posix shell")
+	}
+	dir := t.TempDir()
+	echo := writeTestScript(t, dir, "echo.sh", "echo \"$@\"\necho to stderr >&2\n")
+	fail := writeTestScript(t, dir, "fail.sh", "echo something broke >&2\nexit 3\n")
+	slow := writeTestScript(t, dir, "slow.sh", "exec sleep 5\n")
+	allowPostValidationCommands(t, echo+"\n"+fail+", "+slow)
+	assert.Equal(t, []string{echo, fail, slow}, core.AllowedPostValidationCommands())
+
+	op := core.NewPostValidationSyspemOp(echo, "--bag={{.BagPath}}", "{{.BagName}}")
+	op.PathToBag = "/tmp/bags/my_bag.tar"
+	require.True(t, op.Validate(), op.Errors)
+	op.Result.Start()
+	require.NoError(t, op.Run(nil))
+	assert.Equal(t, "--bag=/tmp/bags/my_bag.tar my_bag.tar\n", op.Result.Stdout)
+	assert.Equal(t, "to stderr\n", op.Result.Stderr)
+
+	// Expanded args must be shell safe.
+	op.PathToBag = "/tmp/bags/my bag; rm -rf ~.tar"
+	op.Result.Start()
+	err := op.Run(nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "not shell safe")
+
+	// Templates may only refer to the values we provide.
+	op = core.NewPostValidationSyspemOp(echo, "{{.Password}}")
+	op.Result.Start()
+	assert.Error(t, op.Run(nil))
+	op = core.NewPostValidationSyspemOp(echo, "{{.BagPath")
+	assert.False(t, op.Validate())
+	assert.Contains(t, op.Errors["PostValidationOp.commandArgs[0]"], "Invalid template")
+
+	op = core.NewPostValidationSyspemOp(fail)
+	op.Result.Start()
+	err = op.Run(nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "exit status 3")
+	assert.Equal(t, "something broke\n", op.Result.Stderr)
+
+	op = core.NewPostValidationSyspemOp(slow)
+	op.TimeoutSeconds = 1
+	op.Result.Start()
+	err = op.Run(nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "did not finish within 1s")
+
+	// The allowlist must match exactly.
+	op = core.NewPostValidationSyspemOp(filepath.Join(dir, ".", "echo.sh") + " ")
+	assert.False(t, op.Validate())
+}
+
+func TestPostValidationOpsFromWorkflow(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("helper scripts in this test require a posix shell")
+	}
+	dir := t.TempDir()
+	echo := writeTestScript(t, dir, "echo.sh", "echo \"$@\"\n")
+	allowPostValidationCommands(t, echo)
+
+	workflow := getPipelineTestWorkflow(t, []*core.StageDefinition{
+		{Type: constants.StagePackage},
+		{Type: constants.StageValidation},
+		{Type: constants.StagePostValidation},
+	})
+	workflow.PostValidationOps = []*core.PostValidationOperation{
+		core.NewPostValidationSyspemOp(echo, "{{.BagName}}"),
+	}
+	require.True(t, workflow.Validate(), workflow.Errors)
+	require.Len(t, workflow.Copy().PostValidationOps, 1)
+	assert.NotSame(t, workflow.PostValidationOps[0], workflow.Copy().PostValidationOps[0])
+
+	// Workflow validation checks the ops.
+	badWorkflow := workflow.Copy()
+	badWorkflow.PostValidationOps = append(badWorkflow.PostValidationOps, core.NewPostValidationSyspemOp("/bin/echo"))
+	assert.False(t, badWorkflow.Validate())
+	assert.NotEmpty(t, badWorkflow.Errors["PostValidationOp[1].command"])
+
+	job := getPipelineTestJob(t, workflow)
+	require.Len(t, job.PostValidationOps, 1)
+	assert.NotSame(t, workflow.PostValidationOps[0], job.PostValidationOps[0])
+	require.True(t, job.Validate(), job.Errors)
+	assert.Equal(t, constants.ExitOK, core.RunJob(job, false, true, false))
+	assert.Equal(t, filepath.Base(job.PackageOp.OutputPath)+"\n", job.PostValidationOps[0].Result.Stdout)
+	assert.Empty(t, workflow.PostValidationOps[0].Result.Stdout, "workflow's op should not record job results")
+	assert.Empty(t, workflow.PostValidationOps[0].PathToBag)
+
+	// Jobs made directly from the workflow get the ops too.
+	assert.Len(t, core.JobFromWorkflow(workflow).PostValidationOps, 1)
+}
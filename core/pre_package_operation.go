@@ -0,0 +1,262 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/util"
+)
+
+// PrePackageOperation runs a command against a job's source files before
+// DART bags them, to scan, normalize or describe them. If the command
+// fails, the job doesn't package the files.
+//
+// Go commands are built into DART. DART.clamd sends each source file to
+// a clamd virus scanner, and fails if any file is infected. Its named arg
+// "address" is the clamd socket, which defaults to
+// /var/run/clamav/clamd.ctl.
+//
+// System commands are external programs, which run only if they appear in
+// the Allowed Pre-Packaging Commands setting. A system command runs once
+// for each of the job's source files or directories. Its args may include
+// {{.SourcePath}}, {{.SourceName}} and {{.PackageName}}.
+//
+// If TagsFromOutput is true, output lines like
+// "bag-info.txt/Source-Organization: Example University" set the value of
+// that tag in the job's bag.
+type PrePackageOperation struct {
+	Command          string            `json:"command"`
+	CommandArgs      []string          `json:"commandArgs"`
+	CommandType      string            `json:"commandType"`
+	Errors           map[string]string `json:"errors"`
+	NamedCommandArgs map[string]string `json:"namedCommandArgs"`
+	PackageName      string            `json:"packageName,omitempty"`
+	Result           *OperationResult  `json:"result"`
+	SourceFiles      []string          `json:"sourceFiles,omitempty"`
+	TagsFromOutput   bool              `json:"tagsFromOutput,omitempty"`
+	TimeoutSeconds   int               `json:"timeoutSeconds,omitempty"`
+}
+
+// prePackageArgs holds the values that system command
+// arg templates can refer to.
+type prePackageArgs struct {
+	SourcePath  string
+	SourceName  string
+	PackageName string
+}
+
+// NewPrePackageGoOp creates an operation that runs one of DART's
+// built-in commands, such as DART.clamd.
+func NewPrePackageGoOp(goCommand string, namedCommandArgs map[string]string) *PrePackageOperation {
+	return &PrePackageOperation{
+		Command:          goCommand,
+		CommandArgs:      make([]string, 0),
+		CommandType:      constants.PostValidateCommandTypeGo,
+		Errors:           make(map[string]string),
+		NamedCommandArgs: namedCommandArgs,
+		Result:           NewOperationResult("pre-package", "DART - "+constants.AppVersion),
+	}
+}
+
+// NewPrePackageSystemOp creates an operation that runs an external
+// command. The command won't run unless it's in the Allowed
+// Pre-Packaging Commands setting.
+func NewPrePackageSystemOp(systemCommand string, args ...string) *PrePackageOperation {
+	return &PrePackageOperation{
+		Command:          systemCommand,
+		CommandArgs:      args,
+		CommandType:      constants.PostValidateCommandTypeSystem,
+		Errors:           make(map[string]string),
+		NamedCommandArgs: make(map[string]string),
+		Result:           NewOperationResult("pre-package", "DART - "+constants.AppVersion),
+	}
+}
+
+// Copy returns a copy of this operation with a fresh result, so each
+// job in a workflow gets its own.
+func (op *PrePackageOperation) Copy() *PrePackageOperation {
+	namedArgs := make(map[string]string)
+	for key, value := range op.NamedCommandArgs {
+		namedArgs[key] = value
+	}
+	return &PrePackageOperation{
+		Command:          op.Command,
+		CommandArgs:      append(make([]string, 0, len(op.CommandArgs)), op.CommandArgs...),
+		CommandType:      op.CommandType,
+		Errors:           make(map[string]string),
+		NamedCommandArgs: namedArgs,
+		Result:           NewOperationResult("pre-package", "DART - "+constants.AppVersion),
+		TagsFromOutput:   op.TagsFromOutput,
+		TimeoutSeconds:   op.TimeoutSeconds,
+	}
+}
+
+func copyPrePackageOps(ops []*PrePackageOperation) []*PrePackageOperation {
+	if ops == nil {
+		return nil
+	}
+	opsCopy := make([]*PrePackageOperation, len(ops))
+	for i, op := range ops {
+		opsCopy[i] = op.Copy()
+	}
+	return opsCopy
+}
+
+func (op *PrePackageOperation) Validate() bool {
+	op.Errors = make(map[string]string)
+	if strings.TrimSpace(op.Command) == "" {
+		op.Errors["PrePackageOp.command"] = "You must specify either a Go command or a system command."
+	} else if op.CommandType == constants.PostValidateCommandTypeSystem {
+		if !IsAllowedPrePackageCommand(op.Command) {
+			op.Errors["PrePackageOp.command"] = fmt.Sprintf("%s: %s", constants.ErrCommandNotAllowed.Error(), op.Command)
+		}
+		for i, err := range argTemplateErrors(op.CommandArgs) {
+			op.Errors[fmt.Sprintf("PrePackageOp.commandArgs[%d]", i)] = fmt.Sprintf("Invalid template: %s", err.Error())
+		}
+	} else if op.Command != constants.PrePackageClamdCommand {
+		op.Errors["PrePackageOp.command"] = fmt.Sprintf("Unsupported pre-packaging operation: %s", op.Command)
+	}
+	if op.TimeoutSeconds < 0 {
+		op.Errors["PrePackageOp.timeoutSeconds"] = "Timeout cannot be negative."
+	}
+	return len(op.Errors) == 0
+}
+
+// Run runs this operation against each of its source files. It returns
+// an error if the command fails or, for virus scans, if it finds an
+// infected file.
+func (op *PrePackageOperation) Run(messageChannel chan *EventMessage) error {
+	return op.RunContext(context.Background(), messageChannel)
+}
+
+// RunContext is like Run, but it stops scanning, or kills the system
+// command, if ctx is cancelled.
+func (op *PrePackageOperation) RunContext(ctx context.Context, messageChannel chan *EventMessage) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if messageChannel != nil {
+		messageChannel <- StartEvent(constants.StagePrePackage, fmt.Sprintf("Running pre-packaging command %s", op.Command))
+	}
+	if op.CommandType == constants.PostValidateCommandTypeSystem {
+		return op.runSystemCommand(ctx)
+	}
+	switch op.Command {
+	case constants.PrePackageClamdCommand:
+		return op.runClamdScan(ctx)
+	default:
+		return fmt.Errorf("Unsupported pre-packaging operation: %s", op.Command)
+	}
+}
+
+// OutputTags returns the tags this operation's output sets, if
+// TagsFromOutput is true.
+func (op *PrePackageOperation) OutputTags() []*Tag {
+	tags := make([]*Tag, 0)
+	if !op.TagsFromOutput || op.Result == nil {
+		return tags
+	}
+	for _, line := range strings.Split(op.Result.Stdout, "\n") {
+		name, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		tagFile, tagName, found := strings.Cut(strings.TrimSpace(name), "/")
+		if !found || !strings.HasSuffix(tagFile, ".txt") || tagName == "" || strings.ContainsAny(tagName, "/ ") {
+			continue
+		}
+		tags = append(tags, NewTag(tagFile, tagName, strings.TrimSpace(value)))
+	}
+	return tags
+}
+
+// AllowedPrePackageCommands returns the system commands that pre-packaging
+// operations may run. Like AllowedPostValidationCommands, these come from
+// a setting that workflows and jobs can't change.
+func AllowedPrePackageCommands() []string {
+	return allowedCommands(constants.AllowedPrePackageCommands)
+}
+
+// IsAllowedPrePackageCommand returns true if command exactly
+// matches one of the AllowedPrePackageCommands.
+func IsAllowedPrePackageCommand(command string) bool {
+	return util.StringListContains(AllowedPrePackageCommands(), command)
+}
+
+// runSystemCommand runs the command once for each source file,
+// collecting the output of all runs. It stops at the first failure.
+func (op *PrePackageOperation) runSystemCommand(ctx context.Context) error {
+	if !IsAllowedPrePackageCommand(op.Command) {
+		return fmt.Errorf("%w: %s", constants.ErrCommandNotAllowed, op.Command)
+	}
+	var stdout, stderr strings.Builder
+	defer func() {
+		op.Result.Stdout = truncateOutput(stdout.String())
+		op.Result.Stderr = truncateOutput(stderr.String())
+	}()
+	for _, sourcePath := range op.SourceFiles {
+		data := prePackageArgs{
+			SourcePath:  sourcePath,
+			SourceName:  filepath.Base(sourcePath),
+			PackageName: op.PackageName,
+		}
+		args, err := expandCommandArgs(op.CommandArgs, data)
+		if err != nil {
+			return err
+		}
+		runResult := NewOperationResult("pre-package", op.Result.Provider)
+		err = runSystemCommand(ctx, op.Command, args, op.TimeoutSeconds, runResult)
+		stdout.WriteString(runResult.Stdout)
+		stderr.WriteString(runResult.Stderr)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runClamdScan sends every file under the source paths to clamd.
+func (op *PrePackageOperation) runClamdScan(ctx context.Context) error {
+	address := op.NamedCommandArgs["address"]
+	if address == "" {
+		address = constants.PrePackageDefaultClamdSocket
+	}
+	timeout := DefaultCommandTimeout
+	if op.TimeoutSeconds > 0 {
+		timeout = time.Duration(op.TimeoutSeconds) * time.Second
+	}
+	infected := make([]string, 0)
+	fileCount := 0
+	for _, sourcePath := range op.SourceFiles {
+		files, err := util.RecursiveFileList(sourcePath, false)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if !file.Mode().IsRegular() {
+				continue
+			}
+			signature, err := ClamdScan(address, file.FullPath, timeout)
+			if err != nil {
+				return err
+			}
+			fileCount++
+			if signature != "" {
+				infected = append(infected, fmt.Sprintf("%s: %s", file.FullPath, signature))
+			}
+		}
+	}
+	if len(infected) > 0 {
+		op.Result.Stdout = strings.Join(infected, "\n") + "\n"
+		return fmt.Errorf("%w: %s", constants.ErrVirusFound, strings.Join(infected, "; "))
+	}
+	op.Result.Info = fmt.Sprintf("Scanned %d files. No viruses found.", fileCount)
+	return nil
+}
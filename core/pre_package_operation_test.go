@@ -0,0 +1,295 @@
+package core_test
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/core"
+	"github.com/APTrust/dart-runner/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClamd is a minimal clamd that understands zSCAN and zINSTREAM
+// and reports any file containing "EICAR" as infected.
+type fakeClamd struct {
+	// maxStream is like clamd's StreamMaxLength. Zero means no limit.
+	maxStream int
+	// unreadable is a path that SCAN can't read, as when the clamd
+	// user doesn't have permission.
+	unreadable string
+	mutex      sync.Mutex
+	commands   []string
+}
+
+// startFakeClamd runs a fakeClamd on TCP and returns its address.
+func startFakeClamd(t *testing.T) string {
+	return (&fakeClamd{}).start(t, "tcp", "127.0.0.1:0")
+}
+
+func (c *fakeClamd) start(t *testing.T, network, address string) string {
+	listener, err := net.Listen(network, address)
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go c.serve(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func (c *fakeClamd) commandsReceived() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]string{}, c.commands...)
+}
+
+func (c *fakeClamd) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	command, err := reader.ReadString('\x00')
+	if err != nil {
+		return
+	}
+	command = strings.TrimSuffix(command, "\x00")
+	c.mutex.Lock()
+	c.commands = append(c.commands, strings.Fields(command)[0])
+	c.mutex.Unlock()
+	if path, ok := strings.CutPrefix(command, "zSCAN "); ok {
+		data, err := os.ReadFile(path)
+		if err != nil || path == c.unreadable {
+			conn.Write([]byte(path + ": lstat() failed: Permission denied. ERROR\x00"))
+		} else {
+			conn.Write([]byte(c.result(path, string(data))))
+		}
+		return
+	}
+	if command != "zINSTREAM" {
+		conn.Write([]byte("UNKNOWN COMMAND\x00"))
+		return
+	}
+	var content strings.Builder
+	size := make([]byte, 4)
+	for {
+		if _, err = io.ReadFull(reader, size); err != nil {
+			return
+		}
+		n := binary.BigEndian.Uint32(size)
+		if n == 0 {
+			break
+		}
+		chunk := make([]byte, n)
+		if _, err = io.ReadFull(reader, chunk); err != nil {
+			return
+		}
+		content.Write(chunk)
+		if c.maxStream > 0 && content.Len() > c.maxStream {
+			conn.Write([]byte("INSTREAM size limit exceeded. ERROR\x00"))
+			return
+		}
+	}
+	conn.Write([]byte(c.result("stream", content.String())))
+}
+
+func (c *fakeClamd) result(name, content string) string {
+	if strings.Contains(content, "EICAR") {
+		return name + ": Eicar-Test-Signature FOUND\x00"
+	}
+	return name + ": OK\x00"
+}
+
+func TestClamdScan(t *testing.T) {
+	address := startFakeClamd(t)
+	dir := t.TempDir()
+	clean := filepath.Join(dir, "clean.txt")
+	infected := filepath.Join(dir, "infected.txt")
+	require.NoError(t, os.WriteFile(clean, []byte(strings.Repeat("nothing to see here ", 10000)), 0644))
+	require.NoError(t, os.WriteFile(infected, []byte("X5O!P%@AP EICAR test file"), 0644))
+
+	signature, err := core.ClamdScan(address, clean, 5*time.Second)
+	require.NoError(t, err)
+	assert.Empty(t, signature)
+
+	signature, err = core.ClamdScan("tcp:"+address, infected, 5*time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "Eicar-Test-Signature", signature)
+
+	_, err = core.ClamdScan(filepath.Join(dir, "no-such.sock"), clean, time.Second)
+	assert.Error(t, err)
+}
+
+func TestClamdScanLocalSocket(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("this test requires unix sockets")
+	}
+	dir := t.TempDir()
+	clean := filepath.Join(dir, "clean.txt")
+	infected := filepath.Join(dir, "infected.txt")
+	unreadable := filepath.Join(dir, "unreadable.txt")
+	require.NoError(t, os.WriteFile(clean, []byte("nothing to see here"), 0644))
+	require.NoError(t, os.WriteFile(infected, []byte("X5O!P%@AP EICAR test file"), 0644))
+	require.NoError(t, os.WriteFile(unreadable, []byte("X5O!P%@AP EICAR test file"), 0644))
+	clamd := &fakeClamd{unreadable: unreadable}
+	socket := clamd.start(t, "unix", filepath.Join(dir, "clamd.sock"))
+
+	// clamd reads files on this machine itself.
+	signature, err := core.ClamdScan(socket, clean, 5*time.Second)
+	require.NoError(t, err)
+	assert.Empty(t, signature)
+	signature, err = core.ClamdScan("unix:"+socket, infected, 5*time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "Eicar-Test-Signature", signature)
+	assert.Equal(t, []string{"zSCAN", "zSCAN"}, clamd.commandsReceived())
+
+	// If clamd can't read a file, we stream it.
+	signature, err = core.ClamdScan(socket, unreadable, 5*time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "Eicar-Test-Signature", signature)
+	assert.Equal(t, []string{"zSCAN", "zSCAN", "zSCAN", "zINSTREAM"}, clamd.commandsReceived())
+}
+
+func TestClamdScanStreamTooLarge(t *testing.T) {
+	clamd := &fakeClamd{maxStream: 100 * 1024}
+	address := clamd.start(t, "tcp", "127.0.0.1:0")
+	dir := t.TempDir()
+	small := filepath.Join(dir, "small.txt")
+	large := filepath.Join(dir, "large.txt")
+	require.NoError(t, os.WriteFile(small, []byte(strings.Repeat("x", 90*1024)), 0644))
+	require.NoError(t, os.WriteFile(large, []byte(strings.Repeat("x", 4*1024*1024)), 0644))
+
+	// The limit applies to the whole stream, not to each chunk.
+	signature, err := core.ClamdScan(address, small, 5*time.Second)
+	require.NoError(t, err)
+	assert.Empty(t, signature)
+
+	_, err = core.ClamdScan(address, large, 5*time.Second)
+	require.Error(t, err)
+	assert.ErrorIs(t, err, constants.ErrClamdStreamTooLarge)
+	assert.Contains(t, err.Error(), "StreamMaxLength")
+}
+
+func TestPrePackageClamdOp(t *testing.T) {
+	address := startFakeClamd(t)
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "sub"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a.txt"), []byte("clean"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "sub", "b.txt"), []byte("clean too"), 0644))
+
+	op := core.NewPrePackageGoOp(constants.PrePackageClamdCommand, map[string]string{"address": address})
+	op.SourceFiles = []string{dir}
+	require.True(t, op.Validate(), op.Errors)
+	op.Result.Start()
+	require.NoError(t, op.Run(nil))
+	assert.Equal(t, "Scanned 2 files. No viruses found.", op.Result.Info)
+
+	infected := filepath.Join(dir, "sub", "eicar.com")
+	require.NoError(t, os.WriteFile(infected, []byte("EICAR"), 0644))
+	op.Result.Start()
+	err := op.Run(nil)
+	require.ErrorIs(t, err, constants.ErrVirusFound)
+	assert.Contains(t, err.Error(), infected+": Eicar-Test-Signature")
+
+	op = core.NewPrePackageGoOp("DART.unknown", nil)
+	assert.False(t, op.Validate())
+}
+
+func TestPrePackageSystemOp(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("helper scripts in this test require a posix shell")
+	}
+	dir := t.TempDir()
+	describe := writeTestScript(t, dir, "describe.sh", "echo \"scanned $1 for $2\"\necho \"bag-info.txt/Source-Organization: Example University\"\necho \"not a tag: skipped\"\n")
+
+	op := core.NewPrePackageSystemOp(describe, "{{.SourceName}}", "{{.PackageName}}")
+	op.SourceFiles = []string{"/data/photos", "/data/letters"}
+	op.PackageName = "my_bag.tar"
+	op.TagsFromOutput = true
+	assert.False(t, op.Validate(), "command is not allowed yet")
+	op.Result.Start()
+	assert.ErrorIs(t, op.Run(nil), constants.ErrCommandNotAllowed)
+
+	setting := core.NewAppSetting(constants.AllowedPrePackageCommands, describe)
+	require.NoError(t, core.ObjSave(setting))
+	defer func() { assert.NoError(t, core.ObjDelete(setting)) }()
+	assert.Equal(t, []string{describe}, core.AllowedPrePackageCommands())
+
+	require.True(t, op.Validate(), op.Errors)
+	op.Result.Start()
+	require.NoError(t, op.Run(nil))
+	assert.Contains(t, op.Result.Stdout, "scanned photos for my_bag.tar\n")
+	assert.Contains(t, op.Result.Stdout, "scanned letters for my_bag.tar\n")
+
+	tags := op.OutputTags()
+	require.Len(t, tags, 2, "one tag for each source directory")
+	assert.Equal(t, "bag-info.txt", tags[0].TagFile)
+	assert.Equal(t, "Source-Organization", tags[0].TagName)
+	assert.Equal(t, "Example University", tags[0].Value)
+
+	op.TagsFromOutput = false
+	assert.Empty(t, op.OutputTags())
+
+	// Copies get their own results.
+	opCopy := op.Copy()
+	assert.Equal(t, op.Command, opCopy.Command)
+	assert.Empty(t, opCopy.Result.Stdout)
+}
+
+func TestPrePackageStage(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("helper scripts in this test require a posix shell")
+	}
+	dir := t.TempDir()
+	tagger := writeTestScript(t, dir, "tagger.sh", "echo \"bag-info.txt/Internal-Sender-Description: Screened by tagger\"\n")
+	veto := writeTestScript(t, dir, "veto.sh", "echo rejected >&2\nexit 1\n")
+	setting := core.NewAppSetting(constants.AllowedPrePackageCommands, tagger+"\n"+veto)
+	require.NoError(t, core.ObjSave(setting))
+	defer func() { assert.NoError(t, core.ObjDelete(setting)) }()
+
+	// Tags from the pre-packaging command end up in the bag's profile.
+	workflow := getPipelineTestWorkflow(t, []*core.StageDefinition{
+		{Type: constants.StagePrePackage},
+		{Type: constants.StagePackage},
+	})
+	tagOp := core.NewPrePackageSystemOp(tagger)
+	tagOp.TagsFromOutput = true
+	workflow.PrePackageOps = []*core.PrePackageOperation{tagOp}
+	require.True(t, workflow.Validate(), workflow.Errors)
+	job := getPipelineTestJob(t, workflow)
+	require.Len(t, job.PrePackageOps, 1)
+	require.True(t, job.Validate(), job.Errors)
+	assert.Equal(t, constants.ExitOK, core.RunJob(job, false, true, false))
+	tagDef := job.BagItProfile.GetTagDef("bag-info.txt", "Internal-Sender-Description")
+	require.NotNil(t, tagDef)
+	assert.Equal(t, "Screened by tagger", tagDef.UserValue)
+	assert.True(t, util.FileExists(job.PackageOp.OutputPath))
+	assert.Empty(t, workflow.PrePackageOps[0].Result.Stdout, "workflow's op should not record job results")
+
+	// A failing command vetoes packaging.
+	workflow.PrePackageOps = []*core.PrePackageOperation{core.NewPrePackageSystemOp(veto)}
+	job = getPipelineTestJob(t, workflow)
+	require.True(t, job.Validate(), job.Errors)
+	assert.Equal(t, constants.ExitRuntimeErr, core.RunJob(job, false, true, false))
+	assert.False(t, job.PackageOp.Result.WasAttempted())
+	assert.False(t, util.FileExists(job.PackageOp.OutputPath))
+	assert.Equal(t, "rejected\n", job.PrePackageOps[0].Result.Stderr)
+	result := core.NewJobResult(job)
+	assert.False(t, result.Succeeded)
+	require.Len(t, result.PrePackageResults, 1)
+	require.Len(t, job.StageResults, 1, "pipeline stops at the failed stage")
+	assert.Equal(t, constants.StatusFailed, job.StageResults[0].Status)
+}
@@ -0,0 +1,290 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/util"
+)
+
+// bagItAlgorithms are the digest algorithms mentioned in the BagIt spec.
+// DART itself supports only constants.PreferredAlgsInOrder.
+var bagItAlgorithms = []string{"md5", "sha1", "sha224", "sha256", "sha384", "sha512"}
+
+// ProfileLintReport describes problems in a BagIt profile that
+// BagItProfile.Validate doesn't catch. Errors are settings that
+// contradict each other, so that no bag (or no bag DART can produce)
+// could satisfy the profile. Warnings are settings that are legal
+// but probably not what the author intended. Both are keyed by profile
+// field name or fully qualified tag name.
+type ProfileLintReport struct {
+	ProfileID   string            `json:"profileId"`
+	ProfileName string            `json:"profileName"`
+	Errors      map[string]string `json:"errors"`
+	Warnings    map[string]string `json:"warnings"`
+}
+
+// NewProfileLintReport returns an empty lint report for profile p.
+func NewProfileLintReport(p *BagItProfile) *ProfileLintReport {
+	return &ProfileLintReport{
+		ProfileID:   p.ID,
+		ProfileName: p.Name,
+		Errors:      make(map[string]string),
+		Warnings:    make(map[string]string),
+	}
+}
+
+// HasErrors returns true if the lint report contains any errors.
+func (r *ProfileLintReport) HasErrors() bool {
+	return len(r.Errors) > 0
+}
+
+// ToJSON returns a JSON representation of this report.
+func (r *ProfileLintReport) ToJSON() (string, error) {
+	data, err := json.MarshalIndent(r, "", "  ")
+	return string(data), err
+}
+
+func (r *ProfileLintReport) addError(key, message string) {
+	r.Errors[key] = appendMessage(r.Errors[key], message)
+}
+
+func (r *ProfileLintReport) addWarning(key, message string) {
+	r.Warnings[key] = appendMessage(r.Warnings[key], message)
+}
+
+func appendMessage(existing, message string) string {
+	if existing == "" {
+		return message
+	}
+	return existing + " " + message
+}
+
+// Lint checks this profile for contradictory or suspicious settings.
+// It includes the results of Validate in the report's errors.
+func (p *BagItProfile) Lint() *ProfileLintReport {
+	report := NewProfileLintReport(p)
+	p.Validate()
+	for key, value := range p.Errors {
+		report.addError(key, value)
+	}
+	p.lintAlgorithms(report, "ManifestsAllowed", p.ManifestsAllowed)
+	p.lintAlgorithms(report, "ManifestsRequired", p.ManifestsRequired)
+	p.lintAlgorithms(report, "TagManifestsAllowed", p.TagManifestsAllowed)
+	p.lintAlgorithms(report, "TagManifestsRequired", p.TagManifestsRequired)
+	for _, alg := range p.ManifestsRequired {
+		if !util.StringListContains(p.ManifestsAllowed, alg) {
+			report.addError("ManifestsRequired", fmt.Sprintf("Manifest algorithm %s is required but not allowed.", alg))
+		}
+	}
+	for _, alg := range p.TagManifestsRequired {
+		if !util.StringListContains(p.TagManifestsAllowed, alg) {
+			report.addError("TagManifestsRequired", fmt.Sprintf("Tag manifest algorithm %s is required but not allowed.", alg))
+		}
+	}
+	if p.Serialization == constants.SerializationRequired && util.IsEmptyStringList(p.AcceptSerialization) {
+		report.addError("AcceptSerialization", "Serialization is required, but no serialization formats are accepted.")
+	}
+	if p.Serialization == constants.SerializationForbidden && !util.IsEmptyStringList(p.AcceptSerialization) {
+		report.addWarning("AcceptSerialization", "Serialization is forbidden, so accepted serialization formats will be ignored.")
+	}
+	for _, tagFile := range p.TagFilesRequired {
+		if !p.tagFileAllowed(tagFile) {
+			report.addError("TagFilesRequired", fmt.Sprintf("Tag file %s is required but not allowed.", tagFile))
+		}
+	}
+	p.lintTags(report)
+	return report
+}
+
+// lintAlgorithms flags digest algorithms that aren't in the BagIt spec
+// (errors) or that are in the spec but DART can't calculate (warnings).
+func (p *BagItProfile) lintAlgorithms(report *ProfileLintReport, field string, algs []string) {
+	for _, alg := range algs {
+		if !util.StringListContains(bagItAlgorithms, alg) {
+			report.addError(field, fmt.Sprintf("Unknown digest algorithm %s.", alg))
+		} else if !util.StringListContains(constants.PreferredAlgsInOrder, alg) {
+			report.addWarning(field, fmt.Sprintf("DART cannot calculate %s digests.", alg))
+		}
+	}
+}
+
+func (p *BagItProfile) lintTags(report *ProfileLintReport) {
+	seen := make(map[string]*TagDefinition)
+	for _, tagDef := range p.Tags {
+		name := tagDef.FullyQualifiedName()
+		key := strings.ToLower(name)
+		if previous, exists := seen[key]; exists {
+			if previous.Required != tagDef.Required || previous.DefaultValue != tagDef.DefaultValue || previous.EmptyOK != tagDef.EmptyOK || !slices.Equal(previous.Values, tagDef.Values) {
+				report.addError(name, "Tag is defined more than once, with conflicting definitions.")
+			} else {
+				report.addWarning(name, "Tag is defined more than once.")
+			}
+		} else {
+			seen[key] = tagDef
+		}
+		if tagDef.Required && tagDef.EmptyOK && len(tagDef.Values) == 0 {
+			report.addWarning(name, "Tag is required but may be empty and has no list of allowed values, so any bag that includes the tag will pass.")
+		}
+		if tagDef.DefaultValue != "" && len(tagDef.Values) > 0 && !util.StringListContains(tagDef.Values, tagDef.DefaultValue) {
+			report.addError(name, fmt.Sprintf("Default value '%s' is not one of the allowed values.", tagDef.DefaultValue))
+		}
+		if tagDef.Required && tagDef.TagFile != "bagit.txt" && !p.tagFileAllowed(tagDef.TagFile) {
+			report.addError(name, fmt.Sprintf("Tag is required, but tag file %s is not allowed.", tagDef.TagFile))
+		}
+	}
+}
+
+// ProfileCompatibilityReport describes the ways in which a bag that is
+// valid under one profile could be invalid under another. The report
+// describes potential failures, not certain ones. For example, if profile
+// B requires a tag that profile A does not, a bag that's valid under A
+// fails B only if it happens to omit that tag.
+type ProfileCompatibilityReport struct {
+	ProfileA        string   `json:"profileA"`
+	ProfileB        string   `json:"profileB"`
+	ValidAMayFailB  []string `json:"validAMayFailB"`
+	ValidBMayFailA  []string `json:"validBMayFailA"`
+	FullyCompatible bool     `json:"fullyCompatible"`
+}
+
+// CompareProfiles returns a report describing which bags that are valid
+// under profile a might fail validation under profile b, and vice versa.
+func CompareProfiles(a, b *BagItProfile) *ProfileCompatibilityReport {
+	report := &ProfileCompatibilityReport{
+		ProfileA:       a.Name,
+		ProfileB:       b.Name,
+		ValidAMayFailB: profileIncompatibilities(a, b),
+		ValidBMayFailA: profileIncompatibilities(b, a),
+	}
+	report.FullyCompatible = len(report.ValidAMayFailB) == 0 && len(report.ValidBMayFailA) == 0
+	return report
+}
+
+// ToJSON returns a JSON representation of this report.
+func (r *ProfileCompatibilityReport) ToJSON() (string, error) {
+	data, err := json.MarshalIndent(r, "", "  ")
+	return string(data), err
+}
+
+// profileIncompatibilities returns a list of reasons a bag that is valid
+// under profile a may fail validation under profile b.
+func profileIncompatibilities(a, b *BagItProfile) []string {
+	problems := make([]string, 0)
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	for _, version := range a.AcceptBagItVersion {
+		if version != "" && !util.StringListContains(b.AcceptBagItVersion, version) {
+			add("BagIt version %s is accepted by %s but not by %s.", version, a.Name, b.Name)
+		}
+	}
+
+	aAllowsUnserialized := a.Serialization != constants.SerializationRequired
+	aAllowsSerialized := a.Serialization != constants.SerializationForbidden
+	if aAllowsUnserialized && b.Serialization == constants.SerializationRequired {
+		add("Unserialized bags are allowed by %s but %s requires serialization.", a.Name, b.Name)
+	}
+	if aAllowsSerialized && b.Serialization == constants.SerializationForbidden {
+		add("Serialized bags are allowed by %s but %s forbids serialization.", a.Name, b.Name)
+	}
+	if aAllowsSerialized && b.Serialization != constants.SerializationForbidden {
+		for _, format := range a.AcceptSerialization {
+			if format != "" && !util.StringListContains(b.AcceptSerialization, format) {
+				add("Serialization format %s is accepted by %s but not by %s.", format, a.Name, b.Name)
+			}
+		}
+	}
+
+	for _, alg := range b.ManifestsRequired {
+		if !util.StringListContains(a.ManifestsRequired, alg) {
+			add("%s requires manifest-%s.txt, which %s does not.", b.Name, alg, a.Name)
+		}
+	}
+	for _, alg := range a.ManifestsAllowed {
+		if alg != "" && !util.StringListContains(b.ManifestsAllowed, alg) {
+			add("%s allows manifest-%s.txt, which %s does not.", a.Name, alg, b.Name)
+		}
+	}
+	for _, alg := range b.TagManifestsRequired {
+		if !util.StringListContains(a.TagManifestsRequired, alg) {
+			add("%s requires tagmanifest-%s.txt, which %s does not.", b.Name, alg, a.Name)
+		}
+	}
+	for _, alg := range a.TagManifestsAllowed {
+		if alg != "" && !util.StringListContains(b.TagManifestsAllowed, alg) {
+			add("%s allows tagmanifest-%s.txt, which %s does not.", a.Name, alg, b.Name)
+		}
+	}
+
+	for _, tagFile := range b.TagFilesRequired {
+		if !util.StringListContains(a.TagFilesRequired, tagFile) {
+			add("%s requires tag file %s, which %s does not.", b.Name, tagFile, a.Name)
+		}
+	}
+	for _, pattern := range a.TagFilesAllowed {
+		if pattern != "" && !tagFilePatternCovered(pattern, b) {
+			add("%s allows tag files matching %s, which %s does not.", a.Name, pattern, b.Name)
+		}
+	}
+
+	if a.AllowFetchTxt && !b.AllowFetchTxt {
+		add("%s allows fetch.txt, which %s does not.", a.Name, b.Name)
+	}
+	if b.TarDirMustMatchName && !a.TarDirMustMatchName {
+		add("%s requires the tarred bag directory to match the bag name, which %s does not.", b.Name, a.Name)
+	}
+
+	for _, bTag := range b.Tags {
+		aTag := a.GetTagDef(bTag.TagFile, bTag.TagName)
+		name := bTag.FullyQualifiedName()
+		if bTag.Required && (aTag == nil || !aTag.Required) {
+			add("%s requires tag %s, which %s does not.", b.Name, name, a.Name)
+			continue
+		}
+		if aTag == nil {
+			continue
+		}
+		if bTag.Required && !bTag.EmptyOK && aTag.EmptyOK {
+			add("%s allows tag %s to be empty, which %s does not.", a.Name, name, b.Name)
+		}
+		if len(bTag.Values) > 0 {
+			if len(aTag.Values) == 0 {
+				add("%s restricts the values of tag %s, which %s does not.", b.Name, name, a.Name)
+			} else {
+				for _, value := range aTag.Values {
+					if !util.StringListContains(bTag.Values, value) {
+						add("%s allows value '%s' for tag %s, which %s does not.", a.Name, value, name, b.Name)
+					}
+				}
+			}
+		}
+	}
+	return problems
+}
+
+// tagFilePatternCovered returns true if every tag file matching pattern
+// is also allowed by profile p. We can only tell for sure when p allows
+// everything or includes the same pattern, or when pattern is a literal
+// file name that one of p's patterns matches.
+func tagFilePatternCovered(pattern string, p *BagItProfile) bool {
+	if util.IsEmptyStringList(p.TagFilesAllowed) || util.StringListContains(p.TagFilesAllowed, "*") {
+		return true
+	}
+	if util.StringListContains(p.TagFilesAllowed, pattern) {
+		return true
+	}
+	if strings.ContainsAny(pattern, "*?[") {
+		return false
+	}
+	for _, allowed := range p.TagFilesAllowed {
+		if matched, _ := filepath.Match(allowed, pattern); matched {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,123 @@
+package core_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBagItProfileLintClean(t *testing.T) {
+	for _, name := range []string{"aptrust-v2.2.json", "aptrust-v2.3.json", "btr-v1.0.json"} {
+		profile := loadProfile(t, name)
+		report := profile.Lint()
+		require.NotNil(t, report)
+		assert.False(t, report.HasErrors(), name, report.Errors)
+		assert.Equal(t, profile.ID, report.ProfileID)
+		assert.Equal(t, profile.Name, report.ProfileName)
+	}
+
+	// The empty profile allows sha224 and sha384, which are
+	// legal BagIt algorithms that DART can't calculate.
+	report := loadProfile(t, "empty_profile.json").Lint()
+	assert.False(t, report.HasErrors(), report.Errors)
+	assert.Contains(t, report.Warnings["ManifestsAllowed"], "sha224")
+	assert.Contains(t, report.Warnings["ManifestsAllowed"], "sha384")
+}
+
+func TestBagItProfileLintErrors(t *testing.T) {
+	profile := loadProfile(t, "aptrust-v2.3.json")
+	profile.ManifestsRequired = []string{"sha256", "md6"}
+	profile.ManifestsAllowed = []string{"md5", "sha512"}
+	profile.TagManifestsRequired = []string{"sha512"}
+	profile.TagManifestsAllowed = []string{"md5"}
+	profile.AcceptSerialization = []string{}
+	profile.TagFilesAllowed = []string{"bag-info.txt", "custom-*.txt"}
+	profile.TagFilesRequired = []string{"custom-tags.txt", "aptrust-info.txt"}
+
+	title := profile.GetTagDef("aptrust-info.txt", "Title")
+	title.EmptyOK = true
+	storageOption := profile.GetTagDef("aptrust-info.txt", "Storage-Option")
+	storageOption.DefaultValue = "Floppy-Disk"
+	access := profile.GetTagDef("aptrust-info.txt", "Access").Copy()
+	access.Values = []string{"Consortia"}
+	profile.Tags = append(profile.Tags, access)
+	sourceOrg := profile.GetTagDef("bag-info.txt", "Source-Organization").Copy()
+	profile.Tags = append(profile.Tags, sourceOrg)
+
+	report := profile.Lint()
+	assert.True(t, report.HasErrors())
+
+	assert.Contains(t, report.Errors["ManifestsRequired"], "Unknown digest algorithm md6")
+	assert.Contains(t, report.Errors["ManifestsRequired"], "sha256 is required but not allowed")
+	assert.Contains(t, report.Errors["TagManifestsRequired"], "sha512 is required but not allowed")
+	assert.Contains(t, report.Errors["AcceptSerialization"], "no serialization formats")
+	assert.Contains(t, report.Errors["TagFilesRequired"], "aptrust-info.txt is required but not allowed")
+	assert.NotContains(t, report.Errors["TagFilesRequired"], "custom-tags.txt")
+
+	assert.Contains(t, report.Warnings["aptrust-info.txt/Title"], "may be empty")
+	assert.Contains(t, report.Errors["aptrust-info.txt/Title"], "tag file aptrust-info.txt is not allowed")
+	assert.Contains(t, report.Errors["aptrust-info.txt/Storage-Option"], "Floppy-Disk")
+	assert.Contains(t, report.Errors["aptrust-info.txt/Access"], "conflicting definitions")
+	assert.Contains(t, report.Warnings["bag-info.txt/Source-Organization"], "defined more than once")
+
+	// Report should serialize for the command line.
+	data, err := report.ToJSON()
+	require.Nil(t, err)
+	assert.True(t, strings.Contains(data, `"errors"`))
+}
+
+func TestCompareProfiles(t *testing.T) {
+	aptrust := loadProfile(t, "aptrust-v2.3.json")
+
+	// Profile is fully compatible with itself.
+	report := core.CompareProfiles(aptrust, loadProfile(t, "aptrust-v2.3.json"))
+	assert.True(t, report.FullyCompatible, report.ValidAMayFailB, report.ValidBMayFailA)
+	assert.Empty(t, report.ValidAMayFailB)
+	assert.Empty(t, report.ValidBMayFailA)
+
+	// Stricter version of the same profile.
+	strict := loadProfile(t, "aptrust-v2.3.json")
+	strict.Name = "Strict"
+	strict.ManifestsRequired = []string{"md5", "sha256"}
+	strict.ManifestsAllowed = []string{"md5", "sha256"}
+	strict.GetTagDef("aptrust-info.txt", "Access").Values = []string{"Institution"}
+	strict.GetTagDef("aptrust-info.txt", "Description").Required = true
+
+	report = core.CompareProfiles(aptrust, strict)
+	assert.False(t, report.FullyCompatible)
+	assertContainsMessage(t, report.ValidAMayFailB, "Strict requires manifest-sha256.txt")
+	assertContainsMessage(t, report.ValidAMayFailB, "allows manifest-sha512.txt")
+	assertContainsMessage(t, report.ValidAMayFailB, "allows value 'Consortia' for tag aptrust-info.txt/Access")
+	assertContainsMessage(t, report.ValidAMayFailB, "Strict requires tag aptrust-info.txt/Description")
+
+	// Everything valid under the strict profile is valid
+	// under the original.
+	assert.Empty(t, report.ValidBMayFailA)
+
+	// APTrust and BTR are different in many ways.
+	report = core.CompareProfiles(aptrust, loadProfile(t, "btr-v1.0.json"))
+	assert.False(t, report.FullyCompatible)
+	assert.NotEmpty(t, report.ValidAMayFailB)
+	assert.NotEmpty(t, report.ValidBMayFailA)
+	assertContainsMessage(t, report.ValidBMayFailA, "requires serialization")
+
+	// Serialization
+	unserialized := loadProfile(t, "aptrust-v2.3.json")
+	unserialized.Name = "Unserialized"
+	unserialized.Serialization = constants.SerializationForbidden
+	report = core.CompareProfiles(aptrust, unserialized)
+	assertContainsMessage(t, report.ValidAMayFailB, "Unserialized forbids serialization")
+}
+
+func assertContainsMessage(t *testing.T, messages []string, substring string) {
+	for _, message := range messages {
+		if strings.Contains(message, substring) {
+			return
+		}
+	}
+	assert.Fail(t, "Message not found", "Expected a message containing %q in %v", substring, messages)
+}
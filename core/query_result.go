@@ -142,6 +142,45 @@ func (qr *QueryResult) ResultCount() int {
 	return count
 }
 
+// persistentObjects returns all of the objects in this result.
+func (qr *QueryResult) persistentObjects() []PersistentObject {
+	objs := make([]PersistentObject, 0, qr.ResultCount())
+	for _, item := range qr.AppSettings {
+		objs = append(objs, item)
+	}
+	for _, item := range qr.BagItProfiles {
+		objs = append(objs, item)
+	}
+	for _, item := range qr.ExportSettings {
+		objs = append(objs, item)
+	}
+	for _, item := range qr.InternalSettings {
+		objs = append(objs, item)
+	}
+	for _, item := range qr.Jobs {
+		objs = append(objs, item)
+	}
+	for _, item := range qr.RemoteRepositories {
+		objs = append(objs, item)
+	}
+	for _, item := range qr.StorageServices {
+		objs = append(objs, item)
+	}
+	for _, item := range qr.UploadJobs {
+		objs = append(objs, item)
+	}
+	for _, item := range qr.ValidationJobs {
+		objs = append(objs, item)
+	}
+	for _, item := range qr.Workflows {
+		objs = append(objs, item)
+	}
+	for _, item := range qr.WorkflowBatches {
+		objs = append(objs, item)
+	}
+	return objs
+}
+
 func (qr *QueryResult) GetForm() (*Form, error) {
 	if qr.ResultType != constants.ResultTypeSingle || qr.ObjCount < 1 {
 		return nil, constants.ErrWrongTypeForForm
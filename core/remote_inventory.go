@@ -0,0 +1,141 @@
+package core
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/APTrust/dart-runner/constants"
+)
+
+// RemoteObject describes a file or object in a storage service. Key is
+// the object's path relative to the service's bucket or root directory,
+// with forward slashes on all platforms.
+type RemoteObject struct {
+	Key      string    `json:"key"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	ETag     string    `json:"etag,omitempty"`
+}
+
+// RemoteInventory lists the files or objects in a storage service whose
+// keys begin with Prefix. As with S3, the prefix is a plain string match,
+// so prefix "photos" matches both "photos.tar" and "photos/img001.jpg".
+// For SFTP, WebDAV and file services, keys are paths relative to the
+// service's bucket (upload directory, collection or root directory).
+type RemoteInventory struct {
+	StorageService *StorageService `json:"-"`
+	Prefix         string          `json:"prefix"`
+	Objects        []*RemoteObject `json:"objects"`
+}
+
+// NewRemoteInventory returns an empty inventory of the objects in ss
+// whose keys begin with prefix. Call Load to fill it in.
+func NewRemoteInventory(ss *StorageService, prefix string) *RemoteInventory {
+	return &RemoteInventory{
+		StorageService: ss,
+		Prefix:         strings.TrimPrefix(prefix, "/"),
+		Objects:        make([]*RemoteObject, 0),
+	}
+}
+
+// Load lists the storage service's objects. Objects are sorted by key.
+func (inv *RemoteInventory) Load() error {
+	ss := inv.StorageService
+	useSSL := !strings.HasPrefix(ss.Host, "localhost") && !strings.HasPrefix(ss.Host, "127.0.0.1")
+	var objects []*RemoteObject
+	var err error
+	switch ss.Protocol {
+	case constants.ProtocolS3:
+		var client *S3Client
+		client, err = NewS3Client(ss, useSSL, nil)
+		if err == nil {
+			objects, err = client.List(inv.Prefix)
+		}
+	case constants.ProtocolSFTP:
+		var client *SFTPClient
+		client, err = NewSFTPClient(ss, nil)
+		if err == nil {
+			defer client.Close()
+			objects, err = client.List(ss.Bucket, inv.Prefix)
+		}
+	case constants.ProtocolWebDAV:
+		var client *WebDAVClient
+		client, err = NewWebDAVClient(ss, useSSL, nil)
+		if err == nil {
+			objects, err = client.List(inv.Prefix)
+		}
+	case constants.ProtocolFile:
+		var client *FileClient
+		client, err = NewFileClient(ss, nil)
+		if err == nil {
+			objects, err = client.List(inv.Prefix)
+		}
+	default:
+		err = fmt.Errorf("listing is not supported for protocol '%s'", ss.Protocol)
+	}
+	if err != nil {
+		return fmt.Errorf("can't list %s: %w", ss.Name, err)
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	inv.Objects = objects
+	return nil
+}
+
+// TotalSize returns the combined size of all objects in the inventory.
+func (inv *RemoteInventory) TotalSize() int64 {
+	total := int64(0)
+	for _, obj := range inv.Objects {
+		total += obj.Size
+	}
+	return total
+}
+
+// ToJson returns the inventory as indented JSON.
+func (inv *RemoteInventory) ToJson() (string, error) {
+	data, err := json.MarshalIndent(inv, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// WriteCSV writes the inventory to w as CSV, with a header row of
+// key, size, modified and etag. Times are in RFC 3339 format.
+func (inv *RemoteInventory) WriteCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	err := writer.Write([]string{"key", "size", "modified", "etag"})
+	if err != nil {
+		return err
+	}
+	for _, obj := range inv.Objects {
+		err = writer.Write([]string{obj.Key, strconv.FormatInt(obj.Size, 10), obj.Modified.UTC().Format(time.RFC3339), obj.ETag})
+		if err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// listingDir returns the directory in which a walk of a file system
+// or SFTP server must start to find all keys beginning with prefix.
+// That's prefix itself if it ends with a slash, or the directory
+// containing the prefix if it doesn't. This returns an empty string
+// for the root.
+func listingDir(prefix string) string {
+	if prefix == "" || strings.HasSuffix(prefix, "/") {
+		return strings.TrimSuffix(prefix, "/")
+	}
+	dir := path.Dir(prefix)
+	if dir == "." || dir == "/" {
+		return ""
+	}
+	return dir
+}
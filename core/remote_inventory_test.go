@@ -0,0 +1,159 @@
+package core_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/APTrust/dart-runner/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// inventoryTestFiles are the files we put in each storage service
+// to test listings, keyed by path relative to the bucket.
+var inventoryTestFiles = map[string]string{
+	"bag1.tar":                   "twelve bytes",
+	"bag2/bagit.txt":             "BagIt-Version: 1.0\n",
+	"bag2/data/photo.jpg":        "not really a photo",
+	"2024/bag3.tar":              "bag three",
+	"2024/photos/bag4/bagit.txt": "BagIt-Version: 1.0\n",
+}
+
+func writeInventoryTestFiles(t *testing.T, root string) {
+	for key, content := range inventoryTestFiles {
+		filePath := filepath.Join(root, filepath.FromSlash(key))
+		require.NoError(t, os.MkdirAll(filepath.Dir(filePath), 0755))
+		require.NoError(t, os.WriteFile(filePath, []byte(content), 0644))
+	}
+}
+
+func inventoryKeys(inv *core.RemoteInventory) []string {
+	keys := make([]string, len(inv.Objects))
+	for i, obj := range inv.Objects {
+		keys[i] = obj.Key
+	}
+	return keys
+}
+
+// testInventoryPrefixes checks listings of ss, which must contain
+// inventoryTestFiles, with a number of different prefixes.
+func testInventoryPrefixes(t *testing.T, ss *core.StorageService) {
+	inv := core.NewRemoteInventory(ss, "")
+	require.NoError(t, inv.Load())
+	assert.Equal(t, []string{
+		"2024/bag3.tar",
+		"2024/photos/bag4/bagit.txt",
+		"bag1.tar",
+		"bag2/bagit.txt",
+		"bag2/data/photo.jpg",
+	}, inventoryKeys(inv))
+	for _, obj := range inv.Objects {
+		assert.Equal(t, int64(len(inventoryTestFiles[obj.Key])), obj.Size, obj.Key)
+		assert.False(t, obj.Modified.IsZero(), obj.Key)
+	}
+	assert.Equal(t, int64(77), inv.TotalSize())
+
+	// Prefixes are string matches, as in S3.
+	inv = core.NewRemoteInventory(ss, "bag")
+	require.NoError(t, inv.Load())
+	assert.Equal(t, []string{"bag1.tar", "bag2/bagit.txt", "bag2/data/photo.jpg"}, inventoryKeys(inv))
+
+	inv = core.NewRemoteInventory(ss, "2024/")
+	require.NoError(t, inv.Load())
+	assert.Equal(t, []string{"2024/bag3.tar", "2024/photos/bag4/bagit.txt"}, inventoryKeys(inv))
+
+	inv = core.NewRemoteInventory(ss, "2024/ph")
+	require.NoError(t, inv.Load())
+	assert.Equal(t, []string{"2024/photos/bag4/bagit.txt"}, inventoryKeys(inv))
+
+	// Prefixes that match nothing are not errors.
+	inv = core.NewRemoteInventory(ss, "1999/")
+	require.NoError(t, inv.Load())
+	assert.Empty(t, inv.Objects)
+}
+
+func TestRemoteInventoryFile(t *testing.T) {
+	ss := getFileStorageService(t)
+	writeInventoryTestFiles(t, ss.Bucket)
+	testInventoryPrefixes(t, ss)
+
+	// Missing root is an error.
+	ss.Bucket = filepath.Join(ss.Bucket, "does-not-exist")
+	inv := core.NewRemoteInventory(ss, "")
+	assert.Error(t, inv.Load())
+}
+
+func TestRemoteInventorySFTP(t *testing.T) {
+	defer core.ClearTrustedHostKeysTable()
+	ss, uploadDir := getDownloadSftpStorageService(t)
+	writeInventoryTestFiles(t, uploadDir)
+	testInventoryPrefixes(t, ss)
+
+	ss.Bucket = "does-not-exist"
+	inv := core.NewRemoteInventory(ss, "")
+	assert.Error(t, inv.Load())
+}
+
+func TestRemoteInventoryWebDAV(t *testing.T) {
+	server := newWebDAVTestServer(t)
+	ss := server.StorageService(t)
+	writeInventoryTestFiles(t, filepath.Join(server.Root, filepath.FromSlash(ss.Bucket)))
+	testInventoryPrefixes(t, ss)
+
+	inv := core.NewRemoteInventory(ss, "bag1")
+	require.NoError(t, inv.Load())
+	require.Equal(t, 1, len(inv.Objects))
+	assert.NotEmpty(t, inv.Objects[0].ETag)
+	assert.False(t, strings.Contains(inv.Objects[0].ETag, `"`))
+
+	ss.Password = "wrong"
+	inv = core.NewRemoteInventory(ss, "")
+	assert.Error(t, inv.Load())
+}
+
+func TestRemoteInventoryS3(t *testing.T) {
+	ss := getS3StorageService()
+	client, err := core.NewS3Client(ss, false, nil)
+	require.NoError(t, err)
+	require.NoError(t, client.Upload(fileToUpload(), "example.edu.tagsample_good.tar"))
+
+	inv := core.NewRemoteInventory(ss, "example.edu.tagsample_good")
+	require.NoError(t, inv.Load())
+	require.NotEmpty(t, inv.Objects)
+	assert.Equal(t, "example.edu.tagsample_good.tar", inv.Objects[0].Key)
+	assert.NotEmpty(t, inv.Objects[0].ETag)
+}
+
+func TestRemoteInventoryUnsupportedProtocol(t *testing.T) {
+	ss := getFileStorageService(t)
+	ss.Protocol = "gopher"
+	inv := core.NewRemoteInventory(ss, "")
+	err := inv.Load()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "listing is not supported for protocol 'gopher'")
+}
+
+func TestRemoteInventoryOutput(t *testing.T) {
+	ss := getFileStorageService(t)
+	writeInventoryTestFiles(t, ss.Bucket)
+	inv := core.NewRemoteInventory(ss, "bag2/")
+	require.NoError(t, inv.Load())
+
+	jsonString, err := inv.ToJson()
+	require.NoError(t, err)
+	assert.Contains(t, jsonString, `"prefix": "bag2/"`)
+	assert.Contains(t, jsonString, `"key": "bag2/data/photo.jpg"`)
+	assert.Contains(t, jsonString, `"size": 18`)
+	assert.NotContains(t, jsonString, `"etag"`)
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, inv.WriteCSV(buf))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Equal(t, 3, len(lines))
+	assert.Equal(t, "key,size,modified,etag", lines[0])
+	assert.True(t, strings.HasPrefix(lines[1], "bag2/bagit.txt,19,"), lines[1])
+	assert.True(t, strings.HasPrefix(lines[2], "bag2/data/photo.jpg,18,"), lines[2])
+}
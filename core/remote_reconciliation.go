@@ -0,0 +1,225 @@
+package core
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/APTrust/dart-runner/constants"
+)
+
+// RemoteItem is a top-level item in a remote inventory. That's either
+// a single object, such as a tarred bag, or all of the objects under
+// a common directory, such as a bag uploaded as a directory.
+type RemoteItem struct {
+	Name      string    `json:"name"`
+	Key       string    `json:"key"`
+	IsDir     bool      `json:"isDir"`
+	Size      int64     `json:"size"`
+	FileCount int       `json:"fileCount"`
+	Modified  time.Time `json:"modified"`
+}
+
+// ReconciliationEntry describes whether the bag named in one row of
+// a CSV batch file exists in a storage service.
+type ReconciliationEntry struct {
+	BagName         string `json:"bagName"`
+	Status          string `json:"status"`
+	RemoteKey       string `json:"remoteKey,omitempty"`
+	RemoteSize      int64  `json:"remoteSize"`
+	RemoteFileCount int    `json:"remoteFileCount"`
+	LocalPath       string `json:"localPath,omitempty"`
+	LocalSize       int64  `json:"localSize"`
+}
+
+// ReconciliationReport compares the bags named in a CSV batch file
+// with the items in a storage service.
+type ReconciliationReport struct {
+	StorageService string                 `json:"storageService"`
+	Prefix         string                 `json:"prefix"`
+	Present        int                    `json:"present"`
+	Missing        int                    `json:"missing"`
+	SizeMismatch   int                    `json:"sizeMismatch"`
+	Entries        []*ReconciliationEntry `json:"entries"`
+}
+
+// Items groups the inventory's objects into top-level items, keyed by
+// name. Top-level means directly inside the directory part of the
+// inventory's prefix. For example, with prefix "2024/", objects
+// "2024/bag1.tar" and "2024/bag2/bagit.txt" belong to items "bag1.tar"
+// and "bag2".
+func (inv *RemoteInventory) Items() map[string]*RemoteItem {
+	items := make(map[string]*RemoteItem)
+	base := listingDir(inv.Prefix)
+	for _, obj := range inv.Objects {
+		relPath := obj.Key
+		if base != "" {
+			relPath = strings.TrimPrefix(obj.Key, base+"/")
+		}
+		name, rest, isDir := strings.Cut(relPath, "/")
+		item, ok := items[name]
+		if !ok {
+			key := name
+			if base != "" {
+				key = base + "/" + name
+			}
+			if isDir && rest != "" {
+				key += "/"
+			}
+			item = &RemoteItem{Name: name, Key: key, IsDir: isDir && rest != ""}
+			items[name] = item
+		}
+		item.Size += obj.Size
+		item.FileCount += 1
+		if obj.Modified.After(item.Modified) {
+			item.Modified = obj.Modified
+		}
+	}
+	return items
+}
+
+// Reconcile compares the bag name of each item in the batch file at
+// pathToBatchFile with the items in this inventory. The batch file may
+// be CSV, JSON Lines or YAML, as described in NewBatchSource. A bag is
+// present if the inventory contains an item with the bag's name, or
+// with its name plus ".tar", which is what DART creates when it tars
+// a bag.
+//
+// If outputDir is not empty and holds a local copy of a present bag, as
+// it will after a batch run with --delete=false, we compare the local
+// and remote sizes, and report a size mismatch if they differ.
+func (inv *RemoteInventory) Reconcile(pathToBatchFile, outputDir string) (*ReconciliationReport, error) {
+	batch, err := NewBatchSource(pathToBatchFile)
+	if err != nil {
+		return nil, err
+	}
+	defer batch.Close()
+
+	report := &ReconciliationReport{
+		StorageService: inv.StorageService.Name,
+		Prefix:         inv.Prefix,
+		Entries:        make([]*ReconciliationEntry, 0),
+	}
+	items := inv.Items()
+	for {
+		batchEntry, err := batch.ReadNext()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("error reading %s: %w", pathToBatchFile, err)
+		}
+		bagName := strings.TrimSpace(batchEntry.BagName)
+		if bagName == "" {
+			continue
+		}
+		entry := reconcileBag(bagName, items, outputDir)
+		switch entry.Status {
+		case constants.ReconcileStatusPresent:
+			report.Present++
+		case constants.ReconcileStatusMissing:
+			report.Missing++
+		default:
+			report.SizeMismatch++
+		}
+		report.Entries = append(report.Entries, entry)
+	}
+	return report, nil
+}
+
+// reconcileBag looks for bagName among items, and for a local copy
+// of the bag in outputDir.
+func reconcileBag(bagName string, items map[string]*RemoteItem, outputDir string) *ReconciliationEntry {
+	entry := &ReconciliationEntry{
+		BagName: bagName,
+		Status:  constants.ReconcileStatusMissing,
+	}
+	names := []string{bagName}
+	if !strings.HasSuffix(bagName, ".tar") {
+		names = append(names, bagName+".tar")
+	}
+	for _, name := range names {
+		item, ok := items[name]
+		if !ok {
+			continue
+		}
+		entry.Status = constants.ReconcileStatusPresent
+		entry.RemoteKey = item.Key
+		entry.RemoteSize = item.Size
+		entry.RemoteFileCount = item.FileCount
+		if outputDir == "" {
+			break
+		}
+		localPath := filepath.Join(outputDir, name)
+		localSize, err := localItemSize(localPath)
+		if err != nil {
+			break
+		}
+		entry.LocalPath = localPath
+		entry.LocalSize = localSize
+		if localSize != item.Size {
+			entry.Status = constants.ReconcileStatusSizeMismatch
+		}
+		break
+	}
+	return entry
+}
+
+// localItemSize returns the size of the file at localPath or, if it's
+// a directory, the combined size of the regular files inside it.
+func localItemSize(localPath string) (int64, error) {
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return 0, err
+	}
+	if info.IsDir() {
+		return GetUploadPayloadSize(localPath)
+	}
+	return info.Size(), nil
+}
+
+// HasProblems returns true if any bags are missing or have
+// different sizes locally and remotely.
+func (r *ReconciliationReport) HasProblems() bool {
+	return r.Missing > 0 || r.SizeMismatch > 0
+}
+
+// ToJson returns the report as indented JSON.
+func (r *ReconciliationReport) ToJson() (string, error) {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// WriteCSV writes the report's entries to w as CSV, with a header row.
+func (r *ReconciliationReport) WriteCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	err := writer.Write([]string{"bagName", "status", "remoteKey", "remoteSize", "remoteFileCount", "localPath", "localSize"})
+	if err != nil {
+		return err
+	}
+	for _, entry := range r.Entries {
+		err = writer.Write([]string{
+			entry.BagName,
+			entry.Status,
+			entry.RemoteKey,
+			strconv.FormatInt(entry.RemoteSize, 10),
+			strconv.Itoa(entry.RemoteFileCount),
+			entry.LocalPath,
+			strconv.FormatInt(entry.LocalSize, 10),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
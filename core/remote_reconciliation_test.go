@@ -0,0 +1,136 @@
+package core_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemoteInventoryItems(t *testing.T) {
+	ss := getFileStorageService(t)
+	writeInventoryTestFiles(t, ss.Bucket)
+
+	inv := core.NewRemoteInventory(ss, "")
+	require.NoError(t, inv.Load())
+	items := inv.Items()
+	require.Equal(t, 3, len(items))
+
+	assert.Equal(t, "bag1.tar", items["bag1.tar"].Key)
+	assert.False(t, items["bag1.tar"].IsDir)
+	assert.Equal(t, int64(12), items["bag1.tar"].Size)
+	assert.Equal(t, 1, items["bag1.tar"].FileCount)
+
+	assert.Equal(t, "bag2/", items["bag2"].Key)
+	assert.True(t, items["bag2"].IsDir)
+	assert.Equal(t, int64(37), items["bag2"].Size)
+	assert.Equal(t, 2, items["bag2"].FileCount)
+	assert.False(t, items["bag2"].Modified.IsZero())
+
+	assert.True(t, items["2024"].IsDir)
+
+	// Items are relative to the directory part of the prefix.
+	inv = core.NewRemoteInventory(ss, "2024/b")
+	require.NoError(t, inv.Load())
+	items = inv.Items()
+	require.Equal(t, 1, len(items))
+	assert.Equal(t, "2024/bag3.tar", items["bag3.tar"].Key)
+}
+
+func TestRemoteInventoryReconcile(t *testing.T) {
+	ss := getFileStorageService(t)
+	writeInventoryTestFiles(t, ss.Bucket)
+	inv := core.NewRemoteInventory(ss, "")
+	require.NoError(t, inv.Load())
+
+	csvFile := filepath.Join(t.TempDir(), "batch.csv")
+	csvData := "Bag-Name,Root-Directory,bag-info.txt/Title\n" +
+		"bag1,/data/bag1,Bag One\n" +
+		"bag2,/data/bag2,Bag Two\n" +
+		"bag5,/data/bag5,Bag Five\n" +
+		",/data/unnamed,Blank rows are skipped\n"
+	require.NoError(t, os.WriteFile(csvFile, []byte(csvData), 0644))
+
+	// Without an output directory, we can only say what's there.
+	report, err := inv.Reconcile(csvFile, "")
+	require.NoError(t, err)
+	assert.Equal(t, ss.Name, report.StorageService)
+	assert.Equal(t, 2, report.Present)
+	assert.Equal(t, 1, report.Missing)
+	assert.Equal(t, 0, report.SizeMismatch)
+	assert.True(t, report.HasProblems())
+	require.Equal(t, 3, len(report.Entries))
+
+	// bag1 was tarred, so we find it as bag1.tar
+	assert.Equal(t, "bag1", report.Entries[0].BagName)
+	assert.Equal(t, constants.ReconcileStatusPresent, report.Entries[0].Status)
+	assert.Equal(t, "bag1.tar", report.Entries[0].RemoteKey)
+	assert.Equal(t, int64(12), report.Entries[0].RemoteSize)
+
+	// bag2 was uploaded as a directory
+	assert.Equal(t, constants.ReconcileStatusPresent, report.Entries[1].Status)
+	assert.Equal(t, "bag2/", report.Entries[1].RemoteKey)
+	assert.Equal(t, int64(37), report.Entries[1].RemoteSize)
+	assert.Equal(t, 2, report.Entries[1].RemoteFileCount)
+
+	assert.Equal(t, constants.ReconcileStatusMissing, report.Entries[2].Status)
+	assert.Empty(t, report.Entries[2].RemoteKey)
+
+	// With local copies, we compare sizes.
+	outputDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(outputDir, "bag1.tar"), []byte("twelve bytes"), 0644))
+	require.NoError(t, os.MkdirAll(filepath.Join(outputDir, "bag2", "data"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(outputDir, "bag2", "bagit.txt"), []byte("BagIt-Version: 1.0\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(outputDir, "bag2", "data", "photo.jpg"), []byte("truncated"), 0644))
+
+	report, err = inv.Reconcile(csvFile, outputDir)
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Present)
+	assert.Equal(t, 1, report.Missing)
+	assert.Equal(t, 1, report.SizeMismatch)
+	assert.Equal(t, filepath.Join(outputDir, "bag1.tar"), report.Entries[0].LocalPath)
+	assert.Equal(t, int64(12), report.Entries[0].LocalSize)
+	assert.Equal(t, constants.ReconcileStatusSizeMismatch, report.Entries[1].Status)
+	assert.Equal(t, int64(28), report.Entries[1].LocalSize)
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, report.WriteCSV(buf))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Equal(t, 4, len(lines))
+	assert.Equal(t, "bagName,status,remoteKey,remoteSize,remoteFileCount,localPath,localSize", lines[0])
+	assert.Equal(t, "bag5,missing,,0,0,,0", lines[3])
+
+	jsonString, err := report.ToJson()
+	require.NoError(t, err)
+	assert.Contains(t, jsonString, `"sizeMismatch": 1`)
+	assert.Contains(t, jsonString, `"status": "size mismatch"`)
+
+	// Batch files need Bag-Name and Root-Directory columns.
+	require.NoError(t, os.WriteFile(csvFile, []byte("Name\nbag1\n"), 0644))
+	_, err = inv.Reconcile(csvFile, "")
+	assert.Error(t, err)
+
+	// JSON Lines and YAML batches work too.
+	jsonlFile := filepath.Join(t.TempDir(), "batch.jsonl")
+	jsonlData := `{"packageName": "bag1", "files": ["/data/bag1"]}` + "\n" +
+		`{"packageName": "bag5", "files": ["/data/bag5"]}` + "\n"
+	require.NoError(t, os.WriteFile(jsonlFile, []byte(jsonlData), 0644))
+	yamlFile := filepath.Join(t.TempDir(), "batch.yaml")
+	yamlData := "- packageName: bag1\n  files: [/data/bag1]\n" +
+		"- packageName: bag5\n  files: [/data/bag5]\n"
+	require.NoError(t, os.WriteFile(yamlFile, []byte(yamlData), 0644))
+	for _, batchFile := range []string{jsonlFile, yamlFile} {
+		report, err = inv.Reconcile(batchFile, "")
+		require.NoError(t, err, batchFile)
+		require.Equal(t, 2, len(report.Entries), batchFile)
+		assert.Equal(t, constants.ReconcileStatusPresent, report.Entries[0].Status)
+		assert.Equal(t, "bag1.tar", report.Entries[0].RemoteKey)
+		assert.Equal(t, constants.ReconcileStatusMissing, report.Entries[1].Status)
+	}
+}
@@ -2,7 +2,6 @@ package core
 
 import (
 	"fmt"
-	"os"
 	"strings"
 
 	"github.com/APTrust/dart-runner/constants"
@@ -40,48 +39,39 @@ func NewRemoteRepository() *RemoteRepository {
 }
 
 // GetUserID returns the UserID for logging into this remote repo.
-// If the UserID comes from an environment variable, this returns
-// the value of the ENV var. Otherwise, it returns the value of
-// this object's UserID property.
+// If the UserID refers to an environment variable, file, helper command
+// or other credential provider (see ResolveCredential), this returns
+// the value it refers to. Otherwise, it returns the value of this
+// object's UserID property.
 //
 // When authenticating with a remote repo, call this instead of
 // accessing UserID directly.
 func (repo *RemoteRepository) GetUserID() string {
-	if strings.HasPrefix(repo.UserID, "env:") {
-		parts := strings.SplitN(repo.UserID, ":", 2)
-		userID := os.Getenv(parts[1])
-		if userID == "" {
-			Dart.Log.Warningf("UserID for repo '%s' is set to env var '%s', but the env var has no value", repo.Name, parts[1])
-		}
-		return userID
-	}
-	return repo.UserID
+	return resolveCredentialOrWarn(repo.UserID, "user id", repo.Name)
 }
 
-// GetUserAPIToken returns the API token for logging into this remote repo.
-// If the token comes from an environment variable, this returns
-// the value of the ENV var. Otherwise, it returns the value of
-// this object's APIToken property.
+// GetAPIToken returns the API token for logging into this remote repo.
+// Like GetUserID, this resolves references to environment variables,
+// files, helper commands and other credential providers.
 //
 // When authenticating with a remote repo, call this instead of
 // accessing APIToken directly.
 func (repo *RemoteRepository) GetAPIToken() string {
-	if strings.HasPrefix(repo.APIToken, "env:") {
-		parts := strings.SplitN(repo.APIToken, ":", 2)
-		token := os.Getenv(parts[1])
-		if token == "" {
-			Dart.Log.Warningf("API token for repo '%s' is set to env var '%s', but the env var has no value", repo.Name, parts[1])
-		}
-		return token
-	}
-	return repo.APIToken
+	return resolveCredentialOrWarn(repo.APIToken, "API token", repo.Name)
 }
 
 // HasPlaintextAPIToken returns true if this repo's API token
-// is non-empty and does not come from an environment variable.
+// is non-empty and is not a reference to an environment variable
+// or other credential provider.
 func (repo *RemoteRepository) HasPlaintextAPIToken() bool {
 	token := strings.TrimSpace(repo.APIToken)
-	return token != "" && !strings.HasPrefix(repo.APIToken, "env:")
+	return token != "" && !IsCredentialReference(repo.APIToken)
+}
+
+// secretFields returns pointers to the fields we encrypt when we
+// save this repo to the DART database.
+func (repo *RemoteRepository) secretFields() []*string {
+	return []*string{&repo.APIToken}
 }
 
 // ObjID returns this remote repo's UUID.
@@ -0,0 +1,197 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/APTrust/dart-runner/util"
+	"github.com/minio/minio-go/v7"
+	"github.com/pkg/sftp"
+)
+
+// RetryPolicy describes how many times and how often to retry a
+// failed transfer to or from a StorageService. Delays grow
+// exponentially from BaseDelayMs, up to MaxDelayMs, with a random
+// jitter so that many clients retrying at once don't hit the server
+// in lockstep.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the
+	// first. A value of one means no retries.
+	MaxAttempts int `json:"maxAttempts"`
+
+	// BaseDelayMs is the delay, in milliseconds, before the first retry.
+	// Each subsequent retry waits twice as long as the one before.
+	BaseDelayMs int `json:"baseDelayMs"`
+
+	// MaxDelayMs caps the delay between attempts, in milliseconds.
+	MaxDelayMs int `json:"maxDelayMs"`
+
+	// Jitter is the fraction, between zero and one, by which each
+	// delay is randomly lengthened or shortened. For example, 0.2
+	// means a 10 second delay becomes somewhere between 8 and 12
+	// seconds.
+	Jitter float64 `json:"jitter"`
+
+	// RetryableErrors is an optional list of strings. If it's not
+	// empty, an error is retryable only if its message contains one
+	// of these strings (case-insensitive). If it's empty, we retry
+	// errors that look transient: network errors, timeouts, dropped
+	// connections and S3 and WebDAV server errors and throttling.
+	// Refused connections are not retried unless they're in this list.
+	RetryableErrors []string `json:"retryableErrors"`
+}
+
+// DefaultRetryPolicy returns the retry policy used for storage services
+// that don't define their own: a single attempt, with no retries. Its
+// delays apply only if the caller raises MaxAttempts.
+func DefaultRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts: 1,
+		BaseDelayMs: 2000,
+		MaxDelayMs:  60000,
+		Jitter:      0.2,
+	}
+}
+
+// transientS3ErrorCodes are S3 error codes that indicate a problem
+// that may go away if we try again.
+var transientS3ErrorCodes = []string{
+	"InternalError",
+	"RequestTimeout",
+	"RequestTimeTooSkewed",
+	"ServiceUnavailable",
+	"SlowDown",
+}
+
+// transientErrorMessages are fragments of error messages that indicate
+// a dropped connection, for errors that don't wrap an identifiable
+// error type.
+var transientErrorMessages = []string{
+	"broken pipe",
+	"connection lost",
+	"connection reset",
+	"i/o timeout",
+	"unexpected eof",
+}
+
+// Copy returns a copy of this policy. It returns nil if p is nil.
+func (p *RetryPolicy) Copy() *RetryPolicy {
+	if p == nil {
+		return nil
+	}
+	policy := *p
+	if p.RetryableErrors != nil {
+		policy.RetryableErrors = make([]string, len(p.RetryableErrors))
+		copy(policy.RetryableErrors, p.RetryableErrors)
+	}
+	return &policy
+}
+
+// Validate returns a map of errors describing problems with this policy.
+// The map is empty if the policy is valid.
+func (p *RetryPolicy) Validate() map[string]string {
+	errs := make(map[string]string)
+	if p.MaxAttempts < 1 {
+		errs["RetryPolicy.MaxAttempts"] = "Retry policy must allow at least one attempt."
+	}
+	if p.BaseDelayMs < 0 {
+		errs["RetryPolicy.BaseDelayMs"] = "Retry policy base delay cannot be negative."
+	}
+	if p.MaxDelayMs < 0 {
+		errs["RetryPolicy.MaxDelayMs"] = "Retry policy max delay cannot be negative."
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		errs["RetryPolicy.Jitter"] = "Retry policy jitter must be between zero and one."
+	}
+	return errs
+}
+
+// Delay returns how long to wait after the specified attempt fails
+// before making the next attempt. Attempt numbers start at one.
+func (p *RetryPolicy) Delay(attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+	delay := float64(p.BaseDelayMs) * math.Pow(2, float64(attempt-1))
+	if p.MaxDelayMs > 0 && delay > float64(p.MaxDelayMs) {
+		delay = float64(p.MaxDelayMs)
+	}
+	if p.Jitter > 0 {
+		delay = delay * (1 - p.Jitter + (rand.Float64() * 2 * p.Jitter))
+	}
+	return time.Duration(delay) * time.Millisecond
+}
+
+// ShouldRetry returns true if an operation that failed on the specified
+// attempt with error err should be tried again.
+func (p *RetryPolicy) ShouldRetry(attempt int, err error) bool {
+	return attempt < p.MaxAttempts && p.IsRetryable(err)
+}
+
+// IsRetryable returns true if err is the kind of error this policy
+// retries. See the documentation for RetryableErrors.
+func (p *RetryPolicy) IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if len(p.RetryableErrors) > 0 {
+		message := strings.ToLower(err.Error())
+		for _, fragment := range p.RetryableErrors {
+			if fragment != "" && strings.Contains(message, strings.ToLower(fragment)) {
+				return true
+			}
+		}
+		return false
+	}
+	return isTransientError(err)
+}
+
+func (p *RetryPolicy) String() string {
+	return fmt.Sprintf("RetryPolicy: %d attempts, base delay %dms, max delay %dms, jitter %.2f", p.MaxAttempts, p.BaseDelayMs, p.MaxDelayMs, p.Jitter)
+}
+
+// isTransientError returns true if err looks like a network problem
+// or a temporary server-side problem. A refused connection usually
+// means the host or port is wrong, or the server is down, so it's
+// not transient.
+func isTransientError(err error) bool {
+	if errors.Is(err, syscall.ECONNREFUSED) || strings.Contains(strings.ToLower(err.Error()), "connection refused") {
+		return false
+	}
+	var s3Err minio.ErrorResponse
+	if errors.As(err, &s3Err) {
+		return s3Err.StatusCode >= 500 || s3Err.StatusCode == 429 || util.StringListContains(transientS3ErrorCodes, s3Err.Code)
+	}
+	var davErr *webDAVError
+	if errors.As(err, &davErr) {
+		return davErr.StatusCode >= 500 || davErr.StatusCode == http.StatusTooManyRequests
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return !dnsErr.IsNotFound
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	for _, target := range []error{io.ErrUnexpectedEOF, sftp.ErrSSHFxConnectionLost, syscall.ECONNRESET, syscall.ECONNABORTED, syscall.EPIPE, syscall.ETIMEDOUT} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	message := strings.ToLower(err.Error())
+	for _, fragment := range transientErrorMessages {
+		if strings.Contains(message, fragment) {
+			return true
+		}
+	}
+	return false
+}
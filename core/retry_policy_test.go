@@ -0,0 +1,96 @@
+package core_test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/APTrust/dart-runner/core"
+	"github.com/minio/minio-go/v7"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := &core.RetryPolicy{
+		MaxAttempts: 5,
+		BaseDelayMs: 1000,
+		MaxDelayMs:  5000,
+	}
+	assert.Equal(t, 1*time.Second, policy.Delay(1))
+	assert.Equal(t, 2*time.Second, policy.Delay(2))
+	assert.Equal(t, 4*time.Second, policy.Delay(3))
+	assert.Equal(t, 5*time.Second, policy.Delay(4))
+	assert.Equal(t, 5*time.Second, policy.Delay(10))
+
+	policy.Jitter = 0.5
+	for i := 0; i < 20; i++ {
+		delay := policy.Delay(2)
+		assert.GreaterOrEqual(t, delay, 1*time.Second)
+		assert.LessOrEqual(t, delay, 3*time.Second)
+	}
+}
+
+func TestRetryPolicyIsRetryable(t *testing.T) {
+	policy := core.DefaultRetryPolicy()
+	assert.False(t, policy.IsRetryable(nil))
+	assert.False(t, policy.IsRetryable(errors.New("failed to read private key file")))
+
+	// Network errors
+	assert.True(t, policy.IsRetryable(fmt.Errorf("upload failed: %w", syscall.ECONNRESET)))
+	assert.True(t, policy.IsRetryable(fmt.Errorf("upload failed: %w", io.ErrUnexpectedEOF)))
+	assert.False(t, policy.IsRetryable(&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}))
+	assert.False(t, policy.IsRetryable(errors.New("dial tcp 127.0.0.1:9: connect: connection refused")))
+	assert.True(t, policy.IsRetryable(errors.New("ssh: handshake failed: read tcp: connection reset by peer")))
+	assert.False(t, policy.IsRetryable(&net.DNSError{Err: "no such host", Name: "example.invalid", IsNotFound: true}))
+
+	// S3 errors
+	assert.True(t, policy.IsRetryable(fmt.Errorf("wrapped: %w", minio.ErrorResponse{StatusCode: http.StatusServiceUnavailable, Code: "ServiceUnavailable"})))
+	assert.True(t, policy.IsRetryable(minio.ErrorResponse{StatusCode: http.StatusBadRequest, Code: "RequestTimeout"}))
+	assert.True(t, policy.IsRetryable(minio.ErrorResponse{StatusCode: http.StatusTooManyRequests}))
+	assert.False(t, policy.IsRetryable(minio.ErrorResponse{StatusCode: http.StatusForbidden, Code: "AccessDenied"}))
+	assert.False(t, policy.IsRetryable(minio.ErrorResponse{StatusCode: http.StatusNotFound, Code: "NoSuchBucket"}))
+
+	// Custom list replaces the defaults.
+	policy.RetryableErrors = []string{"Quota Exceeded"}
+	assert.True(t, policy.IsRetryable(errors.New("remote says quota exceeded, try later")))
+	assert.False(t, policy.IsRetryable(syscall.ECONNRESET))
+
+	// By default, we make one attempt.
+	policy = core.DefaultRetryPolicy()
+	assert.Equal(t, 1, policy.MaxAttempts)
+	assert.False(t, policy.ShouldRetry(1, syscall.ECONNRESET))
+
+	policy.MaxAttempts = 3
+	assert.True(t, policy.ShouldRetry(1, syscall.ECONNRESET))
+	assert.True(t, policy.ShouldRetry(2, syscall.ECONNRESET))
+	assert.False(t, policy.ShouldRetry(3, syscall.ECONNRESET))
+	assert.False(t, policy.ShouldRetry(1, errors.New("permission denied")))
+}
+
+func TestRetryPolicyValidate(t *testing.T) {
+	assert.Empty(t, core.DefaultRetryPolicy().Validate())
+	policy := &core.RetryPolicy{
+		MaxAttempts: 0,
+		BaseDelayMs: -1,
+		MaxDelayMs:  -1,
+		Jitter:      1.5,
+	}
+	errs := policy.Validate()
+	assert.Equal(t, 4, len(errs))
+	assert.NotEmpty(t, errs["RetryPolicy.MaxAttempts"])
+	assert.NotEmpty(t, errs["RetryPolicy.Jitter"])
+
+	ss := getSampleStorageService()
+	ss.RetryPolicy = policy
+	assert.False(t, ss.Validate())
+	assert.NotEmpty(t, ss.Errors["RetryPolicy.BaseDelayMs"])
+
+	copied := ss.Copy()
+	assert.Equal(t, ss.RetryPolicy, copied.RetryPolicy)
+	assert.NotSame(t, ss.RetryPolicy, copied.RetryPolicy)
+}
@@ -5,22 +5,37 @@ import (
 	"fmt"
 	"io"
 	"math"
+	"mime"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/APTrust/dart-runner/constants"
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+)
+
+// Headers for sending SHA-256 checksums with uploads, so S3 can reject
+// data damaged in transit.
+const (
+	amzChecksumAlgorithm = "x-amz-checksum-algorithm"
+	amzChecksumSHA256    = "x-amz-checksum-sha256"
 )
 
 type S3Client struct {
-	messageChannel     chan *EventMessage
-	minioClient        *minio.Client
-	storageService     *StorageService
-	totalBytesToUpload int64
-	bytesUploaded      int64
-	filesUploaded      int64
-	etags              map[string]string
+	messageChannel       chan *EventMessage
+	minioClient          *minio.Client
+	storageService       *StorageService
+	totalBytesToUpload   int64
+	bytesUploaded        int64
+	filesUploaded        int64
+	totalBytesToDownload int64
+	bytesDownloaded      int64
+	filesDownloaded      int64
+	etags                map[string]string
+	checksums            map[string]string
+	bagTags              map[string]string
 }
 
 const (
@@ -42,7 +57,7 @@ func NewS3Client(ss *StorageService, useSSL bool, messageChannel chan *EventMess
 	accessKeyId := ss.GetLogin()
 	secretKey := ss.GetPassword()
 	options := &minio.Options{
-		Creds:  credentials.NewStaticV4(accessKeyId, secretKey, ""),
+		Creds:  credentials.NewStaticV4(accessKeyId, secretKey, ss.GetSessionToken()),
 		Secure: useSSL,
 	}
 	client, err := minio.New(ss.HostAndPort(), options)
@@ -57,12 +72,23 @@ func NewS3Client(ss *StorageService, useSSL bool, messageChannel chan *EventMess
 		bytesUploaded:      0,
 		filesUploaded:      0,
 		etags:              make(map[string]string),
+		checksums:          make(map[string]string),
 	}, nil
 }
 
 // Upload uploads a file or directory from source to destination
 // on the remote server.
 func (c *S3Client) Upload(source, destination string) error {
+	return c.UploadContext(context.Background(), source, destination)
+}
+
+// UploadContext is like Upload, but it stops if ctx is cancelled.
+// Cancelling a multipart upload aborts it on the server, so its
+// parts don't linger there.
+func (c *S3Client) UploadContext(ctx context.Context, source, destination string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	info, err := os.Stat(source)
 	if err != nil {
 		return fmt.Errorf("failed to stat source: %w", err)
@@ -72,13 +98,14 @@ func (c *S3Client) Upload(source, destination string) error {
 	c.bytesUploaded = int64(0)
 	c.filesUploaded = int64(0)
 	c.etags = make(map[string]string)
+	c.checksums = make(map[string]string)
 
 	if info.IsDir() {
 		c.totalBytesToUpload, err = GetUploadPayloadSize(source)
 		if err != nil {
 			return err
 		}
-		return c.uploadDirectory(source)
+		return c.uploadDirectory(ctx, source)
 	}
 	stats, err := os.Stat(source)
 	if err != nil {
@@ -87,16 +114,19 @@ func (c *S3Client) Upload(source, destination string) error {
 		c.totalBytesToUpload = stats.Size()
 	}
 	s3Key := filepath.Base(source)
-	return c.uploadFile(source, s3Key)
+	return c.uploadFile(ctx, source, s3Key)
 }
 
 // uploadDirectory recursively uploads a directory to the remote server
-func (c *S3Client) uploadDirectory(sourceFile string) error {
+func (c *S3Client) uploadDirectory(ctx context.Context, sourceFile string) error {
 	s3KeyPrefix := filepath.Base(sourceFile)
 	return filepath.Walk(sourceFile, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
 		relPath, err := filepath.Rel(sourceFile, path)
 		if err != nil {
 			return fmt.Errorf("failed to get relative path for local path %s: %w", sourceFile, err)
@@ -104,7 +134,7 @@ func (c *S3Client) uploadDirectory(sourceFile string) error {
 		// Create the S3 key for this file and then upload it.
 		s3Key := filepath.ToSlash(filepath.Join(s3KeyPrefix, relPath))
 		if info.Mode().IsRegular() {
-			err = c.uploadFile(path, s3Key)
+			err = c.uploadFile(ctx, path, s3Key)
 			if err != nil {
 				return err
 			}
@@ -115,34 +145,124 @@ func (c *S3Client) uploadDirectory(sourceFile string) error {
 	})
 }
 
-// uploadFile uploads a single file to the remote S3 service
-func (c *S3Client) uploadFile(sourceFile, s3Key string) error {
+// uploadFile uploads a single file to the remote S3 service. Files
+// larger than multipartThreshold go up in resumable multipart uploads.
+// If the storage service is set to verify uploads, this checks the
+// remote copy against the local file after uploading.
+func (c *S3Client) uploadFile(ctx context.Context, sourceFile, s3Key string) error {
+	var checksum string
+	fileInfo, err := os.Stat(sourceFile)
+	if err == nil && fileInfo.Size() > multipartThreshold {
+		checksum, err = c.uploadFileResumable(ctx, sourceFile, s3Key, fileInfo)
+	} else {
+		checksum, err = c.putFile(ctx, sourceFile, s3Key)
+	}
+	if err != nil || !c.storageService.VerifyUploads {
+		return err
+	}
+	digest, err := c.verifyUpload(ctx, sourceFile, s3Key, checksum)
+	if err != nil {
+		return err
+	}
+	c.checksums[c.storageService.URL(s3Key)] = digest
+	return nil
+}
+
+// putFile uploads a single file to the remote S3 service in a single
+// PutObject call, with its SHA-256 checksum in the x-amz-checksum-sha256
+// header, so S3 rejects the upload if the data arrives damaged. It
+// returns the checksum it sent.
+func (c *S3Client) putFile(ctx context.Context, sourceFile, s3Key string) (string, error) {
 	remoteURL := c.storageService.URL(s3Key)
 	Dart.Log.Infof("Starting S3 upload %s to %s", sourceFile, remoteURL)
-	putOptions := minio.PutObjectOptions{}
+	putOptions, err := c.putObjectOptions(sourceFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to set upload options for %s: %w", sourceFile, err)
+	}
+	file, err := os.Open(sourceFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to open %s: %w", sourceFile, err)
+	}
+	defer file.Close()
+	size, digest, err := sha256OfReader(newContextReader(ctx, file))
+	if err != nil {
+		return "", fmt.Errorf("failed to calculate checksum of %s: %w", sourceFile, err)
+	}
+	checksum, err := hexToBase64(digest)
+	if err != nil {
+		return "", err
+	}
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	// minio's PutObject only sends checksum headers if the client uses
+	// trailing headers, so we set the header ourselves and call PutObject
+	// through minio.Core.
+	putOptions.UserMetadata = withUserMetadata(putOptions.UserMetadata, amzChecksumSHA256, checksum)
+	if putOptions.ContentType == "" {
+		putOptions.ContentType = mime.TypeByExtension(filepath.Ext(sourceFile))
+	}
 	if c.messageChannel != nil {
-		progress := NewStreamProgress(c.totalBytesToUpload, c.messageChannel)
-		putOptions = minio.PutObjectOptions{
-			Progress: progress,
-		}
+		putOptions.Progress = NewStreamProgress(c.totalBytesToUpload, c.messageChannel)
 		c.messageChannel <- StartEvent(constants.StageUpload, fmt.Sprintf("Uploading to %s", c.storageService.Name))
 	}
-	uploadInfo, err := c.minioClient.FPutObject(
-		context.Background(),
+	minioCore := minio.Core{Client: c.minioClient}
+	uploadInfo, err := minioCore.PutObject(
+		ctx,
 		c.storageService.Bucket,
 		s3Key,
-		sourceFile,
+		newContextReader(ctx, file),
+		size,
+		"",
+		digest,
 		putOptions,
 	)
 	if err != nil {
-		return fmt.Errorf("failed to upload %s to %s: %w", sourceFile, remoteURL, err)
+		return "", fmt.Errorf("failed to upload %s to %s: %w", sourceFile, remoteURL, err)
 	} else {
 		c.filesUploaded += 1
 		c.bytesUploaded += uploadInfo.Size
 		c.etags[remoteURL] = uploadInfo.ETag
 		Dart.Log.Infof("finished s3 upload of file %s; got e-tag %s", sourceFile, uploadInfo.ETag)
 	}
-	return nil
+	return checksum, nil
+}
+
+// withUserMetadata returns a copy of metadata with key set to value.
+// minio sends x-amz-checksum-* keys as headers, rather than as
+// x-amz-meta-* metadata.
+func withUserMetadata(metadata map[string]string, key, value string) map[string]string {
+	copied := make(map[string]string, len(metadata)+1)
+	for k, v := range metadata {
+		copied[k] = v
+	}
+	copied[key] = value
+	return copied
+}
+
+// SetBagTags sets the bag tag values used to fill in placeholders in
+// the storage service's S3 tags and metadata. Keys are fully qualified
+// tag names, such as "bag-info.txt/Source-Organization".
+func (c *S3Client) SetBagTags(tags map[string]string) {
+	c.bagTags = tags
+}
+
+// putObjectOptions returns the storage class, encryption, tags and
+// metadata to apply to the upload of sourceFile.
+func (c *S3Client) putObjectOptions(sourceFile string) (minio.PutObjectOptions, error) {
+	if c.storageService.S3Options == nil {
+		return minio.PutObjectOptions{}, nil
+	}
+	return c.storageService.S3Options.PutObjectOptions(sourceFile, c.bagTags)
+}
+
+// sseCustomerKey returns the SSE-C encryption setting needed to read
+// objects back from S3, or nil if the storage service doesn't use SSE-C.
+func (c *S3Client) sseCustomerKey() (encrypt.ServerSide, error) {
+	if c.storageService.S3Options == nil || c.storageService.S3Options.Encryption != constants.S3EncryptionSSEC {
+		return nil, nil
+	}
+	return c.storageService.S3Options.ServerSideEncryption()
 }
 
 func (c *S3Client) FilesUploaded() int64 {
@@ -165,6 +285,17 @@ func (c *S3Client) EtagMap() map[string]string {
 	return etagMap
 }
 
+// VerifiedChecksums returns a map of remote URLs and the SHA-256
+// digests of the objects at those URLs. This is populated only when
+// the storage service is set to verify uploads.
+func (c *S3Client) VerifiedChecksums() map[string]string {
+	checksums := make(map[string]string)
+	for key, value := range c.checksums {
+		checksums[key] = value
+	}
+	return checksums
+}
+
 // ListBuckets returns a list of existing S3 buckets.
 func (c *S3Client) ListBuckets() ([]minio.BucketInfo, error) {
 	return c.minioClient.ListBuckets(context.Background())
@@ -172,10 +303,14 @@ func (c *S3Client) ListBuckets() ([]minio.BucketInfo, error) {
 
 // ListObjects lists the objects in the specified bucket.
 func (c *S3Client) ListObjects(bucketName, prefix string, opts minio.ListObjectsOptions) []minio.ObjectInfo {
+	return c.listObjects(context.Background(), bucketName, opts)
+}
+
+func (c *S3Client) listObjects(parent context.Context, bucketName string, opts minio.ListObjectsOptions) []minio.ObjectInfo {
 	// Note that MaxKeys is useless in the Minio client according to
 	// harshavardhana's incredibly obnoxious response at
 	// https://github.com/minio/minio-go/issues/1536
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(parent)
 	objects := make([]minio.ObjectInfo, 0)
 	count := 0
 	for object := range c.minioClient.ListObjects(ctx, bucketName, opts) {
@@ -190,6 +325,28 @@ func (c *S3Client) ListObjects(bucketName, prefix string, opts minio.ListObjects
 	return objects
 }
 
+// List returns the objects in the storage service's bucket whose keys
+// begin with prefix. This skips the zero-length "folder" markers that
+// some tools create.
+func (c *S3Client) List(prefix string) ([]*RemoteObject, error) {
+	objects := make([]*RemoteObject, 0)
+	for _, objInfo := range c.ListObjects(c.storageService.Bucket, prefix, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if objInfo.Err != nil {
+			return nil, objInfo.Err
+		}
+		if strings.HasSuffix(objInfo.Key, "/") {
+			continue
+		}
+		objects = append(objects, &RemoteObject{
+			Key:      objInfo.Key,
+			Size:     objInfo.Size,
+			Modified: objInfo.LastModified,
+			ETag:     strings.Trim(objInfo.ETag, `"`),
+		})
+	}
+	return objects, nil
+}
+
 // GetObject returns the object with the specified bucket name and key.
 func (c *S3Client) GetObject(bucket, key string, opts minio.GetObjectOptions) (*minio.Object, error) {
 	return c.minioClient.GetObject(context.Background(), bucket, key, opts)
@@ -211,7 +368,11 @@ func (c *S3Client) ComputeChunkSize(objectSize int64) int64 {
 // GetLargeObject returns a ReadCloser to download large objects
 // (> 5TB) from S3.
 func (c *S3Client) GetLargeObject(bucket, key string) (io.ReadCloser, error) {
-	info, err := c.minioClient.StatObject(context.Background(), bucket, key, minio.StatObjectOptions{})
+	return c.getLargeObject(context.Background(), bucket, key)
+}
+
+func (c *S3Client) getLargeObject(ctx context.Context, bucket, key string) (io.ReadCloser, error) {
+	info, err := c.minioClient.StatObject(ctx, bucket, key, minio.StatObjectOptions{})
 	if err != nil {
 		return nil, err
 	}
@@ -235,7 +396,7 @@ func (c *S3Client) GetLargeObject(bucket, key string) (io.ReadCloser, error) {
 				break
 			}
 
-			obj, err := c.minioClient.GetObject(context.Background(), bucket, key, opts)
+			obj, err := c.minioClient.GetObject(ctx, bucket, key, opts)
 			if err != nil {
 				writeErr = err
 				break
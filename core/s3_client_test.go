@@ -1,8 +1,13 @@
 package core_test
 
 import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
@@ -13,6 +18,7 @@ import (
 	"github.com/APTrust/dart-runner/core"
 	"github.com/google/uuid"
 	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -424,3 +430,92 @@ func TestGetLargeObjectNonExistent(t *testing.T) {
 	assert.NotNil(t, err)
 	assert.Nil(t, rc)
 }
+
+func TestS3ResumableUpload(t *testing.T) {
+	defer core.ClearUploadCheckpointsTable()
+	ss := getS3StorageService()
+	s3Client, err := core.NewS3Client(ss, false, nil)
+	require.Nil(t, err)
+
+	// 64 MiB is the smallest part size, so this file goes up in two parts.
+	path := makeSparseFile(t, 70*1024*1024)
+	info, err := os.Stat(path)
+	require.Nil(t, err)
+	key := filepath.Base(path)
+
+	// Simulate an upload that was interrupted after the first part.
+	minioClient, err := minio.New(ss.HostAndPort(), &minio.Options{
+		Creds: credentials.NewStaticV4(ss.Login, ss.Password, ""),
+	})
+	require.Nil(t, err)
+	minioCore := minio.Core{Client: minioClient}
+	checkpoint := core.NewUploadCheckpoint(ss.ID, ss.Bucket, key, path, info, s3Client.ComputeChunkSize(info.Size()))
+	require.Equal(t, 2, checkpoint.PartCount())
+	checkpoint.UploadID, err = minioCore.NewMultipartUpload(context.Background(), ss.Bucket, key, minio.PutObjectOptions{
+		UserMetadata: map[string]string{"x-amz-checksum-algorithm": "SHA256"},
+	})
+	require.Nil(t, err)
+	file, err := os.Open(path)
+	require.Nil(t, err)
+	defer file.Close()
+	offset, size := checkpoint.PartRange(1)
+	hash := sha256.New()
+	_, err = io.Copy(hash, io.NewSectionReader(file, offset, size))
+	require.Nil(t, err)
+	checksum := base64.StdEncoding.EncodeToString(hash.Sum(nil))
+	partOptions := minio.PutObjectPartOptions{CustomHeader: http.Header{}}
+	partOptions.CustomHeader.Set("x-amz-checksum-sha256", checksum)
+	part, err := minioCore.PutObjectPart(context.Background(), ss.Bucket, key, checkpoint.UploadID, 1, io.NewSectionReader(file, offset, size), size, partOptions)
+	require.Nil(t, err)
+	checkpoint.AddPart(1, part.ETag, size, checksum)
+	require.Nil(t, core.UploadCheckpointSave(checkpoint))
+
+	// Upload should resume and send only the second part.
+	err = s3Client.Upload(path, key)
+	require.Nil(t, err)
+	assert.Equal(t, int64(1), s3Client.FilesUploaded())
+	assert.Equal(t, info.Size(), s3Client.BytesUploaded())
+	assert.Equal(t, 1, len(s3Client.EtagMap()))
+
+	// Checkpoint is deleted after a successful upload.
+	_, err = core.UploadCheckpointFind(ss.ID, ss.Bucket, key, path)
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	objInfo, err := minioClient.StatObject(context.Background(), ss.Bucket, key, minio.StatObjectOptions{})
+	require.Nil(t, err)
+	assert.Equal(t, info.Size(), objInfo.Size)
+}
+
+func TestS3UploadWithVerification(t *testing.T) {
+	ss := getS3StorageService()
+	ss.VerifyUploads = true
+	s3Client, err := core.NewS3Client(ss, false, nil)
+	require.Nil(t, err)
+	key := filepath.Base(fileToUpload())
+	err = s3Client.Upload(fileToUpload(), key)
+	require.Nil(t, err)
+	checksums := s3Client.VerifiedChecksums()
+	require.Equal(t, 1, len(checksums))
+	assert.Equal(t, sha256Hex(t, fileToUpload()), checksums[ss.URL(key)])
+}
+
+func TestS3UploadWithOptions(t *testing.T) {
+	ss := getS3StorageService()
+	ss.S3Options = &core.S3UploadOptions{
+		Tags:     map[string]string{"institution": "{{Source-Organization}}"},
+		Metadata: map[string]string{"bag-sha256": "{{sha256}}"},
+	}
+	s3Client, err := core.NewS3Client(ss, false, nil)
+	require.Nil(t, err)
+	s3Client.SetBagTags(map[string]string{"bag-info.txt/Source-Organization": "Example University"})
+	key := filepath.Base(fileToUpload())
+	err = s3Client.Upload(fileToUpload(), key)
+	require.Nil(t, err)
+
+	objInfo, err := s3Client.GetObject(ss.Bucket, key, minio.GetObjectOptions{})
+	require.Nil(t, err)
+	stat, err := objInfo.Stat()
+	require.Nil(t, err)
+	assert.Equal(t, sha256Hex(t, fileToUpload()), stat.UserMetadata["Bag-Sha256"])
+	assert.Equal(t, 1, stat.UserTagCount)
+}
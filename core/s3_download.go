@@ -0,0 +1,128 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+)
+
+// Download retrieves the object at key in the storage service's bucket
+// and saves it at destination. If key ends with a slash, or if there's
+// no object at key, this treats key as a prefix and downloads every
+// object under it into the directory destination, recreating the
+// structure of the keys below the prefix.
+//
+// This returns an error wrapping constants.ErrRemoteItemNotFound if
+// there's neither an object nor any objects under a prefix at key.
+func (c *S3Client) Download(key, destination string) error {
+	return c.DownloadContext(context.Background(), key, destination)
+}
+
+// DownloadContext is like Download, but it stops if ctx is cancelled.
+func (c *S3Client) DownloadContext(ctx context.Context, key, destination string) error {
+	c.totalBytesToDownload = int64(0)
+	c.bytesDownloaded = int64(0)
+	c.filesDownloaded = int64(0)
+
+	sse, err := c.sseCustomerKey()
+	if err != nil {
+		return err
+	}
+	bucket := c.storageService.Bucket
+	if !strings.HasSuffix(key, "/") {
+		objInfo, err := c.minioClient.StatObject(ctx, bucket, key, minio.StatObjectOptions{ServerSideEncryption: sse})
+		if err == nil {
+			c.totalBytesToDownload = objInfo.Size
+			progress := c.downloadProgress()
+			return c.downloadObject(ctx, key, destination, objInfo.Size, sse, progress)
+		}
+		if minio.ToErrorResponse(err).StatusCode != http.StatusNotFound {
+			return fmt.Errorf("can't stat %s: %w", c.storageService.URL(key), err)
+		}
+		key += "/"
+	}
+
+	objects := make([]minio.ObjectInfo, 0)
+	for _, objInfo := range c.listObjects(ctx, bucket, minio.ListObjectsOptions{Prefix: key, Recursive: true}) {
+		if objInfo.Err != nil {
+			return fmt.Errorf("can't list objects under %s: %w", c.storageService.URL(key), objInfo.Err)
+		}
+		// Skip the zero-length "folder" markers some tools create.
+		if strings.HasSuffix(objInfo.Key, "/") {
+			continue
+		}
+		objects = append(objects, objInfo)
+		c.totalBytesToDownload += objInfo.Size
+	}
+	if len(objects) == 0 {
+		return fmt.Errorf("%w: bucket %s has no object or prefix %s", constants.ErrRemoteItemNotFound, bucket, strings.TrimSuffix(key, "/"))
+	}
+	progress := c.downloadProgress()
+	for _, objInfo := range objects {
+		localPath, err := downloadTargetPath(destination, strings.TrimPrefix(objInfo.Key, key))
+		if err != nil {
+			return err
+		}
+		err = c.downloadObject(ctx, objInfo.Key, localPath, objInfo.Size, sse, progress)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// downloadObject saves the object at key to localPath. Objects larger
+// than the maximum S3 part size come down in a series of ranged requests
+// through GetLargeObject, unless they're encrypted with SSE-C, which
+// GetLargeObject doesn't support.
+func (c *S3Client) downloadObject(ctx context.Context, key, localPath string, size int64, sse encrypt.ServerSide, progress *StreamProgress) error {
+	remoteURL := c.storageService.URL(key)
+	Dart.Log.Infof("Starting S3 download %s to %s", remoteURL, localPath)
+	var reader io.ReadCloser
+	var err error
+	if size > maxChunkSize && sse == nil {
+		reader, err = c.getLargeObject(ctx, c.storageService.Bucket, key)
+	} else {
+		reader, err = c.minioClient.GetObject(ctx, c.storageService.Bucket, key, minio.GetObjectOptions{ServerSideEncryption: sse})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %w", remoteURL, err)
+	}
+	defer reader.Close()
+	err = saveDownload(newContextReader(ctx, reader), localPath, size, 0644, progress)
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %w", remoteURL, err)
+	}
+	c.filesDownloaded += 1
+	c.bytesDownloaded += size
+	Dart.Log.Infof("Downloaded file: %s -> %s", remoteURL, localPath)
+	return nil
+}
+
+// downloadProgress returns a StreamProgress that reports download progress
+// through the client's message channel, or nil if there's no channel.
+func (c *S3Client) downloadProgress() *StreamProgress {
+	if c.messageChannel == nil {
+		return nil
+	}
+	c.messageChannel <- StartEvent(constants.StageDownload, fmt.Sprintf("Downloading from %s", c.storageService.Name))
+	return NewDownloadProgress(c.totalBytesToDownload, c.messageChannel)
+}
+
+func (c *S3Client) FilesDownloaded() int64 {
+	return c.filesDownloaded
+}
+
+func (c *S3Client) BytesDownloaded() int64 {
+	return c.bytesDownloaded
+}
+
+func (c *S3Client) DownloadSize() int64 {
+	return c.totalBytesToDownload
+}
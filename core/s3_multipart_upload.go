@@ -0,0 +1,322 @@
+package core
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/minio/minio-go/v7"
+)
+
+const (
+	// multipartThreshold is the file size above which the S3 client
+	// uses resumable multipart uploads instead of a single PutObject.
+	multipartThreshold = minChunkSize
+
+	// StaleUploadAge is how long an interrupted multipart upload may
+	// sit without progress before we abort it and discard its parts.
+	StaleUploadAge = 7 * 24 * time.Hour
+)
+
+// uploadFileResumable uploads a large file in parts, recording each
+// completed part in an UploadCheckpoint. If a previous attempt to upload
+// the same file to the same key was interrupted, this uploads only the
+// parts that the previous attempt did not finish.
+//
+// Each part goes up with its SHA-256 checksum, and the upload is
+// completed with the list of part checksums, so S3 can reject damaged
+// parts. This returns the composite checksum S3 should report for the
+// finished object. The checkpoint records each part's checksum, so on
+// resume we don't have to reread the parts already uploaded.
+//
+// If ctx is cancelled, this aborts the multipart upload instead of
+// keeping its checkpoint, since the user asked us to stop rather than
+// being interrupted.
+func (c *S3Client) uploadFileResumable(ctx context.Context, sourceFile, s3Key string, fileInfo os.FileInfo) (string, error) {
+	remoteURL := c.storageService.URL(s3Key)
+	minioCore := minio.Core{Client: c.minioClient}
+
+	putOptions, err := c.putObjectOptions(sourceFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to set upload options for %s: %w", sourceFile, err)
+	}
+	initOptions := putOptions
+	initOptions.UserMetadata = withUserMetadata(putOptions.UserMetadata, amzChecksumAlgorithm, "SHA256")
+	checkpoint, err := c.getCheckpoint(ctx, minioCore, sourceFile, s3Key, fileInfo, initOptions)
+	if err != nil {
+		return "", fmt.Errorf("failed to start multipart upload of %s to %s: %w", sourceFile, remoteURL, err)
+	}
+	bytesAlreadyUploaded := checkpoint.BytesCompleted()
+	if bytesAlreadyUploaded > 0 {
+		Dart.Log.Infof("Resuming S3 upload %s to %s: %d of %d parts already uploaded", sourceFile, remoteURL, len(checkpoint.Parts), checkpoint.PartCount())
+	} else {
+		Dart.Log.Infof("Starting S3 multipart upload %s to %s in %d parts", sourceFile, remoteURL, checkpoint.PartCount())
+	}
+
+	var progress *StreamProgress
+	if c.messageChannel != nil {
+		progress = NewStreamProgress(c.totalBytesToUpload, c.messageChannel)
+		c.messageChannel <- StartEvent(constants.StageUpload, fmt.Sprintf("Uploading to %s", c.storageService.Name))
+		if bytesAlreadyUploaded > 0 {
+			progress.SetTotalBytesCompleted(bytesAlreadyUploaded)
+		}
+	}
+
+	file, err := os.Open(sourceFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to open %s: %w", sourceFile, err)
+	}
+	defer file.Close()
+
+	// We need all of the part checksums to complete the upload. Parts
+	// a previous attempt uploaded keep the checksums in the checkpoint.
+	partChecksums := make([]string, checkpoint.PartCount())
+	for partNumber := 1; partNumber <= checkpoint.PartCount(); partNumber++ {
+		if uploaded := checkpoint.Part(partNumber); uploaded != nil && uploaded.ChecksumSHA256 != "" {
+			partChecksums[partNumber-1] = uploaded.ChecksumSHA256
+			continue
+		}
+		offset, size := checkpoint.PartRange(partNumber)
+		checksum, err := base64SHA256(newContextReader(ctx, io.NewSectionReader(file, offset, size)))
+		if err != nil {
+			c.abortIfCancelled(ctx, minioCore, checkpoint)
+			return "", fmt.Errorf("failed to calculate checksum of part %d of %s: %w", partNumber, sourceFile, err)
+		}
+		partChecksums[partNumber-1] = checksum
+		var reader io.Reader = io.NewSectionReader(file, offset, size)
+		if progress != nil {
+			reader = &progressReader{reader: reader, progress: progress}
+		}
+		partOptions := minio.PutObjectPartOptions{
+			SSE:          putOptions.ServerSideEncryption,
+			CustomHeader: http.Header{},
+		}
+		partOptions.CustomHeader.Set(amzChecksumSHA256, checksum)
+		part, err := minioCore.PutObjectPart(ctx, checkpoint.Bucket, s3Key, checkpoint.UploadID, partNumber, reader, size, partOptions)
+		if err != nil {
+			c.abortIfCancelled(ctx, minioCore, checkpoint)
+			return "", fmt.Errorf("failed to upload part %d of %d of %s to %s: %w", partNumber, checkpoint.PartCount(), sourceFile, remoteURL, err)
+		}
+		checkpoint.AddPart(partNumber, part.ETag, size, checksum)
+		err = UploadCheckpointSave(checkpoint)
+		if err != nil {
+			Dart.Log.Warningf("Could not save checkpoint for upload of %s: %v", sourceFile, err)
+		}
+	}
+
+	completeParts := make([]minio.CompletePart, len(checkpoint.Parts))
+	for i, part := range checkpoint.Parts {
+		completeParts[i] = minio.CompletePart{PartNumber: part.PartNumber, ETag: part.ETag, ChecksumSHA256: part.ChecksumSHA256}
+	}
+	uploadInfo, err := minioCore.CompleteMultipartUpload(ctx, checkpoint.Bucket, s3Key, checkpoint.UploadID, completeParts, minio.PutObjectOptions{ServerSideEncryption: putOptions.ServerSideEncryption})
+	if err != nil {
+		c.abortIfCancelled(ctx, minioCore, checkpoint)
+		return "", fmt.Errorf("failed to complete multipart upload of %s to %s: %w", sourceFile, remoteURL, err)
+	}
+	err = UploadCheckpointDelete(checkpoint.ID)
+	if err != nil {
+		Dart.Log.Warningf("Could not delete checkpoint for completed upload of %s: %v", sourceFile, err)
+	}
+	c.filesUploaded += 1
+	c.bytesUploaded += fileInfo.Size()
+	c.etags[remoteURL] = uploadInfo.ETag
+	Dart.Log.Infof("finished s3 multipart upload of file %s; got e-tag %s", sourceFile, uploadInfo.ETag)
+	return compositeSHA256(partChecksums)
+}
+
+// getCheckpoint returns the checkpoint of a previous, interrupted upload
+// of sourceFile to s3Key, if there is one and it can still be resumed.
+// Otherwise, it initiates a new multipart upload with the specified
+// options and returns a new checkpoint.
+func (c *S3Client) getCheckpoint(ctx context.Context, minioCore minio.Core, sourceFile, s3Key string, fileInfo os.FileInfo, putOptions minio.PutObjectOptions) (*UploadCheckpoint, error) {
+	bucket := c.storageService.Bucket
+	checkpoint, err := UploadCheckpointFind(c.storageService.ID, bucket, s3Key, sourceFile)
+	if err != nil && err != sql.ErrNoRows {
+		Dart.Log.Warningf("Could not look up checkpoint for upload of %s: %v", sourceFile, err)
+	}
+	if checkpoint != nil {
+		if !checkpoint.MatchesFile(fileInfo) {
+			Dart.Log.Infof("%s has changed since the last upload attempt, so the upload will start over", sourceFile)
+		} else if err = c.syncCheckpoint(ctx, minioCore, checkpoint); err != nil {
+			Dart.Log.Warningf("Cannot resume upload of %s, so the upload will start over: %v", sourceFile, err)
+		} else {
+			return checkpoint, nil
+		}
+		c.discardCheckpoint(ctx, minioCore, checkpoint)
+	}
+
+	checkpoint = NewUploadCheckpoint(c.storageService.ID, bucket, s3Key, sourceFile, fileInfo, c.ComputeChunkSize(fileInfo.Size()))
+	checkpoint.UploadID, err = minioCore.NewMultipartUpload(ctx, bucket, s3Key, putOptions)
+	if err != nil {
+		return nil, err
+	}
+	err = UploadCheckpointSave(checkpoint)
+	if err != nil {
+		Dart.Log.Warningf("Could not save checkpoint for upload of %s. This upload will not be resumable: %v", sourceFile, err)
+	}
+	return checkpoint, nil
+}
+
+// syncCheckpoint replaces the checkpoint's list of parts with the list
+// of parts the S3 server actually has. This picks up parts that were
+// uploaded but not recorded before the last attempt was interrupted,
+// and drops parts the server doesn't know about. Parts keep the
+// checksums recorded in the checkpoint, unless the server reports a
+// different one, in which case we upload the part again. It returns an
+// error if the server no longer knows about the upload, or if the
+// upload was started without SHA-256 checksums.
+func (c *S3Client) syncCheckpoint(ctx context.Context, minioCore minio.Core, checkpoint *UploadCheckpoint) error {
+	uploaded := make([]minio.ObjectPart, 0)
+	algorithm := ""
+	marker := 0
+	for {
+		result, err := minioCore.ListObjectParts(ctx, checkpoint.Bucket, checkpoint.ObjectKey, checkpoint.UploadID, marker, 1000)
+		if err != nil {
+			return err
+		}
+		algorithm = result.ChecksumAlgorithm
+		uploaded = append(uploaded, result.ObjectParts...)
+		if !result.IsTruncated {
+			break
+		}
+		marker = result.NextPartNumberMarker
+	}
+	if !hasSHA256Checksums(algorithm, uploaded) {
+		return fmt.Errorf("upload %s was started without SHA-256 checksums", checkpoint.UploadID)
+	}
+	recorded := make(map[int]string)
+	for _, part := range checkpoint.Parts {
+		recorded[part.PartNumber] = part.ChecksumSHA256
+	}
+	checkpoint.Parts = make([]CheckpointPart, 0)
+	for _, part := range uploaded {
+		if part.PartNumber < 1 || part.PartNumber > checkpoint.PartCount() {
+			continue
+		}
+		_, expectedSize := checkpoint.PartRange(part.PartNumber)
+		if part.Size != expectedSize {
+			continue
+		}
+		checksum := part.ChecksumSHA256
+		if recordedChecksum := recorded[part.PartNumber]; recordedChecksum != "" {
+			if checksum != "" && checksum != recordedChecksum {
+				continue
+			}
+			checksum = recordedChecksum
+		}
+		checkpoint.AddPart(part.PartNumber, part.ETag, part.Size, checksum)
+	}
+	return nil
+}
+
+// hasSHA256Checksums returns true if a multipart upload was started with
+// SHA-256 checksums. Some S3 services don't report the upload's checksum
+// algorithm, so in that case we look for checksums on the parts.
+func hasSHA256Checksums(algorithm string, parts []minio.ObjectPart) bool {
+	if algorithm != "" {
+		return strings.EqualFold(algorithm, "SHA256")
+	}
+	if len(parts) == 0 {
+		return false
+	}
+	for _, part := range parts {
+		if part.ChecksumSHA256 == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// discardCheckpoint aborts the checkpoint's multipart upload, so the
+// S3 server can delete the parts, and then deletes the checkpoint.
+// It returns an error if the upload could not be aborted, in which
+// case the checkpoint is kept so we can try again later.
+func (c *S3Client) discardCheckpoint(ctx context.Context, minioCore minio.Core, checkpoint *UploadCheckpoint) error {
+	err := minioCore.AbortMultipartUpload(ctx, checkpoint.Bucket, checkpoint.ObjectKey, checkpoint.UploadID)
+	if err != nil && minio.ToErrorResponse(err).Code != "NoSuchUpload" {
+		Dart.Log.Warningf("Could not abort multipart upload %s of %s: %v", checkpoint.UploadID, checkpoint.LocalPath, err)
+		return err
+	}
+	err = UploadCheckpointDelete(checkpoint.ID)
+	if err != nil {
+		Dart.Log.Warningf("Could not delete checkpoint for upload of %s: %v", checkpoint.LocalPath, err)
+	}
+	return err
+}
+
+// abortIfCancelled aborts the checkpoint's multipart upload if ctx
+// has been cancelled. It uses a fresh context for the abort request,
+// since ctx is already done.
+func (c *S3Client) abortIfCancelled(ctx context.Context, minioCore minio.Core, checkpoint *UploadCheckpoint) {
+	if ctx.Err() == nil {
+		return
+	}
+	Dart.Log.Infof("Aborting multipart upload %s of %s because the upload was cancelled", checkpoint.UploadID, checkpoint.LocalPath)
+	c.discardCheckpoint(context.Background(), minioCore, checkpoint)
+}
+
+// AbortStaleUploads aborts interrupted multipart uploads to this
+// client's storage service that have made no progress in maxAge.
+// It returns the number of uploads aborted. Uploads that can't be
+// aborted are left in place and counted in the returned error.
+//
+// This works from the checkpoints in the local database, so it aborts
+// only uploads that this machine started. Uploads don't call this.
+// Users run it with --abort-stale-uploads.
+func (c *S3Client) AbortStaleUploads(maxAge time.Duration) (int, error) {
+	ctx := context.Background()
+	minioCore := minio.Core{Client: c.minioClient}
+	checkpoints, err := UploadCheckpointListOlderThan(c.storageService.ID, time.Now().Add(-maxAge))
+	if err != nil {
+		return 0, err
+	}
+	aborted := 0
+	failed := 0
+	for _, checkpoint := range checkpoints {
+		Dart.Log.Infof("Aborting stale upload of %s to %s, last updated %s", checkpoint.LocalPath, checkpoint.ObjectKey, checkpoint.UpdatedAt.Format(time.RFC3339))
+		if c.discardCheckpoint(ctx, minioCore, checkpoint) != nil {
+			failed++
+		} else {
+			aborted++
+		}
+	}
+	if failed > 0 {
+		return aborted, fmt.Errorf("could not abort %d stale uploads", failed)
+	}
+	return aborted, nil
+}
+
+// AbortStaleS3Uploads aborts interrupted multipart uploads to the S3
+// storage service ss, as described in S3Client.AbortStaleUploads.
+func AbortStaleS3Uploads(ss *StorageService, maxAge time.Duration) (int, error) {
+	if ss.Protocol != constants.ProtocolS3 {
+		return 0, fmt.Errorf("%s is not an S3 storage service", ss.Name)
+	}
+	useSSL := !strings.HasPrefix(ss.Host, "localhost") && !strings.HasPrefix(ss.Host, "127.0.0.1")
+	client, err := NewS3Client(ss, useSSL, nil)
+	if err != nil {
+		return 0, err
+	}
+	return client.AbortStaleUploads(maxAge)
+}
+
+// progressReader reports bytes read from a multipart upload part
+// to a StreamProgress.
+type progressReader struct {
+	reader   io.Reader
+	progress *StreamProgress
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		r.progress.SetTotalBytesCompleted(int64(n))
+	}
+	return n, err
+}
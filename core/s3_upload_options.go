@@ -0,0 +1,207 @@
+package core
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/util"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+)
+
+// S3 limits on object tags.
+const (
+	maxS3ObjectTags     = 10
+	maxS3TagKeyLength   = 128
+	maxS3TagValueLength = 256
+)
+
+// S3UploadOptions describe how a StorageService stores objects in S3:
+// which storage class to use, how the server should encrypt them, and
+// which tags and metadata to attach.
+//
+// Tag and metadata values may include placeholders such as {{sha256}}
+// or {{Source-Organization}}, which refer to the file being uploaded
+// (usually the tarred bag) and to the bag's tags. See ExpandUploadTemplate
+// for the full list.
+type S3UploadOptions struct {
+	// StorageClass is the S3 storage class, such as STANDARD, GLACIER
+	// or DEEP_ARCHIVE. If empty, the bucket's default applies.
+	StorageClass string `json:"storageClass,omitempty"`
+
+	// Encryption is the type of server-side encryption: SSE-S3,
+	// SSE-KMS, SSE-C or empty for the bucket's default.
+	Encryption string `json:"encryption,omitempty"`
+
+	// KMSKeyID is the ID of the KMS key for SSE-KMS encryption.
+	KMSKeyID string `json:"kmsKeyId,omitempty"`
+
+	// CustomerKey is the base64-encoded 256-bit key for SSE-C
+	// encryption. Like StorageService passwords, this may take the
+	// form "env:VAR_NAME" to read the key from the environment, or
+	// use any other credential reference, such as "file:/path/to/key".
+	CustomerKey string `json:"customerKey,omitempty"`
+
+	// Tags are S3 object tags.
+	Tags map[string]string `json:"tags,omitempty"`
+
+	// Metadata are custom metadata values, sent as x-amz-meta-* headers.
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// Copy returns a copy of these options. It returns nil if o is nil.
+func (o *S3UploadOptions) Copy() *S3UploadOptions {
+	if o == nil {
+		return nil
+	}
+	opts := *o
+	opts.Tags = copyStringMap(o.Tags)
+	opts.Metadata = copyStringMap(o.Metadata)
+	return &opts
+}
+
+// Validate returns a map of errors describing problems with these
+// options. The map is empty if the options are valid.
+func (o *S3UploadOptions) Validate() map[string]string {
+	errs := make(map[string]string)
+	if o.StorageClass != "" && !util.StringListContains(constants.S3StorageClasses, o.StorageClass) {
+		errs["S3Options.StorageClass"] = fmt.Sprintf("Storage class must be one of: %s.", strings.Join(constants.S3StorageClasses, ", "))
+	}
+	if o.Encryption != "" && !util.StringListContains(constants.S3EncryptionTypes, o.Encryption) {
+		errs["S3Options.Encryption"] = fmt.Sprintf("Encryption must be one of: %s.", strings.Join(constants.S3EncryptionTypes, ", "))
+	}
+	if o.Encryption == constants.S3EncryptionSSEKMS && strings.TrimSpace(o.KMSKeyID) == "" {
+		errs["S3Options.KMSKeyID"] = "SSE-KMS encryption requires a KMS key ID."
+	}
+	if o.Encryption == constants.S3EncryptionSSEC {
+		if strings.TrimSpace(o.CustomerKey) == "" {
+			errs["S3Options.CustomerKey"] = "SSE-C encryption requires a customer key."
+		} else if !IsCredentialReference(o.CustomerKey) {
+			// We can't check keys from env vars, files, etc.
+			// until upload time.
+			if _, err := o.customerKey(); err != nil {
+				errs["S3Options.CustomerKey"] = err.Error()
+			}
+		}
+	}
+	if len(o.Tags) > maxS3ObjectTags {
+		errs["S3Options.Tags"] = fmt.Sprintf("S3 allows at most %d tags per object.", maxS3ObjectTags)
+	}
+	for key := range o.Tags {
+		if key == "" || len(key) > maxS3TagKeyLength {
+			errs["S3Options.Tags"] = fmt.Sprintf("Tag keys must be between 1 and %d characters.", maxS3TagKeyLength)
+		}
+	}
+	for key := range o.Metadata {
+		if strings.TrimSpace(key) == "" || strings.ContainsAny(key, " :\t\r\n") {
+			errs["S3Options.Metadata"] = fmt.Sprintf("Metadata key '%s' is not a valid header name.", key)
+		}
+	}
+	return errs
+}
+
+// ServerSideEncryption returns the minio encryption setting for these
+// options, or nil if the options don't specify encryption.
+func (o *S3UploadOptions) ServerSideEncryption() (encrypt.ServerSide, error) {
+	switch o.Encryption {
+	case "":
+		return nil, nil
+	case constants.S3EncryptionSSES3:
+		return encrypt.NewSSE(), nil
+	case constants.S3EncryptionSSEKMS:
+		return encrypt.NewSSEKMS(o.KMSKeyID, nil)
+	case constants.S3EncryptionSSEC:
+		key, err := o.customerKey()
+		if err != nil {
+			return nil, err
+		}
+		return encrypt.NewSSEC(key)
+	}
+	return nil, fmt.Errorf("unsupported S3 encryption type '%s'", o.Encryption)
+}
+
+// PutObjectOptions returns minio PutObjectOptions describing these
+// settings for an upload of sourceFile. Param bagTags maps fully
+// qualified tag names to values, for filling in tag and metadata
+// placeholders.
+func (o *S3UploadOptions) PutObjectOptions(sourceFile string, bagTags map[string]string) (minio.PutObjectOptions, error) {
+	putOptions := minio.PutObjectOptions{
+		StorageClass: o.StorageClass,
+	}
+	sse, err := o.ServerSideEncryption()
+	if err != nil {
+		return putOptions, err
+	}
+	putOptions.ServerSideEncryption = sse
+	resolver := newUploadTemplateResolver(sourceFile, bagTags)
+	if len(o.Tags) > 0 {
+		putOptions.UserTags = make(map[string]string)
+		for key, value := range o.Tags {
+			putOptions.UserTags[key], err = resolver.expand(value)
+			if err != nil {
+				return putOptions, err
+			}
+			if len(putOptions.UserTags[key]) > maxS3TagValueLength {
+				return putOptions, fmt.Errorf("value of S3 tag %s is longer than %d characters", key, maxS3TagValueLength)
+			}
+		}
+	}
+	if len(o.Metadata) > 0 {
+		putOptions.UserMetadata = make(map[string]string)
+		for key, value := range o.Metadata {
+			putOptions.UserMetadata[key], err = resolver.expand(value)
+			if err != nil {
+				return putOptions, err
+			}
+		}
+	}
+	return putOptions, nil
+}
+
+// customerKey returns the decoded SSE-C key.
+func (o *S3UploadOptions) customerKey() ([]byte, error) {
+	value, err := ResolveCredential(o.CustomerKey)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+	if err != nil {
+		return nil, fmt.Errorf("SSE-C customer key must be base64-encoded: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("SSE-C customer key must be 32 bytes, not %d", len(key))
+	}
+	return key, nil
+}
+
+// BagTagValues returns a map of the tag values in profile, keyed by
+// fully qualified tag name, for use in S3 metadata and tag placeholders.
+// Tags with empty values are omitted. If a tag appears more than once,
+// the first value wins.
+func BagTagValues(profile *BagItProfile) map[string]string {
+	values := make(map[string]string)
+	if profile == nil {
+		return values
+	}
+	for _, tagDef := range profile.Tags {
+		value := tagDef.GetValue()
+		name := tagDef.FullyQualifiedName()
+		if _, exists := values[name]; value != "" && !exists {
+			values[name] = value
+		}
+	}
+	return values
+}
+
+func copyStringMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	copied := make(map[string]string, len(m))
+	for key, value := range m {
+		copied[key] = value
+	}
+	return copied
+}
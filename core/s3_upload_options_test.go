@@ -0,0 +1,138 @@
+package core_test
+
+import (
+	"encoding/base64"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/core"
+	"github.com/APTrust/dart-runner/util"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testCustomerKey = base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+
+func TestS3UploadOptionsValidate(t *testing.T) {
+	opts := &core.S3UploadOptions{
+		StorageClass: "DEEP_ARCHIVE",
+		Encryption:   constants.S3EncryptionSSEKMS,
+		KMSKeyID:     "arn:aws:kms:us-east-1:123456789012:key/abcd",
+		Tags:         map[string]string{"Institution": "{{Source-Organization}}"},
+		Metadata:     map[string]string{"sha256": "{{sha256}}"},
+	}
+	assert.Empty(t, opts.Validate())
+
+	opts = &core.S3UploadOptions{
+		StorageClass: "FROZEN_SOLID",
+		Encryption:   "ROT13",
+		Metadata:     map[string]string{"bad key": "value"},
+	}
+	errs := opts.Validate()
+	assert.Contains(t, errs["S3Options.StorageClass"], "DEEP_ARCHIVE")
+	assert.Contains(t, errs["S3Options.Encryption"], "SSE-KMS")
+	assert.Contains(t, errs["S3Options.Metadata"], "bad key")
+
+	opts = &core.S3UploadOptions{Encryption: constants.S3EncryptionSSEKMS}
+	assert.NotEmpty(t, opts.Validate()["S3Options.KMSKeyID"])
+
+	opts = &core.S3UploadOptions{Encryption: constants.S3EncryptionSSEC}
+	assert.NotEmpty(t, opts.Validate()["S3Options.CustomerKey"])
+	opts.CustomerKey = base64.StdEncoding.EncodeToString([]byte("too short"))
+	assert.Contains(t, opts.Validate()["S3Options.CustomerKey"], "32 bytes")
+	opts.CustomerKey = testCustomerKey
+	assert.Empty(t, opts.Validate())
+	opts.CustomerKey = "env:DART_TEST_SSEC_KEY"
+	assert.Empty(t, opts.Validate())
+
+	opts = &core.S3UploadOptions{Tags: make(map[string]string)}
+	for i := 0; i < 11; i++ {
+		opts.Tags[strings.Repeat("k", i+1)] = "v"
+	}
+	assert.NotEmpty(t, opts.Validate()["S3Options.Tags"])
+
+	// Storage service includes S3 option errors.
+	ss := getSampleStorageService()
+	ss.S3Options = &core.S3UploadOptions{StorageClass: "FROZEN_SOLID"}
+	assert.False(t, ss.Validate())
+	assert.NotEmpty(t, ss.Errors["S3Options.StorageClass"])
+	copied := ss.Copy()
+	assert.Equal(t, ss.S3Options, copied.S3Options)
+	assert.NotSame(t, ss.S3Options, copied.S3Options)
+}
+
+func TestS3UploadOptionsServerSideEncryption(t *testing.T) {
+	opts := &core.S3UploadOptions{}
+	sse, err := opts.ServerSideEncryption()
+	require.Nil(t, err)
+	assert.Nil(t, sse)
+
+	opts.Encryption = constants.S3EncryptionSSES3
+	sse, err = opts.ServerSideEncryption()
+	require.Nil(t, err)
+	assert.Equal(t, encrypt.S3, sse.Type())
+
+	opts.Encryption = constants.S3EncryptionSSEKMS
+	opts.KMSKeyID = "my-key"
+	sse, err = opts.ServerSideEncryption()
+	require.Nil(t, err)
+	assert.Equal(t, encrypt.KMS, sse.Type())
+
+	opts.Encryption = constants.S3EncryptionSSEC
+	opts.CustomerKey = "env:DART_TEST_SSEC_KEY"
+	t.Setenv("DART_TEST_SSEC_KEY", testCustomerKey)
+	sse, err = opts.ServerSideEncryption()
+	require.Nil(t, err)
+	assert.Equal(t, encrypt.SSEC, sse.Type())
+
+	t.Setenv("DART_TEST_SSEC_KEY", "")
+	_, err = opts.ServerSideEncryption()
+	assert.NotNil(t, err)
+}
+
+func TestS3UploadOptionsPutObjectOptions(t *testing.T) {
+	bagFile := util.PathToUnitTestBag("example.edu.tagsample_good.tar")
+	profile := loadProfile(t, "aptrust-v2.2.json")
+	profile.GetTagDef("bag-info.txt", "Source-Organization").UserValue = "Example University"
+	profile.GetTagDef("aptrust-info.txt", "Title").UserValue = "Papers of Jane Doe"
+	bagTags := core.BagTagValues(profile)
+	assert.Equal(t, "Example University", bagTags["bag-info.txt/Source-Organization"])
+	assert.Equal(t, "Standard", bagTags["aptrust-info.txt/Storage-Option"])
+
+	opts := &core.S3UploadOptions{
+		StorageClass: "GLACIER",
+		Encryption:   constants.S3EncryptionSSES3,
+		Tags: map[string]string{
+			"institution": "{{Source-Organization}}",
+			"storage":     "{{ aptrust-info.txt/Storage-Option }}",
+		},
+		Metadata: map[string]string{
+			"bag-sha256": "{{sha256}}",
+			"title":      "{{Title}} ({{filename}})",
+			"missing":    "[{{No-Such-Tag}}]",
+		},
+	}
+	putOptions, err := opts.PutObjectOptions(bagFile, bagTags)
+	require.Nil(t, err)
+	assert.Equal(t, "GLACIER", putOptions.StorageClass)
+	require.NotNil(t, putOptions.ServerSideEncryption)
+	assert.Equal(t, encrypt.S3, putOptions.ServerSideEncryption.Type())
+	assert.Equal(t, "Example University", putOptions.UserTags["institution"])
+	assert.Equal(t, "Standard", putOptions.UserTags["storage"])
+	assert.Equal(t, sha256Hex(t, bagFile), putOptions.UserMetadata["bag-sha256"])
+	assert.Equal(t, 64, len(putOptions.UserMetadata["bag-sha256"]))
+	assert.Equal(t, "Papers of Jane Doe ("+filepath.Base(bagFile)+")", putOptions.UserMetadata["title"])
+	assert.Equal(t, "[]", putOptions.UserMetadata["missing"])
+
+	// No bag tags, as in standalone upload jobs.
+	putOptions, err = opts.PutObjectOptions(bagFile, nil)
+	require.Nil(t, err)
+	assert.Equal(t, "", putOptions.UserTags["institution"])
+
+	// File digests require a readable file.
+	_, err = opts.PutObjectOptions("/file/does/not/exist", bagTags)
+	assert.NotNil(t, err)
+}
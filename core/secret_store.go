@@ -0,0 +1,566 @@
+package core
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/scrypt"
+)
+
+// We protect secrets in the DART database with envelope encryption.
+// A random data key encrypts each secret field (storage service
+// passwords, SSE-C customer keys and repository API tokens) with
+// AES-256-GCM. A master key, which never touches the database,
+// encrypts ("wraps") the data key. Rotating the master key rewraps the
+// data key, so we don't have to rewrite every record.
+//
+// Encryption is off until the user supplies a master key. Until then,
+// secrets are stored in plain text, as they always have been. Once the
+// database has a data key, we refuse to save secrets without the master
+// key, rather than quietly storing them in plain text.
+
+// encryptedSecretPrefix marks an encrypted value. The full form is
+// "dart-enc:v1:<data key id>:<base64 nonce and ciphertext>".
+const encryptedSecretPrefix = "dart-enc:v1:"
+
+const (
+	kdfNone   = "none"
+	kdfScrypt = "scrypt"
+)
+
+// secretHolder is implemented by persistent objects that contain
+// secrets we encrypt at rest.
+type secretHolder interface {
+	secretFields() []*string
+}
+
+// EncryptionKey is a data key, wrapped by the master key, as stored
+// in the encryption_keys table. KDF describes how we turned the master
+// key source into a key, and Salt is the salt for scrypt.
+type EncryptionKey struct {
+	ID         string
+	WrappedKey string
+	KDF        string
+	Salt       string
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+// MasterKeySource describes where to find the master key. Set exactly
+// one of these. Key is a base64-encoded 32-byte key. KeyFile is the path
+// to a file containing a 32-byte key, either raw or base64-encoded.
+// Passphrase is any string; we derive the key from it with scrypt.
+// Passphrase may also be a credential reference, such as
+// "keyring:dart/master", as described in ResolveCredential().
+type MasterKeySource struct {
+	Key        string
+	KeyFile    string
+	Passphrase string
+}
+
+type unlockedKey struct {
+	id  string
+	key []byte
+}
+
+var dataKey *unlockedKey
+var dataKeyMutex sync.RWMutex
+
+// CurrentMasterKeySource returns the master key source described by the
+// DART_MASTER_KEY, DART_MASTER_KEY_FILE and DART_MASTER_PASSPHRASE
+// environment variables.
+func CurrentMasterKeySource() *MasterKeySource {
+	return masterKeySourceFromEnv(constants.EnvMasterKey, constants.EnvMasterKeyFile, constants.EnvMasterPassphrase)
+}
+
+// NextMasterKeySource returns the master key source to rotate to, as
+// described by the DART_NEW_MASTER_KEY, DART_NEW_MASTER_KEY_FILE and
+// DART_NEW_MASTER_PASSPHRASE environment variables.
+func NextMasterKeySource() *MasterKeySource {
+	return masterKeySourceFromEnv(constants.EnvNewMasterKey, constants.EnvNewMasterKeyFile, constants.EnvNewMasterPassphrase)
+}
+
+func masterKeySourceFromEnv(keyVar, keyFileVar, passphraseVar string) *MasterKeySource {
+	return &MasterKeySource{
+		Key:        os.Getenv(keyVar),
+		KeyFile:    os.Getenv(keyFileVar),
+		Passphrase: os.Getenv(passphraseVar),
+	}
+}
+
+// IsEmpty returns true if this source doesn't describe a key.
+func (s *MasterKeySource) IsEmpty() bool {
+	return s.Key == "" && s.KeyFile == "" && s.Passphrase == ""
+}
+
+// Validate returns an error if this source doesn't describe exactly
+// one key.
+func (s *MasterKeySource) Validate() error {
+	count := 0
+	for _, value := range []string{s.Key, s.KeyFile, s.Passphrase} {
+		if value != "" {
+			count++
+		}
+	}
+	if count != 1 {
+		return fmt.Errorf("supply exactly one of a master key, key file or passphrase, not %d", count)
+	}
+	return nil
+}
+
+// kdf returns the name of the function that turns this source into a key.
+func (s *MasterKeySource) kdf() string {
+	if s.Passphrase != "" {
+		return kdfScrypt
+	}
+	return kdfNone
+}
+
+// deriveKey returns the 32-byte master key. Param salt is used only
+// for passphrases.
+func (s *MasterKeySource) deriveKey(salt []byte) ([]byte, error) {
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	if s.Passphrase != "" {
+		passphrase, err := ResolveCredential(s.Passphrase)
+		if err != nil {
+			return nil, err
+		}
+		return scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+	}
+	encoded := s.Key
+	if s.KeyFile != "" {
+		path, err := expandHome(s.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("can't read master key file: %w", err)
+		}
+		if len(data) == 32 {
+			return data, nil
+		}
+		encoded = strings.TrimSpace(string(data))
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("master key must be base64-encoded: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("master key must be 32 bytes, not %d", len(key))
+	}
+	return key, nil
+}
+
+// UnlockSecrets unwraps the data key with the master key from source,
+// so that we can encrypt secrets as we save them and decrypt them as
+// we read them. If the database has no data key yet, this creates one
+// and wraps it with the master key.
+//
+// This returns constants.ErrWrongMasterKey if source's key didn't
+// wrap the existing data key.
+func UnlockSecrets(source *MasterKeySource) error {
+	if err := source.Validate(); err != nil {
+		return err
+	}
+	stored, err := EncryptionKeyFind()
+	if errors.Is(err, sql.ErrNoRows) {
+		return createDataKey(source)
+	} else if err != nil {
+		return err
+	}
+	key, err := unwrapDataKey(stored, source)
+	if err != nil {
+		return err
+	}
+	setDataKey(&unlockedKey{id: stored.ID, key: key})
+	return nil
+}
+
+// LockSecrets forgets the data key. After this, we can't read encrypted
+// secrets, and if the database has a data key, we refuse to save new
+// ones.
+func LockSecrets() {
+	setDataKey(nil)
+}
+
+// SecretsUnlocked returns true if we have a data key for encrypting
+// and decrypting secrets.
+func SecretsUnlocked() bool {
+	return getDataKey() != nil
+}
+
+// SecretsAreEncrypted returns true if the database has a data key,
+// which means some secrets may be encrypted.
+func SecretsAreEncrypted() bool {
+	_, err := EncryptionKeyFind()
+	return err == nil
+}
+
+// EncryptExistingSecrets encrypts the plain text secrets in records
+// saved before the user supplied a master key, and returns the number
+// of records it updated. Call UnlockSecrets() first.
+func EncryptExistingSecrets() (int, error) {
+	if !SecretsUnlocked() {
+		return 0, constants.ErrMasterKeyRequired
+	}
+	type storedRow struct{ objType, objJson string }
+	rows, err := Dart.DB.Query(`select obj_type, obj_json from dart where obj_type in (?,?,?,?,?,?,?)`,
+		constants.TypeExportSettings, constants.TypeJob, constants.TypeRemoteRepository,
+		constants.TypeStorageService, constants.TypeUploadJob, constants.TypeWorkflow,
+		constants.TypeWorkflowBatch)
+	if err != nil {
+		return 0, err
+	}
+	// Read everything before saving anything, so we're not
+	// writing to the table while we have a cursor open on it.
+	stored := make([]storedRow, 0)
+	for rows.Next() {
+		row := storedRow{}
+		if err = rows.Scan(&row.objType, &row.objJson); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		stored = append(stored, row)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	updated := 0
+	for _, row := range stored {
+		// Unmarshal directly, rather than through ObjFind, so we see
+		// secrets as stored. (ObjFind fills in a workflow's storage
+		// services from their own, already decrypted, records.)
+		holder := newSecretHolder(row.objType)
+		if err = json.Unmarshal([]byte(row.objJson), holder); err != nil {
+			return updated, err
+		}
+		if !hasPlaintextSecrets(holder) {
+			continue
+		}
+		if err = decryptSecrets(holder); err != nil {
+			return updated, err
+		}
+		obj := holder.(PersistentObject)
+		if err = ObjSaveWithoutValidation(obj); err != nil {
+			return updated, fmt.Errorf("can't encrypt secrets in %s %s: %w", obj.ObjType(), obj.ObjName(), err)
+		}
+		updated++
+	}
+	return updated, nil
+}
+
+// newSecretHolder returns an empty object of objType, which must be
+// one of the types that contain secrets.
+func newSecretHolder(objType string) secretHolder {
+	switch objType {
+	case constants.TypeExportSettings:
+		return &ExportSettings{}
+	case constants.TypeJob:
+		return &Job{}
+	case constants.TypeRemoteRepository:
+		return &RemoteRepository{}
+	case constants.TypeStorageService:
+		return &StorageService{}
+	case constants.TypeUploadJob:
+		return &UploadJob{}
+	case constants.TypeWorkflow:
+		return &Workflow{}
+	default:
+		return &WorkflowBatch{}
+	}
+}
+
+// RotateMasterKey rewraps the data key with the master key from next.
+// The current master key must unwrap the existing data key. Encrypted
+// records don't change, since the data key itself stays the same.
+func RotateMasterKey(current, next *MasterKeySource) error {
+	if err := next.Validate(); err != nil {
+		return fmt.Errorf("new master key: %w", err)
+	}
+	stored, err := EncryptionKeyFind()
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("there is no master key to rotate, because no secrets have been encrypted")
+	} else if err != nil {
+		return err
+	}
+	key, err := unwrapDataKey(stored, current)
+	if err != nil {
+		return err
+	}
+	rewrapped, err := wrapDataKey(stored.ID, key, next)
+	if err != nil {
+		return err
+	}
+	rewrapped.CreatedAt = stored.CreatedAt
+	err = EncryptionKeySave(rewrapped)
+	if err != nil {
+		return err
+	}
+	setDataKey(&unlockedKey{id: stored.ID, key: key})
+	return nil
+}
+
+// initSecretEncryption unlocks secrets with the master key from the
+// environment, if there is one, and encrypts any secrets saved before
+// the key was supplied.
+func initSecretEncryption() {
+	source := CurrentMasterKeySource()
+	if source.IsEmpty() {
+		if SecretsAreEncrypted() {
+			Dart.Log.Warningf("Secrets in the DART database are encrypted, but none of %s, %s or %s is set. DART can't read or save passwords or API tokens.", constants.EnvMasterKey, constants.EnvMasterKeyFile, constants.EnvMasterPassphrase)
+		}
+		return
+	}
+	if err := UnlockSecrets(source); err != nil {
+		Dart.Log.Errorf("Can't unlock secrets in the DART database: %s", err.Error())
+		return
+	}
+	count, err := EncryptExistingSecrets()
+	if err != nil {
+		Dart.Log.Errorf("Error encrypting existing secrets: %s", err.Error())
+	} else if count > 0 {
+		Dart.Log.Infof("Encrypted secrets in %d existing records", count)
+	}
+}
+
+func createDataKey(source *MasterKeySource) error {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	wrapped, err := wrapDataKey(uuid.NewString(), key, source)
+	if err != nil {
+		return err
+	}
+	if err = EncryptionKeySave(wrapped); err != nil {
+		return err
+	}
+	setDataKey(&unlockedKey{id: wrapped.ID, key: key})
+	return nil
+}
+
+// wrapDataKey encrypts key with the master key from source.
+func wrapDataKey(id string, key []byte, source *MasterKeySource) (*EncryptionKey, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	masterKey, err := source.deriveKey(salt)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := seal(masterKey, key, []byte(id))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	return &EncryptionKey{
+		ID:         id,
+		WrappedKey: wrapped,
+		KDF:        source.kdf(),
+		Salt:       base64.StdEncoding.EncodeToString(salt),
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}, nil
+}
+
+// unwrapDataKey decrypts stored with the master key from source.
+func unwrapDataKey(stored *EncryptionKey, source *MasterKeySource) ([]byte, error) {
+	if source.kdf() != stored.KDF {
+		if stored.KDF == kdfScrypt {
+			return nil, fmt.Errorf("%w: secrets were encrypted with a passphrase, not a key", constants.ErrWrongMasterKey)
+		}
+		return nil, fmt.Errorf("%w: secrets were encrypted with a key, not a passphrase", constants.ErrWrongMasterKey)
+	}
+	salt, err := base64.StdEncoding.DecodeString(stored.Salt)
+	if err != nil {
+		return nil, err
+	}
+	masterKey, err := source.deriveKey(salt)
+	if err != nil {
+		return nil, err
+	}
+	key, err := open(masterKey, stored.WrappedKey, []byte(stored.ID))
+	if err != nil {
+		return nil, constants.ErrWrongMasterKey
+	}
+	return key, nil
+}
+
+// encryptSecret returns value encrypted with the data key. Empty values,
+// credential references (which aren't secret) and values that are
+// already encrypted come back unchanged.
+func encryptSecret(key *unlockedKey, value string) (string, error) {
+	if strings.TrimSpace(value) == "" || IsCredentialReference(value) || strings.HasPrefix(value, encryptedSecretPrefix) {
+		return value, nil
+	}
+	sealed, err := seal(key.key, []byte(value), []byte(key.id))
+	if err != nil {
+		return "", err
+	}
+	return encryptedSecretPrefix + key.id + ":" + sealed, nil
+}
+
+// decryptSecret returns the plain text of an encrypted value. Values
+// that aren't encrypted come back unchanged.
+func decryptSecret(key *unlockedKey, value string) (string, error) {
+	if !strings.HasPrefix(value, encryptedSecretPrefix) {
+		return value, nil
+	}
+	if key == nil {
+		return "", constants.ErrMasterKeyRequired
+	}
+	keyID, sealed, found := strings.Cut(strings.TrimPrefix(value, encryptedSecretPrefix), ":")
+	if !found || keyID != key.id {
+		return "", fmt.Errorf("secret was encrypted with unknown data key %s", keyID)
+	}
+	plaintext, err := open(key.key, sealed, []byte(keyID))
+	if err != nil {
+		return "", fmt.Errorf("can't decrypt secret: %w", err)
+	}
+	return string(plaintext), nil
+}
+
+// encryptSecrets encrypts obj's secret fields in place, if obj has any
+// and we have a data key. Call the returned function to restore the
+// plain text values once obj has been serialized.
+//
+// If the database has a data key but we don't, because no master key
+// was supplied, this returns constants.ErrMasterKeyRequired rather than
+// let obj's secrets be saved in plain text.
+func encryptSecrets(obj interface{}) (restore func(), err error) {
+	restore = func() {}
+	holder, ok := obj.(secretHolder)
+	if !ok {
+		return restore, nil
+	}
+	key := getDataKey()
+	if key == nil {
+		if hasPlaintextSecrets(holder) && SecretsAreEncrypted() {
+			return restore, constants.ErrMasterKeyRequired
+		}
+		return restore, nil
+	}
+	fields := holder.secretFields()
+	originals := make([]string, len(fields))
+	// Restore in reverse order, in case two fields point to the same
+	// string, as when two upload ops share a storage service.
+	restore = func() {
+		for i := len(fields) - 1; i >= 0; i-- {
+			*fields[i] = originals[i]
+		}
+	}
+	for i, field := range fields {
+		originals[i] = *field
+		*field, err = encryptSecret(key, *field)
+		if err != nil {
+			restore()
+			return func() {}, err
+		}
+	}
+	return restore, nil
+}
+
+// decryptSecrets decrypts holder's secret fields in place.
+func decryptSecrets(holder secretHolder) error {
+	key := getDataKey()
+	for _, field := range holder.secretFields() {
+		plaintext, err := decryptSecret(key, *field)
+		if err != nil {
+			return err
+		}
+		*field = plaintext
+	}
+	return nil
+}
+
+// hasPlaintextSecrets returns true if any of holder's secrets are
+// stored in plain text.
+func hasPlaintextSecrets(holder secretHolder) bool {
+	for _, field := range holder.secretFields() {
+		value := *field
+		if strings.TrimSpace(value) != "" && !IsCredentialReference(value) && !strings.HasPrefix(value, encryptedSecretPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// decryptQueryResult decrypts the secrets in all of the objects in qr.
+func decryptQueryResult(qr *QueryResult) error {
+	for _, obj := range qr.persistentObjects() {
+		if holder, ok := obj.(secretHolder); ok {
+			if err := decryptSecrets(holder); err != nil {
+				return fmt.Errorf("%s %s: %w", obj.ObjType(), obj.ObjName(), err)
+			}
+		}
+	}
+	return nil
+}
+
+// seal encrypts plaintext with AES-256-GCM and returns the base64-encoded
+// nonce and ciphertext. The additional data must match when we open it.
+func seal(key, plaintext, additionalData []byte) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, plaintext, additionalData)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// open reverses seal.
+func open(key []byte, sealed string, additionalData []byte) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("encrypted value is too short")
+	}
+	return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], additionalData)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func getDataKey() *unlockedKey {
+	dataKeyMutex.RLock()
+	defer dataKeyMutex.RUnlock()
+	return dataKey
+}
+
+func setDataKey(key *unlockedKey) {
+	dataKeyMutex.Lock()
+	defer dataKeyMutex.Unlock()
+	dataKey = key
+}
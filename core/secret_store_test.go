@@ -0,0 +1,259 @@
+package core_test
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/core"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestMasterKey(t *testing.T) *core.MasterKeySource {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	return &core.MasterKeySource{Key: base64.StdEncoding.EncodeToString(key)}
+}
+
+// resetSecrets locks secrets and deletes the data key, now and when
+// the test ends, so that other tests save secrets in plain text.
+func resetSecrets(t *testing.T) {
+	reset := func() {
+		core.LockSecrets()
+		require.NoError(t, core.ClearEncryptionKeysTable())
+		require.NoError(t, core.ClearDartTable())
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func storedJson(t *testing.T, uuid string) string {
+	objJson := ""
+	err := core.Dart.DB.QueryRow("select obj_json from dart where uuid=?", uuid).Scan(&objJson)
+	require.NoError(t, err)
+	return objJson
+}
+
+func newSecretTestStorageService(name, password string) *core.StorageService {
+	ss := core.NewStorageService()
+	ss.Name = name
+	ss.Protocol = constants.ProtocolS3
+	ss.Host = "s3.example.com"
+	ss.Bucket = "bucket"
+	ss.Login = "login"
+	ss.Password = password
+	return ss
+}
+
+func TestSecretsEncryptedOnSave(t *testing.T) {
+	resetSecrets(t)
+	require.NoError(t, core.UnlockSecrets(newTestMasterKey(t)))
+	assert.True(t, core.SecretsUnlocked())
+	assert.True(t, core.SecretsAreEncrypted())
+
+	ss := newSecretTestStorageService("Encrypted", "swordfish")
+	ss.S3Options = &core.S3UploadOptions{Encryption: constants.S3EncryptionSSEC, CustomerKey: base64.StdEncoding.EncodeToString(make([]byte, 32))}
+	require.NoError(t, core.ObjSave(ss))
+
+	// The caller's copy keeps its plain text...
+	assert.Equal(t, "swordfish", ss.Password)
+
+	// ...but the database doesn't have it.
+	objJson := storedJson(t, ss.ID)
+	assert.NotContains(t, objJson, "swordfish")
+	assert.NotContains(t, objJson, ss.S3Options.CustomerKey)
+	assert.Contains(t, objJson, "dart-enc:v1:")
+
+	result := core.ObjFind(ss.ID)
+	require.NoError(t, result.Error)
+	assert.Equal(t, "swordfish", result.StorageService().Password)
+	assert.Equal(t, ss.S3Options.CustomerKey, result.StorageService().S3Options.CustomerKey)
+
+	result = core.ObjList(constants.TypeStorageService, "obj_name", 10, 0)
+	require.NoError(t, result.Error)
+	require.Len(t, result.StorageServices, 1)
+	assert.Equal(t, "swordfish", result.StorageServices[0].Password)
+
+	repo := core.NewRemoteRepository()
+	repo.Name = "Registry"
+	repo.Url = "https://repo.example.com"
+	repo.UserID = "user@example.com"
+	repo.APIToken = "token-1234"
+	require.NoError(t, core.ObjSave(repo))
+	assert.NotContains(t, storedJson(t, repo.ID), "token-1234")
+	result = core.ObjFind(repo.ID)
+	require.NoError(t, result.Error)
+	assert.Equal(t, "token-1234", result.RemoteRepository().APIToken)
+
+	// Credential references aren't secret, so we leave them readable.
+	ss.Password = "env:S3_SECRET"
+	require.NoError(t, core.ObjSave(ss))
+	assert.Contains(t, storedJson(t, ss.ID), `"env:S3_SECRET"`)
+
+	// Without the key, we can't read encrypted secrets.
+	core.LockSecrets()
+	result = core.ObjFind(repo.ID)
+	assert.ErrorIs(t, result.Error, constants.ErrMasterKeyRequired)
+	result = core.ObjList(constants.TypeRemoteRepository, "obj_name", 10, 0)
+	assert.ErrorIs(t, result.Error, constants.ErrMasterKeyRequired)
+
+	// Nor can we save secrets, since they'd be stored in plain text.
+	ss.Password = "new-password"
+	assert.ErrorIs(t, core.ObjSave(ss), constants.ErrMasterKeyRequired)
+	assert.NotContains(t, storedJson(t, ss.ID), "new-password")
+
+	// Records with no plain text secrets can still be saved.
+	ss.Password = "env:S3_SECRET"
+	ss.S3Options = nil
+	ss.Name = "Renamed"
+	assert.NoError(t, core.ObjSave(ss))
+}
+
+func TestSecretsInNestedObjects(t *testing.T) {
+	resetSecrets(t)
+	require.NoError(t, core.UnlockSecrets(newTestMasterKey(t)))
+
+	ss := newSecretTestStorageService("Shared", "shared-secret")
+	job := core.NewJob()
+	job.UploadOps = []*core.UploadOperation{
+		core.NewUploadOperation(ss, []string{"/tmp/bag1.tar"}),
+		core.NewUploadOperation(ss, []string{"/tmp/bag2.tar"}),
+	}
+	require.NoError(t, core.ObjSaveWithoutValidation(job))
+	assert.NotContains(t, storedJson(t, job.ID), "shared-secret")
+
+	// Both ops share one storage service, which must come
+	// back with its plain text password.
+	assert.Equal(t, "shared-secret", ss.Password)
+	result := core.ObjFind(job.ID)
+	require.NoError(t, result.Error)
+	for _, op := range result.Job().UploadOps {
+		assert.Equal(t, "shared-secret", op.StorageService.Password)
+	}
+}
+
+func TestUnlockSecretsWithWrongKey(t *testing.T) {
+	resetSecrets(t)
+	require.NoError(t, core.UnlockSecrets(newTestMasterKey(t)))
+	core.LockSecrets()
+
+	err := core.UnlockSecrets(newTestMasterKey(t))
+	assert.ErrorIs(t, err, constants.ErrWrongMasterKey)
+	assert.False(t, core.SecretsUnlocked())
+
+	err = core.UnlockSecrets(&core.MasterKeySource{Passphrase: "correct horse"})
+	assert.ErrorIs(t, err, constants.ErrWrongMasterKey)
+
+	err = core.UnlockSecrets(&core.MasterKeySource{})
+	assert.Error(t, err)
+	err = core.UnlockSecrets(&core.MasterKeySource{Key: "too short"})
+	assert.Error(t, err)
+}
+
+func TestEncryptExistingSecrets(t *testing.T) {
+	resetSecrets(t)
+
+	// Save some secrets before there's a master key.
+	ss := newSecretTestStorageService("Plain", "plain-password")
+	require.NoError(t, core.ObjSave(ss))
+	workflow := &core.Workflow{
+		ID:              uuid.NewString(),
+		Name:            "Workflow with secrets",
+		StorageServices: []*core.StorageService{ss},
+	}
+	require.NoError(t, core.ObjSaveWithoutValidation(workflow))
+	assert.Contains(t, storedJson(t, ss.ID), "plain-password")
+	assert.Contains(t, storedJson(t, workflow.ID), "plain-password")
+
+	_, err := core.EncryptExistingSecrets()
+	assert.ErrorIs(t, err, constants.ErrMasterKeyRequired)
+
+	require.NoError(t, core.UnlockSecrets(newTestMasterKey(t)))
+	count, err := core.EncryptExistingSecrets()
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+	assert.NotContains(t, storedJson(t, ss.ID), "plain-password")
+	assert.NotContains(t, storedJson(t, workflow.ID), "plain-password")
+
+	// Nothing left to do the second time around.
+	count, err = core.EncryptExistingSecrets()
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	result := core.ObjFind(workflow.ID)
+	require.NoError(t, result.Error)
+	assert.Equal(t, "plain-password", result.Workflow().StorageServices[0].Password)
+}
+
+func TestRotateMasterKey(t *testing.T) {
+	resetSecrets(t)
+	oldKey := newTestMasterKey(t)
+	newKey := &core.MasterKeySource{Passphrase: "it was a dark and stormy night"}
+
+	err := core.RotateMasterKey(oldKey, newKey)
+	assert.Error(t, err, "nothing to rotate yet")
+
+	require.NoError(t, core.UnlockSecrets(oldKey))
+	ss := newSecretTestStorageService("Rotated", "rotate-me")
+	require.NoError(t, core.ObjSave(ss))
+	before := storedJson(t, ss.ID)
+
+	// The current key must be right.
+	err = core.RotateMasterKey(newTestMasterKey(t), newKey)
+	assert.ErrorIs(t, err, constants.ErrWrongMasterKey)
+
+	require.NoError(t, core.RotateMasterKey(oldKey, newKey))
+
+	// Records don't change, since the data key is the same.
+	assert.Equal(t, before, storedJson(t, ss.ID))
+
+	core.LockSecrets()
+	assert.ErrorIs(t, core.UnlockSecrets(oldKey), constants.ErrWrongMasterKey)
+	require.NoError(t, core.UnlockSecrets(newKey))
+	result := core.ObjFind(ss.ID)
+	require.NoError(t, result.Error)
+	assert.Equal(t, "rotate-me", result.StorageService().Password)
+}
+
+func TestMasterKeyFile(t *testing.T) {
+	resetSecrets(t)
+	dir := t.TempDir()
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+
+	// Key files may hold a raw key...
+	rawKeyFile := filepath.Join(dir, "raw.key")
+	require.NoError(t, os.WriteFile(rawKeyFile, key, 0600))
+	require.NoError(t, core.UnlockSecrets(&core.MasterKeySource{KeyFile: rawKeyFile}))
+	core.LockSecrets()
+
+	// ...or a base64-encoded one.
+	encodedKeyFile := filepath.Join(dir, "encoded.key")
+	require.NoError(t, os.WriteFile(encodedKeyFile, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600))
+	require.NoError(t, core.UnlockSecrets(&core.MasterKeySource{KeyFile: encodedKeyFile}))
+	core.LockSecrets()
+	require.NoError(t, core.UnlockSecrets(&core.MasterKeySource{Key: base64.StdEncoding.EncodeToString(key)}))
+}
+
+func TestMasterKeySourceFromEnv(t *testing.T) {
+	t.Setenv(constants.EnvMasterKey, "")
+	t.Setenv(constants.EnvMasterKeyFile, "")
+	t.Setenv(constants.EnvMasterPassphrase, "")
+	assert.True(t, core.CurrentMasterKeySource().IsEmpty())
+
+	t.Setenv(constants.EnvMasterPassphrase, "env:SOMEWHERE_ELSE")
+	t.Setenv(constants.EnvNewMasterKeyFile, "/etc/dart/master.key")
+	assert.Equal(t, "env:SOMEWHERE_ELSE", core.CurrentMasterKeySource().Passphrase)
+	assert.Equal(t, "/etc/dart/master.key", core.NextMasterKeySource().KeyFile)
+	assert.NoError(t, core.NextMasterKeySource().Validate())
+
+	source := &core.MasterKeySource{Key: "a", Passphrase: "b"}
+	assert.Error(t, source.Validate())
+}
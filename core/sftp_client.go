@@ -1,34 +1,44 @@
 package core
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
 
 	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 )
 
 type SFTPClient struct {
-	client             *sftp.Client
-	totalBytesToUpload int64
-	bytesUploaded      int64
-	filesUploaded      int64
-	uploadProgress     *StreamProgress
+	client               *sftp.Client
+	totalBytesToUpload   int64
+	bytesUploaded        int64
+	filesUploaded        int64
+	uploadProgress       *StreamProgress
+	totalBytesToDownload int64
+	bytesDownloaded      int64
+	filesDownloaded      int64
+	verifyUploads        bool
+	checksums            map[string]string
 }
 
 // GetSFTPAuthMethod returns an authentication method to be used
 // when connecting to the remote server. If ss.LoginExtra is not
 // empty, this returns a ssh.PublicKey AuthMethod using the key
-// found in the file pointed to by ss.LoginExtra. Otherwise, it
-// returns an ssh.Password() AuthMethod using ss.Password.
+// that ss.LoginExtra points to. (See StorageService.GetSSHKey().)
+// Otherwise, it returns an ssh.Password() AuthMethod using
+// ss.GetPassword().
 func GetSFTPAuthMethod(ss *StorageService) (ssh.AuthMethod, error) {
 	// ss.LoginExtra will be the path to the SSH key file
-	// needed to authenticate this connection.
+	// needed to authenticate this connection, or a reference
+	// to the key itself.
 	if ss.LoginExtra != "" {
-		key, err := os.ReadFile(ss.LoginExtra)
+		key, err := ss.GetSSHKey()
 		if err != nil {
 			return nil, fmt.Errorf("failed to read private key file: %w", err)
 		}
@@ -41,7 +51,7 @@ func GetSFTPAuthMethod(ss *StorageService) (ssh.AuthMethod, error) {
 		return ssh.PublicKeys(signer), nil
 	}
 	// If ss.LoginExtra is empty, use password authentication
-	return ssh.Password(ss.Password), nil
+	return ssh.Password(ss.GetPassword()), nil
 }
 
 // GetUploadPayloadSize returns the number of bytes to be uploaded
@@ -71,17 +81,19 @@ func NewSFTPClient(ss *StorageService, uploadProgress *StreamProgress) (*SFTPCli
 	if err != nil {
 		return nil, err
 	}
+	addr := fmt.Sprintf("%s:%d", ss.Host, ss.Port)
+
 	// Configure SSH client
 	config := &ssh.ClientConfig{
-		User: ss.Login,
+		User: ss.GetLogin(),
 		Auth: []ssh.AuthMethod{
 			authMethod,
 		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(), // Use proper host key checking in production
+		HostKeyCallback:   SFTPHostKeyCallback(ss),
+		HostKeyAlgorithms: sftpHostKeyAlgorithms(ss, addr),
 	}
 
 	// Connect to SSH server
-	addr := fmt.Sprintf("%s:%d", ss.Host, ss.Port)
 	conn, err := ssh.Dial("tcp", addr, config)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to SSH server: %w", err)
@@ -100,6 +112,8 @@ func NewSFTPClient(ss *StorageService, uploadProgress *StreamProgress) (*SFTPCli
 		bytesUploaded:      int64(0),
 		filesUploaded:      int64(0),
 		uploadProgress:     uploadProgress,
+		verifyUploads:      ss.VerifyUploads,
+		checksums:          make(map[string]string),
 	}
 
 	return sftpClient, nil
@@ -113,6 +127,15 @@ func (sc *SFTPClient) Close() error {
 // Upload uploads a file or directory from source to destination
 // on the remote server.
 func (sc *SFTPClient) Upload(source, destination string) error {
+	return sc.UploadContext(context.Background(), source, destination)
+}
+
+// UploadContext is like Upload, but it stops if ctx is cancelled,
+// removing the partially uploaded file from the server.
+func (sc *SFTPClient) UploadContext(ctx context.Context, source, destination string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	info, err := os.Stat(source)
 	if err != nil {
 		return fmt.Errorf("failed to stat source: %w", err)
@@ -126,12 +149,13 @@ func (sc *SFTPClient) Upload(source, destination string) error {
 	sc.totalBytesToUpload = int64(0)
 	sc.bytesUploaded = int64(0)
 	sc.filesUploaded = int64(0)
+	sc.checksums = make(map[string]string)
 	if info.IsDir() {
 		sc.totalBytesToUpload, err = GetUploadPayloadSize(source)
 		if err != nil {
 			return err
 		}
-		return sc.uploadDirectory(source, destination)
+		return sc.uploadDirectory(ctx, source, destination)
 	}
 	stats, err := os.Stat(source)
 	if err != nil {
@@ -139,7 +163,7 @@ func (sc *SFTPClient) Upload(source, destination string) error {
 	} else {
 		sc.totalBytesToUpload = stats.Size()
 	}
-	return sc.uploadFile(source, destination, info)
+	return sc.uploadFile(ctx, source, destination, info)
 }
 
 // ensureDestinationRootExists ensures that the target root directory exists
@@ -176,7 +200,7 @@ func (sc *SFTPClient) ensureDestinationRootExists(destination string) error {
 }
 
 // uploadFile uploads a single file to the remote server
-func (sc *SFTPClient) uploadFile(localPath, remotePath string, info os.FileInfo) error {
+func (sc *SFTPClient) uploadFile(ctx context.Context, localPath, remotePath string, info os.FileInfo) error {
 	srcFile, err := os.Open(localPath)
 	if err != nil {
 		return fmt.Errorf("failed to open local file: %w", err)
@@ -191,8 +215,14 @@ func (sc *SFTPClient) uploadFile(localPath, remotePath string, info os.FileInfo)
 	defer dstFile.Close()
 
 	// Copy file contents
-	_, err = io.Copy(dstFile, srcFile)
+	_, err = io.Copy(dstFile, newContextReader(ctx, srcFile))
 	if err != nil {
+		if ctx.Err() != nil {
+			dstFile.Close()
+			if removeErr := sc.client.Remove(remotePath); removeErr != nil {
+				Dart.Log.Warningf("SFTP client could not remove partial upload %s: %v", remotePath, removeErr)
+			}
+		}
 		return fmt.Errorf("failed to copy file contents: %w", err)
 	}
 
@@ -202,6 +232,14 @@ func (sc *SFTPClient) uploadFile(localPath, remotePath string, info os.FileInfo)
 		return fmt.Errorf("failed to set file permissions: %w", err)
 	}
 
+	if sc.verifyUploads {
+		digest, err := sc.verifyUpload(localPath, remotePath)
+		if err != nil {
+			return err
+		}
+		sc.checksums[remotePath] = digest
+	}
+
 	// Housekeeping
 	sc.bytesUploaded += info.Size()
 	sc.filesUploaded += 1
@@ -214,12 +252,15 @@ func (sc *SFTPClient) uploadFile(localPath, remotePath string, info os.FileInfo)
 }
 
 // uploadDirectory recursively uploads a directory to the remote server
-func (sc *SFTPClient) uploadDirectory(localPath, remotePath string) error {
+func (sc *SFTPClient) uploadDirectory(ctx context.Context, localPath, remotePath string) error {
 	// Walk through the local directory
 	return filepath.Walk(localPath, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
 
 		// Calculate relative path
 		relPath, err := filepath.Rel(localPath, path)
@@ -246,7 +287,7 @@ func (sc *SFTPClient) uploadDirectory(localPath, remotePath string) error {
 			Dart.Log.Infof("SFTP client created remote directory: %s\n", remoteDest)
 		} else if info.Mode().IsRegular() {
 			// Upload file
-			err = sc.uploadFile(path, remoteDest, info)
+			err = sc.uploadFile(ctx, path, remoteDest, info)
 			if err != nil {
 				detailedErr := fmt.Errorf("SFTP client: error uploading %s: %w", path, err)
 				return detailedErr
@@ -261,6 +302,39 @@ func (sc *SFTPClient) uploadDirectory(localPath, remotePath string) error {
 	})
 }
 
+// List returns the files under the directory root on the server whose
+// paths relative to root begin with prefix. If root is empty, paths are
+// relative to the login's home directory.
+func (sc *SFTPClient) List(root, prefix string) ([]*RemoteObject, error) {
+	root = path.Clean("./" + root)
+	start := path.Join(root, listingDir(prefix))
+	objects := make([]*RemoteObject, 0)
+	walker := sc.client.Walk(start)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			// A prefix naming a directory that doesn't exist
+			// matches nothing, but a missing root is an error.
+			if errors.Is(err, os.ErrNotExist) && walker.Path() == start && start != root {
+				return objects, nil
+			}
+			return nil, fmt.Errorf("failed to list %s: %w", walker.Path(), err)
+		}
+		if !walker.Stat().Mode().IsRegular() {
+			continue
+		}
+		key := strings.TrimPrefix(path.Clean(walker.Path()), root+"/")
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		objects = append(objects, &RemoteObject{
+			Key:      key,
+			Size:     walker.Stat().Size(),
+			Modified: walker.Stat().ModTime(),
+		})
+	}
+	return objects, nil
+}
+
 func (sc *SFTPClient) FilesUploaded() int64 {
 	return sc.filesUploaded
 }
@@ -272,3 +346,14 @@ func (sc *SFTPClient) BytesUploaded() int64 {
 func (sc *SFTPClient) PayloadSize() int64 {
 	return sc.totalBytesToUpload
 }
+
+// VerifiedChecksums returns a map of remote file paths and the SHA-256
+// digests of the files at those paths. This is populated only when the
+// storage service is set to verify uploads.
+func (sc *SFTPClient) VerifiedChecksums() map[string]string {
+	checksums := make(map[string]string)
+	for key, value := range sc.checksums {
+		checksums[key] = value
+	}
+	return checksums
+}
@@ -1,6 +1,8 @@
 package core_test
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"os"
 	"path/filepath"
 	"strings"
@@ -213,5 +215,38 @@ func getSftpStorageService() *core.StorageService {
 		Password:     sftpPassword,
 		Port:         sftpPort,
 		Protocol:     constants.ProtocolSFTP,
+		// The Docker SFTP container gets a new host key each time
+		// it starts, so we can't pin one.
+		HostKeyPolicy: constants.HostKeyPolicyTOFU,
 	}
 }
+
+func TestSFTPUploadWithVerification(t *testing.T) {
+	ss := getSftpStorageService()
+	ss.VerifyUploads = true
+	sftp, err := core.NewSFTPClient(ss, nil)
+	require.Nil(t, err)
+	require.NotNil(t, sftp)
+	defer sftp.Close()
+
+	destPath := filepath.Join("uploads", filepath.Base(fileToUpload()))
+	err = sftp.Upload(fileToUpload(), destPath)
+	require.Nil(t, err)
+	checksums := sftp.VerifiedChecksums()
+	require.Equal(t, 1, len(checksums))
+	assert.Equal(t, sha256Hex(t, fileToUpload()), checksums[destPath])
+
+	// Every file in a directory upload is verified.
+	err = sftp.Upload(dirToUpload(), filepath.Join("uploads", filepath.Base(dirToUpload())))
+	require.Nil(t, err)
+	fileCount, err := fileCount(dirToUpload())
+	require.Nil(t, err)
+	assert.Equal(t, fileCount, len(sftp.VerifiedChecksums()))
+}
+
+func sha256Hex(t *testing.T, path string) string {
+	data, err := os.ReadFile(path)
+	require.Nil(t, err)
+	digest := sha256.Sum256(data)
+	return hex.EncodeToString(digest[:])
+}
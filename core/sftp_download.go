@@ -0,0 +1,112 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/APTrust/dart-runner/constants"
+)
+
+// Download retrieves the file or directory at remotePath on the SFTP
+// server and saves it at destination. Directories are downloaded
+// recursively. Param progress may be nil. It should be nil unless
+// we're running in DART 3 GUI mode.
+//
+// This returns an error wrapping constants.ErrRemoteItemNotFound if
+// there's nothing at remotePath.
+func (sc *SFTPClient) Download(remotePath, destination string, progress *StreamProgress) error {
+	return sc.DownloadContext(context.Background(), remotePath, destination, progress)
+}
+
+// DownloadContext is like Download, but it stops if ctx is cancelled.
+func (sc *SFTPClient) DownloadContext(ctx context.Context, remotePath, destination string, progress *StreamProgress) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	sc.totalBytesToDownload = int64(0)
+	sc.bytesDownloaded = int64(0)
+	sc.filesDownloaded = int64(0)
+
+	info, err := sc.client.Stat(remotePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%w: %s does not exist on the SFTP server", constants.ErrRemoteItemNotFound, remotePath)
+	} else if err != nil {
+		return fmt.Errorf("failed to stat remote path %s: %w", remotePath, err)
+	}
+	if !info.IsDir() {
+		sc.totalBytesToDownload = info.Size()
+		if progress != nil {
+			progress.Total = sc.totalBytesToDownload
+		}
+		return sc.downloadFile(ctx, remotePath, destination, info, progress)
+	}
+
+	// List the directory first, so we know how much we have to
+	// download before we start reporting progress.
+	files := make(map[string]os.FileInfo)
+	walker := sc.client.Walk(remotePath)
+	for walker.Step() {
+		if walker.Err() != nil {
+			return fmt.Errorf("failed to list remote directory %s: %w", remotePath, walker.Err())
+		}
+		if walker.Stat().Mode().IsRegular() {
+			files[walker.Path()] = walker.Stat()
+			sc.totalBytesToDownload += walker.Stat().Size()
+		} else if !walker.Stat().IsDir() {
+			Dart.Log.Warningf("SFTP client is skipping download of %s because it's not a regular file", walker.Path())
+		}
+	}
+	if progress != nil {
+		progress.Total = sc.totalBytesToDownload
+	}
+	err = os.MkdirAll(destination, 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create directory %s: %w", destination, err)
+	}
+	prefix := strings.TrimSuffix(remotePath, "/") + "/"
+	for filePath, fileInfo := range files {
+		localPath, err := downloadTargetPath(destination, strings.TrimPrefix(filePath, prefix))
+		if err != nil {
+			return err
+		}
+		err = sc.downloadFile(ctx, filePath, localPath, fileInfo, progress)
+		if err != nil {
+			return fmt.Errorf("SFTP client: error downloading %s: %w", filePath, err)
+		}
+	}
+	return nil
+}
+
+// downloadFile saves a single remote file to localPath, preserving
+// its permissions.
+func (sc *SFTPClient) downloadFile(ctx context.Context, remotePath, localPath string, info os.FileInfo, progress *StreamProgress) error {
+	srcFile, err := sc.client.Open(remotePath)
+	if err != nil {
+		return fmt.Errorf("failed to open remote file: %w", err)
+	}
+	defer srcFile.Close()
+
+	err = saveDownload(newContextReader(ctx, srcFile), localPath, info.Size(), info.Mode().Perm(), progress)
+	if err != nil {
+		return err
+	}
+	sc.bytesDownloaded += info.Size()
+	sc.filesDownloaded += 1
+	Dart.Log.Infof("Downloaded file: %s -> %s", remotePath, localPath)
+	return nil
+}
+
+func (sc *SFTPClient) FilesDownloaded() int64 {
+	return sc.filesDownloaded
+}
+
+func (sc *SFTPClient) BytesDownloaded() int64 {
+	return sc.bytesDownloaded
+}
+
+func (sc *SFTPClient) DownloadSize() int64 {
+	return sc.totalBytesToDownload
+}
@@ -0,0 +1,226 @@
+package core
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/APTrust/dart-runner/constants"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sha256Fingerprint matches OpenSSH SHA-256 fingerprints, such as
+// "SHA256:uNiVztksCsDhcc0u9e8BujQXVUpKZIDTMczCvj3tD2s".
+var sha256Fingerprint = regexp.MustCompile(`^SHA256:[A-Za-z0-9+/]{43}=?$`)
+
+// md5Fingerprint matches legacy MD5 fingerprints, such as
+// "16:27:ac:a5:76:28:2d:36:63:1b:56:4d:eb:df:a6:48", with or without
+// an "MD5:" prefix.
+var md5Fingerprint = regexp.MustCompile(`^(MD5:)?([0-9a-fA-F]{2}:){15}[0-9a-fA-F]{2}$`)
+
+// TrustedHostKey is a host key that an SFTP server presented the first
+// time we connected to it under the trust-on-first-use policy.
+type TrustedHostKey struct {
+	Address     string
+	KeyType     string
+	PublicKey   string
+	Fingerprint string
+	CreatedAt   time.Time
+}
+
+// NewTrustedHostKey returns a record of key for the server at address.
+func NewTrustedHostKey(address string, key ssh.PublicKey) *TrustedHostKey {
+	return &TrustedHostKey{
+		Address:     knownhosts.Normalize(address),
+		KeyType:     key.Type(),
+		PublicKey:   base64.StdEncoding.EncodeToString(key.Marshal()),
+		Fingerprint: ssh.FingerprintSHA256(key),
+		CreatedAt:   time.Now().UTC(),
+	}
+}
+
+// Matches returns true if key is the same as this trusted key.
+func (k *TrustedHostKey) Matches(key ssh.PublicKey) bool {
+	return k.PublicKey == base64.StdEncoding.EncodeToString(key.Marshal())
+}
+
+// IsValidHostKeyFingerprint returns true if fingerprint looks like an
+// OpenSSH SHA-256 fingerprint or a legacy MD5 fingerprint.
+func IsValidHostKeyFingerprint(fingerprint string) bool {
+	fingerprint = strings.TrimSpace(fingerprint)
+	return sha256Fingerprint.MatchString(fingerprint) || md5Fingerprint.MatchString(fingerprint)
+}
+
+// SFTPHostKeyCallback returns a function that checks the host keys
+// presented by the SFTP server described by ss.
+//
+// If ss has a HostKeyFingerprint, the server's key must match it.
+// Otherwise, under the strict policy (the default), the key must be
+// listed in ss.KnownHostsFile or, if that's empty, in the user's
+// ~/.ssh/known_hosts. Under the trust-on-first-use policy, we record
+// the key the server presents on our first connection in the DART
+// database, and the server must present the same key thereafter.
+//
+// The callback returns an error wrapping constants.ErrHostKeyChanged
+// if the server presents a key other than the one we expect, and
+// constants.ErrHostKeyUnknown if we have no key for the server.
+func SFTPHostKeyCallback(ss *StorageService) ssh.HostKeyCallback {
+	if strings.TrimSpace(ss.HostKeyFingerprint) != "" {
+		return pinnedHostKeyCallback(ss)
+	}
+	if ss.GetHostKeyPolicy() == constants.HostKeyPolicyTOFU {
+		return trustOnFirstUseCallback
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		// We read known_hosts when the server presents its key, rather
+		// than up front, so that network errors come before config errors
+		// and the file is current for long-running processes.
+		knownHostsFile, err := ss.knownHostsFile()
+		if err != nil {
+			return err
+		}
+		callback, err := knownHostsCallback(knownHostsFile)
+		if err != nil {
+			return err
+		}
+		return callback(hostname, remote, key)
+	}
+}
+
+// sftpHostKeyAlgorithms returns the host key algorithms we should ask
+// the server at address to use. When we've already trusted one of the
+// server's keys, we ask for that key's type, so that a server with
+// several keys doesn't present a different (but legitimate) one and
+// trip the changed-key check. This returns nil to let the server choose.
+func sftpHostKeyAlgorithms(ss *StorageService, address string) []string {
+	if strings.TrimSpace(ss.HostKeyFingerprint) != "" || ss.GetHostKeyPolicy() != constants.HostKeyPolicyTOFU {
+		return nil
+	}
+	trusted, err := TrustedHostKeyFind(knownhosts.Normalize(address))
+	if err != nil {
+		return nil
+	}
+	if trusted.KeyType == ssh.KeyAlgoRSA {
+		return []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	}
+	return []string{trusted.KeyType}
+}
+
+// pinnedHostKeyCallback accepts only keys matching ss.HostKeyFingerprint.
+func pinnedHostKeyCallback(ss *StorageService) ssh.HostKeyCallback {
+	pinned := strings.TrimSpace(ss.HostKeyFingerprint)
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if fingerprintMatches(pinned, key) {
+			return nil
+		}
+		return hostKeyChangedError(hostname, key, pinned, "update the host key fingerprint in the storage service settings")
+	}
+}
+
+// trustOnFirstUseCallback accepts and records the first key a server
+// presents, and accepts only that key on later connections.
+func trustOnFirstUseCallback(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	address := knownhosts.Normalize(hostname)
+	trusted, err := TrustedHostKeyFind(address)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("can't look up trusted host key for %s: %w", address, err)
+	}
+	if trusted == nil {
+		trusted = NewTrustedHostKey(hostname, key)
+		err = TrustedHostKeySave(trusted)
+		if err != nil {
+			return fmt.Errorf("can't save trusted host key for %s: %w", address, err)
+		}
+		Dart.Log.Warningf("Trusting %s host key %s for %s on first use", key.Type(), trusted.Fingerprint, address)
+		return nil
+	}
+	if trusted.Matches(key) {
+		return nil
+	}
+	return hostKeyChangedError(hostname, key, trusted.Fingerprint, fmt.Sprintf("run dart-runner --forget-host-key=%s to forget the key trusted on %s", address, trusted.CreatedAt.Format(time.RFC3339)))
+}
+
+// ForgetHostKey deletes the trusted host key for the server at address,
+// which may be a host name or host:port, so that our next connection
+// will trust whatever key the server presents. It returns the key that
+// was deleted, or sql.ErrNoRows if we had no key for the server.
+func ForgetHostKey(address string) (*TrustedHostKey, error) {
+	trusted, err := TrustedHostKeyFind(knownhosts.Normalize(address))
+	if err != nil {
+		return nil, err
+	}
+	return trusted, TrustedHostKeyDelete(trusted.Address)
+}
+
+// knownHostsCallback accepts keys listed for the server in knownHostsFile.
+func knownHostsCallback(knownHostsFile string) (ssh.HostKeyCallback, error) {
+	callback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("can't read known_hosts file %s: %w", knownHostsFile, err)
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := callback(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if errors.As(err, &keyErr) {
+			if len(keyErr.Want) == 0 {
+				return fmt.Errorf("%w: %s is not listed in %s. Its %s key fingerprint is %s. Add it to the known_hosts file, pin the fingerprint in the storage service settings, or use trust-on-first-use", constants.ErrHostKeyUnknown, knownhosts.Normalize(hostname), knownHostsFile, key.Type(), ssh.FingerprintSHA256(key))
+			}
+			expected := make([]string, len(keyErr.Want))
+			for i, want := range keyErr.Want {
+				expected[i] = fmt.Sprintf("%s (%s line %d)", ssh.FingerprintSHA256(want.Key), want.Filename, want.Line)
+			}
+			return hostKeyChangedError(hostname, key, strings.Join(expected, " or "), "update "+knownHostsFile)
+		}
+		return err
+	}, nil
+}
+
+// hostKeyChangedError returns an error explaining that the server at
+// hostname presented key instead of the expected key, and what the user
+// can do about it once they've confirmed the new key is legitimate.
+func hostKeyChangedError(hostname string, key ssh.PublicKey, expected, remedy string) error {
+	return fmt.Errorf("%w: %s presented %s key %s, but we expected %s. Someone may be intercepting the connection, or the server's key may have been replaced. If the server's administrator confirms the new key, %s", constants.ErrHostKeyChanged, knownhosts.Normalize(hostname), key.Type(), ssh.FingerprintSHA256(key), expected, remedy)
+}
+
+// fingerprintMatches returns true if key's fingerprint matches pinned,
+// which may be a SHA-256 or legacy MD5 fingerprint.
+func fingerprintMatches(pinned string, key ssh.PublicKey) bool {
+	if strings.HasPrefix(pinned, "SHA256:") {
+		return strings.TrimRight(pinned, "=") == strings.TrimRight(ssh.FingerprintSHA256(key), "=")
+	}
+	pinned = strings.ToLower(strings.TrimPrefix(pinned, "MD5:"))
+	return pinned == ssh.FingerprintLegacyMD5(key)
+}
+
+// knownHostsFile returns the path to the known_hosts file for strict
+// host key checking. This returns an error if ss doesn't name a file
+// and the user has no ~/.ssh/known_hosts.
+func (ss *StorageService) knownHostsFile() (string, error) {
+	path := strings.TrimSpace(ss.KnownHostsFile)
+	if path == "" {
+		homeDir, err := os.UserHomeDir()
+		if err == nil {
+			defaultFile := filepath.Join(homeDir, ".ssh", "known_hosts")
+			if _, err := os.Stat(defaultFile); err == nil {
+				return defaultFile, nil
+			}
+		}
+		return "", fmt.Errorf("%w: storage service %s has no host key fingerprint or known_hosts file, and there is no ~/.ssh/known_hosts. Set one of these, or use trust-on-first-use", constants.ErrHostKeyUnknown, ss.Name)
+	}
+	if strings.HasPrefix(path, "~/") {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		path = filepath.Join(homeDir, path[2:])
+	}
+	return path, nil
+}
@@ -0,0 +1,226 @@
+package core_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"database/sql"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/core"
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func newTestHostKey(t *testing.T) ssh.Signer {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	require.NoError(t, err)
+	return signer
+}
+
+// startTestSFTPServer runs an in-process SFTP server that identifies
+// itself with hostKey and accepts the password credentials used by
+// getSftpStorageService. It returns the server's address and the
+// directory that receives uploads.
+func startTestSFTPServer(t *testing.T, hostKey ssh.Signer) (string, string) {
+	root := t.TempDir()
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if conn.User() == sftpUserName && string(password) == sftpPassword {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("password rejected for %s", conn.User())
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveTestSFTPConn(conn, config, root)
+		}
+	}()
+	return listener.Addr().String(), root
+}
+
+func serveTestSFTPConn(conn net.Conn, config *ssh.ServerConfig, root string) {
+	defer conn.Close()
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range requests {
+				isSFTP := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				req.Reply(isSFTP, nil)
+				if isSFTP {
+					server, err := sftp.NewServer(channel, sftp.WithServerWorkingDirectory(root))
+					if err == nil {
+						server.Serve()
+						server.Close()
+					}
+					return
+				}
+			}
+		}()
+	}
+}
+
+func getLocalSftpStorageService(t *testing.T, address string) *core.StorageService {
+	host, port, err := net.SplitHostPort(address)
+	require.NoError(t, err)
+	ss := getSftpStorageService()
+	ss.HostKeyPolicy = ""
+	ss.Host = host
+	_, err = fmt.Sscanf(port, "%d", &ss.Port)
+	require.NoError(t, err)
+	return ss
+}
+
+func TestSFTPHostKeyStrict(t *testing.T) {
+	hostKey := newTestHostKey(t)
+	address, root := startTestSFTPServer(t, hostKey)
+	ss := getLocalSftpStorageService(t, address)
+	assert.Equal(t, constants.HostKeyPolicyStrict, ss.GetHostKeyPolicy())
+
+	// With no fingerprint, no known_hosts file and no ~/.ssh/known_hosts,
+	// strict checking rejects the server.
+	t.Setenv("HOME", t.TempDir())
+	_, err := core.NewSFTPClient(ss, nil)
+	require.Error(t, err)
+	assert.ErrorIs(t, err, constants.ErrHostKeyUnknown)
+
+	// known_hosts without this server
+	knownHostsFile := filepath.Join(t.TempDir(), "known_hosts")
+	otherKey := newTestHostKey(t)
+	line := knownhosts.Line([]string{knownhosts.Normalize("sftp.example.com")}, otherKey.PublicKey())
+	require.NoError(t, os.WriteFile(knownHostsFile, []byte(line+"\n"), 0600))
+	ss.KnownHostsFile = knownHostsFile
+	_, err = core.NewSFTPClient(ss, nil)
+	require.Error(t, err)
+	assert.ErrorIs(t, err, constants.ErrHostKeyUnknown)
+
+	// known_hosts listing a different key for this server
+	line = knownhosts.Line([]string{knownhosts.Normalize(address)}, otherKey.PublicKey())
+	require.NoError(t, os.WriteFile(knownHostsFile, []byte(line+"\n"), 0600))
+	_, err = core.NewSFTPClient(ss, nil)
+	require.Error(t, err)
+	assert.ErrorIs(t, err, constants.ErrHostKeyChanged)
+	assert.Contains(t, err.Error(), ssh.FingerprintSHA256(hostKey.PublicKey()))
+	assert.Contains(t, err.Error(), ssh.FingerprintSHA256(otherKey.PublicKey()))
+
+	// known_hosts listing the right key
+	line = knownhosts.Line([]string{knownhosts.Normalize(address)}, hostKey.PublicKey())
+	require.NoError(t, os.WriteFile(knownHostsFile, []byte(line+"\n"), 0600))
+	client, err := core.NewSFTPClient(ss, nil)
+	require.NoError(t, err)
+	defer client.Close()
+
+	// Make sure the connection actually works.
+	bagFile := fileToUpload()
+	require.NoError(t, client.Upload(bagFile, filepath.Base(bagFile)))
+	assert.FileExists(t, filepath.Join(root, filepath.Base(bagFile)))
+}
+
+func TestSFTPHostKeyPinned(t *testing.T) {
+	hostKey := newTestHostKey(t)
+	address, _ := startTestSFTPServer(t, hostKey)
+	ss := getLocalSftpStorageService(t, address)
+
+	ss.HostKeyFingerprint = ssh.FingerprintSHA256(hostKey.PublicKey())
+	assert.True(t, ss.Validate(), ss.Errors)
+	client, err := core.NewSFTPClient(ss, nil)
+	require.NoError(t, err)
+	client.Close()
+
+	ss.HostKeyFingerprint = "MD5:" + ssh.FingerprintLegacyMD5(hostKey.PublicKey())
+	assert.True(t, ss.Validate(), ss.Errors)
+	client, err = core.NewSFTPClient(ss, nil)
+	require.NoError(t, err)
+	client.Close()
+
+	// The pinned fingerprint takes precedence over trust on first use.
+	ss.HostKeyPolicy = constants.HostKeyPolicyTOFU
+	ss.HostKeyFingerprint = ssh.FingerprintSHA256(newTestHostKey(t).PublicKey())
+	_, err = core.NewSFTPClient(ss, nil)
+	require.Error(t, err)
+	assert.ErrorIs(t, err, constants.ErrHostKeyChanged)
+	assert.Contains(t, err.Error(), "update the host key fingerprint")
+}
+
+func TestSFTPHostKeyTrustOnFirstUse(t *testing.T) {
+	require.NoError(t, core.ClearTrustedHostKeysTable())
+	hostKey := newTestHostKey(t)
+	address, _ := startTestSFTPServer(t, hostKey)
+	ss := getLocalSftpStorageService(t, address)
+	ss.HostKeyPolicy = constants.HostKeyPolicyTOFU
+
+	// First connection records the key.
+	client, err := core.NewSFTPClient(ss, nil)
+	require.NoError(t, err)
+	client.Close()
+	trusted, err := core.TrustedHostKeyFind(knownhosts.Normalize(address))
+	require.NoError(t, err)
+	assert.Equal(t, ssh.KeyAlgoED25519, trusted.KeyType)
+	assert.Equal(t, ssh.FingerprintSHA256(hostKey.PublicKey()), trusted.Fingerprint)
+	assert.True(t, trusted.Matches(hostKey.PublicKey()))
+
+	// Later connections accept the same key.
+	client, err = core.NewSFTPClient(ss, nil)
+	require.NoError(t, err)
+	client.Close()
+
+	// Simulate the server's key changing by trusting a different key.
+	otherKey := newTestHostKey(t)
+	require.NoError(t, core.TrustedHostKeySave(core.NewTrustedHostKey(address, otherKey.PublicKey())))
+	_, err = core.NewSFTPClient(ss, nil)
+	require.Error(t, err)
+	assert.ErrorIs(t, err, constants.ErrHostKeyChanged)
+	assert.Contains(t, err.Error(), "--forget-host-key="+knownhosts.Normalize(address))
+
+	// After we forget the old key, the next connection trusts the new one.
+	forgotten, err := core.ForgetHostKey(address)
+	require.NoError(t, err)
+	assert.True(t, forgotten.Matches(otherKey.PublicKey()))
+	_, err = core.ForgetHostKey(address)
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+
+	client, err = core.NewSFTPClient(ss, nil)
+	require.NoError(t, err)
+	client.Close()
+}
+
+func TestIsValidHostKeyFingerprint(t *testing.T) {
+	key := newTestHostKey(t).PublicKey()
+	assert.True(t, core.IsValidHostKeyFingerprint(ssh.FingerprintSHA256(key)))
+	assert.True(t, core.IsValidHostKeyFingerprint(ssh.FingerprintLegacyMD5(key)))
+	assert.True(t, core.IsValidHostKeyFingerprint("MD5:"+ssh.FingerprintLegacyMD5(key)))
+	assert.False(t, core.IsValidHostKeyFingerprint(""))
+	assert.False(t, core.IsValidHostKeyFingerprint("SHA256:too-short"))
+	assert.False(t, core.IsValidHostKeyFingerprint("16:27:ac:a5"))
+}
@@ -17,19 +17,26 @@ import (
 )
 
 type StorageService struct {
-	ID             string            `json:"id"`
-	AllowsDownload bool              `json:"allowsDownload"`
-	AllowsUpload   bool              `json:"allowsUpload"`
-	Bucket         string            `json:"bucket"`
-	Description    string            `json:"description"`
-	Errors         map[string]string `json:"-"`
-	Host           string            `json:"host"`
-	Login          string            `json:"login"`
-	LoginExtra     string            `json:"loginExtra"`
-	Name           string            `json:"name"`
-	Password       string            `json:"password"`
-	Port           int               `json:"port"`
-	Protocol       string            `json:"protocol"`
+	ID                 string            `json:"id"`
+	AllowsDownload     bool              `json:"allowsDownload"`
+	AllowsUpload       bool              `json:"allowsUpload"`
+	Bucket             string            `json:"bucket"`
+	Description        string            `json:"description"`
+	Errors             map[string]string `json:"-"`
+	Host               string            `json:"host"`
+	HostKeyFingerprint string            `json:"hostKeyFingerprint,omitempty"`
+	HostKeyPolicy      string            `json:"hostKeyPolicy,omitempty"`
+	KnownHostsFile     string            `json:"knownHostsFile,omitempty"`
+	Login              string            `json:"login"`
+	LoginExtra         string            `json:"loginExtra"`
+	Name               string            `json:"name"`
+	Password           string            `json:"password"`
+	PathTemplate       string            `json:"pathTemplate,omitempty"`
+	Port               int               `json:"port"`
+	Protocol           string            `json:"protocol"`
+	RetryPolicy        *RetryPolicy      `json:"retryPolicy,omitempty"`
+	S3Options          *S3UploadOptions  `json:"s3Options,omitempty"`
+	VerifyUploads      bool              `json:"verifyUploads,omitempty"`
 }
 
 func NewStorageService() *StorageService {
@@ -43,6 +50,9 @@ func NewStorageService() *StorageService {
 
 // URL returns the URL to which the file will be uploaded.
 func (ss *StorageService) URL(filename string) string {
+	if ss.Protocol == constants.ProtocolFile {
+		return "file://" + filepath.ToSlash(filepath.Join(ss.Bucket, filename))
+	}
 	return fmt.Sprintf("%s://%s/%s/%s", ss.Protocol, ss.HostAndPort(), ss.Bucket, filename)
 }
 
@@ -67,58 +77,143 @@ func (ss *StorageService) Validate() bool {
 	if strings.TrimSpace(ss.Protocol) == "" {
 		ss.Errors["Protocol"] = "StorageService requires a protocol (s3, sftp, etc)."
 	}
-	if strings.TrimSpace(ss.Host) == "" {
-		ss.Errors["Host"] = "StorageService requires a hostname or IP address."
+	if ss.Protocol == constants.ProtocolFile {
+		// Local and mounted file systems need no host or credentials,
+		// just a root directory.
+		if strings.TrimSpace(ss.Bucket) == "" {
+			ss.Errors["Bucket"] = "StorageService requires a root directory when the protocol is file."
+		}
+	} else {
+		if strings.TrimSpace(ss.Host) == "" {
+			ss.Errors["Host"] = "StorageService requires a hostname or IP address."
+		}
+		if ss.Protocol == constants.ProtocolS3 && strings.TrimSpace(ss.Bucket) == "" {
+			ss.Errors["Bucket"] = "StorageService requires a bucket name when the protocol is S3."
+		}
+		// WebDAV services with no login use the password as a bearer token.
+		if strings.TrimSpace(ss.Login) == "" && ss.Protocol != constants.ProtocolWebDAV {
+			ss.Errors["Login"] = "StorageService requires a login name or access key id."
+		}
+		if strings.TrimSpace(ss.Password) == "" && strings.TrimSpace(ss.LoginExtra) == "" {
+			ss.Errors["Password"] = "StorageService requires a password or secret access key, or the path to your SSH private key."
+		}
+	}
+	if ss.HostKeyPolicy != "" && !util.StringListContains(constants.HostKeyPolicies, ss.HostKeyPolicy) {
+		ss.Errors["HostKeyPolicy"] = fmt.Sprintf("Host key policy must be one of: %s.", strings.Join(constants.HostKeyPolicies, ", "))
 	}
-	if ss.Protocol == constants.ProtocolS3 && strings.TrimSpace(ss.Bucket) == "" {
-		ss.Errors["Bucket"] = "StorageService requires a bucket name when the protocol is S3."
+	if strings.TrimSpace(ss.HostKeyFingerprint) != "" && !IsValidHostKeyFingerprint(ss.HostKeyFingerprint) {
+		ss.Errors["HostKeyFingerprint"] = "Host key fingerprint should look like SHA256:<base64 digest> or a colon-separated MD5 digest."
 	}
-	if strings.TrimSpace(ss.Login) == "" {
-		ss.Errors["Login"] = "StorageService requires a login name or access key id."
+	if strings.Contains(filepath.ToSlash(ss.PathTemplate), "../") || strings.HasSuffix(ss.PathTemplate, "..") {
+		ss.Errors["PathTemplate"] = "Path template cannot refer to parent directories."
 	}
-	if strings.TrimSpace(ss.Password) == "" && strings.TrimSpace(ss.LoginExtra) == "" {
-		ss.Errors["Password"] = "StorageService requires a password or secret access key, or the path to your SSH private key."
+	if ss.RetryPolicy != nil {
+		for key, errMsg := range ss.RetryPolicy.Validate() {
+			ss.Errors[key] = errMsg
+		}
+	}
+	if ss.S3Options != nil {
+		for key, errMsg := range ss.S3Options.Validate() {
+			ss.Errors[key] = errMsg
+		}
 	}
 	return len(ss.Errors) == 0
 }
 
 // GetLogin returns the login name or AccessKeyID to connect to this
-// storage service. Per the DART docts, if the login begins with "env:",
+// storage service. Per the DART docs, if the login begins with "env:",
 // we fetch it from the environment. For example, "env:MY_SS_LOGIN"
 // causes us to fetch the env var "MY_SS_LOGIN". This allows us to
 // copy Workflow info across the wire without exposing sensitive credentials.
+// The login may also refer to a file, helper command, AWS profile or
+// OS keyring entry. See ResolveCredential() for details. A login of
+// "aws-profile:name" resolves to the profile's access key ID.
 //
-// If the login does not begin with "env:", this returns it verbatim.
+// If the login does not begin with a known scheme, this returns it
+// verbatim. If the credential can't be resolved, this logs a warning
+// and returns an empty string.
 func (ss *StorageService) GetLogin() string {
-	if strings.HasPrefix(ss.Login, "env:") {
-		return ss.getEnv(ss.Login)
-	}
-	return ss.Login
+	return resolveCredentialOrWarn(withAWSField(ss.Login, AWSAccessKeyID), "login", ss.Name)
 }
 
 // GetPassword returns this storage service's password from the
 // StorageService record or from the environment as necessary. See the
-// documentation for StorageService.GetLogin() for more info.
+// documentation for StorageService.GetLogin() for more info. A password
+// of "aws-profile:name" resolves to the profile's secret access key.
 func (ss *StorageService) GetPassword() string {
-	if strings.HasPrefix(ss.Password, "env:") {
-		return ss.getEnv(ss.Password)
+	return resolveCredentialOrWarn(withAWSField(ss.Password, AWSSecretAccessKey), "password", ss.Name)
+}
+
+// GetSessionToken returns the AWS session token for S3 services whose
+// login comes from an AWS profile with temporary credentials. For all
+// other services, it returns an empty string.
+func (ss *StorageService) GetSessionToken() string {
+	if !strings.HasPrefix(ss.Login, "aws-profile:") {
+		return ""
+	}
+	profile, _, _ := strings.Cut(strings.TrimPrefix(ss.Login, "aws-profile:"), "/")
+	values, err := AWSProfileValues(profile)
+	if err != nil {
+		return ""
+	}
+	return values[AWSSessionToken]
+}
+
+// GetSSHKey returns the private key for SFTP public key authentication.
+// A plain LoginExtra is the path to the key file, as it always has been.
+// LoginExtra may also be a credential reference. If the value it refers
+// to is a PEM-encoded key, we use it directly. Otherwise, we treat it as
+// the path to the key file, so "env:SSH_KEY_PATH" still works.
+func (ss *StorageService) GetSSHKey() ([]byte, error) {
+	value, err := ResolveCredential(ss.LoginExtra)
+	if err != nil {
+		return nil, err
+	}
+	if strings.Contains(value, "-----BEGIN") {
+		return []byte(value), nil
 	}
-	return ss.Password
+	keyFile, err := expandHome(strings.TrimSpace(value))
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(keyFile)
 }
 
-// getEnv returns the value of an environment variable, minus the
-// "ENV:" prefix.
-func (ss *StorageService) getEnv(varname string) string {
-	parts := strings.SplitN(varname, ":", 2)
-	return os.Getenv(parts[1])
+// GetRetryPolicy returns the policy for retrying failed transfers to
+// this storage service. If the service doesn't define its own policy,
+// this returns DefaultRetryPolicy().
+func (ss *StorageService) GetRetryPolicy() *RetryPolicy {
+	if ss.RetryPolicy != nil {
+		return ss.RetryPolicy
+	}
+	return DefaultRetryPolicy()
+}
+
+// GetHostKeyPolicy returns the policy for checking SFTP host keys.
+// This defaults to strict checking when HostKeyPolicy is empty.
+func (ss *StorageService) GetHostKeyPolicy() string {
+	if ss.HostKeyPolicy == "" {
+		return constants.HostKeyPolicyStrict
+	}
+	return ss.HostKeyPolicy
 }
 
 // HasPlaintextPassword returns true if this StorageService
-// has a non-empty password and does not use an environment variable
-// for the password.
+// has a non-empty password that is not a reference to an environment
+// variable, file, helper command or other credential provider.
 func (ss *StorageService) HasPlaintextPassword() bool {
 	pwd := strings.TrimSpace(ss.Password)
-	return pwd != "" && !strings.HasPrefix(ss.Password, "env:")
+	return pwd != "" && !IsCredentialReference(ss.Password)
+}
+
+// secretFields returns pointers to the fields we encrypt when we
+// save this service to the DART database.
+func (ss *StorageService) secretFields() []*string {
+	fields := []*string{&ss.Password}
+	if ss.S3Options != nil {
+		fields = append(fields, &ss.S3Options.CustomerKey)
+	}
+	return fields
 }
 
 // Copy returns a pointer to a new StorageService whose values
@@ -127,19 +222,26 @@ func (ss *StorageService) HasPlaintextPassword() bool {
 // to do that yourself.
 func (ss *StorageService) Copy() *StorageService {
 	return &StorageService{
-		ID:             ss.ID,
-		AllowsDownload: ss.AllowsDownload,
-		AllowsUpload:   ss.AllowsUpload,
-		Bucket:         ss.Bucket,
-		Description:    ss.Description,
-		Errors:         ss.Errors,
-		Host:           ss.Host,
-		Login:          ss.Login,
-		LoginExtra:     ss.LoginExtra,
-		Name:           ss.Name,
-		Password:       ss.Password,
-		Port:           ss.Port,
-		Protocol:       ss.Protocol,
+		ID:                 ss.ID,
+		AllowsDownload:     ss.AllowsDownload,
+		AllowsUpload:       ss.AllowsUpload,
+		Bucket:             ss.Bucket,
+		Description:        ss.Description,
+		Errors:             ss.Errors,
+		Host:               ss.Host,
+		HostKeyFingerprint: ss.HostKeyFingerprint,
+		HostKeyPolicy:      ss.HostKeyPolicy,
+		KnownHostsFile:     ss.KnownHostsFile,
+		Login:              ss.Login,
+		LoginExtra:         ss.LoginExtra,
+		Name:               ss.Name,
+		Password:           ss.Password,
+		PathTemplate:       ss.PathTemplate,
+		Port:               ss.Port,
+		Protocol:           ss.Protocol,
+		RetryPolicy:        ss.RetryPolicy.Copy(),
+		S3Options:          ss.S3Options.Copy(),
+		VerifyUploads:      ss.VerifyUploads,
 	}
 }
 
@@ -172,8 +274,10 @@ func (ss *StorageService) ToForm() *Form {
 
 	protocol := form.AddField("Protocol", "Protocol", ss.Protocol, true)
 	protocol.AddChoice("", "")
+	protocol.AddChoice("file", "file")
 	protocol.AddChoice("s3", "s3")
 	protocol.AddChoice("sftp", "sftp")
+	protocol.AddChoice("webdav", "webdav")
 
 	host := form.AddField("Host", "Host", ss.Host, true)
 	host.Attrs["placeholder"] = "Hostname or IP address. E.g. s3.amazonaws.com or 127.0.0.1"
@@ -181,16 +285,35 @@ func (ss *StorageService) ToForm() *Form {
 	port := form.AddField("Port", "Port", strconv.Itoa(ss.Port), false)
 	port.Attrs["placeholder"] = "Leave at 0 if you're unsure"
 
-	form.AddField("Bucket", "Bucket", ss.Bucket, true)
+	bucket := form.AddField("Bucket", "Bucket", ss.Bucket, true)
+	bucket.Help = "The S3 bucket, the SFTP upload directory or, for the file protocol, the root directory of the deposit area."
+
+	pathTemplate := form.AddField("PathTemplate", "Path Template", ss.PathTemplate, false)
+	pathTemplate.Attrs["placeholder"] = "E.g. {{year}}/{{Source-Organization}}/{{filename}}"
+	pathTemplate.Help = "For the file protocol, where to put each bag under the root directory. Leave empty to copy bags directly into the root."
 
 	form.AddField("Login", "Login", ss.Login, true)
 	form.AddField("Password", "Password", ss.Password, true)
 	form.AddField("LoginExtra", "Login Extra", ss.LoginExtra, false)
 
+	hostKeyPolicy := form.AddField("HostKeyPolicy", "Host Key Policy", ss.GetHostKeyPolicy(), false)
+	hostKeyPolicy.AddChoice("Strict", constants.HostKeyPolicyStrict)
+	hostKeyPolicy.AddChoice("Trust on first use", constants.HostKeyPolicyTOFU)
+	hostKeyPolicy.Help = "For SFTP. Strict accepts only a server key matching the fingerprint or known_hosts file below. Trust on first use records the key the server presents the first time and rejects any other key after that."
+
+	hostKeyFingerprint := form.AddField("HostKeyFingerprint", "Host Key Fingerprint", ss.HostKeyFingerprint, false)
+	hostKeyFingerprint.Attrs["placeholder"] = "E.g. SHA256:uNiVztksCsDhcc0u9e8BujQXVUpKZIDTMczCvj3tD2s"
+
+	knownHostsFile := form.AddField("KnownHostsFile", "Known Hosts File", ss.KnownHostsFile, false)
+	knownHostsFile.Attrs["placeholder"] = "Leave empty to use ~/.ssh/known_hosts"
+
 	allowsUpload := form.AddField("AllowsUpload", "Allows Upload", strconv.FormatBool(ss.AllowsUpload), false)
 	allowsUpload.Choices = YesNoChoices(ss.AllowsUpload)
 	allowsDownload := form.AddField("AllowsDownload", "Allows Download", strconv.FormatBool(ss.AllowsDownload), false)
 	allowsDownload.Choices = YesNoChoices(ss.AllowsDownload)
+	verifyUploads := form.AddField("VerifyUploads", "Verify Uploads", strconv.FormatBool(ss.VerifyUploads), false)
+	verifyUploads.Choices = YesNoChoices(ss.VerifyUploads)
+	verifyUploads.Help = "Verify the checksum of each file after upload? Uploads are checked against the SHA-256 checksums sent with them, or read back if the service does not report checksums."
 
 	for field, errMsg := range ss.Errors {
 		form.Fields[field].Error = errMsg
@@ -212,6 +335,10 @@ func (ss *StorageService) TestConnection() error {
 		return ss.testS3Connection()
 	} else if ss.Protocol == constants.ProtocolSFTP {
 		return ss.testSFTPConnection()
+	} else if ss.Protocol == constants.ProtocolFile {
+		return ss.testFileConnection()
+	} else if ss.Protocol == constants.ProtocolWebDAV {
+		return ss.testWebDAVConnection()
 	}
 	proto := ss.Protocol
 	if proto == "" {
@@ -225,7 +352,7 @@ func (ss *StorageService) testS3Connection() error {
 	secretKey := ss.GetPassword()
 	useSSL := !strings.HasPrefix(ss.Host, "localhost") && !strings.HasPrefix(ss.Host, "127.0.0.1")
 	options := &minio.Options{
-		Creds:  credentials.NewStaticV4(accessKeyId, secretKey, ""),
+		Creds:  credentials.NewStaticV4(accessKeyId, secretKey, ss.GetSessionToken()),
 		Secure: useSSL,
 	}
 	client, err := minio.New(ss.HostAndPort(), options)
@@ -253,6 +380,44 @@ func (ss *StorageService) testSFTPConnection() error {
 	return err
 }
 
+// testFileConnection checks that the root directory exists and
+// that we can create files in it.
+func (ss *StorageService) testFileConnection() error {
+	_, err := NewFileClient(ss, nil)
+	if err != nil {
+		return err
+	}
+	tmpFile, err := os.CreateTemp(ss.Bucket, ".dart-connection-test-*")
+	if err != nil {
+		return fmt.Errorf("can't write to root directory %s: %w", ss.Bucket, err)
+	}
+	tmpFile.Close()
+	return os.Remove(tmpFile.Name())
+}
+
+// testWebDAVConnection checks that the upload collection exists
+// and that our credentials give us access to it.
+func (ss *StorageService) testWebDAVConnection() error {
+	useSSL := !strings.HasPrefix(ss.Host, "localhost") && !strings.HasPrefix(ss.Host, "127.0.0.1")
+	client, err := NewWebDAVClient(ss, useSSL, nil)
+	if err != nil {
+		return err
+	}
+	return client.propfind(ss.Bucket)
+}
+
+// StorageServiceFromJson loads a StorageService from the JSON file
+// at pathToFile.
+func StorageServiceFromJson(pathToFile string) (*StorageService, error) {
+	data, err := util.ReadFile(pathToFile)
+	if err != nil {
+		return nil, err
+	}
+	ss := &StorageService{}
+	err = json.Unmarshal(data, ss)
+	return ss, err
+}
+
 // For testing only. Valid fixtures are:
 //
 // storage_service_local_minio.json
@@ -3,6 +3,7 @@ package core_test
 import (
 	"database/sql"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/APTrust/dart-runner/constants"
@@ -29,6 +30,15 @@ func TestStorageService(t *testing.T) {
 	ss.Validate()
 	assert.Empty(t, ss.Errors["Bucket"])
 
+	// Host key settings must be valid
+	ss.HostKeyPolicy = "trust-everyone"
+	ss.HostKeyFingerprint = "not-a-fingerprint"
+	ss.Validate()
+	assert.Equal(t, "Host key policy must be one of: strict, tofu.", ss.Errors["HostKeyPolicy"])
+	assert.Equal(t, "Host key fingerprint should look like SHA256:<base64 digest> or a colon-separated MD5 digest.", ss.Errors["HostKeyFingerprint"])
+	ss.HostKeyPolicy = ""
+	ss.HostKeyFingerprint = ""
+
 	// But it is for S3
 	ss.Protocol = constants.ProtocolS3
 	ss.Validate()
@@ -46,6 +56,23 @@ func TestStorageService(t *testing.T) {
 	assert.True(t, ss.Validate())
 	assert.Empty(t, ss.Errors)
 	assert.Equal(t, "s3://example.com/uploads/bag.tar", ss.URL("bag.tar"))
+
+	// File protocol requires only a root directory
+	ss = &core.StorageService{
+		ID:       uuid.NewString(),
+		Name:     "Deposit Share",
+		Protocol: constants.ProtocolFile,
+	}
+	assert.False(t, ss.Validate())
+	assert.Equal(t, 1, len(ss.Errors))
+	assert.Equal(t, "StorageService requires a root directory when the protocol is file.", ss.Errors["Bucket"])
+	ss.Bucket = "/mnt/deposit"
+	assert.True(t, ss.Validate())
+	assert.Equal(t, "file:///mnt/deposit/bag.tar", ss.URL("bag.tar"))
+
+	ss.PathTemplate = "{{year}}/../../etc/{{filename}}"
+	assert.False(t, ss.Validate())
+	assert.Equal(t, "Path template cannot refer to parent directories.", ss.Errors["PathTemplate"])
 }
 
 func TestStorageServiceSensitiveData(t *testing.T) {
@@ -198,7 +225,7 @@ func TestStorageServiceToForm(t *testing.T) {
 	ss.Protocol = constants.ProtocolSFTP
 
 	form := ss.ToForm()
-	assert.Equal(t, 12, len(form.Fields))
+	assert.Equal(t, 17, len(form.Fields))
 	assert.True(t, form.UserCanDelete)
 	assert.Equal(t, ss.ID, form.Fields["ID"].Value)
 	assert.Equal(t, ss.Name, form.Fields["Name"].Value)
@@ -212,6 +239,11 @@ func TestStorageServiceToForm(t *testing.T) {
 	assert.Equal(t, ss.Password, form.Fields["Password"].Value)
 	assert.Equal(t, "8080", form.Fields["Port"].Value)
 	assert.Equal(t, ss.Protocol, form.Fields["Protocol"].Value)
+	assert.Equal(t, "false", form.Fields["VerifyUploads"].Value)
+	assert.Equal(t, "", form.Fields["PathTemplate"].Value)
+	assert.Equal(t, constants.HostKeyPolicyStrict, form.Fields["HostKeyPolicy"].Value)
+	assert.Equal(t, "", form.Fields["HostKeyFingerprint"].Value)
+	assert.Equal(t, "", form.Fields["KnownHostsFile"].Value)
 
 	assert.True(t, form.Fields["ID"].Required)
 	assert.True(t, form.Fields["Name"].Required)
@@ -254,6 +286,20 @@ func TestStorageServiceConnectionS3(t *testing.T) {
 	assert.NoError(t, ss.TestConnection())
 }
 
+func TestStorageServiceConnectionFile(t *testing.T) {
+	ss := core.NewStorageService()
+	ss.Protocol = constants.ProtocolFile
+	ss.Bucket = t.TempDir()
+	assert.NoError(t, ss.TestConnection())
+
+	entries, err := os.ReadDir(ss.Bucket)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	ss.Bucket = filepath.Join(ss.Bucket, "does-not-exist")
+	assert.Error(t, ss.TestConnection())
+}
+
 func TestHasPlaintextPassword(t *testing.T) {
 	ss := &core.StorageService{}
 
@@ -268,8 +314,70 @@ func TestHasPlaintextPassword(t *testing.T) {
 	ss.Password = "env:SS_PASSWORD"
 	assert.False(t, ss.HasPlaintextPassword())
 
+	// False because password comes from a file or helper command
+	ss.Password = "file:/run/secrets/ss_password"
+	assert.False(t, ss.HasPlaintextPassword())
+	ss.Password = "cmd:pass show dart/ss"
+	assert.False(t, ss.HasPlaintextPassword())
+
 	// True because password is non-empty, and
 	// not an ENV variable.
 	ss.Password = "this-here-is-secret"
 	assert.True(t, ss.HasPlaintextPassword())
 }
+
+func TestStorageServiceAWSProfileCredentials(t *testing.T) {
+	setAWSTestFiles(t)
+	ss := &core.StorageService{
+		Login:    "aws-profile:temporary",
+		Password: "aws-profile:temporary",
+	}
+	assert.Equal(t, "ASIATEMP", ss.GetLogin())
+	assert.Equal(t, "temp-secret", ss.GetPassword())
+	assert.Equal(t, "temp-session-token", ss.GetSessionToken())
+	assert.False(t, ss.HasPlaintextPassword())
+
+	// Profiles without session tokens have long-lived keys.
+	ss.Login = "aws-profile:default"
+	ss.Password = "aws-profile:default"
+	assert.Equal(t, "AKIDEFAULT", ss.GetLogin())
+	assert.Equal(t, "default-secret", ss.GetPassword())
+	assert.Empty(t, ss.GetSessionToken())
+
+	// Unresolvable credentials come back empty.
+	ss.Password = "aws-profile:no-such-profile"
+	assert.Empty(t, ss.GetPassword())
+	ss.Login = "static-key"
+	assert.Empty(t, ss.GetSessionToken())
+}
+
+func TestStorageServiceGetSSHKey(t *testing.T) {
+	keyFile := filepath.Join(util.ProjectRoot(), "testdata", "sftp", "sftp_user_key")
+	keyData, err := os.ReadFile(keyFile)
+	require.NoError(t, err)
+
+	// A plain LoginExtra is the path to the key file.
+	ss := &core.StorageService{LoginExtra: keyFile}
+	key, err := ss.GetSSHKey()
+	require.NoError(t, err)
+	assert.Equal(t, keyData, key)
+
+	// A reference may point to the key file's path...
+	t.Setenv("DART_TEST_SSH_KEY_PATH", keyFile)
+	ss.LoginExtra = "env:DART_TEST_SSH_KEY_PATH"
+	key, err = ss.GetSSHKey()
+	require.NoError(t, err)
+	assert.Equal(t, keyData, key)
+
+	// ...or to the key itself.
+	ss.LoginExtra = "file:" + keyFile
+	key, err = ss.GetSSHKey()
+	require.NoError(t, err)
+	assert.Contains(t, string(key), "-----BEGIN")
+	_, err = core.GetSFTPAuthMethod(ss)
+	assert.NoError(t, err)
+
+	ss.LoginExtra = "env:DART_TEST_SSH_KEY_NOT_SET"
+	_, err = ss.GetSSHKey()
+	assert.ErrorIs(t, err, constants.ErrCredentialUnavailable)
+}
@@ -17,6 +17,7 @@ type StreamProgress struct {
 	Total          int64
 	Current        int64
 	Percent        int
+	Stage          string
 	MessageChannel chan *EventMessage
 	mutex          sync.RWMutex
 }
@@ -27,10 +28,20 @@ type StreamProgress struct {
 func NewStreamProgress(byteCount int64, messageChannel chan *EventMessage) *StreamProgress {
 	return &StreamProgress{
 		Total:          byteCount,
+		Stage:          constants.StageUpload,
 		MessageChannel: messageChannel,
 	}
 }
 
+// NewDownloadProgress returns a new StreamProgress object that reports
+// progress in the download stage. Param byteCount is the number of bytes
+// we need to receive to complete the download.
+func NewDownloadProgress(byteCount int64, messageChannel chan *EventMessage) *StreamProgress {
+	progress := NewStreamProgress(byteCount, messageChannel)
+	progress.Stage = constants.StageDownload
+	return progress
+}
+
 // Read satisfies the progress interface for the Minio client,
 // which passes progress information as it uploads. Each time
 // Minio calls Read(), the length of b equals the total number
@@ -51,8 +62,16 @@ func (p *StreamProgress) SetTotalBytesCompleted(byteCount int64) (int, error) {
 	p.Percent = int(float64(p.Current) * 100 / float64(p.Total))
 	total := util.ToHumanSize(p.Total, 1024)
 	sent := util.ToHumanSize(p.Current, 1024)
-	message := fmt.Sprintf("Sent %s of %s (%d%%)", sent, total, p.Percent)
-	eventMessage := InfoEvent(constants.StageUpload, message)
+	verb := "Sent"
+	if p.Stage == constants.StageDownload {
+		verb = "Received"
+	}
+	message := fmt.Sprintf("%s %s of %s (%d%%)", verb, sent, total, p.Percent)
+	stage := p.Stage
+	if stage == "" {
+		stage = constants.StageUpload
+	}
+	eventMessage := InfoEvent(stage, message)
 	eventMessage.Total = p.Total
 	eventMessage.Current = p.Current
 	eventMessage.Percent = p.Percent
@@ -26,3 +26,20 @@ func TestS3UploadProgress(t *testing.T) {
 	assert.Equal(t, 5, msg.Percent)
 	assert.Equal(t, "Sent 10 B of 200 B (5%)", msg.Message)
 }
+
+func TestDownloadProgress(t *testing.T) {
+	messageChannel := make(chan *core.EventMessage)
+	defer close(messageChannel)
+
+	dp := core.NewDownloadProgress(200, messageChannel)
+	go func() {
+		dp.SetTotalBytesCompleted(50)
+	}()
+
+	msg, ok := <-messageChannel
+	assert.True(t, ok)
+	assert.Equal(t, constants.StageDownload, msg.Stage)
+	assert.Equal(t, int64(50), msg.Current)
+	assert.Equal(t, 25, msg.Percent)
+	assert.Equal(t, "Received 50 B of 200 B (25%)", msg.Message)
+}
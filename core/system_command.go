@@ -0,0 +1,113 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/APTrust/dart-runner/util"
+)
+
+// DefaultCommandTimeout is how long we let a system command run
+// when its operation doesn't set TimeoutSeconds.
+const DefaultCommandTimeout = 10 * time.Minute
+
+// maxCapturedOutput is the most stdout or stderr we keep from a
+// system command. Anything beyond this is truncated.
+const maxCapturedOutput = 64 * 1024
+
+// allowedCommands returns the list of commands in the named AppSetting,
+// which holds one command per line or a comma-separated list. If the
+// setting doesn't exist, no commands are allowed.
+func allowedCommands(settingName string) []string {
+	setting, err := GetAppSetting(settingName)
+	if err != nil {
+		return make([]string, 0)
+	}
+	commands := make([]string, 0)
+	for _, command := range strings.FieldsFunc(setting, func(r rune) bool { return r == ',' || r == '\n' }) {
+		command = strings.TrimSpace(command)
+		if command != "" {
+			commands = append(commands, command)
+		}
+	}
+	return commands
+}
+
+// argTemplateErrors returns parse errors for any of args that are
+// not valid templates, keyed by the arg's index.
+func argTemplateErrors(args []string) map[int]error {
+	errs := make(map[int]error)
+	for i, arg := range args {
+		if _, err := template.New("arg").Parse(arg); err != nil {
+			errs[i] = err
+		}
+	}
+	return errs
+}
+
+// expandCommandArgs fills in the templates in args with values from
+// data. Templates may refer only to fields of data, and every expanded
+// arg must be shell safe.
+func expandCommandArgs(args []string, data any) ([]string, error) {
+	expanded := make([]string, len(args))
+	for i, arg := range args {
+		tmpl, err := template.New("arg").Option("missingkey=error").Parse(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid template in arg %d: %w", i, err)
+		}
+		var buf bytes.Buffer
+		if err = tmpl.Execute(&buf, data); err != nil {
+			return nil, fmt.Errorf("can't expand arg %d: %w", i, err)
+		}
+		if !util.StringIsShellSafe(buf.String()) {
+			return nil, fmt.Errorf("arg %d expands to '%s', which contains characters that are not shell safe", i, buf.String())
+		}
+		expanded[i] = buf.String()
+	}
+	return expanded, nil
+}
+
+// runSystemCommand runs command without a shell, capturing its stdout
+// and stderr in result. Callers must check the command against an
+// allowlist first. Param timeoutSeconds defaults to DefaultCommandTimeout
+// if it's zero. If parentCtx is cancelled, the command is killed.
+func runSystemCommand(parentCtx context.Context, command string, args []string, timeoutSeconds int, result *OperationResult) error {
+	timeout := DefaultCommandTimeout
+	if timeoutSeconds > 0 {
+		timeout = time.Duration(timeoutSeconds) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(parentCtx, timeout)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, command, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	// If the command is killed while its children hold stdout or
+	// stderr open, don't wait forever for them to close.
+	cmd.WaitDelay = 5 * time.Second
+	err := cmd.Run()
+	result.Stdout = truncateOutput(stdout.String())
+	result.Stderr = truncateOutput(stderr.String())
+	if parentCtx.Err() != nil {
+		return fmt.Errorf("%s was cancelled: %w", command, parentCtx.Err())
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("%s did not finish within %s", command, timeout)
+	}
+	if err != nil {
+		return fmt.Errorf("%s failed: %w", command, err)
+	}
+	return nil
+}
+
+func truncateOutput(output string) string {
+	if len(output) <= maxCapturedOutput {
+		return output
+	}
+	return output[:maxCapturedOutput] + "\n... (output truncated)"
+}
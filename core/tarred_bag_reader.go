@@ -86,6 +86,9 @@ func (r *TarredBagReader) ScanMetadata() error {
 	r.processedBytes = 0
 	lastPercent := -1
 	for {
+		if err := contextErr(r.validator.ctx); err != nil {
+			return err
+		}
 		err := r.processMetaEntry()
 		if err == io.EOF {
 			Dart.Log.Debugf("TarredBagReader.ScanMetadata finished reading metadata in %s", r.validator.PathToBag)
@@ -112,6 +115,9 @@ func (r *TarredBagReader) ScanPayload() error {
 	r.processedBytes = 0
 	lastPercent := -1
 	for {
+		if err := contextErr(r.validator.ctx); err != nil {
+			return err
+		}
 		err := r.processPayloadEntry()
 		if err == io.EOF {
 			Dart.Log.Debugf("TarredBagReader.ScanPayload finished reading payload in %s", r.validator.PathToBag)
@@ -257,7 +263,7 @@ func (r *TarredBagReader) addChecksums(pathInBag string, fileRecord *FileRecord,
 	}
 
 	multiWriter := io.MultiWriter(writers...)
-	_, err := io.Copy(multiWriter, r.tarReader)
+	_, err := io.Copy(multiWriter, newContextReader(r.validator.ctx, r.tarReader))
 	if err != nil {
 		Dart.Log.Errorf("TarredBagReader error adding checksums for file %s: %v", pathInBag, err)
 		return err
@@ -3,6 +3,7 @@ package core
 import (
 	"archive/tar"
 	"compress/gzip"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -21,6 +22,7 @@ type TarredBagWriter struct {
 	gzipwriter     *gzip.Writer
 	digestAlgs     []string
 	rootDirCreated bool
+	ctx            context.Context
 }
 
 func NewTarredBagWriter(outputPath string, digestAlgs []string) *TarredBagWriter {
@@ -174,7 +176,7 @@ func (writer *TarredBagWriter) AddFile(xFileInfo *util.ExtendedFileInfo, pathWit
 	}
 	writers[len(writers)-1] = writer.tarWriter
 	multiWriter := io.MultiWriter(writers...)
-	bytesWritten, err := io.Copy(multiWriter, file)
+	bytesWritten, err := io.Copy(multiWriter, newContextReader(writer.ctx, file))
 	if bytesWritten != header.Size {
 		message := fmt.Sprintf("TarredBagWriter.addToArchive() copied only %d of %d bytes for file %s", bytesWritten, header.Size, xFileInfo.FullPath)
 		Dart.Log.Error(message)
@@ -0,0 +1,153 @@
+package core
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// UploadCheckpoint records the progress of a multipart S3 upload
+// so that an interrupted upload can resume where it left off instead
+// of starting again from zero. We save one checkpoint per local file,
+// storage service, bucket and key, and we update it after each part
+// is uploaded.
+type UploadCheckpoint struct {
+	ID               string
+	StorageServiceID string
+	Bucket           string
+	ObjectKey        string
+	LocalPath        string
+	FileSize         int64
+	FileModTime      time.Time
+	UploadID         string
+	PartSize         int64
+	Parts            []CheckpointPart
+	CreatedAt        time.Time
+	UpdatedAt        time.Time
+}
+
+// CheckpointPart describes one successfully uploaded part of a
+// multipart upload.
+type CheckpointPart struct {
+	PartNumber     int    `json:"partNumber"`
+	ETag           string `json:"etag"`
+	Size           int64  `json:"size"`
+	ChecksumSHA256 string `json:"checksumSha256,omitempty"`
+}
+
+// NewUploadCheckpoint returns a new checkpoint for uploading the file
+// described by fileInfo in parts of partSize bytes. The caller must set
+// UploadID after initiating the multipart upload.
+func NewUploadCheckpoint(storageServiceID, bucket, objectKey, localPath string, fileInfo os.FileInfo, partSize int64) *UploadCheckpoint {
+	now := time.Now().UTC()
+	return &UploadCheckpoint{
+		ID:               uuid.NewString(),
+		StorageServiceID: storageServiceID,
+		Bucket:           bucket,
+		ObjectKey:        objectKey,
+		LocalPath:        localPath,
+		FileSize:         fileInfo.Size(),
+		FileModTime:      fileInfo.ModTime().UTC(),
+		PartSize:         partSize,
+		Parts:            make([]CheckpointPart, 0),
+		CreatedAt:        now,
+		UpdatedAt:        now,
+	}
+}
+
+// MatchesFile returns true if the local file still has the size and
+// modification time it had when this checkpoint was created. If the
+// file has changed, the parts already uploaded are useless.
+func (cp *UploadCheckpoint) MatchesFile(fileInfo os.FileInfo) bool {
+	return cp.FileSize == fileInfo.Size() && cp.FileModTime.Equal(fileInfo.ModTime().UTC())
+}
+
+// PartCount returns the total number of parts in this upload.
+func (cp *UploadCheckpoint) PartCount() int {
+	if cp.PartSize <= 0 {
+		return 0
+	}
+	count := cp.FileSize / cp.PartSize
+	if cp.FileSize%cp.PartSize != 0 || cp.FileSize == 0 {
+		count++
+	}
+	return int(count)
+}
+
+// PartRange returns the offset and length within the local file of
+// part number partNumber. Part numbers start at one.
+func (cp *UploadCheckpoint) PartRange(partNumber int) (offset int64, size int64) {
+	offset = int64(partNumber-1) * cp.PartSize
+	size = cp.PartSize
+	if offset+size > cp.FileSize {
+		size = cp.FileSize - offset
+	}
+	return offset, size
+}
+
+// HasPart returns true if part number partNumber has been uploaded.
+func (cp *UploadCheckpoint) HasPart(partNumber int) bool {
+	return cp.Part(partNumber) != nil
+}
+
+// Part returns the record of part number partNumber, or nil if
+// that part has not been uploaded.
+func (cp *UploadCheckpoint) Part(partNumber int) *CheckpointPart {
+	for i := range cp.Parts {
+		if cp.Parts[i].PartNumber == partNumber {
+			return &cp.Parts[i]
+		}
+	}
+	return nil
+}
+
+// AddPart records that a part has been uploaded. checksumSHA256 is the
+// part's base64-encoded SHA-256 digest, as sent to S3. If the part was
+// already recorded, this replaces the old record.
+func (cp *UploadCheckpoint) AddPart(partNumber int, etag string, size int64, checksumSHA256 string) {
+	part := CheckpointPart{PartNumber: partNumber, ETag: etag, Size: size, ChecksumSHA256: checksumSHA256}
+	for i := range cp.Parts {
+		if cp.Parts[i].PartNumber == partNumber {
+			cp.Parts[i] = part
+			return
+		}
+	}
+	cp.Parts = append(cp.Parts, part)
+	sort.Slice(cp.Parts, func(i, j int) bool {
+		return cp.Parts[i].PartNumber < cp.Parts[j].PartNumber
+	})
+}
+
+// MissingParts returns the numbers of the parts that have not yet
+// been uploaded, in ascending order.
+func (cp *UploadCheckpoint) MissingParts() []int {
+	missing := make([]int, 0)
+	for i := 1; i <= cp.PartCount(); i++ {
+		if !cp.HasPart(i) {
+			missing = append(missing, i)
+		}
+	}
+	return missing
+}
+
+// BytesCompleted returns the number of bytes already uploaded.
+func (cp *UploadCheckpoint) BytesCompleted() int64 {
+	total := int64(0)
+	for _, part := range cp.Parts {
+		total += part.Size
+	}
+	return total
+}
+
+// IsComplete returns true if all parts have been uploaded.
+func (cp *UploadCheckpoint) IsComplete() bool {
+	return len(cp.MissingParts()) == 0
+}
+
+func (cp *UploadCheckpoint) partsJson() (string, error) {
+	data, err := json.Marshal(cp.Parts)
+	return string(data), err
+}
@@ -0,0 +1,122 @@
+package core_test
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/APTrust/dart-runner/core"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// makeSparseFile creates a file of the specified size without
+// writing any data to it.
+func makeSparseFile(t *testing.T, size int64) string {
+	path := filepath.Join(t.TempDir(), "large_file.tar")
+	file, err := os.Create(path)
+	require.Nil(t, err)
+	require.Nil(t, file.Truncate(size))
+	require.Nil(t, file.Close())
+	return path
+}
+
+func TestUploadCheckpointParts(t *testing.T) {
+	path := makeSparseFile(t, 250)
+	info, err := os.Stat(path)
+	require.Nil(t, err)
+
+	cp := core.NewUploadCheckpoint(uuid.NewString(), "bucket", "large_file.tar", path, info, 100)
+	assert.Equal(t, int64(250), cp.FileSize)
+	assert.Equal(t, 3, cp.PartCount())
+	assert.Equal(t, []int{1, 2, 3}, cp.MissingParts())
+	assert.Equal(t, int64(0), cp.BytesCompleted())
+	assert.False(t, cp.IsComplete())
+	assert.True(t, cp.MatchesFile(info))
+
+	offset, size := cp.PartRange(1)
+	assert.Equal(t, int64(0), offset)
+	assert.Equal(t, int64(100), size)
+	offset, size = cp.PartRange(3)
+	assert.Equal(t, int64(200), offset)
+	assert.Equal(t, int64(50), size)
+
+	// Parts are kept in order, and re-adding a part replaces it.
+	cp.AddPart(3, "etag-3", 50, "")
+	cp.AddPart(1, "etag-1-old", 100, "")
+	cp.AddPart(1, "etag-1", 100, "")
+	require.Equal(t, 2, len(cp.Parts))
+	assert.Equal(t, 1, cp.Parts[0].PartNumber)
+	assert.Equal(t, "etag-1", cp.Parts[0].ETag)
+	assert.Equal(t, 3, cp.Parts[1].PartNumber)
+	assert.True(t, cp.HasPart(3))
+	assert.False(t, cp.HasPart(2))
+	assert.Equal(t, []int{2}, cp.MissingParts())
+	assert.Equal(t, int64(150), cp.BytesCompleted())
+
+	cp.AddPart(2, "etag-2", 100, "")
+	assert.True(t, cp.IsComplete())
+	assert.Equal(t, int64(250), cp.BytesCompleted())
+
+	// Checkpoint no longer matches if the file changes.
+	require.Nil(t, os.Truncate(path, 300))
+	info, err = os.Stat(path)
+	require.Nil(t, err)
+	assert.False(t, cp.MatchesFile(info))
+}
+
+func TestUploadCheckpointPersistence(t *testing.T) {
+	defer core.ClearUploadCheckpointsTable()
+	path := makeSparseFile(t, 250)
+	info, err := os.Stat(path)
+	require.Nil(t, err)
+
+	ssID := uuid.NewString()
+	cp := core.NewUploadCheckpoint(ssID, "bucket", "large_file.tar", path, info, 100)
+	cp.UploadID = "upload-1234"
+	require.Nil(t, core.UploadCheckpointSave(cp))
+
+	found, err := core.UploadCheckpointFind(ssID, "bucket", "large_file.tar", path)
+	require.Nil(t, err)
+	require.NotNil(t, found)
+	assert.Equal(t, cp.ID, found.ID)
+	assert.Equal(t, "upload-1234", found.UploadID)
+	assert.Equal(t, int64(100), found.PartSize)
+	assert.Empty(t, found.Parts)
+	assert.True(t, found.MatchesFile(info))
+
+	// Part checksums are saved, so a resumed upload can reuse them.
+	cp.AddPart(1, "etag-1", 100, "checksum-1")
+	cp.AddPart(2, "etag-2", 100, "checksum-2")
+	require.Nil(t, core.UploadCheckpointSave(cp))
+	found, err = core.UploadCheckpointFind(ssID, "bucket", "large_file.tar", path)
+	require.Nil(t, err)
+	assert.Equal(t, cp.Parts, found.Parts)
+	assert.Equal(t, "checksum-2", found.Part(2).ChecksumSHA256)
+	assert.Equal(t, []int{3}, found.MissingParts())
+
+	_, err = core.UploadCheckpointFind(ssID, "bucket", "other_file.tar", path)
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	// Checkpoint is stale only if it hasn't been updated since cutoff.
+	stale, err := core.UploadCheckpointListOlderThan(ssID, time.Now().Add(-1*time.Hour))
+	require.Nil(t, err)
+	assert.Empty(t, stale)
+	stale, err = core.UploadCheckpointListOlderThan(ssID, time.Now().Add(time.Hour))
+	require.Nil(t, err)
+	require.Equal(t, 1, len(stale))
+	assert.Equal(t, cp.ID, stale[0].ID)
+	stale, err = core.UploadCheckpointListOlderThan(uuid.NewString(), time.Now().Add(time.Hour))
+	require.Nil(t, err)
+	assert.Empty(t, stale)
+	stale, err = core.UploadCheckpointListOlderThan("", time.Now().Add(time.Hour))
+	require.Nil(t, err)
+	assert.Equal(t, 1, len(stale))
+
+	require.Nil(t, core.UploadCheckpointDelete(cp.ID))
+	_, err = core.UploadCheckpointFind(ssID, "bucket", "large_file.tar", path)
+	assert.Equal(t, sql.ErrNoRows, err)
+}
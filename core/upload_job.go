@@ -1,6 +1,7 @@
 package core
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/APTrust/dart-runner/constants"
@@ -97,7 +98,23 @@ func (job *UploadJob) GetErrors() map[string]string {
 	return job.Errors
 }
 
+// secretFields returns pointers to the secrets in this job's
+// upload operations.
+func (job *UploadJob) secretFields() []*string {
+	fields := make([]*string, 0)
+	for _, op := range job.UploadOps {
+		fields = append(fields, op.secretFields()...)
+	}
+	return fields
+}
+
 func (job *UploadJob) Run(messageChannel chan *EventMessage) int {
+	return job.RunContext(context.Background(), messageChannel)
+}
+
+// RunContext is like Run, but it stops uploading if ctx is cancelled,
+// in which case it returns constants.ExitCancelled.
+func (job *UploadJob) RunContext(ctx context.Context, messageChannel chan *EventMessage) int {
 	job.UploadOps = make([]*UploadOperation, 0)
 
 	if !job.Validate() {
@@ -129,12 +146,20 @@ func (job *UploadJob) Run(messageChannel chan *EventMessage) int {
 	status := constants.StatusSuccess
 	message := ""
 	for _, storageService := range uploadTargets {
-		if !job.runOne(storageService, messageChannel) {
+		if ctx.Err() != nil {
+			break
+		}
+		if !job.runOne(ctx, storageService, messageChannel) {
 			exitCode = constants.ExitRuntimeErr
 			status = constants.StatusFailed
 			message += fmt.Sprintf("One or more uploads to %s failed", storageService)
 		}
 	}
+	if ctx.Err() != nil {
+		exitCode = constants.ExitCancelled
+		status = constants.StatusCancelled
+		message = "Uploads were cancelled."
+	}
 
 	// Tell the listener we finished.
 	if messageChannel != nil {
@@ -154,7 +179,7 @@ func (job *UploadJob) Run(messageChannel chan *EventMessage) int {
 	return exitCode
 }
 
-func (job *UploadJob) runOne(storageService *StorageService, messageChannel chan *EventMessage) bool {
+func (job *UploadJob) runOne(ctx context.Context, storageService *StorageService, messageChannel chan *EventMessage) bool {
 	uploadOp := NewUploadOperation(storageService, job.PathsToUpload)
 	job.UploadOps = append(job.UploadOps, uploadOp)
 	uploadOp.Result.Start()
@@ -168,7 +193,7 @@ func (job *UploadJob) runOne(storageService *StorageService, messageChannel chan
 		uploadOp.Result.Finish(map[string]string{"Upload.CalculatePayloadSize": err.Error()})
 		return false
 	}
-	ok := uploadOp.DoUpload(messageChannel)
+	ok := uploadOp.DoUploadContext(ctx, messageChannel)
 	uploadOp.Result.Finish(uploadOp.Errors)
 	if messageChannel != nil {
 		status := constants.StatusFailed
@@ -1,16 +1,20 @@
 package core
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/APTrust/dart-runner/constants"
 	"github.com/APTrust/dart-runner/util"
 )
 
 type UploadOperation struct {
+	BagTags        map[string]string  `json:"-"`
 	Errors         map[string]string  `json:"errors"`
 	PayloadSize    int64              `json:"payloadSize"`
 	Result         *OperationResult   `json:"result"`
@@ -60,6 +64,15 @@ func (u *UploadOperation) Validate() bool {
 	return len(u.Errors) == 0
 }
 
+// secretFields returns pointers to the secrets in this operation's
+// copy of its storage service.
+func (u *UploadOperation) secretFields() []*string {
+	if u.StorageService == nil {
+		return nil
+	}
+	return u.StorageService.secretFields()
+}
+
 func (u *UploadOperation) CalculatePayloadSize() error {
 	u.PayloadSize = 0
 	for _, fileOrDir := range u.SourceFiles {
@@ -86,47 +99,103 @@ func (u *UploadOperation) CalculatePayloadSize() error {
 	return nil
 }
 
+// DoUpload uploads all of this operation's source files to its storage
+// service. Transfers that fail with retryable errors are retried according
+// to the storage service's RetryPolicy. Each retry uploads only the files
+// that failed on the previous attempt, and each attempt is recorded in
+// u.Result.History.
 func (u *UploadOperation) DoUpload(messageChannel chan *EventMessage) bool {
-	ok := false
-	switch u.StorageService.Protocol {
-	case constants.ProtocolS3:
-		ok = u.sendToS3(messageChannel)
-	case constants.ProtocolSFTP:
-		ok = u.sendToSFTP(messageChannel)
-	default:
+	return u.DoUploadContext(context.Background(), messageChannel)
+}
+
+// DoUploadContext is like DoUpload, but it stops the transfer in
+// progress, and makes no more attempts, if ctx is cancelled.
+func (u *UploadOperation) DoUploadContext(ctx context.Context, messageChannel chan *EventMessage) bool {
+	if !util.StringListContains([]string{constants.ProtocolFile, constants.ProtocolS3, constants.ProtocolSFTP, constants.ProtocolWebDAV}, u.StorageService.Protocol) {
 		u.Errors["Protocol"] = fmt.Sprintf("Unsupported upload protocol: %s", u.StorageService.Protocol)
+		Dart.Log.Errorf("Protocol: %s", u.Errors["Protocol"])
+		return false
 	}
-	if len(u.Errors) > 0 {
-		Dart.Log.Error("One or more errors occurred while uploading to %s service %s at %s", u.StorageService.Protocol, u.StorageService.Name, u.StorageService.HostAndPort())
-	}
-	for key, value := range u.Errors {
-		Dart.Log.Errorf("%s: %s", key, value)
+	policy := u.StorageService.GetRetryPolicy()
+	pending := u.SourceFiles
+	for attempt := 1; ; attempt++ {
+		started := time.Now()
+		u.Errors = make(map[string]string)
+		var failed map[string]error
+		switch u.StorageService.Protocol {
+		case constants.ProtocolS3:
+			failed = u.sendToS3(ctx, messageChannel, pending)
+		case constants.ProtocolSFTP:
+			failed = u.sendToSFTP(ctx, messageChannel, pending)
+		case constants.ProtocolWebDAV:
+			failed = u.sendToWebDAV(ctx, messageChannel, pending)
+		default:
+			failed = u.sendToFile(ctx, messageChannel, pending)
+		}
+		retryable := len(failed) > 0 && ctx.Err() == nil
+		for _, err := range failed {
+			if !policy.IsRetryable(err) {
+				retryable = false
+			}
+		}
+		u.Result.RecordAttempt(started, u.Errors, retryable)
+		if len(failed) == 0 {
+			return true
+		}
+		for file, err := range failed {
+			if errors.Is(err, constants.ErrUploadVerificationFailed) {
+				u.Result.Warning = fmt.Sprintf("Remote copy of %s did not match the local copy, so the local copy was not deleted.", file)
+			}
+		}
+		Dart.Log.Errorf("One or more errors occurred while uploading to %s service %s at %s", u.StorageService.Protocol, u.StorageService.Name, u.StorageService.HostAndPort())
+		for key, value := range u.Errors {
+			Dart.Log.Errorf("%s: %s", key, value)
+		}
+		if !retryable || attempt >= policy.MaxAttempts {
+			return false
+		}
+		delay := policy.Delay(attempt)
+		Dart.Log.Infof("Retrying upload of %d item(s) to %s in %s (attempt %d of %d)", len(failed), u.StorageService.Name, delay, attempt+1, policy.MaxAttempts)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return false
+		}
+		pending = make([]string, 0, len(failed))
+		for _, file := range u.SourceFiles {
+			if _, ok := failed[file]; ok {
+				pending = append(pending, file)
+			}
+		}
+		u.Result.Attempt += 1
 	}
-	return ok
 }
 
-func (u *UploadOperation) sendToS3(messageChannel chan *EventMessage) bool {
+// sendToS3 uploads files to an S3 service. It returns a map of
+// files that failed to upload and the errors that caused them to fail.
+func (u *UploadOperation) sendToS3(ctx context.Context, messageChannel chan *EventMessage, files []string) map[string]error {
+	failed := make(map[string]error)
+
 	// Set up an S3 client. This may fail under certain conditions.
 	s3Client, err := NewS3Client(u.StorageService, u.useSSL(), messageChannel)
 	if err != nil {
-		u.Errors[u.StorageService.Name] = fmt.Sprintf("Error initializing SFTP client for %s : %s", u.StorageService.Name, err.Error())
-		return false
+		u.Errors[u.StorageService.Name] = fmt.Sprintf("Error initializing S3 client for %s : %s", u.StorageService.Name, err.Error())
+		for _, file := range files {
+			failed[file] = err
+		}
+		return failed
 	}
+	s3Client.SetBagTags(u.BagTags)
 
-	// Okay, now we're set up to start uploading.
-	// The allSucceeded flag will let us know later if there
-	// were any errors.
-	allSucceeded := true
-
-	for _, fileOrDirectoryPath := range u.SourceFiles {
+	for _, fileOrDirectoryPath := range files {
 		// Now, do the upload. Note that we may be uploading
 		// a single file or an entire directory tree.
 		dest := filepath.Join(u.StorageService.Bucket, filepath.Base(fileOrDirectoryPath))
-		err = s3Client.Upload(fileOrDirectoryPath, filepath.ToSlash(dest))
+		err = s3Client.UploadContext(ctx, fileOrDirectoryPath, filepath.ToSlash(dest))
 		if err != nil {
 			key := fmt.Sprintf("%s - %s", u.StorageService.Name, fileOrDirectoryPath)
 			u.Errors[key] = fmt.Sprintf("Error copying %s to S3: %s", fileOrDirectoryPath, err.Error())
-			allSucceeded = false
+			failed[fileOrDirectoryPath] = err
 		} else {
 			Dart.Log.Infof("Finished S3 upload of file/directory %s to %s", fileOrDirectoryPath, u.StorageService.Name)
 		}
@@ -142,17 +211,21 @@ func (u *UploadOperation) sendToS3(messageChannel chan *EventMessage) bool {
 			u.Result.RemoteURL = url
 			u.Result.EtagMap[url] = etag
 		}
+		u.recordVerifiedChecksums(s3Client.VerifiedChecksums())
 		u.Result.PayloadSize = s3Client.PayloadSize()
 		u.Result.BytesUploaded = s3Client.BytesUploaded()
 		u.Result.FilesUploaded = s3Client.FilesUploaded()
 	}
-	return allSucceeded
+	return failed
 }
 
-// upload an item to SFTP server. If messageChannel is not nil,
-// the uploader will send progress updates through it. Otherwise,
-// no progress updates.
-func (u *UploadOperation) sendToSFTP(messageChannel chan *EventMessage) bool {
+// sendToSFTP uploads files to an SFTP server. If messageChannel is not
+// nil, the uploader will send progress updates through it. Otherwise,
+// no progress updates. This returns a map of files that failed to upload
+// and the errors that caused them to fail.
+func (u *UploadOperation) sendToSFTP(ctx context.Context, messageChannel chan *EventMessage, files []string) map[string]error {
+	failed := make(map[string]error)
+
 	// Set up StreamProgress so the uploader can send status
 	// info back to the progress bar. We only do this when
 	// messageChannel is not nil, which means we're running
@@ -171,36 +244,133 @@ func (u *UploadOperation) sendToSFTP(messageChannel chan *EventMessage) bool {
 			sftpClient.Close()
 		}
 		u.Errors[u.StorageService.Name] = fmt.Sprintf("Error initializing SFTP client for %s : %s", u.StorageService.Name, err.Error())
-		return false
+		for _, file := range files {
+			failed[file] = err
+		}
+		return failed
 	}
 
 	// If we got this far, we have a connection.
 	// Make sure to clean it up.
 	defer sftpClient.Close()
 
-	// Okay, now we're set up to start uploading.
-	// The allSucceeded flag will let us know later if there
-	// were any errors.
-	allSucceeded := true
-
-	for _, fileOrDirectoryPath := range u.SourceFiles {
+	for _, fileOrDirectoryPath := range files {
 		// Now, do the upload. Note that we may be uploading
 		// a single file or an entire directory tree.
 		dest := filepath.Join(u.StorageService.Bucket, filepath.Base(fileOrDirectoryPath))
-		err = sftpClient.Upload(fileOrDirectoryPath, filepath.ToSlash(dest))
+		err = sftpClient.UploadContext(ctx, fileOrDirectoryPath, filepath.ToSlash(dest))
 		if err != nil {
 			key := fmt.Sprintf("%s - %s", u.StorageService.Name, fileOrDirectoryPath)
 			u.Errors[key] = fmt.Sprintf("Error copying %s to S3: %s", fileOrDirectoryPath, err.Error())
-			allSucceeded = false
+			failed[fileOrDirectoryPath] = err
 		} else {
 			Dart.Log.Infof("Finished SFTP upload of file/directory %s to %s", fileOrDirectoryPath, u.StorageService.Name)
 		}
 		// Record result data.
+		u.recordVerifiedChecksums(sftpClient.VerifiedChecksums())
 		u.Result.PayloadSize = sftpClient.PayloadSize()
 		u.Result.BytesUploaded = sftpClient.BytesUploaded()
 		u.Result.FilesUploaded = sftpClient.FilesUploaded()
 	}
-	return allSucceeded
+	return failed
+}
+
+// sendToWebDAV uploads files to a WebDAV server. If messageChannel is
+// not nil, the uploader will send progress updates through it. This
+// returns a map of files that failed to upload and the errors that
+// caused them to fail.
+func (u *UploadOperation) sendToWebDAV(ctx context.Context, messageChannel chan *EventMessage, files []string) map[string]error {
+	failed := make(map[string]error)
+
+	var progress *StreamProgress
+	if messageChannel != nil {
+		progress = NewStreamProgress(u.PayloadSize, messageChannel)
+		messageChannel <- StartEvent(constants.StageUpload, fmt.Sprintf("Uploading to %s", u.StorageService.Name))
+	}
+
+	webdavClient, err := NewWebDAVClient(u.StorageService, u.useSSL(), progress)
+	if err != nil {
+		u.Errors[u.StorageService.Name] = fmt.Sprintf("Error initializing WebDAV client for %s : %s", u.StorageService.Name, err.Error())
+		for _, file := range files {
+			failed[file] = err
+		}
+		return failed
+	}
+
+	for _, fileOrDirectoryPath := range files {
+		dest := filepath.Join(u.StorageService.Bucket, filepath.Base(fileOrDirectoryPath))
+		err = webdavClient.UploadContext(ctx, fileOrDirectoryPath, filepath.ToSlash(dest))
+		if err != nil {
+			key := fmt.Sprintf("%s - %s", u.StorageService.Name, fileOrDirectoryPath)
+			u.Errors[key] = fmt.Sprintf("Error copying %s to WebDAV: %s", fileOrDirectoryPath, err.Error())
+			failed[fileOrDirectoryPath] = err
+		} else {
+			Dart.Log.Infof("Finished WebDAV upload of file/directory %s to %s", fileOrDirectoryPath, u.StorageService.Name)
+		}
+		if urls := webdavClient.UploadedURLs(); len(urls) == 1 {
+			u.Result.RemoteURL = urls[0]
+		}
+		u.recordVerifiedChecksums(webdavClient.VerifiedChecksums())
+		u.Result.PayloadSize = webdavClient.PayloadSize()
+		u.Result.BytesUploaded = webdavClient.BytesUploaded()
+		u.Result.FilesUploaded = webdavClient.FilesUploaded()
+	}
+	return failed
+}
+
+// sendToFile copies files to a local or mounted directory. If
+// messageChannel is not nil, the client will send progress updates
+// through it. This returns a map of files that failed to copy and the
+// errors that caused them to fail.
+func (u *UploadOperation) sendToFile(ctx context.Context, messageChannel chan *EventMessage, files []string) map[string]error {
+	failed := make(map[string]error)
+
+	var progress *StreamProgress
+	if messageChannel != nil {
+		progress = NewStreamProgress(u.PayloadSize, messageChannel)
+		messageChannel <- StartEvent(constants.StageUpload, fmt.Sprintf("Copying to %s", u.StorageService.Name))
+	}
+
+	fileClient, err := NewFileClient(u.StorageService, progress)
+	if err != nil {
+		u.Errors[u.StorageService.Name] = fmt.Sprintf("Error initializing file client for %s : %s", u.StorageService.Name, err.Error())
+		for _, file := range files {
+			failed[file] = err
+		}
+		return failed
+	}
+	fileClient.SetBagTags(u.BagTags)
+
+	for _, fileOrDirectoryPath := range files {
+		destination, err := fileClient.UploadContext(ctx, fileOrDirectoryPath)
+		if err != nil {
+			key := fmt.Sprintf("%s - %s", u.StorageService.Name, fileOrDirectoryPath)
+			u.Errors[key] = fmt.Sprintf("Error copying %s to %s: %s", fileOrDirectoryPath, u.StorageService.Bucket, err.Error())
+			failed[fileOrDirectoryPath] = err
+		} else {
+			u.Result.RemoteURL = "file://" + filepath.ToSlash(destination)
+			Dart.Log.Infof("Finished copy of file/directory %s to %s", fileOrDirectoryPath, destination)
+		}
+		u.recordVerifiedChecksums(fileClient.VerifiedChecksums())
+		u.Result.PayloadSize = fileClient.PayloadSize()
+		u.Result.BytesUploaded = fileClient.BytesUploaded()
+		u.Result.FilesUploaded = fileClient.FilesUploaded()
+	}
+	return failed
+}
+
+// recordVerifiedChecksums adds the SHA-256 digests of verified
+// uploads to the operation result.
+func (u *UploadOperation) recordVerifiedChecksums(checksums map[string]string) {
+	if len(checksums) == 0 {
+		return
+	}
+	if u.Result.VerifiedChecksums == nil {
+		u.Result.VerifiedChecksums = make(map[string]string)
+	}
+	for remotePath, digest := range checksums {
+		u.Result.VerifiedChecksums[remotePath] = digest
+	}
 }
 
 // useSSL returns a boolean describing whether we should use secure
@@ -1,9 +1,11 @@
 package core_test
 
 import (
+	"net"
 	"path/filepath"
 	"testing"
 
+	"github.com/APTrust/dart-runner/constants"
 	"github.com/APTrust/dart-runner/core"
 	"github.com/APTrust/dart-runner/util"
 	"github.com/google/uuid"
@@ -72,3 +74,119 @@ func TestUploadOperation(t *testing.T) {
 	assert.True(t, op.PayloadSize > 300000)
 
 }
+
+func TestUploadOperationRetries(t *testing.T) {
+	// Grab a free port, then close it, so uploads to that port
+	// fail with "connection refused." That's not retryable by
+	// default, so the policy below lists it explicitly.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	port := listener.Addr().(*net.TCPAddr).Port
+	require.Nil(t, listener.Close())
+
+	files := []string{
+		util.PathToUnitTestBag("test.edu.btr_good_sha256.tar"),
+		util.PathToUnitTestBag("test.edu.btr_good_sha512.tar"),
+	}
+	for _, protocol := range []string{constants.ProtocolS3, constants.ProtocolSFTP} {
+		ss := &core.StorageService{
+			ID:       uuid.NewString(),
+			Name:     "Unreachable " + protocol,
+			Host:     "127.0.0.1",
+			Port:     port,
+			Bucket:   "uploads",
+			Login:    "user",
+			Password: "secret",
+			Protocol: protocol,
+			RetryPolicy: &core.RetryPolicy{
+				MaxAttempts:     3,
+				BaseDelayMs:     1,
+				RetryableErrors: []string{"connection refused"},
+			},
+		}
+		op := core.NewUploadOperation(ss, files)
+		op.Result.Start()
+		assert.False(t, op.DoUpload(nil), protocol)
+		assert.NotEmpty(t, op.Errors, protocol)
+		assert.Equal(t, 3, op.Result.Attempt, protocol)
+		require.Equal(t, 3, len(op.Result.History), protocol)
+
+		for i, record := range op.Result.History {
+			assert.Equal(t, i+1, record.Attempt, protocol)
+			assert.True(t, record.Retryable, protocol)
+			assert.NotEmpty(t, record.Errors, protocol)
+			assert.False(t, record.Completed.Before(record.Started), protocol)
+		}
+
+		// Errors that don't match the policy are not retried.
+		ss.RetryPolicy.RetryableErrors = []string{"service unavailable"}
+		op = core.NewUploadOperation(ss, files)
+		op.Result.Start()
+		assert.False(t, op.DoUpload(nil), protocol)
+		assert.Equal(t, 1, op.Result.Attempt, protocol)
+		require.Equal(t, 1, len(op.Result.History), protocol)
+		assert.False(t, op.Result.History[0].Retryable, protocol)
+
+		// With the default policy, we try once.
+		ss.RetryPolicy = nil
+		op = core.NewUploadOperation(ss, files)
+		op.Result.Start()
+		assert.False(t, op.DoUpload(nil), protocol)
+		assert.Equal(t, 1, op.Result.Attempt, protocol)
+	}
+}
+
+func TestUploadOperationFile(t *testing.T) {
+	ss := core.NewStorageService()
+	ss.Name = "Local deposit"
+	ss.Protocol = constants.ProtocolFile
+	ss.Bucket = t.TempDir()
+	ss.PathTemplate = "incoming/{{filename}}"
+
+	files := []string{
+		util.PathToUnitTestBag("test.edu.btr_good_sha256.tar"),
+		util.PathToUnitTestBag("test.edu.btr_good_sha512.tar"),
+	}
+	op := core.NewUploadOperation(ss, files)
+	require.True(t, op.Validate())
+	require.NoError(t, op.CalculatePayloadSize())
+
+	messageChannel := make(chan *core.EventMessage, 1000)
+	op.Result.Start()
+	require.True(t, op.DoUpload(messageChannel), op.Errors)
+	assert.Empty(t, op.Errors)
+	assert.Equal(t, 2, len(op.Result.VerifiedChecksums))
+	for _, file := range files {
+		destination := filepath.Join(ss.Bucket, "incoming", filepath.Base(file))
+		assert.FileExists(t, destination)
+		assert.Equal(t, sha256Hex(t, file), op.Result.VerifiedChecksums[destination])
+	}
+}
+
+func TestUploadOperationWebDAV(t *testing.T) {
+	server := newWebDAVTestServer(t)
+	ss := server.StorageService(t)
+	ss.VerifyUploads = true
+	ss.RetryPolicy = &core.RetryPolicy{
+		MaxAttempts: 3,
+		BaseDelayMs: 1,
+	}
+
+	// The first PUT fails with 503, which should be retried.
+	server.failNextPuts = 1
+	files := []string{
+		util.PathToUnitTestBag("test.edu.btr_good_sha256.tar"),
+		util.PathToUnitTestBag("test.edu.btr_good_sha512.tar"),
+	}
+	op := core.NewUploadOperation(ss, files)
+	require.True(t, op.Validate(), op.Errors)
+	op.Result.Start()
+	require.True(t, op.DoUpload(nil), op.Errors)
+	assert.Equal(t, 2, op.Result.Attempt)
+	require.Equal(t, 2, len(op.Result.History))
+	assert.True(t, op.Result.History[0].Retryable)
+	assert.Equal(t, 2, len(op.Result.VerifiedChecksums))
+	for _, file := range files {
+		assert.FileExists(t, filepath.Join(server.Root, "deposits", "incoming", filepath.Base(file)))
+	}
+}
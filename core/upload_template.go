@@ -0,0 +1,137 @@
+package core
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/util"
+)
+
+// uploadTemplateVar matches placeholders such as {{sha256}} or
+// {{bag-info.txt/Source-Organization}} in upload templates.
+var uploadTemplateVar = regexp.MustCompile(`\{\{\s*([^{}]+?)\s*\}\}`)
+
+// ExpandUploadTemplate fills in placeholders in template, which describes
+// S3 metadata, tags or a remote path for the upload of sourceFile.
+// Placeholders go in double curly braces:
+//
+//   - {{sha256}}, {{sha512}}, {{md5}} and {{sha1}} are digests of sourceFile.
+//   - {{filename}} is the base name of sourceFile, and {{bagname}} is the
+//     same without the serialization extension (.tar, etc).
+//   - {{date}}, {{year}}, {{month}} and {{day}} describe the current date.
+//   - Anything else is the name of a bag tag, either fully qualified, as in
+//     {{bag-info.txt/Source-Organization}}, or as a plain tag name, as in
+//     {{Source-Organization}}. Param bagTags maps fully qualified tag names
+//     to values.
+//
+// Placeholders that match nothing are replaced with an empty string.
+func ExpandUploadTemplate(template, sourceFile string, bagTags map[string]string) (string, error) {
+	return newUploadTemplateResolver(sourceFile, bagTags).expand(template)
+}
+
+// uploadTemplateResolver fills in placeholders in upload templates.
+// It calculates file digests only if a placeholder needs one, and then
+// only once.
+type uploadTemplateResolver struct {
+	sourceFile string
+	bagTags    map[string]string
+	digests    map[string]string
+	now        time.Time
+}
+
+func newUploadTemplateResolver(sourceFile string, bagTags map[string]string) *uploadTemplateResolver {
+	return &uploadTemplateResolver{
+		sourceFile: sourceFile,
+		bagTags:    bagTags,
+		now:        time.Now(),
+	}
+}
+
+func (r *uploadTemplateResolver) expand(template string) (string, error) {
+	var expandErr error
+	result := uploadTemplateVar.ReplaceAllStringFunc(template, func(match string) string {
+		name := uploadTemplateVar.FindStringSubmatch(match)[1]
+		value, err := r.lookup(name)
+		if err != nil && expandErr == nil {
+			expandErr = err
+		}
+		return value
+	})
+	return result, expandErr
+}
+
+func (r *uploadTemplateResolver) lookup(name string) (string, error) {
+	lowerName := strings.ToLower(name)
+	if util.StringListContains(constants.PreferredAlgsInOrder, lowerName) {
+		if r.digests == nil {
+			digests, err := digestsOfFile(r.sourceFile, constants.PreferredAlgsInOrder)
+			if err != nil {
+				return "", err
+			}
+			r.digests = digests
+		}
+		return r.digests[lowerName], nil
+	}
+	switch lowerName {
+	case "filename":
+		return filepath.Base(r.sourceFile), nil
+	case "bagname":
+		return util.CleanBagName(filepath.Base(r.sourceFile)), nil
+	case "date":
+		return r.now.Format("2006-01-02"), nil
+	case "year":
+		return r.now.Format("2006"), nil
+	case "month":
+		return r.now.Format("01"), nil
+	case "day":
+		return r.now.Format("02"), nil
+	}
+	if value, ok := r.bagTags[name]; ok {
+		return value, nil
+	}
+	for _, fullName := range slices.Sorted(maps.Keys(r.bagTags)) {
+		value := r.bagTags[fullName]
+		if strings.Contains(name, "/") {
+			if strings.EqualFold(fullName, name) {
+				return value, nil
+			}
+		} else if _, tagName, found := strings.Cut(fullName, "/"); found && strings.EqualFold(tagName, name) {
+			return value, nil
+		}
+	}
+	Dart.Log.Warningf("Upload template placeholder {{%s}} does not match any bag tag; using an empty value", name)
+	return "", nil
+}
+
+// digestsOfFile returns hex-encoded digests of the file at path
+// for each of the specified algorithms.
+func digestsOfFile(path string, algs []string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("can't open %s to calculate checksums: %w", path, err)
+	}
+	defer file.Close()
+	hashes := util.GetHashes(algs)
+	writers := make([]io.Writer, 0, len(hashes))
+	for _, hash := range hashes {
+		writers = append(writers, hash)
+	}
+	_, err = io.Copy(io.MultiWriter(writers...), file)
+	if err != nil {
+		return nil, fmt.Errorf("can't read %s to calculate checksums: %w", path, err)
+	}
+	digests := make(map[string]string)
+	for alg, hash := range hashes {
+		digests[alg] = hex.EncodeToString(hash.Sum(nil))
+	}
+	return digests, nil
+}
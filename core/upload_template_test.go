@@ -0,0 +1,49 @@
+package core_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/APTrust/dart-runner/core"
+	"github.com/APTrust/dart-runner/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpandUploadTemplate(t *testing.T) {
+	bagFile := util.PathToUnitTestBag("example.edu.tagsample_good.tar")
+	bagTags := map[string]string{
+		"bag-info.txt/Source-Organization": "Example University",
+		"aptrust-info.txt/Title":           "Papers of Jane Doe",
+	}
+
+	value, err := core.ExpandUploadTemplate("{{Source-Organization}}/{{bagname}}/{{filename}}", bagFile, bagTags)
+	require.NoError(t, err)
+	assert.Equal(t, "Example University/example.edu.tagsample_good/example.edu.tagsample_good.tar", value)
+
+	value, err = core.ExpandUploadTemplate("{{ aptrust-info.txt/Title }}", bagFile, bagTags)
+	require.NoError(t, err)
+	assert.Equal(t, "Papers of Jane Doe", value)
+
+	now := time.Now()
+	value, err = core.ExpandUploadTemplate("{{year}}/{{month}}/{{day}}", bagFile, bagTags)
+	require.NoError(t, err)
+	assert.Equal(t, now.Format("2006/01/02"), value)
+
+	value, err = core.ExpandUploadTemplate("{{date}}", bagFile, bagTags)
+	require.NoError(t, err)
+	assert.Equal(t, now.Format("2006-01-02"), value)
+
+	value, err = core.ExpandUploadTemplate("{{sha256}}", bagFile, bagTags)
+	require.NoError(t, err)
+	assert.Len(t, value, 64)
+
+	// Unknown placeholders resolve to empty strings.
+	value, err = core.ExpandUploadTemplate("x{{No-Such-Tag}}y", bagFile, bagTags)
+	require.NoError(t, err)
+	assert.Equal(t, "xy", value)
+
+	// Digests of a missing file are an error.
+	_, err = core.ExpandUploadTemplate("{{md5}}", "file-does-not-exist", bagTags)
+	assert.Error(t, err)
+}
@@ -0,0 +1,209 @@
+package core
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/minio/minio-go/v7"
+)
+
+// verifyUpload checks that the object at s3Key matches the local file
+// at localPath. expectedChecksum is the x-amz-checksum-sha256 value we
+// sent with the upload: the file's base64-encoded SHA-256 digest for a
+// single-part upload, or the composite checksum of its parts for a
+// multipart upload. If S3 reports a checksum for the object, we compare
+// it to expectedChecksum. Only if S3 doesn't report one do we read the
+// object back and hash it. This returns the remote object's SHA-256
+// digest in hex format, or an error wrapping
+// constants.ErrUploadVerificationFailed if the remote copy doesn't match.
+func (c *S3Client) verifyUpload(ctx context.Context, localPath, s3Key, expectedChecksum string) (string, error) {
+	remoteURL := c.storageService.URL(s3Key)
+	localSize, localDigest, err := sha256OfFile(localPath)
+	if err != nil {
+		return "", err
+	}
+	sse, err := c.sseCustomerKey()
+	if err != nil {
+		return "", err
+	}
+	objInfo, err := c.minioClient.StatObject(ctx, c.storageService.Bucket, s3Key, minio.StatObjectOptions{Checksum: true, ServerSideEncryption: sse})
+	if err != nil {
+		return "", fmt.Errorf("can't stat %s to verify upload: %w", remoteURL, err)
+	}
+	if objInfo.Size != localSize {
+		return "", uploadVerificationError(localPath, remoteURL, fmt.Sprintf("local size is %d bytes, remote size is %d bytes", localSize, objInfo.Size))
+	}
+
+	remoteDigest := ""
+	isFullObjectChecksum := objInfo.ChecksumSHA256 != "" && !strings.Contains(objInfo.ChecksumSHA256, "-") && objInfo.ChecksumMode != "COMPOSITE"
+	if expectedChecksum != "" && objInfo.ChecksumSHA256 != "" {
+		if !s3ChecksumsMatch(expectedChecksum, objInfo.ChecksumSHA256) {
+			return "", uploadVerificationError(localPath, remoteURL, fmt.Sprintf("local sha256 checksum is %s, remote sha256 checksum is %s", expectedChecksum, objInfo.ChecksumSHA256))
+		}
+		remoteDigest = localDigest
+	} else if isFullObjectChecksum {
+		decoded, err := base64.StdEncoding.DecodeString(objInfo.ChecksumSHA256)
+		if err == nil {
+			remoteDigest = hex.EncodeToString(decoded)
+		}
+	}
+	if remoteDigest == "" {
+		Dart.Log.Infof("Reading back %s to verify upload", remoteURL)
+		obj, err := c.minioClient.GetObject(ctx, c.storageService.Bucket, s3Key, minio.GetObjectOptions{ServerSideEncryption: sse})
+		if err != nil {
+			return "", fmt.Errorf("can't read %s to verify upload: %w", remoteURL, err)
+		}
+		defer obj.Close()
+		_, remoteDigest, err = sha256OfReader(obj)
+		if err != nil {
+			return "", fmt.Errorf("can't read %s to verify upload: %w", remoteURL, err)
+		}
+	}
+	if remoteDigest != localDigest {
+		return "", uploadVerificationError(localPath, remoteURL, fmt.Sprintf("local sha256 is %s, remote sha256 is %s", localDigest, remoteDigest))
+	}
+	Dart.Log.Infof("Verified upload of %s to %s: sha256 %s", localPath, remoteURL, remoteDigest)
+	return remoteDigest, nil
+}
+
+// verifyUpload checks that the file at remotePath on the SFTP server
+// has the same size and SHA-256 digest as the local file at localPath.
+// It returns the remote file's digest in hex format, or an error wrapping
+// constants.ErrUploadVerificationFailed if the remote copy doesn't match.
+func (sc *SFTPClient) verifyUpload(localPath, remotePath string) (string, error) {
+	localSize, localDigest, err := sha256OfFile(localPath)
+	if err != nil {
+		return "", err
+	}
+	remoteInfo, err := sc.client.Stat(remotePath)
+	if err != nil {
+		return "", fmt.Errorf("can't stat remote file %s to verify upload: %w", remotePath, err)
+	}
+	if remoteInfo.Size() != localSize {
+		return "", uploadVerificationError(localPath, remotePath, fmt.Sprintf("local size is %d bytes, remote size is %d bytes", localSize, remoteInfo.Size()))
+	}
+	remoteFile, err := sc.client.Open(remotePath)
+	if err != nil {
+		return "", fmt.Errorf("can't open remote file %s to verify upload: %w", remotePath, err)
+	}
+	defer remoteFile.Close()
+	_, remoteDigest, err := sha256OfReader(remoteFile)
+	if err != nil {
+		return "", fmt.Errorf("can't read remote file %s to verify upload: %w", remotePath, err)
+	}
+	if remoteDigest != localDigest {
+		return "", uploadVerificationError(localPath, remotePath, fmt.Sprintf("local sha256 is %s, remote sha256 is %s", localDigest, remoteDigest))
+	}
+	Dart.Log.Infof("Verified upload of %s to %s: sha256 %s", localPath, remotePath, remoteDigest)
+	return remoteDigest, nil
+}
+
+// verifyUpload reads back the file at remotePath on the WebDAV server
+// and checks that it has the same size and SHA-256 digest as the local
+// file at localPath. It returns the remote file's digest in hex format,
+// or an error wrapping constants.ErrUploadVerificationFailed if the
+// remote copy doesn't match.
+func (wc *WebDAVClient) verifyUpload(localPath, remotePath string) (string, error) {
+	remoteURL := wc.URL(remotePath)
+	localSize, localDigest, err := sha256OfFile(localPath)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest(http.MethodGet, remoteURL, nil)
+	if err != nil {
+		return "", err
+	}
+	var remoteSize int64
+	var remoteDigest string
+	err = wc.read(req, func(body io.Reader) error {
+		remoteSize, remoteDigest, err = sha256OfReader(body)
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("can't read %s to verify upload: %w", remoteURL, err)
+	}
+	if remoteSize != localSize {
+		return "", uploadVerificationError(localPath, remoteURL, fmt.Sprintf("local size is %d bytes, remote size is %d bytes", localSize, remoteSize))
+	}
+	if remoteDigest != localDigest {
+		return "", uploadVerificationError(localPath, remoteURL, fmt.Sprintf("local sha256 is %s, remote sha256 is %s", localDigest, remoteDigest))
+	}
+	Dart.Log.Infof("Verified upload of %s to %s: sha256 %s", localPath, remoteURL, remoteDigest)
+	return remoteDigest, nil
+}
+
+func uploadVerificationError(localPath, remotePath, detail string) error {
+	return fmt.Errorf("%w: %s does not match %s: %s", constants.ErrUploadVerificationFailed, remotePath, localPath, detail)
+}
+
+// sha256OfFile returns the size and hex-encoded SHA-256 digest
+// of the file at path.
+func sha256OfFile(path string) (int64, string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, "", fmt.Errorf("can't open %s to calculate checksum: %w", path, err)
+	}
+	defer file.Close()
+	return sha256OfReader(file)
+}
+
+func sha256OfReader(reader io.Reader) (int64, string, error) {
+	hash := sha256.New()
+	size, err := io.Copy(hash, reader)
+	if err != nil {
+		return size, "", err
+	}
+	return size, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// base64SHA256 returns the base64-encoded SHA-256 digest of reader,
+// which is the form S3 uses in x-amz-checksum-sha256 headers.
+func base64SHA256(reader io.Reader) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, reader); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(hash.Sum(nil)), nil
+}
+
+// hexToBase64 converts a hex-encoded digest to base64.
+func hexToBase64(hexDigest string) (string, error) {
+	digest, err := hex.DecodeString(hexDigest)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(digest), nil
+}
+
+// compositeSHA256 returns the checksum S3 reports for a multipart upload
+// whose parts have the specified base64-encoded SHA-256 checksums: the
+// base64-encoded SHA-256 digest of the parts' digests, followed by a dash
+// and the number of parts.
+func compositeSHA256(partChecksums []string) (string, error) {
+	hash := sha256.New()
+	for _, checksum := range partChecksums {
+		digest, err := base64.StdEncoding.DecodeString(checksum)
+		if err != nil {
+			return "", err
+		}
+		hash.Write(digest)
+	}
+	return fmt.Sprintf("%s-%d", base64.StdEncoding.EncodeToString(hash.Sum(nil)), len(partChecksums)), nil
+}
+
+// s3ChecksumsMatch returns true if the checksum S3 reports for an object
+// matches the one we expect. Some S3 services leave the part count off
+// composite checksums, so we compare part counts only if both have them.
+func s3ChecksumsMatch(expected, actual string) bool {
+	expectedDigest, expectedParts, _ := strings.Cut(expected, "-")
+	actualDigest, actualParts, _ := strings.Cut(actual, "-")
+	return expectedDigest == actualDigest && (expectedParts == "" || actualParts == "" || expectedParts == actualParts)
+}
@@ -1,23 +1,40 @@
 package core
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"fmt"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/util"
 	"github.com/google/uuid"
 )
 
 // ValidationJob is a job that only validates bags.
 // This type of job may validate multiple bags, but
 // it includes no package or upload operations.
+//
+// If BagItProfileID is constants.BagItProfileAuto, the job validates
+// each bag against the profile named in the bag's
+// bag-info.txt/BagIt-Profile-Identifier tag. It looks for that profile
+// in the local database and among DART's built-in profiles, and, if
+// FetchProfiles is true, at the URL in the identifier. If the bag
+// declares no identifier, or the profile can't be found, the job
+// falls back to FallbackProfileID and records a warning.
 type ValidationJob struct {
-	ID              string
-	BagItProfileID  string
-	PathsToValidate []string
-	ValidationOps   []*ValidationOperation
-	Name            string
-	Errors          map[string]string
+	ID                string
+	BagItProfileID    string
+	FallbackProfileID string
+	FetchProfiles     bool
+	PathsToValidate   []string
+	ValidationOps     []*ValidationOperation
+	Name              string
+	Errors            map[string]string
+	fetchedProfiles   map[string]*BagItProfile
 }
 
 func NewValidationJob() *ValidationJob {
@@ -67,6 +84,19 @@ func (job *ValidationJob) ToForm() *Form {
 
 	profileField := form.AddField("BagItProfileID", "BagIt Profile", job.BagItProfileID, true)
 	profileField.Choices = ObjChoiceList(constants.TypeBagItProfile, []string{job.BagItProfileID})
+	profileField.Choices = append(profileField.Choices, Choice{
+		Label:    "Auto-detect from BagIt-Profile-Identifier",
+		Value:    constants.BagItProfileAuto,
+		Selected: job.BagItProfileID == constants.BagItProfileAuto,
+	})
+
+	fallbackField := form.AddField("FallbackProfileID", "Fallback Profile", job.FallbackProfileID, false)
+	fallbackField.Choices = ObjChoiceList(constants.TypeBagItProfile, []string{job.FallbackProfileID})
+	fallbackField.Help = "When auto-detecting profiles, validate against this profile if a bag does not declare a BagIt-Profile-Identifier or DART cannot find the profile it declares."
+
+	fetchField := form.AddField("FetchProfiles", "Fetch Unknown Profiles", strconv.FormatBool(job.FetchProfiles), false)
+	fetchField.Choices = YesNoChoices(job.FetchProfiles)
+	fetchField.Help = "When auto-detecting profiles, try to download unknown profiles from the URL in the bag's BagIt-Profile-Identifier."
 
 	pathsField := form.AddMultiValueField("PathsToValidate", "Items to Validate", job.PathsToValidate, true)
 	pathsField.Values = job.PathsToValidate
@@ -85,9 +115,33 @@ func (job *ValidationJob) Validate() bool {
 	if strings.TrimSpace(job.BagItProfileID) == "" {
 		job.Errors["BagItProfileID"] = "Please choose a BagIt profile."
 	}
+	if job.FallbackProfileID != "" {
+		if msg := fallbackProfileError(job.FallbackProfileID); msg != "" {
+			job.Errors["FallbackProfileID"] = msg
+		}
+	}
 	return len(job.Errors) == 0
 }
 
+// fallbackProfileError returns a message describing what's wrong with
+// a fallback profile ID, or an empty string if the ID refers to a BagIt
+// profile in the database.
+func fallbackProfileError(id string) string {
+	if !util.LooksLikeUUID(id) {
+		return "Fallback profile ID must be a UUID."
+	}
+	result := ObjFind(id)
+	if result.Error == sql.ErrNoRows {
+		return "Fallback profile does not exist."
+	} else if result.Error != nil {
+		return fmt.Sprintf("Cannot load fallback profile: %s", result.Error.Error())
+	}
+	if result.ObjType != constants.TypeBagItProfile {
+		return fmt.Sprintf("Fallback profile ID refers to a %s, not a BagIt profile.", result.ObjType)
+	}
+	return ""
+}
+
 // GetErrors returns a map of errors describing why this
 // ValidationJob is not valid.
 func (job *ValidationJob) GetErrors() map[string]string {
@@ -105,35 +159,42 @@ func (job *ValidationJob) GetErrors() map[string]string {
 // validate, this will attempt to validate all bags. It's possible that
 // some bags will be valid and some will not. Check the results of each
 // ValidationOperation.Result if you get a non-zero exit code.
+//
+// In auto mode, the profile for each bag is chosen after scanning the
+// bag, so profile problems show up in that bag's ValidationOperation.Result.
 func (job *ValidationJob) Run(messageChannel chan *EventMessage) int {
+	return job.RunContext(context.Background(), messageChannel)
+}
+
+// RunContext is like Run, but it stops validating if ctx is cancelled,
+// in which case it returns constants.ExitCancelled.
+func (job *ValidationJob) RunContext(ctx context.Context, messageChannel chan *EventMessage) int {
 	job.ValidationOps = make([]*ValidationOperation, 0)
 	if !job.Validate() {
 		// job.Errors is set inside call to Validate()
 		return constants.ExitUsageErr
 	}
-	result := ObjFind(job.BagItProfileID)
-	if result.Error != nil {
-		job.Errors["BagItProfile"] = result.Error.Error()
-		return constants.ExitRuntimeErr
-	}
-	profile := result.BagItProfile()
-	if !profile.Validate() {
-		job.Errors["BagItProfile"] = "BagIt profile is not valid"
-		for key, value := range profile.Errors {
-			job.Errors[key] = value
-		}
-		return constants.ExitUsageErr
+	profile, exitCode := job.loadProfile()
+	if exitCode != constants.ExitOK {
+		return exitCode
 	}
-	exitCode := constants.ExitOK
 	status := constants.StatusSuccess
 	message := ""
 	for _, pathToValidate := range job.PathsToValidate {
-		if !job.runOne(pathToValidate, profile, messageChannel) {
+		if ctx.Err() != nil {
+			break
+		}
+		if !job.runOne(ctx, pathToValidate, profile, messageChannel) {
 			exitCode = constants.ExitRuntimeErr
 			status = constants.StatusFailed
 			message += fmt.Sprintf("%s failed validation", pathToValidate)
 		}
 	}
+	if ctx.Err() != nil {
+		exitCode = constants.ExitCancelled
+		status = constants.StatusCancelled
+		message = "Validation was cancelled."
+	}
 
 	// Tell the listener we finished.
 	if messageChannel != nil {
@@ -153,7 +214,31 @@ func (job *ValidationJob) Run(messageChannel chan *EventMessage) int {
 	return exitCode
 }
 
-func (job *ValidationJob) runOne(pathToBag string, profile *BagItProfile, messageChannel chan *EventMessage) bool {
+// loadProfile returns the BagIt profile this job validates against, or
+// nil in auto mode, where we choose a profile for each bag. If the
+// profile can't be loaded or is invalid, this records the problem in
+// job.Errors and returns a non-zero exit code.
+func (job *ValidationJob) loadProfile() (*BagItProfile, int) {
+	if job.BagItProfileID == constants.BagItProfileAuto {
+		return nil, constants.ExitOK
+	}
+	result := ObjFind(job.BagItProfileID)
+	if result.Error != nil {
+		job.Errors["BagItProfile"] = result.Error.Error()
+		return nil, constants.ExitRuntimeErr
+	}
+	profile := result.BagItProfile()
+	if !profile.Validate() {
+		job.Errors["BagItProfile"] = "BagIt profile is not valid"
+		for key, value := range profile.Errors {
+			job.Errors[key] = value
+		}
+		return nil, constants.ExitUsageErr
+	}
+	return profile, constants.ExitOK
+}
+
+func (job *ValidationJob) runOne(ctx context.Context, pathToBag string, profile *BagItProfile, messageChannel chan *EventMessage) bool {
 	op := NewValidationOperation(pathToBag)
 	job.ValidationOps = append(job.ValidationOps, op)
 	op.Result.Start()
@@ -178,10 +263,12 @@ func (job *ValidationJob) runOne(pathToBag string, profile *BagItProfile, messag
 	// Scan the bag first, to build up an idea of what's in it.
 	// This man return an error if the path is unreadable or if
 	// we're trying to read a corrupt tar file.
-	err = validator.ScanBag()
+	err = validator.ScanBagContext(ctx)
 	if err != nil {
 		errors := make(map[string]string)
-		if len(validator.Errors) > 0 {
+		if ctx.Err() != nil {
+			errors["Cancelled"] = fmt.Sprintf("Validation was cancelled: %s", err.Error())
+		} else if len(validator.Errors) > 0 {
 			errors = validator.Errors
 		} else {
 			errors["Validator.Scan"] = err.Error()
@@ -190,6 +277,23 @@ func (job *ValidationJob) runOne(pathToBag string, profile *BagItProfile, messag
 		return false
 	}
 
+	// In auto mode, we can choose a profile only after we've
+	// read the bag's tags.
+	autoSelected := profile == nil
+	if autoSelected {
+		var warning string
+		profile, warning, err = job.selectProfile(validator)
+		if err != nil {
+			op.Result.Finish(map[string]string{"BagItProfile": err.Error()})
+			return false
+		}
+		validator.Profile = profile
+		op.Result.Warning = warning
+		if warning != "" {
+			Dart.Log.Warningf("%s: %s", pathToBag, warning)
+		}
+	}
+
 	// Now that we know what's in the bag, validate it.
 	// If the contents are invalid, validator.Errors will
 	// contain specific info about what's wrong.
@@ -197,6 +301,103 @@ func (job *ValidationJob) runOne(pathToBag string, profile *BagItProfile, messag
 	op.Result.Finish(validator.Errors)
 	if ok {
 		op.Result.Info = "Bag is valid."
+		if autoSelected {
+			op.Result.Info = fmt.Sprintf("Bag is valid according to profile %s.", profile.Name)
+		}
 	}
 	return ok
 }
+
+// selectProfile returns the profile named in the BagIt-Profile-Identifier
+// tag of the bag that validator has scanned. If the bag doesn't declare a
+// profile, or we can't find the one it declares, this returns the job's
+// fallback profile along with a warning explaining why. It returns an
+// error if it has to fall back and there's no fallback profile.
+func (job *ValidationJob) selectProfile(validator *Validator) (*BagItProfile, string, error) {
+	identifier := ""
+	tags := validator.GetTags("bag-info.txt", "BagIt-Profile-Identifier")
+	if len(tags) > 0 {
+		identifier = strings.TrimSpace(tags[0].Value)
+	}
+	var reason string
+	if identifier == "" {
+		reason = "Bag does not declare a BagIt-Profile-Identifier."
+	} else {
+		profile, err := job.findProfile(identifier)
+		if profile != nil {
+			return profile, "", nil
+		}
+		reason = fmt.Sprintf("Cannot find BagIt profile %s.", identifier)
+		if errors.Is(err, constants.ErrAmbiguousProfile) {
+			reason = fmt.Sprintf("Cannot choose BagIt profile: %s.", err.Error())
+		} else if err != nil {
+			reason = fmt.Sprintf("Cannot fetch BagIt profile %s: %s.", identifier, err.Error())
+		}
+	}
+	if job.FallbackProfileID == "" {
+		return nil, "", fmt.Errorf("%s No fallback profile was specified.", reason)
+	}
+	result := ObjFind(job.FallbackProfileID)
+	if result.Error != nil {
+		return nil, "", fmt.Errorf("%s Cannot load fallback profile: %s", reason, result.Error.Error())
+	}
+	fallback := result.BagItProfile()
+	if fallback == nil {
+		return nil, "", fmt.Errorf("%s Fallback profile %s is a %s, not a BagIt profile.", reason, job.FallbackProfileID, result.ObjType)
+	}
+	return fallback, fmt.Sprintf("%s Validated against fallback profile %s.", reason, fallback.Name), nil
+}
+
+// findProfile looks for the profile with the specified identifier in
+// the database and among DART's built-in profiles, as described in
+// LookupProfile. If it's not there and the job allows fetching, it
+// tries to import the profile from the identifier URL. Fetched profiles
+// are cached for the life of the job, so we don't download them once
+// per bag.
+//
+// A fetched profile comes from a remote server we don't control, so we
+// resolve and validate it before using it. If it's not valid, this
+// returns an error, as it would if the download failed.
+func (job *ValidationJob) findProfile(identifier string) (*BagItProfile, error) {
+	if profile, err := LookupProfile(identifier); profile != nil || err != nil {
+		return profile, err
+	}
+	if !job.FetchProfiles || !util.LooksLikeURL(identifier) {
+		return nil, nil
+	}
+	if job.fetchedProfiles == nil {
+		job.fetchedProfiles = make(map[string]*BagItProfile)
+	}
+	if profile, ok := job.fetchedProfiles[identifier]; ok {
+		return profile, nil
+	}
+	profileImport := NewBagItProfileImport(constants.ImportSourceUrl, identifier, nil)
+	fetched, err := profileImport.Convert()
+	if err != nil {
+		return nil, err
+	}
+	profile, err := fetched.Resolve()
+	if err != nil {
+		return nil, err
+	}
+	if !profile.Validate() {
+		return nil, fmt.Errorf("profile is not valid (%s)", profileErrors(profile))
+	}
+	job.fetchedProfiles[identifier] = profile
+	return profile, nil
+}
+
+// profileErrors returns the profile's validation errors as a single
+// string, sorted by field name.
+func profileErrors(profile *BagItProfile) string {
+	fields := make([]string, 0, len(profile.Errors))
+	for field := range profile.Errors {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	messages := make([]string, len(fields))
+	for i, field := range fields {
+		messages[i] = profile.Errors[field]
+	}
+	return strings.Join(messages, " ")
+}
@@ -1,12 +1,22 @@
 package core_test
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/APTrust/dart-runner/constants"
 	"github.com/APTrust/dart-runner/core"
 	"github.com/APTrust/dart-runner/util"
 	"github.com/brianvoe/gofakeit/v6"
+	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -154,3 +164,165 @@ func TestValidationJobRun(t *testing.T) {
 	result = valJob.Run(nil)
 	assert.Equal(t, constants.ExitRuntimeErr, result)
 }
+
+func TestValidationJobRunAutoProfile(t *testing.T) {
+	defer core.ClearDartTable()
+	aptProfile := loadProfile(t, APTProfile)
+	require.NoError(t, core.ObjSave(aptProfile))
+	btrProfile := loadProfile(t, BTRProfile)
+	require.NoError(t, core.ObjSave(btrProfile))
+
+	// BTR bags declare the BTR profile identifier, so they
+	// should be validated against the BTR profile. The sample
+	// bags declare no profile, so they fall back to APTrust.
+	valJob := core.NewValidationJob()
+	valJob.BagItProfileID = constants.BagItProfileAuto
+	valJob.FallbackProfileID = aptProfile.ID
+	valJob.PathsToValidate = []string{
+		util.PathToUnitTestBag("test.edu.btr_good_sha256.tar"),
+		util.PathToUnitTestBag("test.edu.btr_good_sha512.tar"),
+		util.PathToUnitTestBag("example.edu.sample_good.tar"),
+	}
+	result := valJob.Run(nil)
+	assert.Equal(t, constants.ExitOK, result)
+	require.Equal(t, 3, len(valJob.ValidationOps))
+	for _, op := range valJob.ValidationOps {
+		assert.True(t, op.Result.Succeeded(), op.PathToBag, op.Result.Errors)
+	}
+	assert.Contains(t, valJob.ValidationOps[0].Result.Info, btrProfile.Name)
+	assert.Empty(t, valJob.ValidationOps[0].Result.Warning)
+	assert.Contains(t, valJob.ValidationOps[2].Result.Info, aptProfile.Name)
+	assert.Contains(t, valJob.ValidationOps[2].Result.Warning, "does not declare a BagIt-Profile-Identifier")
+
+	// BTR bag is invalid under the APTrust profile, so we
+	// know it's not being validated against the fallback.
+	valJob = core.NewValidationJob()
+	valJob.BagItProfileID = aptProfile.ID
+	valJob.PathsToValidate = []string{util.PathToUnitTestBag("test.edu.btr_good_sha256.tar")}
+	assert.Equal(t, constants.ExitRuntimeErr, valJob.Run(nil))
+
+	// Without a fallback, bags that declare no profile fail.
+	valJob = core.NewValidationJob()
+	valJob.BagItProfileID = constants.BagItProfileAuto
+	valJob.PathsToValidate = []string{util.PathToUnitTestBag("example.edu.sample_good.tar")}
+	assert.Equal(t, constants.ExitRuntimeErr, valJob.Run(nil))
+	require.Equal(t, 1, len(valJob.ValidationOps))
+	assert.Contains(t, valJob.ValidationOps[0].Result.Errors["BagItProfile"], "No fallback profile")
+
+	// Unknown profile falls back with a warning.
+	require.NoError(t, core.ObjDelete(btrProfile))
+	valJob = core.NewValidationJob()
+	valJob.BagItProfileID = constants.BagItProfileAuto
+	valJob.FallbackProfileID = aptProfile.ID
+	valJob.PathsToValidate = []string{util.PathToUnitTestBag("test.edu.btr_good_sha256.tar")}
+	valJob.Run(nil)
+	require.Equal(t, 1, len(valJob.ValidationOps))
+	assert.Contains(t, valJob.ValidationOps[0].Result.Warning, "Cannot find BagIt profile")
+	assert.Contains(t, valJob.ValidationOps[0].Result.Warning, aptProfile.Name)
+}
+
+func TestValidationJobValidateFallback(t *testing.T) {
+	valJob := core.NewValidationJob()
+	valJob.BagItProfileID = constants.BagItProfileAuto
+	valJob.PathsToValidate = []string{"/usr/file1.txt"}
+	assert.True(t, valJob.Validate())
+
+	valJob.FallbackProfileID = "not-a-uuid"
+	assert.False(t, valJob.Validate())
+	assert.NotEmpty(t, valJob.Errors["FallbackProfileID"])
+
+	valJob.FallbackProfileID = uuid.NewString()
+	assert.False(t, valJob.Validate())
+	assert.Equal(t, "Fallback profile does not exist.", valJob.Errors["FallbackProfileID"])
+
+	// The fallback must be a BagIt profile, not some other object.
+	defer core.ClearDartTable()
+	ss := core.NewStorageService()
+	ss.Name = "Not a profile"
+	require.NoError(t, core.ObjSaveWithoutValidation(ss))
+	valJob.FallbackProfileID = ss.ID
+	assert.False(t, valJob.Validate())
+	assert.Contains(t, valJob.Errors["FallbackProfileID"], "not a BagIt profile")
+
+	profile := loadProfile(t, EmptyProfile)
+	require.NoError(t, core.ObjSave(profile))
+	valJob.FallbackProfileID = profile.ID
+	assert.True(t, valJob.Validate())
+}
+
+func TestValidationJobFetchProfile(t *testing.T) {
+	defer core.ClearDartTable()
+	fallback := loadProfile(t, EmptyProfile)
+	require.NoError(t, core.ObjSave(fallback))
+
+	validJson, err := os.ReadFile(filepath.Join(util.ProjectRoot(), "profiles", EmptyProfile))
+	require.NoError(t, err)
+	invalidJson, err := os.ReadFile(filepath.Join(util.ProjectRoot(), "testdata", "profiles", "invalid_profile.json"))
+	require.NoError(t, err)
+	derived := make(map[string]interface{})
+	require.NoError(t, json.Unmarshal(validJson, &derived))
+	derived["inheritsFromBase"] = true
+	derived["baseProfileId"] = "https://example.com/no-such-profile.json"
+	derivedJson, err := json.Marshal(derived)
+	require.NoError(t, err)
+
+	var profileJson []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(profileJson)
+	}))
+	defer server.Close()
+
+	// Identifiers must look like real URLs, so send requests for
+	// profiles.example.com to the test server.
+	defaultTransport := http.DefaultTransport
+	http.DefaultTransport = &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial("tcp", server.Listener.Addr().String())
+		},
+	}
+	defer func() { http.DefaultTransport = defaultTransport }()
+	profileUrl := "http://profiles.example.com/"
+
+	// A valid profile from the bag's identifier URL is used as is.
+	profileJson = validJson
+	pathToBag := makeProfileIdentifierBag(t, profileUrl+"valid.json")
+	valJob := core.NewValidationJob()
+	valJob.BagItProfileID = constants.BagItProfileAuto
+	valJob.FallbackProfileID = fallback.ID
+	valJob.FetchProfiles = true
+	valJob.PathsToValidate = []string{pathToBag}
+	valJob.Run(nil)
+	require.Equal(t, 1, len(valJob.ValidationOps))
+	assert.Empty(t, valJob.ValidationOps[0].Result.Warning)
+
+	// Invalid profiles, and profiles whose base we can't find,
+	// are treated as fetch failures, so we use the fallback.
+	for _, body := range [][]byte{invalidJson, derivedJson} {
+		profileJson = body
+		pathToBag = makeProfileIdentifierBag(t, profileUrl+uuid.NewString()+".json")
+		valJob.PathsToValidate = []string{pathToBag}
+		valJob.Run(nil)
+		require.Equal(t, 1, len(valJob.ValidationOps))
+		assert.Contains(t, valJob.ValidationOps[0].Result.Warning, "Cannot fetch BagIt profile")
+		assert.Contains(t, valJob.ValidationOps[0].Result.Warning, "Validated against fallback profile")
+	}
+	assert.Contains(t, valJob.ValidationOps[0].Result.Warning, "not found")
+}
+
+// makeProfileIdentifierBag creates a minimal unserialized bag whose
+// BagIt-Profile-Identifier is identifier, and returns its path.
+func makeProfileIdentifierBag(t *testing.T, identifier string) string {
+	bagDir := filepath.Join(t.TempDir(), "bag")
+	require.NoError(t, os.MkdirAll(filepath.Join(bagDir, "data"), 0755))
+	payload := []byte("Hello, bag.\n")
+	require.NoError(t, os.WriteFile(filepath.Join(bagDir, "data", "hello.txt"), payload, 0644))
+	files := map[string]string{
+		"bagit.txt":           "BagIt-Version: 1.0\nTag-File-Character-Encoding: UTF-8\n",
+		"bag-info.txt":        fmt.Sprintf("BagIt-Profile-Identifier: %s\n", identifier),
+		"manifest-sha256.txt": fmt.Sprintf("%x  data/hello.txt\n", sha256.Sum256(payload)),
+	}
+	for name, content := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(bagDir, name), []byte(content), 0644))
+	}
+	return bagDir
+}
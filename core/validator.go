@@ -1,6 +1,7 @@
 package core
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
@@ -27,6 +28,7 @@ type Validator struct {
 	Warnings           map[string]string
 	mapForType         map[string]*FileMap
 	IgnoreOxumMismatch bool
+	ctx                context.Context
 }
 
 // TODO: Deprecate this. New version should always use channel.
@@ -75,6 +77,14 @@ func (v *Validator) TagManifestAlgs() ([]string, error) {
 //
 // Caller needs to call ScanBag() before calling Validate().
 func (v *Validator) Validate() bool {
+	// Resolve the effective profile if this one inherits from a base.
+	profile, err := v.Profile.resolveOrWarn(FindProfile)
+	if err != nil {
+		v.Errors["BaseProfileID"] = err.Error()
+		return v.finish()
+	}
+	v.Profile = profile
+
 	// Make sure BagItProfile is present and valid.
 	if !v.Profile.Validate() {
 		v.Errors = v.Profile.Errors
@@ -162,6 +172,16 @@ func (v *Validator) Validate() bool {
 // mismatch when you call Validate(), but you'll get to see which
 // extra or missing files may be triggering the Oxum mismatch.
 func (v *Validator) ScanBag() error {
+	return v.ScanBagContext(context.Background())
+}
+
+// ScanBagContext is like ScanBag, but it stops and returns ctx's
+// error if ctx is cancelled before the scan is complete. In that
+// case, the validator's file maps are incomplete, so don't call
+// Validate().
+func (v *Validator) ScanBagContext(ctx context.Context) error {
+	v.ctx = ctx
+	defer func() { v.ctx = nil }()
 	reader, err := v.getReader()
 	if err != nil {
 		return err
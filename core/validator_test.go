@@ -1,6 +1,7 @@
 package core_test
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -385,3 +386,10 @@ func TestValidator_IllegalControlCharacter(t *testing.T) {
 	assert.True(t, strings.Contains(validator.Errors["File Names"], filepath.Base(tempFile.Name())))
 
 }
+
+func TestValidator_ScanBagContextCancelled(t *testing.T) {
+	v := getValidator(t, "example.edu.tagsample_good.tar", aptrustProfile)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, v.ScanBagContext(ctx), context.Canceled)
+}
@@ -0,0 +1,449 @@
+package core
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// webdavChunkedThreshold is the file size above which the WebDAV
+// client sends files with chunked transfer encoding instead of a
+// fixed Content-Length.
+const webdavChunkedThreshold = 16 * 1024 * 1024
+
+// webDAVError describes an unexpected HTTP response from a WebDAV server.
+type webDAVError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Status     string
+}
+
+func (e *webDAVError) Error() string {
+	return fmt.Sprintf("WebDAV %s %s returned %s", e.Method, e.URL, e.Status)
+}
+
+// WebDAVClient uploads files and directories to a WebDAV server, such
+// as Nextcloud or an institutional drop box. The StorageService.Bucket
+// attribute is the path of the collection that receives uploads.
+//
+// If the storage service has a login, the client uses basic auth with
+// that login and password. If the login is empty, the client sends the
+// password as a bearer token. Both may use the "env:", "file:" and other
+// credential references described in StorageService.GetLogin().
+type WebDAVClient struct {
+	storageService     *StorageService
+	httpClient         *http.Client
+	scheme             string
+	totalBytesToUpload int64
+	bytesUploaded      int64
+	filesUploaded      int64
+	uploadProgress     *StreamProgress
+	collections        map[string]bool
+	checksums          map[string]string
+	urls               []string
+}
+
+// NewWebDAVClient returns a new client that uploads to the WebDAV server
+// described by ss. If param uploadProgress is not nil, this will update
+// the progress bar as files are uploaded. Param uploadProgress should be
+// nil unless we're running in DART 3 GUI mode.
+func NewWebDAVClient(ss *StorageService, useSSL bool, uploadProgress *StreamProgress) (*WebDAVClient, error) {
+	if strings.TrimSpace(ss.Host) == "" {
+		return nil, fmt.Errorf("storage service %s has no host", ss.Name)
+	}
+	scheme := "http"
+	if useSSL {
+		scheme = "https"
+	}
+	return &WebDAVClient{
+		storageService: ss,
+		httpClient:     &http.Client{},
+		scheme:         scheme,
+		uploadProgress: uploadProgress,
+		collections:    make(map[string]bool),
+		checksums:      make(map[string]string),
+		urls:           make([]string, 0),
+	}, nil
+}
+
+// Upload uploads a file or directory from source to destination on the
+// WebDAV server. Param destination is a path on the server, such as
+// "deposits/bag.tar". This creates any collections in the destination
+// path that don't already exist.
+func (wc *WebDAVClient) Upload(source, destination string) error {
+	return wc.UploadContext(context.Background(), source, destination)
+}
+
+// UploadContext is like Upload, but it stops if ctx is cancelled.
+// Cancelling closes the connection in the middle of the PUT, so the
+// server discards the partial file.
+func (wc *WebDAVClient) UploadContext(ctx context.Context, source, destination string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	info, err := os.Stat(source)
+	if err != nil {
+		return fmt.Errorf("failed to stat source: %w", err)
+	}
+
+	wc.totalBytesToUpload = int64(0)
+	wc.bytesUploaded = int64(0)
+	wc.filesUploaded = int64(0)
+	wc.checksums = make(map[string]string)
+	wc.urls = make([]string, 0)
+
+	err = wc.mkcolAll(path.Dir(destination))
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		wc.totalBytesToUpload, err = GetUploadPayloadSize(source)
+		if err != nil {
+			return err
+		}
+		return wc.uploadDirectory(ctx, source, destination)
+	}
+	wc.totalBytesToUpload = info.Size()
+	return wc.uploadFile(ctx, source, destination, info)
+}
+
+// uploadDirectory recursively uploads a directory to the server,
+// creating a collection for each subdirectory.
+func (wc *WebDAVClient) uploadDirectory(ctx context.Context, localPath, remotePath string) error {
+	return filepath.Walk(localPath, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(localPath, filePath)
+		if err != nil {
+			return fmt.Errorf("failed to get relative path for local path %s: %w", localPath, err)
+		}
+		remoteDest := path.Join(remotePath, filepath.ToSlash(relPath))
+		if info.IsDir() {
+			return wc.mkcolAll(remoteDest)
+		} else if info.Mode().IsRegular() {
+			err = wc.uploadFile(ctx, filePath, remoteDest, info)
+			if err != nil {
+				return fmt.Errorf("WebDAV client: error uploading %s: %w", filePath, err)
+			}
+		} else {
+			Dart.Log.Warningf("WebDAV client is skipping upload of %s because it's not a regular file", filePath)
+		}
+		return nil
+	})
+}
+
+// uploadFile sends a single file to the server in a PUT request.
+// Files larger than webdavChunkedThreshold go with chunked transfer
+// encoding, so servers and proxies can stream them without limits on
+// Content-Length. For those, we send the size in the
+// X-Expected-Entity-Length header, which Apache, nginx and Nextcloud
+// use to check that the upload is complete.
+func (wc *WebDAVClient) uploadFile(ctx context.Context, localPath, remotePath string, info os.FileInfo) error {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return fmt.Errorf("failed to open local file: %w", err)
+	}
+	defer file.Close()
+
+	var body io.Reader = file
+	if wc.uploadProgress != nil {
+		body = &progressReader{reader: file, progress: wc.uploadProgress}
+	}
+	remoteURL := wc.URL(remotePath)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, remoteURL, io.NopCloser(body))
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		req.Body = http.NoBody
+		req.ContentLength = 0
+	} else if info.Size() > webdavChunkedThreshold {
+		req.ContentLength = -1
+		req.Header.Set("X-Expected-Entity-Length", strconv.FormatInt(info.Size(), 10))
+	} else {
+		req.ContentLength = info.Size()
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	Dart.Log.Infof("Starting WebDAV upload %s to %s", localPath, remoteURL)
+	_, err = wc.do(req, http.StatusOK, http.StatusCreated, http.StatusNoContent)
+	if err != nil {
+		return fmt.Errorf("failed to upload %s to %s: %w", localPath, remoteURL, err)
+	}
+
+	if wc.storageService.VerifyUploads {
+		digest, err := wc.verifyUpload(localPath, remotePath)
+		if err != nil {
+			return err
+		}
+		wc.checksums[remoteURL] = digest
+	}
+
+	wc.bytesUploaded += info.Size()
+	wc.filesUploaded += 1
+	wc.urls = append(wc.urls, remoteURL)
+	Dart.Log.Infof("Uploaded file: %s -> %s", localPath, remoteURL)
+	return nil
+}
+
+// mkcolAll creates the collection at remotePath and any missing parent
+// collections, like os.MkdirAll. Servers respond to MKCOL on an existing
+// collection with 405 Method Not Allowed, so we treat that as success.
+func (wc *WebDAVClient) mkcolAll(remotePath string) error {
+	current := ""
+	for _, segment := range strings.Split(strings.Trim(path.Clean("/"+remotePath), "/"), "/") {
+		if segment == "" {
+			continue
+		}
+		current = current + "/" + segment
+		if wc.collections[current] {
+			continue
+		}
+		req, err := http.NewRequest("MKCOL", wc.URL(current)+"/", nil)
+		if err != nil {
+			return err
+		}
+		statusCode, err := wc.do(req, http.StatusCreated, http.StatusMethodNotAllowed)
+		if err != nil {
+			return fmt.Errorf("failed to create collection %s: %w", current, err)
+		}
+		if statusCode == http.StatusCreated {
+			Dart.Log.Infof("WebDAV client created collection %s", current)
+		}
+		wc.collections[current] = true
+	}
+	return nil
+}
+
+// propfind checks that remotePath exists on the server and that our
+// credentials let us see it.
+func (wc *WebDAVClient) propfind(remotePath string) error {
+	body := `<?xml version="1.0" encoding="utf-8"?><propfind xmlns="DAV:"><prop><resourcetype/></prop></propfind>`
+	req, err := http.NewRequest("PROPFIND", wc.URL(remotePath), strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Depth", "0")
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+	_, err = wc.do(req, http.StatusMultiStatus)
+	return err
+}
+
+// webdavMultistatus is the body of a PROPFIND response.
+type webdavMultistatus struct {
+	Responses []webdavResponse `xml:"DAV: response"`
+}
+
+type webdavResponse struct {
+	Href      string           `xml:"DAV: href"`
+	Propstats []webdavPropstat `xml:"DAV: propstat"`
+}
+
+type webdavPropstat struct {
+	Status string `xml:"DAV: status"`
+	Prop   struct {
+		ResourceType struct {
+			Collection *struct{} `xml:"DAV: collection"`
+		} `xml:"DAV: resourcetype"`
+		ContentLength int64  `xml:"DAV: getcontentlength"`
+		LastModified  string `xml:"DAV: getlastmodified"`
+		ETag          string `xml:"DAV: getetag"`
+	} `xml:"DAV: prop"`
+}
+
+// List returns the files under the storage service's collection whose
+// paths relative to the collection begin with prefix. This walks the
+// collection tree one level at a time, because many servers refuse
+// PROPFIND requests with Depth: infinity.
+func (wc *WebDAVClient) List(prefix string) ([]*RemoteObject, error) {
+	root := path.Clean("/" + wc.storageService.Bucket)
+	start := path.Join(root, listingDir(prefix))
+	objects := make([]*RemoteObject, 0)
+	pending := []string{start}
+	for len(pending) > 0 {
+		collection := pending[0]
+		pending = pending[1:]
+		responses, err := wc.propfindChildren(collection)
+		if err != nil {
+			var davErr *webDAVError
+			if errors.As(err, &davErr) && davErr.StatusCode == http.StatusNotFound && collection == start && start != root {
+				return objects, nil
+			}
+			return nil, err
+		}
+		for _, resp := range responses {
+			href, err := url.PathUnescape(resp.Href)
+			if err != nil {
+				return nil, fmt.Errorf("server returned invalid href %s: %w", resp.Href, err)
+			}
+			// Some servers return absolute URLs rather than paths.
+			if u, err := url.Parse(href); err == nil && u.Host != "" {
+				href = u.Path
+			}
+			href = path.Clean("/" + href)
+			if href == collection {
+				continue
+			}
+			for _, propstat := range resp.Propstats {
+				if !strings.Contains(propstat.Status, " 200 ") {
+					continue
+				}
+				if propstat.Prop.ResourceType.Collection != nil {
+					pending = append(pending, href)
+					break
+				}
+				key := strings.TrimPrefix(strings.TrimPrefix(href, root), "/")
+				if !strings.HasPrefix(key, prefix) {
+					break
+				}
+				modified, _ := http.ParseTime(propstat.Prop.LastModified)
+				objects = append(objects, &RemoteObject{
+					Key:      key,
+					Size:     propstat.Prop.ContentLength,
+					Modified: modified,
+					ETag:     strings.Trim(strings.TrimPrefix(propstat.Prop.ETag, "W/"), `"`),
+				})
+				break
+			}
+		}
+	}
+	return objects, nil
+}
+
+// propfindChildren returns the PROPFIND responses describing the
+// collection at remotePath and its immediate members.
+func (wc *WebDAVClient) propfindChildren(remotePath string) ([]webdavResponse, error) {
+	body := `<?xml version="1.0" encoding="utf-8"?><propfind xmlns="DAV:"><prop><resourcetype/><getcontentlength/><getlastmodified/><getetag/></prop></propfind>`
+	collectionURL := wc.URL(remotePath)
+	if !strings.HasSuffix(collectionURL, "/") {
+		collectionURL += "/"
+	}
+	req, err := http.NewRequest("PROPFIND", collectionURL, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Depth", "1")
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+	resp, err := wc.send(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusMultiStatus {
+		io.Copy(io.Discard, resp.Body)
+		return nil, newWebDAVError(req, resp)
+	}
+	multistatus := &webdavMultistatus{}
+	err = xml.NewDecoder(resp.Body).Decode(multistatus)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse PROPFIND response from %s: %w", req.URL.String(), err)
+	}
+	return multistatus.Responses, nil
+}
+
+// do sends req with our credentials and returns the response's status
+// code. It returns a webDAVError if the status code is not one of
+// expectedStatus.
+func (wc *WebDAVClient) do(req *http.Request, expectedStatus ...int) (int, error) {
+	resp, err := wc.send(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	for _, status := range expectedStatus {
+		if resp.StatusCode == status {
+			return resp.StatusCode, nil
+		}
+	}
+	return resp.StatusCode, newWebDAVError(req, resp)
+}
+
+// read sends req with our credentials and passes the body of a
+// successful response to readBody.
+func (wc *WebDAVClient) read(req *http.Request, readBody func(io.Reader) error) error {
+	resp, err := wc.send(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return newWebDAVError(req, resp)
+	}
+	return readBody(resp.Body)
+}
+
+// send adds our credentials to req and sends it.
+func (wc *WebDAVClient) send(req *http.Request) (*http.Response, error) {
+	login := wc.storageService.GetLogin()
+	if login == "" {
+		req.Header.Set("Authorization", "Bearer "+wc.storageService.GetPassword())
+	} else {
+		req.SetBasicAuth(login, wc.storageService.GetPassword())
+	}
+	return wc.httpClient.Do(req)
+}
+
+func newWebDAVError(req *http.Request, resp *http.Response) *webDAVError {
+	return &webDAVError{
+		Method:     req.Method,
+		URL:        req.URL.String(),
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+	}
+}
+
+// URL returns the full URL of remotePath on the server.
+func (wc *WebDAVClient) URL(remotePath string) string {
+	u := url.URL{
+		Scheme: wc.scheme,
+		Host:   wc.storageService.HostAndPort(),
+		Path:   path.Clean("/" + remotePath),
+	}
+	return u.String()
+}
+
+func (wc *WebDAVClient) FilesUploaded() int64 {
+	return wc.filesUploaded
+}
+
+func (wc *WebDAVClient) BytesUploaded() int64 {
+	return wc.bytesUploaded
+}
+
+func (wc *WebDAVClient) PayloadSize() int64 {
+	return wc.totalBytesToUpload
+}
+
+// UploadedURLs returns the URLs of the files uploaded by the last
+// call to Upload.
+func (wc *WebDAVClient) UploadedURLs() []string {
+	urls := make([]string, len(wc.urls))
+	copy(urls, wc.urls)
+	return urls
+}
+
+// VerifiedChecksums returns a map of remote URLs and the SHA-256
+// digests of the files at those URLs. This is populated only when the
+// storage service is set to verify uploads.
+func (wc *WebDAVClient) VerifiedChecksums() map[string]string {
+	checksums := make(map[string]string)
+	for key, value := range wc.checksums {
+		checksums[key] = value
+	}
+	return checksums
+}
@@ -0,0 +1,180 @@
+package core_test
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/core"
+	"github.com/APTrust/dart-runner/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/webdav"
+)
+
+// webdavTestServer is a local WebDAV server backed by a temp directory.
+// It accepts basic auth as user/secret and the bearer token "token123".
+type webdavTestServer struct {
+	*httptest.Server
+	Root string
+
+	mutex          sync.Mutex
+	chunkedPuts    int
+	expectedLength string
+	failNextPuts   int
+}
+
+func newWebDAVTestServer(t *testing.T) *webdavTestServer {
+	server := &webdavTestServer{Root: t.TempDir()}
+	handler := &webdav.Handler{
+		FileSystem: webdav.Dir(server.Root),
+		LockSystem: webdav.NewMemLS(),
+	}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		login, password, hasBasicAuth := r.BasicAuth()
+		bearerOK := r.Header.Get("Authorization") == "Bearer token123"
+		if !bearerOK && (!hasBasicAuth || login != "user" || password != "secret") {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Method == http.MethodPut {
+			server.mutex.Lock()
+			if server.failNextPuts > 0 {
+				server.failNextPuts--
+				server.mutex.Unlock()
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			if len(r.TransferEncoding) > 0 && r.TransferEncoding[0] == "chunked" {
+				server.chunkedPuts++
+				server.expectedLength = r.Header.Get("X-Expected-Entity-Length")
+			}
+			server.mutex.Unlock()
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func (s *webdavTestServer) StorageService(t *testing.T) *core.StorageService {
+	host, port, err := net.SplitHostPort(s.Listener.Addr().String())
+	require.NoError(t, err)
+	portNumber, err := strconv.Atoi(port)
+	require.NoError(t, err)
+	ss := core.NewStorageService()
+	ss.Name = "Local WebDAV"
+	ss.Protocol = constants.ProtocolWebDAV
+	ss.Host = host
+	ss.Port = portNumber
+	ss.Bucket = "deposits/incoming"
+	ss.Login = "user"
+	ss.Password = "secret"
+	return ss
+}
+
+func TestWebDAVClientUploadFile(t *testing.T) {
+	server := newWebDAVTestServer(t)
+	ss := server.StorageService(t)
+	ss.VerifyUploads = true
+	bagFile := util.PathToUnitTestBag("example.edu.tagsample_good.tar")
+	info, err := os.Stat(bagFile)
+	require.NoError(t, err)
+
+	messageChannel := make(chan *core.EventMessage, 1000)
+	progress := core.NewStreamProgress(info.Size(), messageChannel)
+	client, err := core.NewWebDAVClient(ss, false, progress)
+	require.NoError(t, err)
+
+	// This should create the deposits and incoming collections.
+	require.NoError(t, client.Upload(bagFile, "deposits/incoming/example.edu.tagsample_good.tar"))
+	uploaded := filepath.Join(server.Root, "deposits", "incoming", "example.edu.tagsample_good.tar")
+	assert.FileExists(t, uploaded)
+	assert.Equal(t, sha256Hex(t, bagFile), sha256Hex(t, uploaded))
+	assert.EqualValues(t, 1, client.FilesUploaded())
+	assert.Equal(t, info.Size(), client.BytesUploaded())
+	assert.Equal(t, info.Size(), client.PayloadSize())
+	assert.Equal(t, info.Size(), progress.Current)
+	assert.Equal(t, 0, server.chunkedPuts)
+
+	remoteURL := server.URL + "/deposits/incoming/example.edu.tagsample_good.tar"
+	assert.Equal(t, []string{remoteURL}, client.UploadedURLs())
+	assert.Equal(t, sha256Hex(t, bagFile), client.VerifiedChecksums()[remoteURL])
+
+	// Uploading again should overwrite the file.
+	require.NoError(t, client.Upload(bagFile, "deposits/incoming/example.edu.tagsample_good.tar"))
+}
+
+func TestWebDAVClientAuth(t *testing.T) {
+	server := newWebDAVTestServer(t)
+	bagFile := util.PathToUnitTestBag("example.edu.tagsample_good.tar")
+
+	// Bearer token from the environment, with no login.
+	os.Setenv("RUNNER_UNIT_TEST_WEBDAV_TOKEN", "token123")
+	defer os.Unsetenv("RUNNER_UNIT_TEST_WEBDAV_TOKEN")
+	ss := server.StorageService(t)
+	ss.Login = ""
+	ss.Password = "env:RUNNER_UNIT_TEST_WEBDAV_TOKEN"
+	assert.True(t, ss.Validate(), ss.Errors)
+	client, err := core.NewWebDAVClient(ss, false, nil)
+	require.NoError(t, err)
+	require.NoError(t, client.Upload(bagFile, "bearer/bag.tar"))
+	assert.FileExists(t, filepath.Join(server.Root, "bearer", "bag.tar"))
+
+	// Bad credentials
+	ss.Login = "user"
+	ss.Password = "wrong"
+	client, err = core.NewWebDAVClient(ss, false, nil)
+	require.NoError(t, err)
+	err = client.Upload(bagFile, "basic/bag.tar")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "401")
+	assert.False(t, core.DefaultRetryPolicy().IsRetryable(err))
+}
+
+func TestWebDAVClientUploadDirectory(t *testing.T) {
+	server := newWebDAVTestServer(t)
+	ss := server.StorageService(t)
+	client, err := core.NewWebDAVClient(ss, false, nil)
+	require.NoError(t, err)
+
+	source := filepath.Join(util.ProjectRoot(), "profiles")
+	expectedSize, err := core.GetUploadPayloadSize(source)
+	require.NoError(t, err)
+	require.NoError(t, client.Upload(source, "deposits/profiles"))
+	assert.Equal(t, expectedSize, client.BytesUploaded())
+	assert.FileExists(t, filepath.Join(server.Root, "deposits", "profiles", "aptrust-v2.2.json"))
+}
+
+func TestWebDAVClientChunkedUpload(t *testing.T) {
+	server := newWebDAVTestServer(t)
+	ss := server.StorageService(t)
+	ss.VerifyUploads = true
+	client, err := core.NewWebDAVClient(ss, false, nil)
+	require.NoError(t, err)
+
+	size := int64(17 * 1024 * 1024)
+	largeFile := makeSparseFile(t, size)
+	require.NoError(t, client.Upload(largeFile, "large/large_file.tar"))
+	assert.Equal(t, 1, server.chunkedPuts)
+	assert.Equal(t, strconv.FormatInt(size, 10), server.expectedLength)
+	info, err := os.Stat(filepath.Join(server.Root, "large", "large_file.tar"))
+	require.NoError(t, err)
+	assert.Equal(t, size, info.Size())
+}
+
+func TestStorageServiceConnectionWebDAV(t *testing.T) {
+	server := newWebDAVTestServer(t)
+	ss := server.StorageService(t)
+	require.NoError(t, os.MkdirAll(filepath.Join(server.Root, "deposits", "incoming"), 0755))
+	assert.NoError(t, ss.TestConnection())
+
+	ss.Bucket = "does-not-exist"
+	assert.Error(t, ss.TestConnection())
+}
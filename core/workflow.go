@@ -11,15 +11,18 @@ import (
 )
 
 type Workflow struct {
-	ID                string            `json:"id"`
-	BagItProfile      *BagItProfile     `json:"bagItProfile"`
-	Description       string            `json:"description"`
-	Errors            map[string]string `json:"-"`
-	Name              string            `json:"name"`
-	PackageFormat     string            `json:"packageFormat"`
-	Serialization     string            `json:"serialization"`
-	StorageServiceIDs []string          `json:"storageServiceIds"`
-	StorageServices   []*StorageService `json:"storageServices"`
+	ID                string                     `json:"id"`
+	BagItProfile      *BagItProfile              `json:"bagItProfile"`
+	Description       string                     `json:"description"`
+	Errors            map[string]string          `json:"-"`
+	Name              string                     `json:"name"`
+	PackageFormat     string                     `json:"packageFormat"`
+	Serialization     string                     `json:"serialization"`
+	StorageServiceIDs []string                   `json:"storageServiceIds"`
+	StorageServices   []*StorageService          `json:"storageServices"`
+	Stages            []*StageDefinition         `json:"stages,omitempty"`
+	PrePackageOps     []*PrePackageOperation     `json:"prePackageOps,omitempty"`
+	PostValidationOps []*PostValidationOperation `json:"postValidationOps,omitempty"`
 }
 
 func WorkflowFromJson(pathToFile string) (*Workflow, error) {
@@ -43,11 +46,14 @@ func WorkflowFromJson(pathToFile string) (*Workflow, error) {
 // upload operations on a large of set of materials.
 func WorkFlowFromJob(job *Job) (*Workflow, error) {
 	workflow := &Workflow{
-		ID:              uuid.NewString(),
-		Name:            "New Workflow",
-		Description:     "",
-		PackageFormat:   constants.PackageFormatNone,
-		StorageServices: make([]*StorageService, len(job.UploadOps)),
+		ID:                uuid.NewString(),
+		Name:              "New Workflow",
+		Description:       "",
+		PackageFormat:     constants.PackageFormatNone,
+		StorageServices:   make([]*StorageService, len(job.UploadOps)),
+		Stages:            job.Stages,
+		PrePackageOps:     copyPrePackageOps(job.PrePackageOps),
+		PostValidationOps: copyPostValidationOps(job.PostValidationOps),
 	}
 	if job.PackageOp != nil {
 		workflow.PackageFormat = job.PackageOp.PackageFormat
@@ -95,6 +101,23 @@ func (w *Workflow) Validate() bool {
 			}
 		}
 	}
+	for key, value := range ValidateStages(w.Stages, w.StorageServices) {
+		w.Errors[key] = value
+	}
+	for i, op := range w.PrePackageOps {
+		if !op.Validate() {
+			for key, value := range op.Errors {
+				w.Errors[strings.Replace(key, "PrePackageOp", fmt.Sprintf("PrePackageOp[%d]", i), 1)] = value
+			}
+		}
+	}
+	for i, op := range w.PostValidationOps {
+		if !op.Validate() {
+			for key, value := range op.Errors {
+				w.Errors[strings.Replace(key, "PostValidationOp", fmt.Sprintf("PostValidationOp[%d]", i), 1)] = value
+			}
+		}
+	}
 	return len(w.Errors) == 0
 }
 
@@ -104,6 +127,14 @@ func (w *Workflow) Copy() *Workflow {
 		ssCopy[i] = ss.Copy()
 	}
 	profile := BagItProfileClone(w.BagItProfile)
+	var stagesCopy []*StageDefinition
+	if w.Stages != nil {
+		stagesCopy = make([]*StageDefinition, len(w.Stages))
+		for i, stage := range w.Stages {
+			stageCopy := *stage
+			stagesCopy[i] = &stageCopy
+		}
+	}
 	return &Workflow{
 		ID:                w.ID,
 		BagItProfile:      profile,
@@ -113,6 +144,9 @@ func (w *Workflow) Copy() *Workflow {
 		PackageFormat:     w.PackageFormat,
 		StorageServiceIDs: w.StorageServiceIDs,
 		StorageServices:   ssCopy,
+		Stages:            stagesCopy,
+		PrePackageOps:     copyPrePackageOps(w.PrePackageOps),
+		PostValidationOps: copyPostValidationOps(w.PostValidationOps),
 	}
 }
 
@@ -246,9 +280,21 @@ func (w *Workflow) ExportJson() ([]byte, error) {
 func (w *Workflow) HasPlaintextPasswords() bool {
 	w.resolveStorageServices()
 	for _, ss := range w.StorageServices {
-		if ss.Password != "" && !strings.HasPrefix(ss.Password, "env:") {
+		if ss.HasPlaintextPassword() {
 			return true
 		}
 	}
 	return false
 }
+
+// secretFields returns pointers to the secrets in this workflow's
+// copies of its storage services.
+func (w *Workflow) secretFields() []*string {
+	fields := make([]*string, 0)
+	for _, ss := range w.StorageServices {
+		if ss != nil {
+			fields = append(fields, ss.secretFields()...)
+		}
+	}
+	return fields
+}
@@ -2,6 +2,7 @@ package core
 
 import (
 	"fmt"
+	"io"
 	"strings"
 
 	"github.com/APTrust/dart-runner/constants"
@@ -52,9 +53,53 @@ func (wb *WorkflowBatch) Validate() bool {
 	}
 
 	// Now validate the contents of the file.
+	if BatchFileFormat(wb.PathToCSVFile) != "csv" {
+		return wb.validateBatchSource()
+	}
 	return wb.validateCSVFile()
 }
 
+// validateBatchSource validates the items in a JSON Lines or YAML
+// batch file, as validateCSVFile does for CSV files.
+func (wb *WorkflowBatch) validateBatchSource() bool {
+	source, err := NewBatchSource(wb.PathToCSVFile)
+	if err != nil {
+		wb.Errors["CSVFile"] = err.Error()
+		return false
+	}
+	defer source.Close()
+	for itemNumber := 1; ; itemNumber++ {
+		entry, err := source.ReadNext()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			wb.Errors["CSVFile"] = fmt.Sprintf("%s. Be sure this is a valid %s file.", err.Error(), strings.ToUpper(BatchFileFormat(wb.PathToCSVFile)))
+			return false
+		}
+		sourceFiles := entry.SourceFiles()
+		if len(sourceFiles) == 0 {
+			key := fmt.Sprintf("Item %d", itemNumber)
+			wb.Errors[key] = fmt.Sprintf("Item %d: This entry has no files, so DART does not know what to bag.", itemNumber)
+		}
+		for _, sourceFile := range sourceFiles {
+			if !util.FileExists(sourceFile) {
+				wb.Errors[sourceFile] = fmt.Sprintf("Item %d: file or directory does not exist: '%s'.", itemNumber, sourceFile)
+			}
+		}
+		record := util.NewNameValuePairList()
+		record.Add("Bag-Name", entry.BagName)
+		for _, tag := range entry.Tags {
+			record.Add(tag.FullyQualifiedName(), tag.Value)
+		}
+		profile := wb.checkOverrides(&entry.Overrides, "Item", itemNumber)
+		wb.checkRequiredTags(record, itemNumber, profile)
+	}
+	for key, value := range wb.Errors {
+		Dart.Log.Errorf("%s: %s", key, value)
+	}
+	return len(wb.Errors) == 0
+}
+
 func (wb *WorkflowBatch) validateCSVFile() bool {
 	// First, make the CSV file parses without errors.
 	_, records, err := util.ParseCSV(wb.PathToCSVFile)
@@ -77,9 +122,19 @@ func (wb *WorkflowBatch) validateCSVFile() bool {
 			key := fmt.Sprintf("Line %d", lineNumber)
 			wb.Errors[key] = fmt.Sprintf("Line %d: This entry is missing the 'Root-Directory' value, so DART does not know what to bag.", lineNumber)
 		}
+		// Make sure the profile, files, serialization and storage
+		// services this line overrides are valid.
+		overrides := &JobOverrides{}
+		for _, nvp := range record.Items {
+			if isOverrideColumn(nvp.Name) {
+				overrides.setFromColumn(nvp.Name, nvp.Value)
+			}
+		}
+		profile := wb.checkOverrides(overrides, "Line", lineNumber)
+
 		// Lastly, make sure this line of the CSV file contains
-		// valid values for all of the workflow's required tags.
-		wb.checkRequiredTags(record, lineNumber)
+		// valid values for all of the profile's required tags.
+		wb.checkRequiredTags(record, lineNumber, profile)
 	}
 
 	for key, value := range wb.Errors {
@@ -89,13 +144,32 @@ func (wb *WorkflowBatch) validateCSVFile() bool {
 	return len(wb.Errors) == 0
 }
 
-func (wb *WorkflowBatch) checkRequiredTags(record *util.NameValuePairList, lineNumber int) bool {
+// checkOverrides adds an error for each invalid override in a line or
+// item of the batch file. It returns the BagIt profile that line or item
+// will use.
+func (wb *WorkflowBatch) checkOverrides(overrides *JobOverrides, label string, number int) *BagItProfile {
+	for key, errMsg := range overrides.Validate(wb.Workflow) {
+		errKey := fmt.Sprintf("%d-%s", number, key)
+		wb.Errors[errKey] = fmt.Sprintf("%s %d: %s", label, number, errMsg)
+	}
+	if overrides.BagItProfileName != "" {
+		if profile := findProfileByName(overrides.BagItProfileName); profile != nil {
+			return profile
+		}
+	}
+	return wb.Workflow.BagItProfile
+}
+
+func (wb *WorkflowBatch) checkRequiredTags(record *util.NameValuePairList, lineNumber int, profile *BagItProfile) bool {
 	bagName, _ := record.FirstMatching("Bag-Name")
 	if strings.TrimSpace(bagName.Value) == "" {
 		errKey := fmt.Sprintf("%d-Bag-Name", lineNumber)
 		wb.Errors[errKey] = fmt.Sprintf("Bag-Name is missing from line %d", lineNumber)
 	}
-	for _, tagDef := range wb.Workflow.BagItProfile.Tags {
+	if profile == nil {
+		return true
+	}
+	for _, tagDef := range profile.Tags {
 		// We don't need to validate workflow tags in bagit.txt
 		// because DART fills these in automatically.
 		if tagDef.TagFile == "bagit.txt" {
@@ -171,3 +245,11 @@ func (wb *WorkflowBatch) GetErrors() map[string]string {
 func (wb *WorkflowBatch) IsDeletable() bool {
 	return true
 }
+
+// secretFields returns pointers to the secrets in this batch's workflow.
+func (wb *WorkflowBatch) secretFields() []*string {
+	if wb.Workflow == nil {
+		return nil
+	}
+	return wb.Workflow.secretFields()
+}
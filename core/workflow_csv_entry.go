@@ -1,12 +1,23 @@
 package core
 
 // WorkflowCSVEntry represents a single entry from a workflow
-// CSV file. Bag up whatever's in RootDir and run it through
+// batch file. Bag up whatever's in RootDir and run it through
 // the workflow.
+//
+// Entries from CSV files have a single RootDir. Entries from JSON Lines
+// and YAML batch files may list several Files, in which case RootDir is
+// the first of them.
+//
+// Overrides let this entry use settings that differ from the workflow's.
 type WorkflowCSVEntry struct {
-	BagName string
-	RootDir string
-	Tags    []*Tag
+	BagName   string
+	RootDir   string
+	Files     []string
+	Tags      []*Tag
+	Overrides JobOverrides
+	// record holds the raw CSV values, or the item's JSON, so we
+	// can write failed items back out as the user wrote them.
+	record []string
 }
 
 // NewWorkflowCSVEntry creates a new WorkflowCSVEntry.
@@ -18,6 +29,17 @@ func NewWorkflowCSVEntry(bagName, rootDir string) *WorkflowCSVEntry {
 	}
 }
 
+// SourceFiles returns the files and directories to bag for this entry.
+func (entry *WorkflowCSVEntry) SourceFiles() []string {
+	if len(entry.Files) > 0 {
+		return entry.Files
+	}
+	if entry.RootDir != "" {
+		return []string{entry.RootDir}
+	}
+	return make([]string, 0)
+}
+
 // AddTag adds a tag to this entry. Tag values from the CSV file will
 // be written into the bag.
 func (entry *WorkflowCSVEntry) AddTag(tagFile, tagName, value string) {
@@ -65,6 +65,10 @@ func (csvFile *WorkflowCSVFile) parseHeaders() error {
 			headerTags[i] = NewTag("", h, "")
 			continue
 		}
+		if isOverrideColumn(h) {
+			headerTags[i] = NewTag("", h, "")
+			continue
+		}
 		parts := strings.Split(h, "/")
 		if len(parts) != 2 {
 			return fmt.Errorf("Bag tag header '%s' in column %d. Header name should use tagFile/tagName pattern.", h, i)
@@ -84,7 +88,8 @@ func (csvFile *WorkflowCSVFile) parseHeaders() error {
 
 // Headers returns the headers (column names) from the first line of
 // the file. Other than the required headers Bag-Name and Root-Directory,
-// all headers should be in the format FileName/TagName. For example,
+// and the optional override headers described in JobOverrides, all
+// headers should be in the format FileName/TagName. For example,
 // "bag-info.txt/Source-Organization".
 func (csvFile *WorkflowCSVFile) Headers() []string {
 	return csvFile.headers
@@ -112,11 +117,14 @@ func (csvFile *WorkflowCSVFile) ReadNext() (*WorkflowCSVEntry, error) {
 		return nil, err
 	}
 	entry := NewWorkflowCSVEntry("", "")
+	entry.record = record
 	for i, value := range record {
 		if csvFile.headers[i] == "Bag-Name" {
 			entry.BagName = value
 		} else if csvFile.headers[i] == "Root-Directory" {
 			entry.RootDir = value
+		} else if isOverrideColumn(csvFile.headers[i]) {
+			entry.Overrides.setFromColumn(csvFile.headers[i], value)
 		} else {
 			tag := csvFile.headerTags[i]
 			entry.AddTag(tag.TagFile, tag.TagName, value)
@@ -125,6 +133,27 @@ func (csvFile *WorkflowCSVFile) ReadNext() (*WorkflowCSVEntry, error) {
 	return entry, nil
 }
 
+// WriteEntries writes this file's headers and the raw values of
+// entries to a new CSV file at path.
+func (csvFile *WorkflowCSVFile) WriteEntries(path string, entries []*WorkflowCSVEntry) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	writer := csv.NewWriter(file)
+	if err = writer.Write(csvFile.headers); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err = writer.Write(entry.record); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
 // Close closes the CSV's underlying file object.
 func (csvFile *WorkflowCSVFile) Close() {
 	if csvFile.file != nil {
@@ -2,40 +2,68 @@ package core
 
 import (
 	"bytes"
+	"context"
+	"database/sql"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
 
 	"github.com/APTrust/dart-runner/constants"
 	"github.com/APTrust/dart-runner/util"
 )
 
-// WorkflowRunner runs all jobs in CSVFile through Workflow.
+// WorkflowRunner runs all jobs in Batch through Workflow.
+//
+// The runner records the outcome of each row in the DART database.
+// If Resume is true, it skips rows that succeeded in an earlier run.
+// If RetryFailed is true, it runs only rows that failed in an earlier
+// run. If FailedRowsFile is set, the runner writes the rows that fail
+// to that file, which can be run as a batch of its own.
+//
+// Rows whose jobs are cancelled by RunContext count as failed rows,
+// so RetryFailed and FailedRowsFile pick them up on the next run.
 type WorkflowRunner struct {
-	Workflow      *Workflow
-	CSVFile       *WorkflowCSVFile
-	OutputDir     string
-	Cleanup       bool
-	SkipArtifacts bool
-	Concurrency   int
-	SuccessCount  int
-	FailureCount  int
-	parseError    error
-	jobChannel    chan *Job
-	waitGroup     sync.WaitGroup
-	outMutex      sync.Mutex
-	errMutex      sync.Mutex
-	fCountMutex   sync.Mutex
-	sCountMutex   sync.Mutex
-	stdErrWriter  *bytes.Buffer
-	stdOutWriter  *bytes.Buffer
+	Workflow       *Workflow
+	Batch          BatchSource
+	BatchFilePath  string
+	OutputDir      string
+	Cleanup        bool
+	SkipArtifacts  bool
+	Concurrency    int
+	Resume         bool
+	RetryFailed    bool
+	FailedRowsFile string
+	SuccessCount   int
+	FailureCount   int
+	SkippedCount   int
+	CancelledCount int
+	parseError     error
+	ctx            context.Context
+	jobChannel     chan *workflowItem
+	waitGroup      sync.WaitGroup
+	outMutex       sync.Mutex
+	errMutex       sync.Mutex
+	fCountMutex    sync.Mutex
+	sCountMutex    sync.Mutex
+	failedRows     []*workflowItem
+	stdErrWriter   *bytes.Buffer
+	stdOutWriter   *bytes.Buffer
+}
+
+// workflowItem is a job created from one item in the batch file.
+type workflowItem struct {
+	job         *Job
+	entry       *WorkflowCSVEntry
+	fingerprint string
+	itemNumber  int
 }
 
 // NewWorkflowRunner creates a new WorkFlowRunner object. Param workflowFile
 // is the path the JSON file that contains a description of the workflow.
-// Param csvFile is the path to the file contains a CSV list of directories
+// Param csvFile is the path to the batch file that lists the directories
 // to package. (That file also contains tag values for each package.)
 // Param outputDir is the path to the directory into which the packages
 // should be written. Param concurrency is the number of jobs to run in
@@ -57,7 +85,8 @@ type WorkflowRunner struct {
 // to bag and what tag values to apply to each bag. See
 // https://aptrust.github.io/dart-docs/users/workflows/batch_jobs/
 // for a description of the csv file and an example of what it looks like.
-// This should be an absolute path.
+// This may also be a JSON Lines (.jsonl) or YAML (.yaml) file. See
+// NewBatchSource. This should be an absolute path.
 //
 // outputDir is the path the output directory where DART will write
 // the bags it creates. This should be an absolute path.
@@ -78,7 +107,7 @@ func NewWorkflowRunner(workflowFile, csvFile, outputDir string, cleanup, skipArt
 	if !util.FileExists(outputDir) {
 		return nil, fmt.Errorf("output directory '%s' does not exist; you must create it first", outputDir)
 	}
-	workflowCSVFile, err := NewWorkflowCSVFile(csvFile)
+	batch, err := NewBatchSource(csvFile)
 	if err != nil {
 		return nil, err
 	}
@@ -96,12 +125,13 @@ func NewWorkflowRunner(workflowFile, csvFile, outputDir string, cleanup, skipArt
 	// goes out of scope as soon as the job completes.
 	runner := &WorkflowRunner{
 		Workflow:      workflow,
-		CSVFile:       workflowCSVFile,
+		Batch:         batch,
+		BatchFilePath: csvFile,
 		OutputDir:     outputDir,
 		Cleanup:       cleanup,
 		SkipArtifacts: skipArtifacts,
 		Concurrency:   concurrency,
-		jobChannel:    make(chan *Job, concurrency*2),
+		jobChannel:    make(chan *workflowItem, concurrency*2),
 	}
 	// Create one or more workers to run jobs.
 	for i := 0; i < concurrency; i++ {
@@ -124,7 +154,8 @@ func NewWorkflowRunner(workflowFile, csvFile, outputDir string, cleanup, skipArt
 // to bag and what tag values to apply to each bag. See
 // https://aptrust.github.io/dart-docs/users/workflows/batch_jobs/
 // for a description of the csv file and an example of what it looks like.
-// This should be an absolute path.
+// This may also be a JSON Lines (.jsonl) or YAML (.yaml) file. See
+// NewBatchSource. This should be an absolute path.
 //
 // outputDir is the path the output directory where DART will write
 // the bags it creates. This should be an absolute path.
@@ -138,7 +169,7 @@ func NewWorkflowRunnerWithMessageChannel(workflowID, csvFile, outputDir string,
 	if !util.FileExists(outputDir) {
 		return nil, fmt.Errorf("output directory '%s' does not exist; you must create it first", outputDir)
 	}
-	workflowCSVFile, err := NewWorkflowCSVFile(csvFile)
+	batch, err := NewBatchSource(csvFile)
 	if err != nil {
 		return nil, err
 	}
@@ -151,12 +182,13 @@ func NewWorkflowRunnerWithMessageChannel(workflowID, csvFile, outputDir string,
 	// See note in NewWorkflowRunner above about creating workflow runner.
 	runner := &WorkflowRunner{
 		Workflow:      workflow,
-		CSVFile:       workflowCSVFile,
+		Batch:         batch,
+		BatchFilePath: csvFile,
 		OutputDir:     outputDir,
 		Cleanup:       cleanup,
 		SkipArtifacts: false,
 		Concurrency:   1,
-		jobChannel:    make(chan *Job, 1),
+		jobChannel:    make(chan *workflowItem, 1),
 	}
 	go runner.listenForJobs(messageChannel)
 	return runner, nil
@@ -184,19 +216,53 @@ func (r *WorkflowRunner) SetStdErr(b *bytes.Buffer) {
 // will be written to STDERR, though there **should** also be
 // JobResult written to STDOUT if a job fails.
 func (r *WorkflowRunner) Run() int {
-	for {
-		entry, err := r.CSVFile.ReadNext()
+	return r.RunContext(context.Background())
+}
+
+// RunContext is like Run, but when ctx is cancelled, it stops starting
+// new jobs and cancels the jobs in progress. It then returns
+// constants.ExitCancelled.
+func (r *WorkflowRunner) RunContext(ctx context.Context) int {
+	r.ctx = ctx
+	workflowID := batchWorkflowID(r.Workflow)
+	itemNumber := 0
+	for ctx.Err() == nil {
+		entry, err := r.Batch.ReadNext()
 		if err == io.EOF {
 			break
 		} else if err != nil {
 			r.parseError = err
 			break
 		}
+		itemNumber++
+		fingerprint := BatchRowFingerprint(entry)
+		if r.Resume || r.RetryFailed {
+			state, err := BatchRowStateFind(workflowID, entry.BagName)
+			if err != nil && err != sql.ErrNoRows {
+				Dart.Log.Errorf("Can't read batch state for %s: %v", entry.BagName, err)
+			}
+			if shouldSkipBatchRow(state, fingerprint, r.Resume, r.RetryFailed) {
+				Dart.Log.Infof("Skipping %s, item %d of %s", entry.BagName, itemNumber, r.BatchFilePath)
+				r.SkippedCount++
+				continue
+			}
+		}
 		jobParams := r.getJobParams(entry)
+		item := &workflowItem{
+			job:         jobParams.ToJob(),
+			entry:       entry,
+			fingerprint: fingerprint,
+			itemNumber:  itemNumber,
+		}
 		r.waitGroup.Add(1)
-		r.jobChannel <- jobParams.ToJob()
+		select {
+		case r.jobChannel <- item:
+		case <-ctx.Done():
+			r.waitGroup.Done()
+		}
 	}
 	r.waitGroup.Wait()
+	r.writeFailedRows()
 	return r.getExitCode()
 }
 
@@ -204,12 +270,13 @@ func (r *WorkflowRunner) Run() int {
 // those jobs as they appear. It should run up to
 // WorkflowRunner.Concurrency jobs at once.
 func (r *WorkflowRunner) listenForJobs(messageChannel chan *EventMessage) {
-	for job := range r.jobChannel {
+	for item := range r.jobChannel {
+		job := item.job
 		var retVal int
 		if messageChannel != nil {
-			retVal = RunJobWithMessageChannel(job, r.Cleanup, messageChannel)
+			retVal = RunJobWithMessageChannelContext(r.context(), job, r.Cleanup, messageChannel)
 		} else {
-			retVal = RunJob(job, r.Cleanup, r.SkipArtifacts, false)
+			retVal = RunJobContext(r.context(), job, r.Cleanup, r.SkipArtifacts, false)
 		}
 		if retVal == constants.ExitOK {
 			r.sCountMutex.Lock()
@@ -217,32 +284,100 @@ func (r *WorkflowRunner) listenForJobs(messageChannel chan *EventMessage) {
 			r.sCountMutex.Unlock()
 		} else {
 			r.fCountMutex.Lock()
-			r.FailureCount++
+			if retVal == constants.ExitCancelled {
+				r.CancelledCount++
+			} else {
+				r.FailureCount++
+			}
+			r.failedRows = append(r.failedRows, item)
 			r.fCountMutex.Unlock()
 		}
+		r.recordOutcome(item, retVal == constants.ExitOK)
 		r.writeResult(job)
 		r.waitGroup.Done()
 	}
 }
 
+// context returns the context of the current run, or the background
+// context for jobs that arrive before Run starts.
+func (r *WorkflowRunner) context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
 func (r *WorkflowRunner) getJobParams(entry *WorkflowCSVEntry) *JobParams {
-	return NewJobParams(
+	params := NewJobParams(
 		r.Workflow.Copy(),
 		entry.BagName,
 		filepath.Join(r.OutputDir, entry.BagName),
-		[]string{entry.RootDir},
+		entry.SourceFiles(),
 		entry.Tags)
+	params.JobOverrides = entry.Overrides
+	return params
+}
+
+// recordOutcome saves the outcome of a row in the DART database, so a
+// later run with Resume or RetryFailed knows whether to run it again.
+// Failing to record the outcome doesn't fail the job.
+func (r *WorkflowRunner) recordOutcome(item *workflowItem, succeeded bool) {
+	status := constants.StatusSuccess
+	if !succeeded {
+		status = constants.StatusFailed
+	}
+	state := NewBatchRowState(batchWorkflowID(r.Workflow), item.entry.BagName, item.fingerprint, status, item.job.ID)
+	if err := BatchRowStateSave(state); err != nil {
+		Dart.Log.Errorf("Can't record batch state for %s: %v", item.entry.BagName, err)
+	}
+}
+
+// writeFailedRows writes the rows that failed, in the order they
+// appear in the batch file, to FailedRowsFile. If no rows failed,
+// it removes any FailedRowsFile left over from an earlier run.
+func (r *WorkflowRunner) writeFailedRows() {
+	if r.FailedRowsFile == "" {
+		return
+	}
+	if len(r.failedRows) == 0 {
+		if err := os.Remove(r.FailedRowsFile); err != nil && !os.IsNotExist(err) {
+			Dart.Log.Warningf("Can't remove old failed rows file %s: %v", r.FailedRowsFile, err)
+		}
+		return
+	}
+	sort.Slice(r.failedRows, func(i, j int) bool {
+		return r.failedRows[i].itemNumber < r.failedRows[j].itemNumber
+	})
+	entries := make([]*WorkflowCSVEntry, len(r.failedRows))
+	for i, item := range r.failedRows {
+		entries[i] = item.entry
+	}
+	err := r.Batch.WriteEntries(r.FailedRowsFile, entries)
+	if err != nil {
+		r.writeStdErr(fmt.Sprintf("Error writing failed rows to %s: %s", r.FailedRowsFile, err.Error()))
+	} else {
+		r.writeStdErr(fmt.Sprintf("Wrote %d failed row(s) to %s", len(entries), r.FailedRowsFile))
+	}
 }
 
 func (r *WorkflowRunner) getExitCode() int {
 	if r.parseError != nil {
-		errMsg := fmt.Sprintf("Error parsing CSV batch file: %s", r.parseError.Error())
+		errMsg := fmt.Sprintf("Error parsing batch file: %s", r.parseError.Error())
 		r.writeStdErr(errMsg)
 		return constants.ExitRuntimeErr
 	}
+	if r.SkippedCount > 0 {
+		r.writeStdErr(fmt.Sprintf("Skipped %d row(s) based on earlier runs", r.SkippedCount))
+	}
 	if r.FailureCount > 0 {
 		errMsg := fmt.Sprintf("%d job(s) failed", r.FailureCount)
 		r.writeStdErr(errMsg)
+	}
+	if r.context().Err() != nil {
+		r.writeStdErr(fmt.Sprintf("Workflow was cancelled. %d job(s) were stopped before they finished.", r.CancelledCount))
+		return constants.ExitCancelled
+	}
+	if r.FailureCount > 0 {
 		return constants.ExitRuntimeErr
 	}
 	return constants.ExitOK
@@ -2,6 +2,7 @@ package core_test
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -116,6 +117,27 @@ func testWorkflowRunner(t *testing.T, skipArtifacts bool) {
 	}
 }
 
+func TestWorkflowRunnerCancelled(t *testing.T) {
+	workflowFile := filepath.Join(util.PathToTestData(), "files", "runner_test_workflow.json")
+	batchFile := createBatchFile(t)
+	defer runnerCleanup()
+
+	runner, err := core.NewWorkflowRunner(workflowFile, batchFile, os.TempDir(), false, true, 1)
+	require.Nil(t, err)
+	stdErr := new(bytes.Buffer)
+	runner.SetStdErr(stdErr)
+	stdOut := new(bytes.Buffer)
+	runner.SetStdOut(stdOut)
+
+	// A workflow cancelled before it starts runs no jobs.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, constants.ExitCancelled, runner.RunContext(ctx))
+	assert.Empty(t, stdOut.String())
+	assert.Contains(t, stdErr.String(), "Workflow was cancelled")
+	assert.Equal(t, 0, runner.SuccessCount)
+}
+
 // deleteOldArtifacts deletes artifact directories and
 // their contents that may have lingered from prior tests.
 func deleteOldArtifacts(t *testing.T, outputDir string) {
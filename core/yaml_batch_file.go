@@ -0,0 +1,222 @@
+package core
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// YAMLBatchFile reads a batch file that contains a YAML list of items.
+// Each item has the same fields as the job params dart-runner reads
+// from STDIN. For example:
+//
+//	# batch.yaml
+//	- packageName: photos.tar
+//	  files:
+//	    - /data/photos
+//	  tags:
+//	    - tagFile: bag-info.txt
+//	      tagName: Source-Organization
+//	      value: Example University
+//
+// Items must start with "- " at the beginning of a line. We read one
+// item at a time, so large batches don't have to fit in memory. Scalar
+// values are always read as strings, so a tag value such as 2024-01-01
+// or 007 stays as written.
+type YAMLBatchFile struct {
+	PathToFile string
+	file       *os.File
+	reader     *bufio.Reader
+	lineNumber int
+	nextItem   string
+	started    bool
+}
+
+// NewYAMLBatchFile opens the YAML file at pathToFile. See ReadNext()
+// for extracting data from the file.
+func NewYAMLBatchFile(pathToFile string) (*YAMLBatchFile, error) {
+	f, err := os.Open(pathToFile)
+	if err != nil {
+		Dart.Log.Errorf("Can't open YAML file %s: %v", pathToFile, err)
+		return nil, err
+	}
+	return &YAMLBatchFile{
+		PathToFile: pathToFile,
+		file:       f,
+		reader:     bufio.NewReader(f),
+	}, nil
+}
+
+// ReadNext returns the next item in the list. It returns io.EOF when
+// there are no more items.
+func (batchFile *YAMLBatchFile) ReadNext() (*WorkflowCSVEntry, error) {
+	if !batchFile.started {
+		if err := batchFile.findFirstItem(); err != nil {
+			return nil, err
+		}
+	}
+	if batchFile.nextItem == "" {
+		return nil, io.EOF
+	}
+	firstLine := batchFile.lineNumber
+	lines := []string{batchFile.nextItem}
+	batchFile.nextItem = ""
+	for {
+		line, err := batchFile.readLine()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if isYAMLBatchItem(line) {
+			batchFile.nextItem = line
+			break
+		}
+		if startsYAMLBlock(line) {
+			return nil, fmt.Errorf("line %d: expected a list item starting with \"- \" but found %q", batchFile.lineNumber, line)
+		}
+		lines = append(lines, line)
+	}
+	// Parse errors count lines from the start of the item.
+	value, err := parseYAMLBatchItem(strings.Join(lines, "\n"))
+	if err != nil {
+		return nil, fmt.Errorf("item starting on line %d: %w", firstLine, err)
+	}
+	items, _ := value.([]interface{})
+	if len(items) != 1 {
+		return nil, fmt.Errorf("line %d: expected one item", firstLine)
+	}
+	if _, isMap := items[0].(map[string]interface{}); !isMap {
+		return nil, fmt.Errorf("line %d: item should have packageName, files and tags", firstLine)
+	}
+	jsonData, err := json.Marshal(items[0])
+	if err != nil {
+		return nil, fmt.Errorf("line %d: %w", firstLine, err)
+	}
+	params, err := jobParamsFromJson(jsonData)
+	if err != nil {
+		return nil, fmt.Errorf("line %d: %w", firstLine, err)
+	}
+	return entryFromJobParams(params, jsonData), nil
+}
+
+// WriteEntries writes entries to a new batch file at path. We write
+// failed YAML items as JSON Lines, which the runner can read just as
+// well, and which saves us from having to write YAML.
+func (batchFile *YAMLBatchFile) WriteEntries(path string, entries []*WorkflowCSVEntry) error {
+	return writeJSONLinesEntries(path, entries)
+}
+
+// Close closes the underlying file.
+func (batchFile *YAMLBatchFile) Close() {
+	if batchFile.file != nil {
+		batchFile.file.Close()
+	}
+}
+
+// findFirstItem skips comments, blank lines and the document start
+// marker at the top of the file.
+func (batchFile *YAMLBatchFile) findFirstItem() error {
+	batchFile.started = true
+	for {
+		line, err := batchFile.readLine()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if isYAMLBatchItem(line) {
+			batchFile.nextItem = line
+			return nil
+		}
+		if startsYAMLBlock(line) && strings.TrimSpace(line) != "---" {
+			return fmt.Errorf("line %d: a YAML batch file should be a list of items, but found %q", batchFile.lineNumber, line)
+		}
+	}
+}
+
+func (batchFile *YAMLBatchFile) readLine() (string, error) {
+	line, err := batchFile.reader.ReadString('\n')
+	if err == io.EOF && line == "" {
+		return "", io.EOF
+	} else if err != nil && err != io.EOF {
+		return "", err
+	}
+	batchFile.lineNumber++
+	if batchFile.lineNumber == 1 {
+		line = strings.TrimPrefix(line, "\uFEFF")
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// isYAMLBatchItem returns true if line starts a new top-level list item.
+func isYAMLBatchItem(line string) bool {
+	return line == "-" || strings.HasPrefix(line, "- ")
+}
+
+// startsYAMLBlock returns true if line has content in the first
+// column that isn't a comment.
+func startsYAMLBlock(line string) bool {
+	return line != "" && line[0] != ' ' && line[0] != '#' && line[0] != '\t'
+}
+
+// parseYAMLBatchItem parses the YAML text of one batch item and returns
+// a tree of map[string]interface{}, []interface{}, string and nil values.
+func parseYAMLBatchItem(text string) (interface{}, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(text), &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+	return yamlNodeValue(doc.Content[0])
+}
+
+// yamlNodeValue converts node to plain Go values. Unlike yaml.Unmarshal,
+// this leaves scalars as strings instead of guessing at their types,
+// and it rejects duplicate keys at any depth.
+func yamlNodeValue(node *yaml.Node) (interface{}, error) {
+	switch node.Kind {
+	case yaml.AliasNode:
+		return yamlNodeValue(node.Alias)
+	case yaml.SequenceNode:
+		items := make([]interface{}, len(node.Content))
+		for i, child := range node.Content {
+			value, err := yamlNodeValue(child)
+			if err != nil {
+				return nil, err
+			}
+			items[i] = value
+		}
+		return items, nil
+	case yaml.MappingNode:
+		mapping := make(map[string]interface{})
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i]
+			if key.Kind != yaml.ScalarNode {
+				return nil, fmt.Errorf("line %d: keys must be strings", key.Line)
+			}
+			if _, exists := mapping[key.Value]; exists {
+				return nil, fmt.Errorf("line %d: duplicate key %q", key.Line, key.Value)
+			}
+			value, err := yamlNodeValue(node.Content[i+1])
+			if err != nil {
+				return nil, err
+			}
+			mapping[key.Value] = value
+		}
+		return mapping, nil
+	case yaml.ScalarNode:
+		if node.ShortTag() == "!!null" {
+			return nil, nil
+		}
+		return node.Value, nil
+	}
+	return nil, fmt.Errorf("line %d: unexpected YAML content", node.Line)
+}
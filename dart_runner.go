@@ -1,11 +1,18 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	_ "embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/APTrust/dart-runner/constants"
 	"github.com/APTrust/dart-runner/core"
@@ -29,6 +36,32 @@ func main() {
 		ShowHelp()
 	} else if options.Version {
 		ShowVersion()
+	} else if options.LintProfilePath != "" {
+		exitCode = LintProfile(options)
+	} else if options.ForgetHostKey != "" {
+		exitCode = ForgetHostKey(options)
+	} else if options.RotateMasterKey {
+		exitCode = RotateMasterKey(options)
+	} else if options.SetSetting != "" {
+		exitCode = SetSetting(options)
+	} else if options.AbortStaleUploads != "" {
+		exitCode = AbortStaleUploads(options)
+	} else if options.ListRemote != "" {
+		exitCode = ListRemote(options)
+	} else if options.DownloadJobPath != "" {
+		exitCode = RunDownloadJob(options)
+	} else if options.Serve != "" {
+		exitCode = RunApiServer(options)
+	} else if options.WatchDir != "" {
+		exitCode = WatchHotFolder(options)
+	} else if options.Daemon {
+		exitCode = RunDaemon(options)
+	} else if options.ListQueue {
+		exitCode = ListQueue(options)
+	} else if options.CancelJobID != "" {
+		exitCode = CancelQueuedJob(options)
+	} else if options.Enqueue {
+		exitCode = EnqueueJobs(options)
 	} else if len(options.StdinData) > 0 || core.StdinHasData() {
 		exitCode = RunJob(options)
 	} else {
@@ -43,7 +76,16 @@ func RunJob(opts *core.Options) int {
 		fmt.Fprintf(os.Stderr, "Error creating job: %s\n", err.Error())
 		return constants.ExitRuntimeErr
 	}
-	return core.RunJob(params.ToJob(), opts.DeleteAfterUpload, opts.SkipArtifacts, true)
+	ctx, stop := signalContext()
+	defer stop()
+	return core.RunJobContext(ctx, params.ToJob(), opts.DeleteAfterUpload, opts.SkipArtifacts, true)
+}
+
+// signalContext returns a context that's cancelled when dart-runner
+// receives SIGINT (Ctrl-C) or SIGTERM, so jobs can stop cleanly, and
+// a function that stops listening for those signals.
+func signalContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 }
 
 func RunWorkflow(opts *core.Options) int {
@@ -59,7 +101,382 @@ func RunWorkflow(opts *core.Options) int {
 		fmt.Fprintf(os.Stderr, "Cannot start workflow: %s\n", err.Error())
 		return constants.ExitRuntimeErr
 	}
-	return runner.Run()
+	runner.Resume = opts.Resume
+	runner.RetryFailed = opts.RetryFailed
+	runner.FailedRowsFile = filepath.Join(opts.OutputDir, core.FailedRowsFileName(opts.BatchFilePath))
+	ctx, stop := signalContext()
+	defer stop()
+	return runner.RunContext(ctx)
+}
+
+// WatchHotFolder runs new items in the --watch directory through the
+// workflow until dart-runner receives SIGINT or SIGTERM.
+func WatchHotFolder(opts *core.Options) int {
+	watcher, err := core.NewHotFolderWatcher(
+		opts.WorkflowFilePath,
+		opts.WatchDir,
+		opts.OutputDir,
+		opts.DeleteAfterUpload,
+		opts.SkipArtifacts,
+	)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot watch folder: %s\n", err.Error())
+		return constants.ExitRuntimeErr
+	}
+	watcher.QuietPeriod = time.Duration(opts.QuietSeconds) * time.Second
+	if opts.PollSeconds > 0 {
+		watcher.PollInterval = time.Duration(opts.PollSeconds) * time.Second
+	}
+	watcher.DoneMarker = opts.DoneMarker
+	if opts.NameTags != "" {
+		watcher.NameTags = strings.Split(opts.NameTags, ",")
+	}
+	ctx, stop := signalContext()
+	defer stop()
+	return watcher.RunContext(ctx)
+}
+
+// RunDaemon runs jobs from the job queue until the process receives
+// SIGINT or SIGTERM. Jobs running at that point go back in the queue.
+func RunDaemon(opts *core.Options) int {
+	daemon, err := core.NewJobDaemon(opts.Concurrency, opts.DeleteAfterUpload, opts.SkipArtifacts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot start daemon: %s\n", err.Error())
+		return constants.ExitUsageErr
+	}
+	ctx, stop := signalContext()
+	defer stop()
+	return daemon.RunContext(ctx)
+}
+
+// RunApiServer serves the HTTP API at the --serve address, and runs
+// the jobs submitted to it, until dart-runner receives SIGINT or
+// SIGTERM. Clients
+// authenticate with the token in DART_API_TOKEN. If that's not set,
+// this makes up a token and prints it to STDERR.
+func RunApiServer(opts *core.Options) int {
+	core.Dart.RuntimeMode = constants.ModeDartServer
+	var workflow *core.Workflow
+	if opts.WorkflowFilePath != "" {
+		var err error
+		workflow, err = core.WorkflowFromJson(opts.WorkflowFilePath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Workflow JSON (%s): %s\n", opts.WorkflowFilePath, err.Error())
+			return constants.ExitRuntimeErr
+		}
+	}
+	token, isNew := core.ApiTokenFromEnv()
+	if token == "" {
+		fmt.Fprintf(os.Stderr, "Cannot generate API token. Set %s.\n", constants.EnvApiToken)
+		return constants.ExitRuntimeErr
+	}
+	daemon, err := core.NewJobDaemon(opts.Concurrency, opts.DeleteAfterUpload, opts.SkipArtifacts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot start daemon: %s\n", err.Error())
+		return constants.ExitUsageErr
+	}
+	server, err := core.NewApiServer(opts.Serve, token, workflow, opts.OutputDir, daemon)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot start API server: %s\n", err.Error())
+		return constants.ExitUsageErr
+	}
+	if isNew {
+		fmt.Fprintf(os.Stderr, "%s is not set. Clients must use this token: %s\n", constants.EnvApiToken, token)
+	}
+	fmt.Fprintf(os.Stderr, "Serving API at %s\n", opts.Serve)
+	ctx, stop := signalContext()
+	defer stop()
+	return server.RunContext(ctx)
+}
+
+// EnqueueJobs adds the job described by the job params on STDIN, or a
+// job for each item in the --batch file, to the job queue. It prints one
+// line of JSON describing each queued job.
+func EnqueueJobs(opts *core.Options) int {
+	var queuedJobs []*core.QueuedJob
+	if len(opts.StdinData) > 0 {
+		params, err := InitParams(opts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating job: %s\n", err.Error())
+			return constants.ExitRuntimeErr
+		}
+		job := params.ToJob()
+		qj, err := core.JobQueueAdd(job)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot queue job: %s %v\n", err.Error(), job.Errors)
+			return constants.ExitRuntimeErr
+		}
+		queuedJobs = append(queuedJobs, qj)
+	} else {
+		workflow, err := core.WorkflowFromJson(opts.WorkflowFilePath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Workflow JSON (%s): %s\n", opts.WorkflowFilePath, err.Error())
+			return constants.ExitRuntimeErr
+		}
+		queuedJobs, err = core.JobQueueAddBatch(workflow, opts.BatchFilePath, opts.OutputDir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot queue batch:\n%s\n", err.Error())
+			return constants.ExitRuntimeErr
+		}
+	}
+	for _, qj := range queuedJobs {
+		data, _ := json.Marshal(qj)
+		fmt.Println(string(data))
+	}
+	return constants.ExitOK
+}
+
+// ListQueue prints one line of JSON for each job in the job queue.
+func ListQueue(opts *core.Options) int {
+	queuedJobs, err := core.QueuedJobList("")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot list job queue: %s\n", err.Error())
+		return constants.ExitRuntimeErr
+	}
+	for _, qj := range queuedJobs {
+		data, _ := json.Marshal(qj)
+		fmt.Println(string(data))
+	}
+	return constants.ExitOK
+}
+
+// CancelQueuedJob cancels a job that's waiting in the job queue.
+func CancelQueuedJob(opts *core.Options) int {
+	err := core.QueuedJobCancel(opts.CancelJobID)
+	if err == sql.ErrNoRows {
+		fmt.Fprintf(os.Stderr, "No job with id %s in the queue\n", opts.CancelJobID)
+		return constants.ExitUsageErr
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot cancel job: %s\n", err.Error())
+		return constants.ExitRuntimeErr
+	}
+	fmt.Printf("Cancelled job %s\n", opts.CancelJobID)
+	return constants.ExitOK
+}
+
+// RunDownloadJob runs the download job described in the JSON file at
+// --download, saving the items it retrieves in --output-dir. Like the
+// workflow runner, it prints one line of JSON to stdout for each item.
+func RunDownloadJob(opts *core.Options) int {
+	job, err := core.DownloadJobFromJson(opts.DownloadJobPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot load download job %s: %s\n", opts.DownloadJobPath, err.Error())
+		return constants.ExitUsageErr
+	}
+	job.OutputDir = opts.OutputDir
+	ctx, stop := signalContext()
+	defer stop()
+	exitCode := job.RunContext(ctx, nil)
+	if exitCode == constants.ExitUsageErr || len(job.Results) == 0 {
+		for key, value := range job.Errors {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", key, value)
+		}
+		return exitCode
+	}
+	failed := 0
+	for _, result := range job.Results {
+		if !result.Succeeded {
+			failed++
+		}
+		data, err := result.ToJson()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error formatting result for %s: %s\n", result.JobName, err.Error())
+			continue
+		}
+		fmt.Println(data)
+	}
+	if failed > 0 {
+		fmt.Fprintf(os.Stderr, "%d of %d download(s) failed\n", failed, len(job.Results))
+	}
+	return exitCode
+}
+
+// ListRemote prints an inventory of the storage service named by
+// --list-remote, in the format specified by --format. With --reconcile,
+// it prints a report comparing the bags named in a batch file with
+// the inventory, and returns constants.ExitRuntimeErr if any bags are
+// missing or differ in size from local copies in --output-dir.
+func ListRemote(opts *core.Options) int {
+	ss, err := loadStorageService(opts, opts.ListRemote)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return constants.ExitUsageErr
+	}
+	inventory := core.NewRemoteInventory(ss, opts.Prefix)
+	err = inventory.Load()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return constants.ExitRuntimeErr
+	}
+	if opts.ReconcileBatchPath == "" {
+		if opts.Format == "csv" {
+			err = inventory.WriteCSV(os.Stdout)
+		} else {
+			var data string
+			data, err = inventory.ToJson()
+			fmt.Println(data)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error formatting inventory: %s\n", err.Error())
+			return constants.ExitRuntimeErr
+		}
+		return constants.ExitOK
+	}
+	report, err := inventory.Reconcile(opts.ReconcileBatchPath, opts.OutputDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot reconcile %s: %s\n", opts.ReconcileBatchPath, err.Error())
+		return constants.ExitUsageErr
+	}
+	if opts.Format == "csv" {
+		err = report.WriteCSV(os.Stdout)
+	} else {
+		var data string
+		data, err = report.ToJson()
+		fmt.Println(data)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error formatting reconciliation report: %s\n", err.Error())
+		return constants.ExitRuntimeErr
+	}
+	if report.HasProblems() {
+		fmt.Fprintf(os.Stderr, "%d bag(s) missing, %d with different sizes\n", report.Missing, report.SizeMismatch)
+		return constants.ExitRuntimeErr
+	}
+	return constants.ExitOK
+}
+
+// loadStorageService returns the storage service named by ref, which
+// comes from --list-remote or --abort-stale-uploads. With --workflow,
+// that's the name or ID of one of the workflow's storage services.
+// Otherwise, it's the path to a storage service json file.
+func loadStorageService(opts *core.Options, ref string) (*core.StorageService, error) {
+	if opts.WorkflowFilePath == "" {
+		ss, err := core.StorageServiceFromJson(ref)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot load storage service %s: %s", ref, err.Error())
+		}
+		return ss, nil
+	}
+	workflow, err := core.WorkflowFromJson(opts.WorkflowFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("Workflow JSON (%s): %s", opts.WorkflowFilePath, err.Error())
+	}
+	for _, ss := range workflow.StorageServices {
+		if ss.Name == ref || ss.ID == ref {
+			return ss, nil
+		}
+	}
+	return nil, fmt.Errorf("Workflow %s has no storage service named %s", opts.WorkflowFilePath, ref)
+}
+
+// AbortStaleUploads aborts multipart uploads to the S3 storage service
+// named by --abort-stale-uploads that were interrupted and have not
+// been resumed in the last week, so their parts don't linger on the
+// server.
+func AbortStaleUploads(opts *core.Options) int {
+	ss, err := loadStorageService(opts, opts.AbortStaleUploads)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return constants.ExitUsageErr
+	}
+	if ss.Protocol != constants.ProtocolS3 {
+		fmt.Fprintf(os.Stderr, "Storage service %s does not use S3. Only S3 uploads can be resumed.\n", ss.Name)
+		return constants.ExitUsageErr
+	}
+	count, err := core.AbortStaleS3Uploads(ss, core.StaleUploadAge)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Aborted %d stale uploads to %s, but: %s\n", count, ss.Name, err.Error())
+		return constants.ExitRuntimeErr
+	}
+	fmt.Printf("Aborted %d stale uploads to %s\n", count, ss.Name)
+	return constants.ExitOK
+}
+
+// LintProfile prints a lint report for the profile at --lint-profile.
+// If --compare-profile is also specified, it prints a compatibility report
+// comparing the two profiles. This returns constants.ExitRuntimeErr if
+// either profile can't be loaded or the lint report contains errors.
+func LintProfile(opts *core.Options) int {
+	profile, err := core.BagItProfileLoad(opts.LintProfilePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot load profile %s: %s\n", opts.LintProfilePath, err.Error())
+		return constants.ExitRuntimeErr
+	}
+	report := profile.Lint()
+	output := map[string]interface{}{
+		"lint": report,
+	}
+	if opts.CompareProfilePath != "" {
+		otherProfile, err := core.BagItProfileLoad(opts.CompareProfilePath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot load profile %s: %s\n", opts.CompareProfilePath, err.Error())
+			return constants.ExitRuntimeErr
+		}
+		output["compatibility"] = core.CompareProfiles(profile, otherProfile)
+	}
+	data, err := json.MarshalIndent(output, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error formatting lint report: %s\n", err.Error())
+		return constants.ExitRuntimeErr
+	}
+	fmt.Println(string(data))
+	if report.HasErrors() {
+		return constants.ExitRuntimeErr
+	}
+	return constants.ExitOK
+}
+
+// ForgetHostKey deletes the host key DART trusted on first connecting
+// to the SFTP server at --forget-host-key. Use this after confirming
+// with the server's administrator that the server's key has changed.
+func ForgetHostKey(opts *core.Options) int {
+	trusted, err := core.ForgetHostKey(opts.ForgetHostKey)
+	if errors.Is(err, sql.ErrNoRows) {
+		fmt.Fprintf(os.Stderr, "No trusted host key for %s\n", opts.ForgetHostKey)
+		return constants.ExitRuntimeErr
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot forget host key for %s: %s\n", opts.ForgetHostKey, err.Error())
+		return constants.ExitRuntimeErr
+	}
+	fmt.Printf("Forgot %s host key %s for %s\n", trusted.KeyType, trusted.Fingerprint, trusted.Address)
+	return constants.ExitOK
+}
+
+// SetSetting saves the application setting in --set-setting, which
+// looks like "Name=value". Use this to set the allowed command lists,
+// which workflow and job files can't change.
+func SetSetting(opts *core.Options) int {
+	name, value, _ := strings.Cut(opts.SetSetting, "=")
+	name = strings.TrimSpace(name)
+	err := core.SetAppSetting(name, value)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot save setting %s: %s\n", name, err.Error())
+		return constants.ExitRuntimeErr
+	}
+	fmt.Printf("Saved setting %s\n", name)
+	return constants.ExitOK
+}
+
+// RotateMasterKey rewraps the key that encrypts secrets in the DART
+// database. The current master key comes from DART_MASTER_KEY,
+// DART_MASTER_KEY_FILE or DART_MASTER_PASSPHRASE, and the new one from
+// the same variables with DART_NEW_ in place of DART_.
+func RotateMasterKey(opts *core.Options) int {
+	current := core.CurrentMasterKeySource()
+	next := core.NextMasterKeySource()
+	if current.IsEmpty() || next.IsEmpty() {
+		fmt.Fprintf(os.Stderr, "Set one of %s, %s or %s to the current master key, and one of %s, %s or %s to the new one.\n",
+			constants.EnvMasterKey, constants.EnvMasterKeyFile, constants.EnvMasterPassphrase,
+			constants.EnvNewMasterKey, constants.EnvNewMasterKeyFile, constants.EnvNewMasterPassphrase)
+		return constants.ExitUsageErr
+	}
+	err := core.RotateMasterKey(current, next)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot rotate master key: %s\n", err.Error())
+		return constants.ExitRuntimeErr
+	}
+	fmt.Println("Rotated master key. Use the new key from now on.")
+	return constants.ExitOK
 }
 
 func InitParams(opts *core.Options) (*core.JobParams, error) {
@@ -81,6 +498,7 @@ func InitParams(opts *core.Options) (*core.JobParams, error) {
 		filepath.Join(opts.OutputDir, partialParams.PackageName),
 		partialParams.Files,
 		partialParams.Tags)
+	params.JobOverrides = partialParams.JobOverrides
 	return params, nil
 }
 
@@ -2,7 +2,9 @@ package main_test
 
 import (
 	"archive/tar"
-	// "encoding/json"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
@@ -19,6 +21,7 @@ import (
 	"github.com/APTrust/dart-runner/util"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
 )
 
 // NOTE: This file tests that functions in main run without error.
@@ -101,6 +104,116 @@ func TestInitParams(t *testing.T) {
 	require.NotNil(t, jobParams)
 }
 
+func TestLintProfile(t *testing.T) {
+	opts := &core.Options{
+		LintProfilePath:    filepath.Join(util.ProjectRoot(), "profiles", "aptrust-v2.3.json"),
+		CompareProfilePath: filepath.Join(util.ProjectRoot(), "profiles", "btr-v1.0.json"),
+	}
+	assert.Equal(t, constants.ExitOK, main.LintProfile(opts))
+
+	opts.LintProfilePath = filepath.Join(util.PathToTestData(), "profiles", "invalid_profile.json")
+	assert.Equal(t, constants.ExitRuntimeErr, main.LintProfile(opts))
+
+	opts.LintProfilePath = "/path/does/not/exist.json"
+	assert.Equal(t, constants.ExitRuntimeErr, main.LintProfile(opts))
+}
+
+func TestForgetHostKey(t *testing.T) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	require.Nil(t, err)
+	publicKey, err := ssh.NewPublicKey(privateKey.Public())
+	require.Nil(t, err)
+	require.Nil(t, core.TrustedHostKeySave(core.NewTrustedHostKey("sftp.example.com:2222", publicKey)))
+
+	opts := &core.Options{ForgetHostKey: "sftp.example.com:2222"}
+	assert.Equal(t, constants.ExitOK, main.ForgetHostKey(opts))
+
+	// Already forgotten
+	assert.Equal(t, constants.ExitRuntimeErr, main.ForgetHostKey(opts))
+}
+
+func TestRotateMasterKey(t *testing.T) {
+	for _, name := range []string{
+		constants.EnvMasterKey, constants.EnvMasterKeyFile, constants.EnvMasterPassphrase,
+		constants.EnvNewMasterKey, constants.EnvNewMasterKeyFile, constants.EnvNewMasterPassphrase,
+	} {
+		t.Setenv(name, "")
+	}
+	opts := &core.Options{RotateMasterKey: true}
+
+	// Both keys are required.
+	t.Setenv(constants.EnvMasterPassphrase, "old passphrase")
+	assert.Equal(t, constants.ExitUsageErr, main.RotateMasterKey(opts))
+
+	// Nothing has been encrypted, so there's nothing to rotate.
+	t.Setenv(constants.EnvNewMasterPassphrase, "new passphrase")
+	require.NoError(t, core.ClearEncryptionKeysTable())
+	assert.Equal(t, constants.ExitRuntimeErr, main.RotateMasterKey(opts))
+
+	require.NoError(t, core.UnlockSecrets(core.CurrentMasterKeySource()))
+	defer func() {
+		core.LockSecrets()
+		core.ClearEncryptionKeysTable()
+	}()
+	assert.Equal(t, constants.ExitOK, main.RotateMasterKey(opts))
+	core.LockSecrets()
+	assert.NoError(t, core.UnlockSecrets(core.NextMasterKeySource()))
+}
+
+func TestListRemote(t *testing.T) {
+	ss := core.NewStorageService()
+	ss.Name = "Local deposit"
+	ss.Protocol = constants.ProtocolFile
+	ss.Bucket = t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(ss.Bucket, "bag1.tar"), []byte("bag one"), 0644))
+	data, err := json.Marshal(ss)
+	require.NoError(t, err)
+	ssFile := filepath.Join(t.TempDir(), "storage_service.json")
+	require.NoError(t, os.WriteFile(ssFile, data, 0644))
+
+	opts := &core.Options{ListRemote: ssFile, Format: "json"}
+	assert.Equal(t, constants.ExitOK, main.ListRemote(opts))
+	opts.Format = "csv"
+	assert.Equal(t, constants.ExitOK, main.ListRemote(opts))
+
+	// Reconciliation fails if any bags are missing.
+	csvFile := filepath.Join(t.TempDir(), "batch.csv")
+	require.NoError(t, os.WriteFile(csvFile, []byte("Bag-Name,Root-Directory\nbag1,/data/bag1\n"), 0644))
+	opts.ReconcileBatchPath = csvFile
+	assert.Equal(t, constants.ExitOK, main.ListRemote(opts))
+	require.NoError(t, os.WriteFile(csvFile, []byte("Bag-Name,Root-Directory\nbag1,/data/bag1\nbag2,/data/bag2\n"), 0644))
+	assert.Equal(t, constants.ExitRuntimeErr, main.ListRemote(opts))
+
+	opts = &core.Options{ListRemote: "/path/does/not/exist.json"}
+	assert.Equal(t, constants.ExitUsageErr, main.ListRemote(opts))
+}
+
+func TestAbortStaleUploads(t *testing.T) {
+	ss := core.NewStorageService()
+	ss.Name = "Interrupted uploads"
+	ss.Protocol = constants.ProtocolS3
+	ss.Host = "s3.example.com"
+	ss.Bucket = "bucket"
+	data, err := json.Marshal(ss)
+	require.NoError(t, err)
+	ssFile := filepath.Join(t.TempDir(), "storage_service.json")
+	require.NoError(t, os.WriteFile(ssFile, data, 0644))
+
+	// With no checkpoints, there's nothing to abort.
+	opts := &core.Options{AbortStaleUploads: ssFile}
+	assert.Equal(t, constants.ExitOK, main.AbortStaleUploads(opts))
+
+	// Only S3 uploads can be resumed, so only they can be stale.
+	ss.Protocol = constants.ProtocolFile
+	data, err = json.Marshal(ss)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(ssFile, data, 0644))
+	assert.Equal(t, constants.ExitUsageErr, main.AbortStaleUploads(opts))
+
+	opts = &core.Options{AbortStaleUploads: "/path/does/not/exist.json"}
+	assert.Equal(t, constants.ExitUsageErr, main.AbortStaleUploads(opts))
+}
+
 // Note: post_build_test tests output of this function
 func TestShowHelp(t *testing.T) {
 	assert.NotPanics(t, func() { main.ShowHelp() })
@@ -3,11 +3,15 @@ package profiles
 import _ "embed"
 
 // We embed these profiles because we need to install
-// them in the DB for new DART installations.
+// them in the DB for new DART installations, and so the
+// validator can recognize bags that declare them.
 
 //go:embed aptrust-v2.2.json
 var APTrust_V_2_2 string
 
+//go:embed aptrust-v2.3.json
+var APTrust_V_2_3 string
+
 //go:embed btr-v1.0-1.3.0.json
 var BTR_V_1_0 string
 